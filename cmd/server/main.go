@@ -9,11 +9,18 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/laurikarhu/stream-paywall/internal/billing"
 	"github.com/laurikarhu/stream-paywall/internal/config"
 	"github.com/laurikarhu/stream-paywall/internal/docker"
 	"github.com/laurikarhu/stream-paywall/internal/handlers"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
+	"github.com/laurikarhu/stream-paywall/internal/mail"
 	"github.com/laurikarhu/stream-paywall/internal/metrics"
 	"github.com/laurikarhu/stream-paywall/internal/middleware"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/scheduler"
+	"github.com/laurikarhu/stream-paywall/internal/security"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -80,14 +87,83 @@ func main() {
 		log.Info().Msg("Docker manager initialized")
 	}
 
+	// Each stream's Owncast gets its own admin password, stored encrypted with the stream
+	credentialsBox, err := security.NewSecretBox(cfg.CredentialsSecret)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize credentials encryption")
+	}
+	log.Info().Str("key_id", credentialsBox.KeyID()).Msg("Credentials encryption initialized")
+	owncastCreds := ingest.NewCredentials(credentialsBox, cfg.OwncastAdminPassword)
+	owncastAdmin := ingest.NewOwncastAdmin(owncastCreds)
+
+	// Register the ingest backends streams' Owncast instances can run on
+	backends := ingest.NewRegistry(models.IngestBackend(cfg.IngestBackend))
+	backends.Register(models.IngestBackendExternal, ingest.NewExternalBackend())
+	if dockerMgr != nil {
+		backends.Register(models.IngestBackendDocker, ingest.NewDockerBackend(dockerMgr, pgStore, owncastCreds, cfg.RTMPPortStart, cfg.RTMPPublicHost))
+	}
+	if cfg.KubernetesNamespace != "" {
+		kubernetesBackend, err := ingest.NewKubernetesBackend(ingest.KubernetesConfig{
+			APIURL:         cfg.KubernetesAPIURL,
+			Namespace:      cfg.KubernetesNamespace,
+			TokenFile:      cfg.KubernetesTokenFile,
+			CAFile:         cfg.KubernetesCAFile,
+			StorageClass:   cfg.KubernetesStorageClass,
+			VolumeSize:     cfg.KubernetesVolumeSize,
+			ServiceType:    cfg.KubernetesServiceType,
+			Image:          cfg.OwncastImage,
+			CPULimit:       cfg.OwncastCPULimit,
+			MemoryLimit:    cfg.OwncastMemoryLimit,
+			RTMPPortStart:  cfg.RTMPPortStart,
+			RTMPPublicHost: cfg.RTMPPublicHost,
+		}, pgStore, owncastCreds)
+		if err != nil {
+			log.Warn().Err(err).Msg("Kubernetes backend not available")
+		} else {
+			backends.Register(models.IngestBackendKubernetes, kubernetesBackend)
+			log.Info().Str("namespace", cfg.KubernetesNamespace).Msg("Kubernetes backend initialized")
+		}
+	}
+
+	// Owncast instances report broadcasts and chat to the paywall through webhooks
+	webhooks := ingest.NewWebhooks(cfg.OwncastWebhookBaseURL, cfg.SigningSecret, owncastAdmin)
+
+	// Started Owncast instances get the stream's settings on first boot, and their webhook
+	videoVariants, err := ingest.ParseVideoVariants(cfg.OwncastVideoVariants)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid OWNCAST_VIDEO_VARIANTS")
+	}
+	provisioner := ingest.NewProvisioner(owncastAdmin, webhooks, pgStore, cfg.BaseURL, videoVariants, cfg.OwncastLatencyLevel)
+
+	// Run scheduled streams: warm-up, going live, ending and stopping their Owncast
+	streamScheduler := scheduler.NewScheduler(cfg, pgStore, redisStore, backends, provisioner)
+	go streamScheduler.Run(ctx)
+
+	// Start reconciliation of pending payments whose callbacks never arrived, and membership renewals
+	paytrailClient := paytrail.NewClient(cfg.PaytrailAPIURL, cfg.PaytrailMerchantID, cfg.PaytrailSecretKey)
+	billingService := billing.NewService(cfg, pgStore, redisStore, paytrailClient)
+	go billing.NewReconciler(cfg, pgStore, billingService, redisStore, paytrailClient).Run(ctx)
+	go billing.NewRenewer(cfg, pgStore, billingService, paytrailClient).Run(ctx)
+
 	// Initialize handlers
 	paymentHandler := handlers.NewPaymentHandler(cfg, pgStore, redisStore)
 	recoveryHandler := handlers.NewRecoveryHandler(cfg, pgStore, redisStore)
-	streamHandler := handlers.NewStreamHandler(cfg, pgStore, redisStore)
-	adminHandler := handlers.NewAdminHandler(cfg, pgStore, redisStore)
+	membershipHandler := handlers.NewMembershipHandler(cfg, pgStore, redisStore)
+	streamHandler, err := handlers.NewStreamHandler(cfg, pgStore, redisStore)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize stream handler")
+	}
+	go streamHandler.RunCacheJanitor(ctx)
+	go streamHandler.RunStreamChanges(ctx)
+	adminHandler := handlers.NewAdminHandler(cfg, pgStore, redisStore, backends, webhooks, owncastCreds)
 
 	// Find template directory
 	templateDir := findTemplateDir()
+
+	// Start delivery of queued transactional email
+	mailWorker := mail.NewWorker(cfg, pgStore, mail.NewTransport(cfg), templateDir)
+	go mailWorker.Run(ctx)
+
 	pageHandler, err := handlers.NewPageHandler(cfg, pgStore, redisStore, templateDir)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize page handler")
@@ -98,21 +174,28 @@ func main() {
 	adminSessionMiddleware := middleware.NewAdminSessionMiddleware(pgStore, redisStore)
 
 	// Initialize admin page handler
-	adminPageHandler, err := handlers.NewAdminPageHandler(cfg, pgStore, redisStore, templateDir, adminSessionMiddleware, dockerMgr)
+	adminPageHandler, err := handlers.NewAdminPageHandler(cfg, pgStore, redisStore, templateDir, adminSessionMiddleware, backends, webhooks, provisioner, owncastCreds)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize admin page handler")
 	}
 
 	// Initialize Owncast proxy handler
-	owncastProxyHandler := handlers.NewOwncastProxyHandler(cfg, pgStore, redisStore, adminSessionMiddleware)
+	owncastProxyHandler := handlers.NewOwncastProxyHandler(cfg, pgStore, redisStore, adminSessionMiddleware, owncastAdmin)
+	owncastWebhookHandler := handlers.NewOwncastWebhookHandler(pgStore, redisStore, webhooks)
 
 	// Initialize metrics collector and handler
 	var metricsCollector *metrics.Collector
 	if dockerMgr != nil {
 		metricsCollector = metrics.NewCollector(dockerMgr.GetClient(), redisStore.GetClient(), pgStore.GetPool())
+
+		// Keep container statuses in line with Docker
+		containerReconciler := docker.NewReconciler(dockerMgr.GetClient(), pgStore, cfg.ContainerReconcileInterval)
+		go containerReconciler.Run(ctx)
+		metricsCollector.SetReconcileSource(containerReconciler)
 	} else {
 		metricsCollector = metrics.NewCollector(nil, redisStore.GetClient(), pgStore.GetPool())
 	}
+	metricsCollector.AddCacheSource(streamHandler)
 	metricsHandler := handlers.NewMetricsHandler(metricsCollector)
 
 	// Create router
@@ -138,15 +221,31 @@ func main() {
 	// Public API endpoints
 	mux.HandleFunc("GET /api/streams", streamHandler.ListStreams)
 	mux.HandleFunc("GET /api/streams/{slug}", streamHandler.GetStreamInfo)
+	mux.HandleFunc("GET /api/streams/{slug}/broadcast", streamHandler.GetBroadcastStatus)
 	mux.HandleFunc("POST /api/payment/create", paymentHandler.CreatePayment)
+	mux.HandleFunc("POST /api/payment/bundle", paymentHandler.CreateBundlePayment)
 	mux.HandleFunc("POST /api/payment/recover", recoveryHandler.RecoverToken)
+	mux.HandleFunc("POST /api/payment/recover/confirm", recoveryHandler.ConfirmRecovery)
+	mux.HandleFunc("POST /api/payment/redeem", recoveryHandler.RedeemAccessCode)
+	mux.HandleFunc("GET /api/payment/status", paymentHandler.GetPaymentStatus)
 	mux.HandleFunc("GET /api/callback/success", paymentHandler.HandleSuccessCallback)
 	mux.HandleFunc("GET /api/callback/cancel", paymentHandler.HandleCancelCallback)
+	mux.HandleFunc("GET /api/callback/payment", paymentHandler.HandleServerCallback)
+	mux.HandleFunc("POST /api/webhooks/owncast/{id}/{token}", owncastWebhookHandler.Receive)
+	mux.HandleFunc("GET /api/callback/refund/success", paymentHandler.HandleRefundCallback)
+	mux.HandleFunc("GET /api/callback/refund/cancel", paymentHandler.HandleRefundCallback)
+	mux.HandleFunc("POST /api/membership/subscribe", membershipHandler.Subscribe)
+	mux.HandleFunc("POST /api/membership/card", membershipHandler.UpdateCard)
+	mux.HandleFunc("POST /api/membership/cancel", membershipHandler.Cancel)
+	mux.HandleFunc("GET /api/membership/card/success", membershipHandler.HandleCardSuccess)
+	mux.HandleFunc("GET /api/membership/charge/return", membershipHandler.HandleChargeReturn)
+	mux.HandleFunc("GET /api/membership/charge/callback", membershipHandler.HandleChargeCallback)
 	mux.HandleFunc("POST /api/stream/{id}/heartbeat", streamHandler.Heartbeat)
 	mux.HandleFunc("GET /api/stream/{slug}/playlist", streamHandler.GetPlaylistURL)
 
-	// HLS proxy (protected by signed URLs)
+	// HLS proxy and segment keys (protected by signed URLs and sessions)
 	mux.HandleFunc("GET /stream/{id}/hls/{path...}", streamHandler.ServeHLS)
+	mux.HandleFunc("GET /stream/{id}/key/{epoch}", streamHandler.ServeKey)
 
 	// Admin API endpoints (protected by API key) - for programmatic access
 	mux.Handle("GET /api/admin/streams", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListStreams)))
@@ -157,9 +256,27 @@ func main() {
 	mux.Handle("DELETE /api/admin/streams/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.DeleteStream)))
 	mux.Handle("GET /api/admin/streams/{id}/viewers", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.GetViewerCount)))
 	mux.Handle("GET /api/admin/streams/{id}/payments", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListPayments)))
+	mux.Handle("POST /api/admin/payments/{id}/refund", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.RefundPayment)))
 	mux.Handle("GET /api/admin/streams/{id}/whitelist", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListWhitelist)))
 	mux.Handle("POST /api/admin/streams/{id}/whitelist", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.AddToWhitelist)))
 	mux.Handle("DELETE /api/admin/streams/{id}/whitelist/{email}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.RemoveFromWhitelist)))
+	mux.Handle("GET /api/admin/streams/{id}/access-codes", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListAccessCodeBatches)))
+	mux.Handle("POST /api/admin/streams/{id}/access-codes", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.CreateAccessCodeBatch)))
+	mux.Handle("GET /api/admin/access-codes/{id}/export", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ExportAccessCodes)))
+	mux.Handle("DELETE /api/admin/access-codes/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.DeleteAccessCodeBatch)))
+	mux.Handle("GET /api/admin/promo-codes", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListPromoCodes)))
+	mux.Handle("POST /api/admin/promo-codes", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.CreatePromoCode)))
+	mux.Handle("PUT /api/admin/promo-codes/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.UpdatePromoCode)))
+	mux.Handle("DELETE /api/admin/promo-codes/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.DeletePromoCode)))
+	mux.Handle("GET /api/admin/bundles", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListBundles)))
+	mux.Handle("POST /api/admin/bundles", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.CreateBundle)))
+	mux.Handle("GET /api/admin/bundles/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.GetBundle)))
+	mux.Handle("PUT /api/admin/bundles/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.UpdateBundle)))
+	mux.Handle("DELETE /api/admin/bundles/{id}", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.DeleteBundle)))
+	mux.Handle("GET /api/admin/bundles/{id}/payments", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListBundlePayments)))
+	mux.Handle("GET /api/admin/subscriptions", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListSubscriptions)))
+	mux.Handle("GET /api/admin/subscriptions/{id}/charges", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.ListSubscriptionCharges)))
+	mux.Handle("POST /api/admin/subscriptions/{id}/cancel", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.CancelSubscription)))
 	mux.Handle("GET /api/admin/stats", adminAPIMiddleware.RequireAdmin(http.HandlerFunc(adminHandler.GetStats)))
 
 	// Admin Web UI routes (protected by session)
@@ -177,6 +294,7 @@ func main() {
 	mux.Handle("POST /admin/streams/{id}/status", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.UpdateStreamStatus)))
 	mux.Handle("POST /admin/streams/{id}/delete", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.DeleteStream)))
 	mux.Handle("GET /admin/streams/{id}/payments", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.StreamPayments)))
+	mux.Handle("POST /admin/streams/{id}/payments/{paymentID}/refund", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.RefundPayment)))
 
 	// Container management routes
 	mux.Handle("POST /admin/streams/{id}/container/start", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.StartContainer)))
@@ -189,6 +307,12 @@ func main() {
 	// Admin API for AJAX requests (protected by session)
 	mux.Handle("GET /admin/api/streams/{id}/viewers", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.GetViewerCountAPI)))
 
+	// Promo code management page
+	mux.Handle("GET /admin/promo-codes", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.PromoCodesPage)))
+
+	// Bundle management page
+	mux.Handle("GET /admin/bundles", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.BundlesPage)))
+
 	// Metrics routes
 	mux.Handle("GET /admin/metrics", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(adminPageHandler.MetricsPage)))
 	mux.Handle("GET /admin/api/metrics", adminSessionMiddleware.RequireAdminSession(http.HandlerFunc(metricsHandler.GetMetrics)))
@@ -196,8 +320,11 @@ func main() {
 	// Page routes
 	mux.HandleFunc("GET /{$}", pageHandler.Home) // Exact match for root
 	mux.HandleFunc("GET /stream/{slug}", pageHandler.Stream)
+	mux.HandleFunc("GET /bundle/{slug}", pageHandler.Bundle)
 	mux.HandleFunc("GET /watch/{slug}", pageHandler.Watch)
 	mux.HandleFunc("GET /recover/{slug}", pageHandler.Recover)
+	mux.HandleFunc("GET /payment/pending", pageHandler.PaymentPending)
+	mux.HandleFunc("GET /membership", pageHandler.Membership)
 
 	// Apply global middleware
 	handler := middleware.Recovery(middleware.Logging(mux))
@@ -0,0 +1,138 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/security"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// MaxAccessCodesPerBatch limits how many codes one batch can hold
+const MaxAccessCodesPerBatch = 5000
+
+var (
+	// ErrAccessCodeNotFound is returned when a code is unknown, expired, or for another stream
+	ErrAccessCodeNotFound = errors.New("access code not found")
+	// ErrAccessCodeRedeemed is returned when a code has already been used
+	ErrAccessCodeRedeemed = errors.New("access code already redeemed")
+)
+
+// GenerateAccessCode generates a random single-use access code, e.g. PASS-7KQ2-M9XD-H4TB
+func GenerateAccessCode() (string, error) {
+	return generateCode("PASS")
+}
+
+// CreateAccessCodeBatch generates a batch of count single-use codes for a stream
+func (s *Service) CreateAccessCodeBatch(ctx context.Context, stream *models.Stream, label string, count int, expiresAt *time.Time) (*models.AccessCodeBatch, error) {
+	codes := make([]string, 0, count)
+	seen := make(map[string]bool, count)
+	for len(codes) < count {
+		code, err := GenerateAccessCode()
+		if err != nil {
+			return nil, err
+		}
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		codes = append(codes, code)
+	}
+
+	batch := &models.AccessCodeBatch{
+		ID:        uuid.New(),
+		StreamID:  stream.ID,
+		Label:     label,
+		CodeCount: count,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	if err := s.pgStore.CreateAccessCodeBatch(ctx, batch, codes); err != nil {
+		return nil, fmt.Errorf("failed to create access code batch: %w", err)
+	}
+
+	log.Info().
+		Str("batch_id", batch.ID.String()).
+		Str("stream_id", stream.ID.String()).
+		Str("label", label).
+		Int("count", count).
+		Msg("Access code batch created")
+	return batch, nil
+}
+
+// AccessCodeStore looks up and redeems access codes; *storage.PostgresStore implements it
+type AccessCodeStore interface {
+	GetAccessCodeByCode(ctx context.Context, code string) (*models.AccessCode, error)
+	GetAccessCodeBatchByID(ctx context.Context, id uuid.UUID) (*models.AccessCodeBatch, error)
+	RedeemAccessCode(ctx context.Context, id uuid.UUID, payment *models.Payment, pendingSince time.Time) (bool, error)
+}
+
+// RedeemAccessCode uses up an access code and grants the email free access to the stream
+// The completed zero-amount payment works like whitelisted access, so the viewer
+// can later recover it by email. Unlike whitelisting, a code takes a seat and
+// fails with storage.ErrSoldOut once a capped stream is full.
+func (s *Service) RedeemAccessCode(ctx context.Context, code, email string, stream *models.Stream) (*models.Payment, error) {
+	payment, err := s.redeemAccessCode(ctx, s.pgStore, code, email, stream)
+	if err != nil {
+		return nil, err
+	}
+	s.startFreeSession(ctx, payment)
+	return payment, nil
+}
+
+// redeemAccessCode stores the payment for a valid, unused code
+func (s *Service) redeemAccessCode(ctx context.Context, store AccessCodeStore, code, email string, stream *models.Stream) (*models.Payment, error) {
+	accessCode, err := store.GetAccessCodeByCode(ctx, NormalizeGiftCode(code))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access code: %w", err)
+	}
+	if accessCode == nil {
+		return nil, ErrAccessCodeNotFound
+	}
+
+	batch, err := store.GetAccessCodeBatchByID(ctx, accessCode.BatchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access code batch: %w", err)
+	}
+	if batch == nil || batch.StreamID != stream.ID || batch.IsExpiredAt(time.Now()) {
+		return nil, ErrAccessCodeNotFound
+	}
+	if accessCode.RedeemedAt != nil {
+		return nil, ErrAccessCodeRedeemed
+	}
+
+	payment := &models.Payment{
+		ID:          uuid.New(),
+		StreamID:    stream.ID,
+		Email:       email,
+		PaytrailRef: "access-code", // Indicates prepaid access outside Paytrail
+		CreatedAt:   time.Now(),
+	}
+	if err := s.completeFree(payment); err != nil {
+		return nil, err
+	}
+
+	applied, err := store.RedeemAccessCode(ctx, accessCode.ID, payment, time.Now().Add(-security.PendingSeatHold))
+	if errors.Is(err, storage.ErrSoldOut) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem access code: %w", err)
+	}
+	if !applied {
+		return nil, ErrAccessCodeRedeemed
+	}
+
+	log.Info().
+		Str("payment_id", payment.ID.String()).
+		Str("batch_id", batch.ID.String()).
+		Str("stream_id", stream.ID.String()).
+		Str("email", email).
+		Msg("Access code redeemed")
+	return payment, nil
+}
@@ -0,0 +1,109 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+)
+
+// fakeAccessCodeStore keeps codes in memory and sells at most seats tickets
+type fakeAccessCodeStore struct {
+	codes   map[string]*models.AccessCode
+	batches map[uuid.UUID]*models.AccessCodeBatch
+	seats   int
+	sold    int
+}
+
+func (f *fakeAccessCodeStore) GetAccessCodeByCode(ctx context.Context, code string) (*models.AccessCode, error) {
+	return f.codes[code], nil
+}
+
+func (f *fakeAccessCodeStore) GetAccessCodeBatchByID(ctx context.Context, id uuid.UUID) (*models.AccessCodeBatch, error) {
+	return f.batches[id], nil
+}
+
+func (f *fakeAccessCodeStore) RedeemAccessCode(ctx context.Context, id uuid.UUID, payment *models.Payment, pendingSince time.Time) (bool, error) {
+	if f.sold >= f.seats {
+		return false, storage.ErrSoldOut
+	}
+	for _, code := range f.codes {
+		if code.ID == id {
+			if code.RedeemedAt != nil {
+				return false, nil
+			}
+			now := time.Now()
+			code.RedeemedAt = &now
+			code.RedeemedEmail = payment.Email
+			f.sold++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestRedeemAccessCode(t *testing.T) {
+	stream := &models.Stream{ID: uuid.New(), MaxViewers: 2}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	open := &models.AccessCodeBatch{ID: uuid.New(), StreamID: stream.ID}
+	expired := &models.AccessCodeBatch{ID: uuid.New(), StreamID: stream.ID, ExpiresAt: &yesterday}
+	other := &models.AccessCodeBatch{ID: uuid.New(), StreamID: uuid.New()}
+
+	newCode := func(batch *models.AccessCodeBatch, redeemed bool) *models.AccessCode {
+		code := &models.AccessCode{ID: uuid.New(), BatchID: batch.ID}
+		if redeemed {
+			code.RedeemedAt = &yesterday
+		}
+		return code
+	}
+	store := &fakeAccessCodeStore{
+		codes: map[string]*models.AccessCode{
+			"PASS-AAAA-AAAA-AAAA": newCode(open, false),
+			"PASS-BBBB-BBBB-BBBB": newCode(open, false),
+			"PASS-CCCC-CCCC-CCCC": newCode(open, false),
+			"PASS-USED-USED-USED": newCode(open, true),
+			"PASS-EXPD-EXPD-EXPD": newCode(expired, false),
+			"PASS-OTHR-OTHR-OTHR": newCode(other, false),
+		},
+		batches: map[uuid.UUID]*models.AccessCodeBatch{open.ID: open, expired.ID: expired, other.ID: other},
+		seats:   stream.MaxViewers,
+	}
+	s := &Service{cfg: &config.Config{SessionDuration: time.Hour}}
+
+	// In order: the third valid code finds the stream full
+	tests := []struct {
+		name    string
+		code    string
+		wantErr error
+	}{
+		{"valid code", "pass-aaaa-aaaa-aaaa", nil},
+		{"used code", "PASS-USED-USED-USED", ErrAccessCodeRedeemed},
+		{"expired batch", "PASS-EXPD-EXPD-EXPD", ErrAccessCodeNotFound},
+		{"other stream", "PASS-OTHR-OTHR-OTHR", ErrAccessCodeNotFound},
+		{"unknown code", "PASS-NONE-NONE-NONE", ErrAccessCodeNotFound},
+		{"redeemed twice", "PASS-AAAA-AAAA-AAAA", ErrAccessCodeRedeemed},
+		{"last seat", "PASS-BBBB-BBBB-BBBB", nil},
+		{"sold out", "PASS-CCCC-CCCC-CCCC", storage.ErrSoldOut},
+	}
+
+	for _, tt := range tests {
+		payment, err := s.redeemAccessCode(context.Background(), store, tt.code, "viewer@example.com", stream)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if payment.Status != models.PaymentStatusCompleted || payment.AccessToken == "" || payment.StreamID != stream.ID {
+			t.Errorf("%s: payment = %+v, want a completed payment with a token", tt.name, payment)
+		}
+	}
+	if store.codes["PASS-CCCC-CCCC-CCCC"].RedeemedAt != nil {
+		t.Error("code was used up although the stream was sold out")
+	}
+}
@@ -0,0 +1,100 @@
+package billing
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrGiftNotFound is returned when a gift code is unknown, unpaid, or addressed to another email or stream
+var ErrGiftNotFound = errors.New("gift not found")
+
+// codeAlphabet leaves out characters that are easy to misread (0/O, 1/I/L)
+const codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// GenerateGiftCode generates a random code the gift recipient redeems, e.g. GIFT-7KQ2-M9XD-H4TB
+func GenerateGiftCode() (string, error) {
+	return generateCode("GIFT")
+}
+
+// generateCode generates a random code of three four-character groups after prefix
+func generateCode(prefix string) (string, error) {
+	bytes := make([]byte, 12)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i, v := range bytes {
+		if i%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(codeAlphabet[int(v)%len(codeAlphabet)])
+	}
+	return b.String(), nil
+}
+
+// NormalizeGiftCode upper-cases a code typed in by a viewer
+func NormalizeGiftCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// LookupGift finds the paid gift a code grants to email for a stream, without redeeming it
+func (s *Service) LookupGift(ctx context.Context, code, email string, stream *models.Stream) (*models.Payment, error) {
+	payment, err := s.pgStore.GetPaymentByGiftCode(ctx, NormalizeGiftCode(code))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gift: %w", err)
+	}
+	if payment == nil || payment.Status != models.PaymentStatusCompleted ||
+		payment.StreamID != stream.ID || !strings.EqualFold(payment.RecipientEmail, strings.TrimSpace(email)) {
+		return nil, ErrGiftNotFound
+	}
+	return payment, nil
+}
+
+// RedeemGift claims a paid gift for its recipient and starts the access window
+// Redeeming an already redeemed gift returns it unchanged, so the recipient can
+// use the code again like token recovery. The caller issues the access token.
+func (s *Service) RedeemGift(ctx context.Context, code, email string, stream *models.Stream) (*models.Payment, error) {
+	payment, err := s.LookupGift(ctx, code, email, stream)
+	if err != nil {
+		return nil, err
+	}
+	if payment.GiftRedeemedAt != nil {
+		return payment, nil
+	}
+
+	expiry := time.Now().Add(s.cfg.SessionDuration)
+	applied, err := s.pgStore.RedeemGiftPayment(ctx, payment.ID, expiry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem gift: %w", err)
+	}
+	if !applied {
+		// Redeemed concurrently, or refunded in the meantime
+		if err := s.refresh(ctx, payment); err != nil {
+			return nil, err
+		}
+		if payment.Status != models.PaymentStatusCompleted {
+			return nil, ErrGiftNotFound
+		}
+		return payment, nil
+	}
+
+	now := time.Now()
+	payment.GiftRedeemedAt = &now
+	payment.TokenExpiry = &expiry
+
+	log.Info().
+		Str("payment_id", payment.ID.String()).
+		Str("stream_id", payment.StreamID.String()).
+		Str("recipient", payment.RecipientEmail).
+		Msg("Gift redeemed")
+	return payment, nil
+}
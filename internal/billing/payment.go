@@ -0,0 +1,179 @@
+package billing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrPaymentNotFound is returned when a callback references an unknown payment stamp
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// ProcessPaymentCallback applies a verified Paytrail payment callback and records it
+// The pending -> completed/failed transitions are compare-and-set, so replays and
+// concurrent redirect/server callbacks never mint a second token or undo a completion.
+// The returned payment reflects the state after processing.
+func (s *Service) ProcessPaymentCallback(ctx context.Context, params *paytrail.CallbackParams, source models.CallbackSource) (*models.Payment, models.CallbackOutcome, error) {
+	payment, err := s.pgStore.GetPaymentByPaytrailRef(ctx, params.Stamp)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get payment: %w", err)
+	}
+	if payment == nil {
+		s.RecordCallback(ctx, nil, params, source, models.CallbackOutcomeNotFound)
+		return nil, models.CallbackOutcomeNotFound, ErrPaymentNotFound
+	}
+
+	var outcome models.CallbackOutcome
+	switch {
+	case params.IsSuccessful():
+		outcome, err = s.CompletePayment(ctx, payment, params.TransactionID)
+	case params.IsPending():
+		outcome = models.CallbackOutcomePending
+		if payment.Status != models.PaymentStatusPending {
+			outcome = models.CallbackOutcomeDuplicate
+		}
+	default:
+		outcome, err = s.FailPayment(ctx, payment, params.TransactionID)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.RecordCallback(ctx, payment, params, source, outcome)
+	return payment, outcome, nil
+}
+
+// CompletePayment marks a pending payment completed and creates its viewer session
+// If the payment already left pending, payment is refreshed from the database
+// and CallbackOutcomeDuplicate is returned.
+func (s *Service) CompletePayment(ctx context.Context, payment *models.Payment, transactionID string) (models.CallbackOutcome, error) {
+	if payment.Status != models.PaymentStatusPending {
+		return models.CallbackOutcomeDuplicate, nil
+	}
+
+	accessToken, err := GenerateAccessToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate access token: %w", err)
+	}
+	tokenExpiry := time.Now().Add(s.cfg.SessionDuration)
+
+	applied, err := s.pgStore.CompletePendingPayment(ctx, payment.ID, transactionID, accessToken, &tokenExpiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to complete payment: %w", err)
+	}
+	if !applied {
+		// Lost the race to another callback; use whatever it stored
+		if err := s.refresh(ctx, payment); err != nil {
+			return "", err
+		}
+		return models.CallbackOutcomeDuplicate, nil
+	}
+
+	payment.Status = models.PaymentStatusCompleted
+	payment.PaytrailTransactionID = transactionID
+	payment.AccessToken = accessToken
+	payment.TokenExpiry = &tokenExpiry
+
+	// Gifts get their session when the recipient redeems them
+	if !payment.IsGift() {
+		session := storage.NewPaymentSession(payment, accessToken, tokenExpiry)
+		if err := s.redis.SetSession(ctx, accessToken, session, s.cfg.SessionDuration); err != nil {
+			log.Error().Err(err).Msg("Failed to create session")
+			// Continue anyway - the database has the token
+		}
+	}
+
+	event := log.Info().Str("payment_id", payment.ID.String())
+	if payment.IsBundle() {
+		event = event.Str("bundle_id", payment.BundleID.String())
+	} else {
+		event = event.Str("stream_id", payment.StreamID.String())
+	}
+	event.Msg("Payment completed successfully")
+
+	// Only the call that completed the payment gets here, so each payment gets one receipt
+	s.queueReceipt(ctx, payment)
+
+	return models.CallbackOutcomeCompleted, nil
+}
+
+// FailPayment marks a pending payment failed
+// Payments that already left pending are left untouched and refreshed from the database.
+func (s *Service) FailPayment(ctx context.Context, payment *models.Payment, transactionID string) (models.CallbackOutcome, error) {
+	if payment.Status != models.PaymentStatusPending {
+		return models.CallbackOutcomeDuplicate, nil
+	}
+
+	applied, err := s.pgStore.FailPendingPayment(ctx, payment.ID, transactionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to fail payment: %w", err)
+	}
+	if !applied {
+		if err := s.refresh(ctx, payment); err != nil {
+			return "", err
+		}
+		return models.CallbackOutcomeDuplicate, nil
+	}
+
+	payment.Status = models.PaymentStatusFailed
+	if transactionID != "" {
+		payment.PaytrailTransactionID = transactionID
+	}
+
+	log.Info().Str("payment_id", payment.ID.String()).Msg("Payment failed")
+
+	return models.CallbackOutcomeFailed, nil
+}
+
+// RecordCallback stores an audit record of a payment callback
+// Only call it for callbacks whose signature verified; anyone can send unsigned ones.
+// Failures are logged only; the audit trail must never block payment processing.
+func (s *Service) RecordCallback(ctx context.Context, payment *models.Payment, params *paytrail.CallbackParams, source models.CallbackSource, outcome models.CallbackOutcome) {
+	cb := &models.PaymentCallback{
+		ID:            uuid.New(),
+		Stamp:         params.Stamp,
+		TransactionID: params.TransactionID,
+		Status:        params.Status,
+		Source:        source,
+		Outcome:       outcome,
+		ReceivedAt:    time.Now(),
+	}
+	if payment != nil {
+		cb.PaymentID = &payment.ID
+	}
+
+	if err := s.pgStore.RecordPaymentCallback(ctx, cb); err != nil {
+		log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to record payment callback")
+	}
+}
+
+// refresh reloads a payment in place after a lost compare-and-set
+func (s *Service) refresh(ctx context.Context, payment *models.Payment) error {
+	current, err := s.pgStore.GetPaymentByID(ctx, payment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to reload payment: %w", err)
+	}
+	if current == nil {
+		return ErrPaymentNotFound
+	}
+	*payment = *current
+	return nil
+}
+
+// GenerateAccessToken generates a secure random access token
+func GenerateAccessToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
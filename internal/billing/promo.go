@@ -0,0 +1,136 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/security"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrPromoCodeInvalid is returned for unknown, inactive or expired promo codes
+	ErrPromoCodeInvalid = errors.New("promo code is not valid")
+	// ErrPromoCodeNotApplicable is returned when a promo code is scoped to another stream
+	ErrPromoCodeNotApplicable = errors.New("promo code does not apply to this stream")
+)
+
+// ResolvePromoCode looks up a promo code and checks it can be used for the stream right now
+// Usage limits are enforced later, atomically, when the payment is created.
+func (s *Service) ResolvePromoCode(ctx context.Context, code string, stream *models.Stream) (*models.PromoCode, error) {
+	promo, err := s.pgStore.GetPromoCodeByCode(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get promo code: %w", err)
+	}
+	if promo == nil || !promo.IsValidAt(time.Now()) {
+		return nil, ErrPromoCodeInvalid
+	}
+	if !promo.AppliesTo(stream.ID) {
+		return nil, ErrPromoCodeNotApplicable
+	}
+	return promo, nil
+}
+
+// ApplyPromoCode sets the payment amount from the stream price and the promo code's discount
+func ApplyPromoCode(payment *models.Payment, stream *models.Stream, promo *models.PromoCode) {
+	payment.AmountCents = stream.PriceCents
+	payment.DiscountCents = 0
+	payment.PromoCodeID = nil
+	if promo == nil {
+		return
+	}
+
+	payment.DiscountCents = promo.DiscountFor(stream.PriceCents)
+	payment.AmountCents = stream.PriceCents - payment.DiscountCents
+	payment.PromoCodeID = &promo.ID
+}
+
+// CreatePayment stores a new sale, reserving a seat on a capped stream and redeeming the promo code if one is given
+// A bundle sale reserves a seat on every stream the bundle covers that has not
+// ended. Returns storage.ErrSoldOut when a stream has no seats left, and
+// storage.ErrPromoCodeExhausted or storage.ErrPromoCodeEmailLimit when the
+// code's usage limits are reached. Pending payments hold a seat and a use for
+// PendingSeatHold.
+func (s *Service) CreatePayment(ctx context.Context, payment *models.Payment, promo *models.PromoCode) error {
+	streamIDs := []uuid.UUID{payment.StreamID}
+	if payment.IsBundle() {
+		streams, err := s.bundleStreams(ctx, *payment.BundleID)
+		if err != nil {
+			return err
+		}
+		streamIDs = streamIDs[:0]
+		for _, stream := range streams {
+			if stream.Status != models.StreamStatusEnded {
+				streamIDs = append(streamIDs, stream.ID)
+			}
+		}
+	}
+	return s.pgStore.CreatePaymentWithSeats(ctx, payment, streamIDs, promo, time.Now().Add(-security.PendingSeatHold))
+}
+
+// GrantWhitelistedAccess stores a completed zero-price payment for a whitelisted email and creates its viewer session
+// Whitelisted guests are not sold a seat, so they get in even when the stream is sold out.
+func (s *Service) GrantWhitelistedAccess(ctx context.Context, payment *models.Payment) error {
+	if err := s.completeFree(payment); err != nil {
+		return err
+	}
+	if err := s.pgStore.CreatePayment(ctx, payment); err != nil {
+		return err
+	}
+	s.startFreeSession(ctx, payment)
+	return nil
+}
+
+// GrantFreeAccess stores a completed zero-price sale and creates its viewer session
+// Used for 100%-off promo codes and free bundles; no Paytrail transaction is
+// involved, but the sale takes seats like a paid one and can fail with
+// storage.ErrSoldOut. promo may be nil.
+func (s *Service) GrantFreeAccess(ctx context.Context, payment *models.Payment, promo *models.PromoCode) error {
+	if err := s.completeFree(payment); err != nil {
+		return err
+	}
+
+	if err := s.CreatePayment(ctx, payment, promo); err != nil {
+		return err
+	}
+
+	// Create session in Redis (gifts get theirs when redeemed)
+	if !payment.IsGift() {
+		s.startFreeSession(ctx, payment)
+		return nil
+	}
+
+	// The recipient learns about the gift from the gift email
+	s.queueReceipt(ctx, payment)
+
+	return nil
+}
+
+// completeFree marks a new payment as completed at zero price and issues its access token
+func (s *Service) completeFree(payment *models.Payment) error {
+	token, err := GenerateAccessToken()
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(s.cfg.SessionDuration)
+
+	payment.AmountCents = 0 // Free access
+	payment.Status = models.PaymentStatusCompleted
+	payment.AccessToken = token
+	payment.TokenExpiry = &expiry
+	return nil
+}
+
+// startFreeSession creates the viewer session for a stored free payment
+func (s *Service) startFreeSession(ctx context.Context, payment *models.Payment) {
+	session := storage.NewPaymentSession(payment, payment.AccessToken, *payment.TokenExpiry)
+	if err := s.redis.SetSession(ctx, payment.AccessToken, session, s.cfg.SessionDuration); err != nil {
+		log.Error().Err(err).Msg("Failed to create session for free access")
+		// Continue anyway - database has the token
+	}
+}
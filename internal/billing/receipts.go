@@ -0,0 +1,70 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// queueReceipt queues the purchase receipt for a completed payment
+// Gift payments also send the gift code to the recipient. Failures are only
+// logged: the payment itself has already succeeded.
+func (s *Service) queueReceipt(ctx context.Context, payment *models.Payment) {
+	// Where the buyer watches and recovers: the stream's pages, or the bundle page to pick a stream
+	var title, watchURL, recoverURL string
+	if payment.IsBundle() {
+		bundle, err := s.pgStore.GetBundleByID(ctx, *payment.BundleID)
+		if err != nil || bundle == nil {
+			log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to get bundle for receipt")
+			return
+		}
+		title = bundle.Title
+		watchURL = s.cfg.BaseURL + "/bundle/" + bundle.Slug
+		recoverURL = watchURL
+	} else {
+		stream, err := s.pgStore.GetStreamByID(ctx, payment.StreamID)
+		if err != nil || stream == nil {
+			log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to get stream for receipt")
+			return
+		}
+		title = stream.Title
+		watchURL = s.cfg.BaseURL + "/watch/" + stream.Slug
+		recoverURL = s.cfg.BaseURL + "/recover/" + stream.Slug
+	}
+
+	redeemURL := ""
+	if payment.IsGift() {
+		redeemURL = recoverURL + "?gift=" + url.QueryEscape(payment.GiftCode)
+	}
+
+	data := map[string]any{
+		"Title":         title,
+		"Amount":        fmt.Sprintf("%.2f", float64(payment.AmountCents)/100),
+		"Date":          payment.CreatedAt.Format("2.1.2006"),
+		"PaymentID":     payment.ID.String(),
+		"WatchURL":      watchURL,
+		"RecoverURL":    recoverURL,
+		"GiftCode":      payment.GiftCode,
+		"GiftRecipient": payment.RecipientEmail,
+		"RedeemURL":     redeemURL,
+	}
+	if err := s.emails.Enqueue(ctx, payment.Email, "receipt", data); err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to queue receipt")
+	}
+
+	if !payment.IsGift() {
+		return
+	}
+	data = map[string]any{
+		"Title":     title,
+		"Payer":     payment.Email,
+		"GiftCode":  payment.GiftCode,
+		"RedeemURL": redeemURL,
+	}
+	if err := s.emails.Enqueue(ctx, payment.RecipientEmail, "gift", data); err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to queue gift email")
+	}
+}
@@ -0,0 +1,238 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// reconcileBatchSize is how many pending payments are loaded per page
+	reconcileBatchSize = 100
+	// reconcileLeaderJob is the leadership instances compete for to reconcile
+	reconcileLeaderJob = "payment-reconciler"
+)
+
+// PendingPaymentStore pages through pending payments; *storage.PostgresStore implements it
+type PendingPaymentStore interface {
+	ListPendingPaymentsBefore(ctx context.Context, createdBefore, afterCreatedAt time.Time, afterID uuid.UUID, limit int) ([]*models.Payment, error)
+}
+
+// PaymentSettler completes or fails pending payments; *Service implements it
+type PaymentSettler interface {
+	CompletePayment(ctx context.Context, payment *models.Payment, transactionID string) (models.CallbackOutcome, error)
+	FailPayment(ctx context.Context, payment *models.Payment, transactionID string) (models.CallbackOutcome, error)
+}
+
+// LeaderLock makes one instance at a time run a background job; *storage.RedisStore implements it
+type LeaderLock interface {
+	AcquireLeadership(ctx context.Context, job, owner string, ttl time.Duration) (bool, error)
+	ReleaseLeadership(ctx context.Context, job, owner string) error
+}
+
+// ReconcileReport summarises what a reconciliation pass changed
+type ReconcileReport struct {
+	Checked      int // Pending payments examined
+	Completed    int // Paid at Paytrail; completed and given an access token
+	Failed       int // Failed or cancelled at Paytrail
+	Expired      int // Never paid within PaymentAbandonAfter
+	StillPending int // Left for a later pass
+	Errors       int // Could not be checked this pass
+}
+
+// Changed returns true if the pass updated any payments
+func (r *ReconcileReport) Changed() bool {
+	return r.Completed+r.Failed+r.Expired > 0
+}
+
+// Reconciler settles pending payments whose Paytrail callbacks never arrived
+// Only the instance holding the leadership in Redis reconciles, so replicas
+// do not query Paytrail for the same payments.
+type Reconciler struct {
+	store        PendingPaymentStore
+	settler      PaymentSettler
+	paytrail     *paytrail.Client
+	lock         LeaderLock
+	interval     time.Duration
+	minAge       time.Duration
+	abandonAfter time.Duration
+	owner        string
+	now          func() time.Time
+}
+
+// NewReconciler creates a reconciler with the intervals from the configuration
+func NewReconciler(cfg *config.Config, store PendingPaymentStore, settler PaymentSettler, lock LeaderLock, paytrailClient *paytrail.Client) *Reconciler {
+	return &Reconciler{
+		store:        store,
+		settler:      settler,
+		paytrail:     paytrailClient,
+		lock:         lock,
+		interval:     cfg.PaymentReconcileInterval,
+		minAge:       cfg.PaymentReconcileMinAge,
+		abandonAfter: cfg.PaymentAbandonAfter,
+		owner:        uuid.New().String(),
+		now:          time.Now,
+	}
+}
+
+// Run re-checks stale pending payments every interval while this instance is the leader, until ctx is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.interval <= 0 {
+		log.Info().Msg("Payment reconciliation disabled")
+		return
+	}
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.lock.ReleaseLeadership(releaseCtx, reconcileLeaderJob, r.owner); err != nil {
+			log.Warn().Err(err).Msg("Failed to release payment reconciler leadership")
+		}
+	}()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leader, err := r.lock.AcquireLeadership(ctx, reconcileLeaderJob, r.owner, 3*r.interval)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to acquire payment reconciler leadership")
+				continue
+			}
+			if !leader {
+				continue
+			}
+			r.ReconcilePendingPayments(ctx)
+		}
+	}
+}
+
+// ReconcilePendingPayments pages through pending payments older than
+// cfg.PaymentReconcileMinAge and settles them from their Paytrail status.
+// Payments the buyer never paid are failed once older than cfg.PaymentAbandonAfter.
+func (r *Reconciler) ReconcilePendingPayments(ctx context.Context) *ReconcileReport {
+	report := &ReconcileReport{}
+	now := r.now()
+	createdBefore := now.Add(-r.minAge)
+	abandonBefore := now.Add(-r.abandonAfter)
+
+	var afterCreatedAt time.Time
+	afterID := uuid.Nil
+	for {
+		payments, err := r.store.ListPendingPaymentsBefore(ctx, createdBefore, afterCreatedAt, afterID, reconcileBatchSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list pending payments")
+			report.Errors++
+			break
+		}
+
+		for _, payment := range payments {
+			if ctx.Err() != nil {
+				return report
+			}
+			report.Checked++
+			r.reconcilePayment(ctx, payment, payment.CreatedAt.Before(abandonBefore), report)
+		}
+
+		if len(payments) < reconcileBatchSize {
+			break
+		}
+		last := payments[len(payments)-1]
+		afterCreatedAt, afterID = last.CreatedAt, last.ID
+	}
+
+	event := log.Debug()
+	if report.Changed() || report.Errors > 0 {
+		event = log.Info()
+	}
+	event.
+		Int("checked", report.Checked).
+		Int("completed", report.Completed).
+		Int("failed", report.Failed).
+		Int("expired", report.Expired).
+		Int("still_pending", report.StillPending).
+		Int("errors", report.Errors).
+		Msg("Payment reconciliation finished")
+
+	return report
+}
+
+// reconcilePayment settles a single pending payment and updates the report
+func (r *Reconciler) reconcilePayment(ctx context.Context, payment *models.Payment, abandoned bool, report *ReconcileReport) {
+	// Payments created before transaction IDs were stored cannot be looked up
+	if payment.PaytrailTransactionID == "" {
+		r.expireOrKeep(ctx, payment, abandoned, report)
+		return
+	}
+
+	status, err := r.paytrail.GetPayment(ctx, payment.PaytrailTransactionID)
+	if err == paytrail.ErrPaymentNotFound {
+		r.expireOrKeep(ctx, payment, abandoned, report)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to get Paytrail payment status")
+		report.Errors++
+		return
+	}
+
+	var outcome models.CallbackOutcome
+	switch {
+	case status.IsSuccessful():
+		outcome, err = r.settler.CompletePayment(ctx, payment, status.TransactionID)
+	case status.IsFailed():
+		outcome, err = r.settler.FailPayment(ctx, payment, status.TransactionID)
+	case status.IsNew():
+		// The buyer never finished checkout at the provider
+		r.expireOrKeep(ctx, payment, abandoned, report)
+		return
+	default:
+		// pending/delayed: the provider is still processing, leave it be
+		report.StillPending++
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to reconcile payment")
+		report.Errors++
+		return
+	}
+
+	switch outcome {
+	case models.CallbackOutcomeCompleted:
+		report.Completed++
+	case models.CallbackOutcomeFailed:
+		report.Failed++
+	}
+	log.Info().
+		Str("payment_id", payment.ID.String()).
+		Str("paytrail_status", status.Status).
+		Str("outcome", string(outcome)).
+		Msg("Payment reconciled")
+}
+
+// expireOrKeep fails an abandoned payment, or leaves a recent one for a later pass
+func (r *Reconciler) expireOrKeep(ctx context.Context, payment *models.Payment, abandoned bool, report *ReconcileReport) {
+	if !abandoned {
+		report.StillPending++
+		return
+	}
+
+	outcome, err := r.settler.FailPayment(ctx, payment, "")
+	if err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to expire payment")
+		report.Errors++
+		return
+	}
+	if outcome == models.CallbackOutcomeFailed {
+		report.Expired++
+		log.Info().Str("payment_id", payment.ID.String()).Msg("Abandoned payment expired")
+	}
+}
@@ -0,0 +1,111 @@
+package billing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+)
+
+// fakePendingStore hands out the pending payments in one page
+type fakePendingStore struct {
+	payments []*models.Payment
+}
+
+func (f *fakePendingStore) ListPendingPaymentsBefore(ctx context.Context, createdBefore, afterCreatedAt time.Time, afterID uuid.UUID, limit int) ([]*models.Payment, error) {
+	var page []*models.Payment
+	for _, payment := range f.payments {
+		if payment.Status == models.PaymentStatusPending && payment.CreatedAt.Before(createdBefore) && payment.CreatedAt.After(afterCreatedAt) {
+			page = append(page, payment)
+		}
+	}
+	return page, nil
+}
+
+// fakeSettler moves payments out of pending in memory
+type fakeSettler struct{}
+
+func (fakeSettler) CompletePayment(ctx context.Context, payment *models.Payment, transactionID string) (models.CallbackOutcome, error) {
+	payment.Status = models.PaymentStatusCompleted
+	return models.CallbackOutcomeCompleted, nil
+}
+
+func (fakeSettler) FailPayment(ctx context.Context, payment *models.Payment, transactionID string) (models.CallbackOutcome, error) {
+	payment.Status = models.PaymentStatusFailed
+	return models.CallbackOutcomeFailed, nil
+}
+
+func TestReconcilePendingPayments(t *testing.T) {
+	// Paytrail answers with the status after the "tx-" prefix of the transaction ID
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := strings.TrimPrefix(r.URL.Path, "/payments/tx-")
+		status, _, _ = strings.Cut(status, "-")
+		switch status {
+		case "missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"transactionId":"tx","status":"` + status + `"}`))
+		}
+	}))
+	defer server.Close()
+
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	stale := now.Add(-30 * time.Minute)   // Past the minimum age, not abandoned
+	abandoned := now.Add(-48 * time.Hour) // Past the abandon age
+	recent := now.Add(-time.Minute)       // Still left to the callbacks
+
+	tests := []struct {
+		name          string
+		transactionID string
+		createdAt     time.Time
+		want          models.PaymentStatus
+	}{
+		{"paid", "tx-ok", stale, models.PaymentStatusCompleted},
+		{"failed at Paytrail", "tx-fail", stale, models.PaymentStatusFailed},
+		{"still processing", "tx-pending", abandoned, models.PaymentStatusPending},
+		{"checkout not finished", "tx-new", stale, models.PaymentStatusPending},
+		{"checkout abandoned", "tx-new-old", abandoned, models.PaymentStatusFailed},
+		{"unknown to Paytrail", "tx-missing", stale, models.PaymentStatusPending},
+		{"unknown and abandoned", "tx-missing-old", abandoned, models.PaymentStatusFailed},
+		{"Paytrail error", "tx-error", abandoned, models.PaymentStatusPending},
+		{"too recent", "tx-ok-recent", recent, models.PaymentStatusPending},
+	}
+
+	store := &fakePendingStore{}
+	for i, tt := range tests {
+		store.payments = append(store.payments, &models.Payment{
+			ID:                    uuid.New(),
+			Status:                models.PaymentStatusPending,
+			PaytrailTransactionID: tt.transactionID,
+			CreatedAt:             tt.createdAt.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	reconciler := &Reconciler{
+		store:        store,
+		settler:      fakeSettler{},
+		paytrail:     paytrail.NewClient(server.URL, "375917", "SAIPPUAKAUPPIAS"),
+		minAge:       15 * time.Minute,
+		abandonAfter: 24 * time.Hour,
+		now:          func() time.Time { return now },
+	}
+	report := reconciler.ReconcilePendingPayments(context.Background())
+
+	for i, tt := range tests {
+		if got := store.payments[i].Status; got != tt.want {
+			t.Errorf("%s: status = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	want := ReconcileReport{Checked: 8, Completed: 1, Failed: 1, Expired: 2, StillPending: 3, Errors: 1}
+	if *report != want {
+		t.Errorf("report = %+v, want %+v", *report, want)
+	}
+}
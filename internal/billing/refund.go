@@ -0,0 +1,176 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrNotRefundable is returned for payments that have no Paytrail charge to refund
+	ErrNotRefundable = errors.New("payment cannot be refunded")
+	// ErrRefundInProgress is returned when a refund is already waiting for Paytrail
+	ErrRefundInProgress = errors.New("a refund is already in progress for this payment")
+	// ErrRefundNotFound is returned when a refund callback references an unknown stamp
+	ErrRefundNotFound = errors.New("refund not found")
+)
+
+// RefundPayment refunds a completed payment in full through Paytrail
+// If Paytrail completes the refund immediately, access is revoked right away;
+// otherwise the refund stays pending until the refund callback arrives. A refund
+// whose request fails in transport also stays pending, since Paytrail may have
+// accepted it; only an explicit rejection or a failure callback fails it.
+func (s *Service) RefundPayment(ctx context.Context, payment *models.Payment, requestedBy string) (*models.Refund, error) {
+	if payment.Status != models.PaymentStatusCompleted {
+		return nil, ErrNotRefundable
+	}
+	// Whitelisted and other free access has no Paytrail transaction behind it
+	if payment.PaytrailTransactionID == "" || payment.AmountCents <= 0 {
+		return nil, ErrNotRefundable
+	}
+
+	refundID := uuid.New()
+	refund := &models.Refund{
+		ID:          refundID,
+		PaymentID:   payment.ID,
+		AmountCents: payment.AmountCents,
+		Status:      models.RefundStatusPending,
+		RefundStamp: "refund-" + refundID.String(),
+		RequestedBy: requestedBy,
+		CreatedAt:   time.Now(),
+	}
+	// The pending refund is the lock: a second request for the same payment fails here
+	if err := s.pgStore.CreateRefund(ctx, refund); err != nil {
+		if errors.Is(err, storage.ErrRefundPending) {
+			existing, getErr := s.pgStore.GetPendingRefundByPayment(ctx, payment.ID)
+			if getErr != nil {
+				return nil, fmt.Errorf("failed to get pending refund: %w", getErr)
+			}
+			return existing, ErrRefundInProgress
+		}
+		return nil, fmt.Errorf("failed to create refund record: %w", err)
+	}
+
+	resp, err := s.paytrail.RefundPayment(ctx, payment.PaytrailTransactionID, &paytrail.RefundRequest{
+		Amount:          refund.AmountCents,
+		Email:           payment.Email,
+		RefundStamp:     refund.RefundStamp,
+		RefundReference: payment.PaytrailRef,
+		CallbackURLs: &paytrail.CallbackURLs{
+			Success: s.cfg.BaseURL + "/api/callback/refund/success",
+			Cancel:  s.cfg.BaseURL + "/api/callback/refund/cancel",
+		},
+	})
+	if errors.Is(err, paytrail.ErrRefundRejected) {
+		s.failRefund(ctx, refund, "")
+		return refund, fmt.Errorf("paytrail refund failed: %w", err)
+	}
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("payment_id", payment.ID.String()).
+			Str("refund_stamp", refund.RefundStamp).
+			Msg("Refund request unconfirmed; keeping it pending until Paytrail calls back")
+		return refund, nil
+	}
+
+	log.Info().
+		Str("payment_id", payment.ID.String()).
+		Str("refund_stamp", refund.RefundStamp).
+		Str("status", resp.Status).
+		Str("requested_by", requestedBy).
+		Msg("Refund requested")
+
+	switch {
+	case resp.IsSuccessful():
+		if err := s.completeRefund(ctx, refund, payment, resp.TransactionID); err != nil {
+			return refund, err
+		}
+	case resp.IsPending():
+		if err := s.pgStore.UpdateRefundStatus(ctx, refund.ID, models.RefundStatusPending, resp.TransactionID); err != nil {
+			log.Error().Err(err).Str("refund_id", refund.ID.String()).Msg("Failed to store refund transaction ID")
+		}
+		refund.PaytrailTransactionID = resp.TransactionID
+	default:
+		s.failRefund(ctx, refund, resp.TransactionID)
+		return refund, fmt.Errorf("paytrail rejected the refund (status %q)", resp.Status)
+	}
+
+	return refund, nil
+}
+
+// HandleRefundCallback applies a Paytrail refund callback
+// Callbacks for refunds that already reached a final state are ignored.
+func (s *Service) HandleRefundCallback(ctx context.Context, params *paytrail.CallbackParams) (*models.Refund, error) {
+	refund, err := s.pgStore.GetRefundByStamp(ctx, params.Stamp)
+	if err != nil {
+		return nil, err
+	}
+	if refund == nil {
+		return nil, ErrRefundNotFound
+	}
+	if refund.Status != models.RefundStatusPending {
+		return refund, nil
+	}
+
+	switch {
+	case params.IsSuccessful():
+		payment, err := s.pgStore.GetPaymentByID(ctx, refund.PaymentID)
+		if err != nil {
+			return nil, err
+		}
+		if payment == nil {
+			return nil, fmt.Errorf("payment %s not found for refund", refund.PaymentID)
+		}
+		if err := s.completeRefund(ctx, refund, payment, params.TransactionID); err != nil {
+			return nil, err
+		}
+	case params.IsFailed():
+		s.failRefund(ctx, refund, params.TransactionID)
+	}
+
+	return refund, nil
+}
+
+// completeRefund marks the refund and payment as refunded and revokes access
+func (s *Service) completeRefund(ctx context.Context, refund *models.Refund, payment *models.Payment, transactionID string) error {
+	if err := s.pgStore.UpdateRefundStatus(ctx, refund.ID, models.RefundStatusCompleted, transactionID); err != nil {
+		return fmt.Errorf("failed to update refund status: %w", err)
+	}
+	refund.Status = models.RefundStatusCompleted
+	if transactionID != "" {
+		refund.PaytrailTransactionID = transactionID
+	}
+
+	if _, err := s.pgStore.MarkPaymentRefunded(ctx, payment.ID); err != nil {
+		return fmt.Errorf("failed to mark payment refunded: %w", err)
+	}
+	s.RevokeAccess(ctx, payment)
+
+	log.Info().
+		Str("payment_id", payment.ID.String()).
+		Str("refund_stamp", refund.RefundStamp).
+		Msg("Payment refunded and access revoked")
+
+	return nil
+}
+
+// failRefund marks a refund as failed; the payment keeps its access
+func (s *Service) failRefund(ctx context.Context, refund *models.Refund, transactionID string) {
+	if err := s.pgStore.UpdateRefundStatus(ctx, refund.ID, models.RefundStatusFailed, transactionID); err != nil {
+		log.Error().Err(err).Str("refund_id", refund.ID.String()).Msg("Failed to update refund status")
+	}
+	refund.Status = models.RefundStatusFailed
+
+	log.Warn().
+		Str("payment_id", refund.PaymentID.String()).
+		Str("refund_stamp", refund.RefundStamp).
+		Msg("Refund failed")
+}
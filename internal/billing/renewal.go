@@ -0,0 +1,217 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/rs/zerolog/log"
+)
+
+// dunningSchedule is how long to wait before each retry of a failed renewal
+// The membership expires when the charge after the last delay also fails.
+var dunningSchedule = []time.Duration{
+	24 * time.Hour,
+	3 * 24 * time.Hour,
+	3 * 24 * time.Hour,
+}
+
+const (
+	// renewalBatchSize is how many due subscriptions are charged per pass
+	renewalBatchSize = 100
+
+	// renewalLease is how long a claimed renewal is held before it is retried
+	renewalLease = time.Hour
+)
+
+// RenewalReport summarises what a renewal pass changed
+type RenewalReport struct {
+	Checked  int // Due subscriptions examined
+	Renewed  int // Charged and extended by a period
+	Failed   int // Charge declined; moved to dunning
+	Canceled int // Reached the end of a canceled period
+	Expired  int // Dunning gave up
+	Errors   int // Could not be charged this pass; retried after the lease
+}
+
+// Changed returns true if the pass updated any subscriptions
+func (r *RenewalReport) Changed() bool {
+	return r.Renewed+r.Failed+r.Canceled+r.Expired > 0
+}
+
+// RenewalStore is the part of the subscription storage renewals use; *storage.PostgresStore implements it
+type RenewalStore interface {
+	ChargeStore
+	ListDueSubscriptions(ctx context.Context, now time.Time, limit int) ([]*models.Subscription, error)
+	ClaimDueSubscription(ctx context.Context, id uuid.UUID, dueAt, leaseUntil time.Time) (bool, error)
+	MarkSubscriptionPastDue(ctx context.Context, id uuid.UUID, failedCharges int, nextChargeAt time.Time) error
+}
+
+// MembershipSettler ends memberships and starts paid periods; *Service implements it
+type MembershipSettler interface {
+	EndSubscription(ctx context.Context, sub *models.Subscription, status models.SubscriptionStatus) error
+	CompleteCharge(ctx context.Context, sub *models.Subscription, charge *models.SubscriptionCharge, transactionID string) error
+}
+
+// Renewer charges memberships when their period ends and retries declined renewals
+type Renewer struct {
+	store    RenewalStore
+	settler  MembershipSettler
+	paytrail *paytrail.Client
+	baseURL  string
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewRenewer creates a renewer with the interval from the configuration
+func NewRenewer(cfg *config.Config, store RenewalStore, settler MembershipSettler, paytrailClient *paytrail.Client) *Renewer {
+	return &Renewer{
+		store:    store,
+		settler:  settler,
+		paytrail: paytrailClient,
+		baseURL:  cfg.BaseURL,
+		interval: cfg.MembershipRenewInterval,
+		now:      time.Now,
+	}
+}
+
+// Run charges due memberships every interval until ctx is cancelled
+func (r *Renewer) Run(ctx context.Context) {
+	if r.interval <= 0 {
+		log.Info().Msg("Membership renewals disabled")
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.RenewDueSubscriptions(ctx)
+		}
+	}
+}
+
+// RenewDueSubscriptions charges memberships whose period ended or whose dunning retry is due
+// Members who canceled are ended instead of charged.
+func (r *Renewer) RenewDueSubscriptions(ctx context.Context) *RenewalReport {
+	report := &RenewalReport{}
+	now := r.now()
+
+	subs, err := r.store.ListDueSubscriptions(ctx, now, renewalBatchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list due subscriptions")
+		report.Errors++
+		return report
+	}
+
+	for _, sub := range subs {
+		if ctx.Err() != nil {
+			break
+		}
+		report.Checked++
+		r.renewSubscription(ctx, sub, now, report)
+	}
+
+	event := log.Debug()
+	if report.Changed() || report.Errors > 0 {
+		event = log.Info()
+	}
+	event.
+		Int("checked", report.Checked).
+		Int("renewed", report.Renewed).
+		Int("failed", report.Failed).
+		Int("canceled", report.Canceled).
+		Int("expired", report.Expired).
+		Int("errors", report.Errors).
+		Msg("Membership renewals finished")
+
+	return report
+}
+
+// renewSubscription charges a single due membership and updates the report
+func (r *Renewer) renewSubscription(ctx context.Context, sub *models.Subscription, now time.Time, report *RenewalReport) {
+	if sub.CancelAtPeriodEnd {
+		if err := r.settler.EndSubscription(ctx, sub, models.SubscriptionStatusCanceled); err != nil {
+			log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to end canceled membership")
+			report.Errors++
+			return
+		}
+		report.Canceled++
+		return
+	}
+
+	claimed, err := r.store.ClaimDueSubscription(ctx, sub.ID, *sub.NextChargeAt, now.Add(renewalLease))
+	if err != nil {
+		log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to claim renewal")
+		report.Errors++
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if sub.CardToken == "" {
+		r.failRenewal(ctx, sub, now, report)
+		return
+	}
+
+	charge, resp, err := chargeCard(ctx, r.store, r.paytrail, r.baseURL, sub, paytrail.ChargeMerchantInitiated)
+	if errors.Is(err, paytrail.ErrChargeDeclined) {
+		r.failRenewal(ctx, sub, now, report)
+		return
+	}
+	if err != nil {
+		// Paytrail unreachable: the charge stays pending and is sent again with
+		// the same stamp when the lease runs out, without counting as a decline
+		log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Renewal charge failed")
+		report.Errors++
+		return
+	}
+
+	if err := r.settler.CompleteCharge(ctx, sub, charge, resp.TransactionID); err != nil {
+		log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to record renewal")
+		report.Errors++
+		return
+	}
+	report.Renewed++
+}
+
+// failRenewal moves a membership into dunning, or expires it once the retries are used up
+func (r *Renewer) failRenewal(ctx context.Context, sub *models.Subscription, now time.Time, report *RenewalReport) {
+	failed := sub.FailedCharges + 1
+	if failed > len(dunningSchedule) {
+		if err := r.settler.EndSubscription(ctx, sub, models.SubscriptionStatusExpired); err != nil {
+			log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to expire membership")
+			report.Errors++
+			return
+		}
+		report.Expired++
+		return
+	}
+
+	retryAt := now.Add(dunningSchedule[failed-1])
+	if err := r.store.MarkSubscriptionPastDue(ctx, sub.ID, failed, retryAt); err != nil {
+		log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to mark membership past due")
+		report.Errors++
+		return
+	}
+	sub.Status = models.SubscriptionStatusPastDue
+	sub.FailedCharges = failed
+	sub.NextChargeAt = &retryAt
+	report.Failed++
+
+	log.Warn().
+		Str("subscription_id", sub.ID.String()).
+		Str("email", sub.Email).
+		Int("failed_charges", failed).
+		Time("retry_at", retryAt).
+		Msg("Membership renewal declined")
+}
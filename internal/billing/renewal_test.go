@@ -0,0 +1,155 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+)
+
+// fakeRenewalStore keeps subscriptions and charges in memory
+type fakeRenewalStore struct {
+	subs    []*models.Subscription
+	charges []*models.SubscriptionCharge
+}
+
+func (f *fakeRenewalStore) ListDueSubscriptions(ctx context.Context, now time.Time, limit int) ([]*models.Subscription, error) {
+	var due []*models.Subscription
+	for _, sub := range f.subs {
+		if sub.NextChargeAt != nil && !sub.NextChargeAt.After(now) {
+			copied := *sub
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeRenewalStore) ClaimDueSubscription(ctx context.Context, id uuid.UUID, dueAt, leaseUntil time.Time) (bool, error) {
+	for _, sub := range f.subs {
+		if sub.ID == id && sub.NextChargeAt != nil && sub.NextChargeAt.Equal(dueAt) {
+			sub.NextChargeAt = &leaseUntil
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeRenewalStore) MarkSubscriptionPastDue(ctx context.Context, id uuid.UUID, failedCharges int, nextChargeAt time.Time) error {
+	return nil
+}
+
+func (f *fakeRenewalStore) GetUnconfirmedSubscriptionCharge(ctx context.Context, subscriptionID uuid.UUID, initiator string) (*models.SubscriptionCharge, error) {
+	for i := len(f.charges) - 1; i >= 0; i-- {
+		charge := f.charges[i]
+		if charge.SubscriptionID == subscriptionID && charge.Initiator == initiator &&
+			charge.Status == models.ChargeStatusPending && charge.PaytrailTransactionID == "" {
+			return charge, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeRenewalStore) CreateSubscriptionCharge(ctx context.Context, charge *models.SubscriptionCharge) error {
+	f.charges = append(f.charges, charge)
+	return nil
+}
+
+func (f *fakeRenewalStore) SettleSubscriptionCharge(ctx context.Context, id uuid.UUID, status models.ChargeStatus, transactionID, errMsg string) (bool, error) {
+	for _, charge := range f.charges {
+		if charge.ID == id && charge.Status == models.ChargeStatusPending {
+			charge.Status = status
+			charge.PaytrailTransactionID = transactionID
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fakeMembershipSettler completes charges in the fake store
+type fakeMembershipSettler struct {
+	store *fakeRenewalStore
+}
+
+func (f *fakeMembershipSettler) EndSubscription(ctx context.Context, sub *models.Subscription, status models.SubscriptionStatus) error {
+	return nil
+}
+
+func (f *fakeMembershipSettler) CompleteCharge(ctx context.Context, sub *models.Subscription, charge *models.SubscriptionCharge, transactionID string) error {
+	_, err := f.store.SettleSubscriptionCharge(ctx, charge.ID, models.ChargeStatusCompleted, transactionID, "")
+	return err
+}
+
+func TestRenewalRetriesUnansweredChargeWithSameStamp(t *testing.T) {
+	failures := map[string]func(w http.ResponseWriter){
+		"server error": func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		"dropped connection": func(w http.ResponseWriter) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		},
+	}
+
+	for name, fail := range failures {
+		t.Run(name, func(t *testing.T) {
+			var stamps []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req paytrail.TokenPaymentRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				stamps = append(stamps, req.Stamp)
+				if len(stamps) == 1 {
+					fail(w)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"transactionId":"tx-1"}`))
+			}))
+			defer server.Close()
+
+			now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+			due := now.Add(-time.Minute)
+			store := &fakeRenewalStore{subs: []*models.Subscription{{
+				ID:           uuid.New(),
+				Status:       models.SubscriptionStatusActive,
+				PriceCents:   990,
+				CardToken:    "card-token",
+				NextChargeAt: &due,
+			}}}
+			renewer := &Renewer{
+				store:    store,
+				settler:  &fakeMembershipSettler{store: store},
+				paytrail: paytrail.NewClient(server.URL, "375917", "SAIPPUAKAUPPIAS"),
+				now:      func() time.Time { return now },
+			}
+
+			report := renewer.RenewDueSubscriptions(context.Background())
+			if report.Errors != 1 || report.Failed != 0 {
+				t.Fatalf("first pass = %+v, want one error and no decline", *report)
+			}
+			if len(store.charges) != 1 || store.charges[0].Status != models.ChargeStatusPending {
+				t.Fatalf("charges after failure = %+v, want one pending charge", store.charges)
+			}
+
+			// Retried once the lease runs out
+			now = now.Add(renewalLease + time.Minute)
+			report = renewer.RenewDueSubscriptions(context.Background())
+			if report.Renewed != 1 {
+				t.Fatalf("second pass = %+v, want one renewal", *report)
+			}
+			if len(store.charges) != 1 || store.charges[0].Status != models.ChargeStatusCompleted {
+				t.Errorf("charges after retry = %+v, want the same charge completed", store.charges)
+			}
+			if len(stamps) != 2 || stamps[0] != stamps[1] {
+				t.Errorf("stamps sent = %v, want the same stamp twice", stamps)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/mail"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Service handles payment lifecycle operations shared by handlers and background jobs
+type Service struct {
+	cfg      *config.Config
+	pgStore  *storage.PostgresStore
+	redis    *storage.RedisStore
+	paytrail *paytrail.Client
+	emails   *mail.Queue
+}
+
+// NewService creates a new billing service
+func NewService(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore, paytrailClient *paytrail.Client) *Service {
+	return &Service{
+		cfg:      cfg,
+		pgStore:  pgStore,
+		redis:    redis,
+		paytrail: paytrailClient,
+		emails:   mail.NewQueue(pgStore),
+	}
+}
+
+// RevokeAccess removes everything in Redis that grants access for a payment's token
+// The database row must already be in a non-completed state, otherwise the
+// token would simply be re-validated on the next page load.
+func (s *Service) RevokeAccess(ctx context.Context, payment *models.Payment) {
+	if payment.AccessToken == "" {
+		return
+	}
+
+	if err := s.redis.DeleteSession(ctx, payment.AccessToken); err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to delete session")
+	}
+	if err := s.redis.DeleteActiveDevice(ctx, payment.AccessToken); err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to delete active device")
+	}
+
+	streamIDs := []uuid.UUID{payment.StreamID}
+	if payment.IsBundle() {
+		// A bundle token may hold a viewing seat on any stream the bundle covers
+		streams, err := s.bundleStreams(ctx, *payment.BundleID)
+		if err != nil {
+			log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to get bundle streams")
+		}
+		streamIDs = streamIDs[:0]
+		for _, stream := range streams {
+			streamIDs = append(streamIDs, stream.ID)
+		}
+	}
+	for _, streamID := range streamIDs {
+		if err := s.redis.RemoveActiveSession(ctx, streamID, payment.AccessToken); err != nil {
+			log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to release viewer seat")
+		}
+	}
+}
+
+// bundleStreams returns the streams a bundle covers
+func (s *Service) bundleStreams(ctx context.Context, bundleID uuid.UUID) ([]*models.Stream, error) {
+	bundle, err := s.pgStore.GetBundleByID(ctx, bundleID)
+	if err != nil {
+		return nil, err
+	}
+	if bundle == nil {
+		return nil, fmt.Errorf("bundle %s not found", bundleID)
+	}
+	streams, err := s.pgStore.ListStreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var covered []*models.Stream
+	for _, stream := range streams {
+		if bundle.Covers(stream) {
+			covered = append(covered, stream)
+		}
+	}
+	return covered, nil
+}
@@ -0,0 +1,309 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrMembershipsDisabled is returned when no membership price is configured
+	ErrMembershipsDisabled = errors.New("memberships are not on sale")
+	// ErrAlreadyMember is returned when the email already has a running membership
+	ErrAlreadyMember = errors.New("email already has a membership")
+	// ErrNoCard is returned when charging a subscription that has no saved card
+	ErrNoCard = errors.New("subscription has no saved card")
+	// ErrChargeNotFound is returned when a callback references an unknown charge stamp
+	ErrChargeNotFound = errors.New("subscription charge not found")
+)
+
+// StartSubscription creates an incomplete membership and returns the form that saves the buyer's card
+// The first period is charged once the card has been saved.
+func (s *Service) StartSubscription(ctx context.Context, email string) (*models.Subscription, *paytrail.AddCardForm, error) {
+	if !s.cfg.MembershipsEnabled() {
+		return nil, nil, ErrMembershipsDisabled
+	}
+
+	existing, err := s.pgStore.GetLiveSubscriptionByEmail(ctx, email)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up membership: %w", err)
+	}
+	if existing != nil {
+		return nil, nil, ErrAlreadyMember
+	}
+
+	sub := &models.Subscription{
+		ID:           uuid.New(),
+		Email:        email,
+		Status:       models.SubscriptionStatusIncomplete,
+		PriceCents:   s.cfg.MembershipPriceCents,
+		PeriodMonths: s.cfg.MembershipPeriodMonths,
+		CreatedAt:    time.Now(),
+	}
+	if err := s.pgStore.CreateSubscription(ctx, sub); err != nil {
+		return nil, nil, fmt.Errorf("failed to create subscription: %w", err)
+	}
+
+	return sub, s.CardForm(sub), nil
+}
+
+// CardForm builds the Paytrail form that saves a card for the subscription
+// Used both at signup and when a member replaces their card.
+func (s *Service) CardForm(sub *models.Subscription) *paytrail.AddCardForm {
+	return s.paytrail.AddCardForm(&paytrail.AddCardRequest{
+		SuccessURL: s.cfg.BaseURL + "/api/membership/card/success?subscription=" + url.QueryEscape(sub.ID.String()),
+		CancelURL:  s.cfg.BaseURL + "/membership",
+		Language:   "FI",
+	})
+}
+
+// SaveCard exchanges a tokenization ID from the add card redirect for a card token and stores it
+func (s *Service) SaveCard(ctx context.Context, sub *models.Subscription, tokenizationID string) error {
+	card, err := s.paytrail.GetCardToken(ctx, tokenizationID)
+	if err != nil {
+		return fmt.Errorf("failed to get card token: %w", err)
+	}
+
+	expiry := ""
+	if card.Card.ExpireMonth != "" && card.Card.ExpireYear != "" {
+		expiry = card.Card.ExpireMonth + "/" + card.Card.ExpireYear
+	}
+	if err := s.pgStore.SetSubscriptionCard(ctx, sub.ID, card.Token, card.Card.Type, card.Card.PartialPAN, expiry); err != nil {
+		return fmt.Errorf("failed to save card: %w", err)
+	}
+
+	sub.CardToken = card.Token
+	sub.CardType = card.Card.Type
+	sub.CardLast4 = card.Card.PartialPAN
+	sub.CardExpiry = expiry
+
+	log.Info().Str("subscription_id", sub.ID.String()).Str("card_type", card.Card.Type).Msg("Membership card saved")
+	return nil
+}
+
+// ChargeNow charges the current period while the member is present (signup or card update in dunning)
+// Returns a 3-D Secure URL the member must be sent to, or "" if the charge completed.
+// Declined charges return an error wrapping paytrail.ErrChargeDeclined.
+func (s *Service) ChargeNow(ctx context.Context, sub *models.Subscription) (string, error) {
+	if sub.CardToken == "" {
+		return "", ErrNoCard
+	}
+
+	charge, resp, err := chargeCard(ctx, s.pgStore, s.paytrail, s.cfg.BaseURL, sub, paytrail.ChargeCustomerInitiated)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.RequiresThreeDS() {
+		if err := s.pgStore.SetSubscriptionChargeTransaction(ctx, charge.ID, resp.TransactionID); err != nil {
+			log.Error().Err(err).Str("charge_id", charge.ID.String()).Msg("Failed to store charge transaction ID")
+		}
+		return resp.ThreeDSecureURL, nil
+	}
+
+	if err := s.CompleteCharge(ctx, sub, charge, resp.TransactionID); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// ProcessChargeCallback applies a verified Paytrail callback for a charge that went through 3-D Secure
+// The returned subscription reflects the state after processing.
+func (s *Service) ProcessChargeCallback(ctx context.Context, params *paytrail.CallbackParams) (*models.Subscription, error) {
+	charge, err := s.pgStore.GetSubscriptionChargeByStamp(ctx, params.Stamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get charge: %w", err)
+	}
+	if charge == nil {
+		return nil, ErrChargeNotFound
+	}
+
+	sub, err := s.pgStore.GetSubscriptionByID(ctx, charge.SubscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	if sub == nil {
+		return nil, ErrChargeNotFound
+	}
+
+	switch {
+	case params.IsSuccessful():
+		if err := s.CompleteCharge(ctx, sub, charge, params.TransactionID); err != nil {
+			return nil, err
+		}
+	case params.IsPending():
+		// Wait for the final callback
+	default:
+		settleFailed(ctx, s.pgStore, charge, params.TransactionID, "charge failed: "+params.Status)
+	}
+
+	return sub, nil
+}
+
+// CancelAtPeriodEnd stops a membership from renewing; access lasts until the paid period ends
+func (s *Service) CancelAtPeriodEnd(ctx context.Context, sub *models.Subscription) error {
+	if err := s.pgStore.SetSubscriptionCancelAtPeriodEnd(ctx, sub.ID, true); err != nil {
+		return fmt.Errorf("failed to cancel subscription: %w", err)
+	}
+	sub.CancelAtPeriodEnd = true
+
+	log.Info().Str("subscription_id", sub.ID.String()).Msg("Membership set to cancel at period end")
+	return nil
+}
+
+// EndSubscription ends a membership immediately and revokes its sessions
+func (s *Service) EndSubscription(ctx context.Context, sub *models.Subscription, status models.SubscriptionStatus) error {
+	if err := s.pgStore.EndSubscription(ctx, sub.ID, status); err != nil {
+		return fmt.Errorf("failed to end subscription: %w", err)
+	}
+	sub.Status = status
+	sub.NextChargeAt = nil
+
+	if sub.AccessToken != "" {
+		if err := s.redis.DeleteSession(ctx, sub.AccessToken); err != nil {
+			log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to delete session")
+		}
+	}
+
+	log.Info().
+		Str("subscription_id", sub.ID.String()).
+		Str("status", string(status)).
+		Msg("Membership ended")
+	return nil
+}
+
+// CompleteCharge settles a successful charge and starts the paid period
+// A charge that was already settled (e.g. by a concurrent callback) is left alone.
+func (s *Service) CompleteCharge(ctx context.Context, sub *models.Subscription, charge *models.SubscriptionCharge, transactionID string) error {
+	applied, err := s.pgStore.SettleSubscriptionCharge(ctx, charge.ID, models.ChargeStatusCompleted, transactionID, "")
+	if err != nil {
+		return fmt.Errorf("failed to settle charge: %w", err)
+	}
+	if !applied {
+		fresh, err := s.pgStore.GetSubscriptionByID(ctx, sub.ID)
+		if err != nil {
+			return fmt.Errorf("failed to refresh subscription: %w", err)
+		}
+		if fresh != nil {
+			*sub = *fresh
+		}
+		return nil
+	}
+
+	now := time.Now()
+	start, end := now, now.AddDate(0, sub.PeriodMonths, 0)
+	if sub.IsLive() && sub.CurrentPeriodEnd != nil {
+		start, end = sub.NextPeriod(*sub.CurrentPeriodEnd, now)
+	}
+
+	newToken := ""
+	if sub.AccessToken == "" {
+		newToken, err = GenerateAccessToken()
+		if err != nil {
+			return fmt.Errorf("failed to generate access token: %w", err)
+		}
+	}
+
+	if err := s.pgStore.StartSubscriptionPeriod(ctx, sub.ID, start, end, newToken); err != nil {
+		return fmt.Errorf("failed to start period: %w", err)
+	}
+
+	sub.Status = models.SubscriptionStatusActive
+	sub.CurrentPeriodStart = &start
+	sub.CurrentPeriodEnd = &end
+	sub.NextChargeAt = &end
+	sub.FailedCharges = 0
+	if newToken != "" {
+		sub.AccessToken = newToken
+		session := storage.NewSubscriptionSession(sub, newToken, end)
+		if err := s.redis.SetSession(ctx, newToken, session, s.cfg.SessionDuration); err != nil {
+			log.Error().Err(err).Msg("Failed to create session")
+			// Continue anyway - the database has the token
+		}
+	}
+
+	log.Info().
+		Str("subscription_id", sub.ID.String()).
+		Str("charge_id", charge.ID.String()).
+		Time("period_end", end).
+		Msg("Membership period paid")
+	return nil
+}
+
+// ChargeStore records subscription charges; *storage.PostgresStore implements it
+type ChargeStore interface {
+	GetUnconfirmedSubscriptionCharge(ctx context.Context, subscriptionID uuid.UUID, initiator string) (*models.SubscriptionCharge, error)
+	CreateSubscriptionCharge(ctx context.Context, charge *models.SubscriptionCharge) error
+	SettleSubscriptionCharge(ctx context.Context, id uuid.UUID, status models.ChargeStatus, transactionID, errMsg string) (bool, error)
+}
+
+// chargeCard charges a subscription's saved card for one period
+// A pending charge that Paytrail never answered is sent again with its own
+// stamp rather than a new one, so a charge whose response was lost cannot be
+// taken twice. Declined charges are marked failed; after transport and server
+// errors the charge stays pending for the retry (or for Paytrail's callback).
+func chargeCard(ctx context.Context, store ChargeStore, client *paytrail.Client, baseURL string, sub *models.Subscription, initiator paytrail.ChargeInitiator) (*models.SubscriptionCharge, *paytrail.TokenChargeResponse, error) {
+	charge, err := store.GetUnconfirmedSubscriptionCharge(ctx, sub.ID, string(initiator))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pending charge: %w", err)
+	}
+	if charge == nil {
+		charge = newCharge(sub, initiator)
+		if err := store.CreateSubscriptionCharge(ctx, charge); err != nil {
+			return nil, nil, fmt.Errorf("failed to create charge: %w", err)
+		}
+	}
+
+	resp, err := client.ChargeToken(ctx, initiator, chargeRequest(baseURL, sub, charge))
+	if errors.Is(err, paytrail.ErrChargeDeclined) {
+		settleFailed(ctx, store, charge, "", err.Error())
+	}
+	if err != nil {
+		return charge, nil, err
+	}
+	return charge, resp, nil
+}
+
+// settleFailed marks a charge failed, logging rather than returning storage errors
+func settleFailed(ctx context.Context, store ChargeStore, charge *models.SubscriptionCharge, transactionID, reason string) {
+	if _, err := store.SettleSubscriptionCharge(ctx, charge.ID, models.ChargeStatusFailed, transactionID, reason); err != nil {
+		log.Error().Err(err).Str("charge_id", charge.ID.String()).Msg("Failed to mark charge failed")
+	}
+}
+
+// newCharge builds a pending charge for one period of the subscription
+func newCharge(sub *models.Subscription, initiator paytrail.ChargeInitiator) *models.SubscriptionCharge {
+	id := uuid.New()
+	return &models.SubscriptionCharge{
+		ID:             id,
+		SubscriptionID: sub.ID,
+		AmountCents:    sub.PriceCents,
+		Status:         models.ChargeStatusPending,
+		Initiator:      string(initiator),
+		PaytrailStamp:  "sub-" + id.String(),
+		CreatedAt:      time.Now(),
+	}
+}
+
+// chargeRequest builds the Paytrail token charge for a pending charge
+// Redirect URLs are only followed by customer-initiated charges that need 3-D Secure.
+func chargeRequest(baseURL string, sub *models.Subscription, charge *models.SubscriptionCharge) *paytrail.TokenPaymentRequest {
+	return paytrail.NewTokenPaymentRequest(&paytrail.SimplePaymentRequest{
+		Stamp:       charge.PaytrailStamp,
+		Reference:   sub.ID.String()[:8],
+		Amount:      charge.AmountCents,
+		Description: "Membership",
+		Email:       sub.Email,
+		SuccessURL:  baseURL + "/api/membership/charge/return",
+		CancelURL:   baseURL + "/api/membership/charge/return",
+		CallbackURL: baseURL + "/api/membership/charge/callback",
+	}, sub.CardToken)
+}
@@ -0,0 +1,223 @@
+// Package cache provides the bounded in-memory caches of the HLS proxy
+// Entries are evicted least recently used first once the cache's byte budget
+// is reached, and expired entries are removed by Sweep, so memory use stays
+// bounded no matter how many streams, variants and tokens pass through.
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// entryOverhead approximates the memory an entry uses besides its key and value
+const entryOverhead = 128
+
+// Stats is a snapshot of a cache's usage and counters
+type Stats struct {
+	Name        string
+	Entries     int
+	Bytes       int64
+	MaxBytes    int64
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64 // Removed to stay within the byte budget
+	Expirations uint64 // Removed after their TTL
+	Streams     []StreamStats
+}
+
+// StreamStats is the share of a cache used by one stream
+type StreamStats struct {
+	StreamID string
+	Entries  int
+	Bytes    int64
+}
+
+// entry is one cached value
+type entry[V any] struct {
+	key       string
+	streamID  string
+	value     V
+	size      int64
+	expiresAt time.Time
+}
+
+// Cache is a size-bounded LRU cache with per-entry TTLs, safe for concurrent use
+type Cache[V any] struct {
+	name     string
+	maxBytes int64
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Front is the most recently used
+	bytes   int64
+	streams map[string]*StreamStats
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+}
+
+// New creates a cache holding at most maxBytes
+func New[V any](name string, maxBytes int64) *Cache[V] {
+	return &Cache[V]{
+		name:     name,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		streams:  make(map[string]*StreamStats),
+	}
+}
+
+// Get returns the value cached under key, unless it has expired
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return zero, false
+	}
+	e := elem.Value.(*entry[V])
+	if !c.now().Before(e.expiresAt) {
+		c.remove(elem)
+		c.expirations++
+		c.misses++
+		return zero, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return e.value, true
+}
+
+// Set caches value under key for ttl, accounted to streamID
+// size is the value's size in bytes; the key and a fixed overhead are added.
+// Least recently used entries are evicted to make room. Returns false when the
+// value alone exceeds the budget and was not cached.
+func (c *Cache[V]) Set(key, streamID string, value V, size int64, ttl time.Duration) bool {
+	size += int64(len(key)) + entryOverhead
+	if size > c.maxBytes {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+
+	e := &entry[V]{key: key, streamID: streamID, value: value, size: size, expiresAt: c.now().Add(ttl)}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += size
+
+	usage, ok := c.streams[streamID]
+	if !ok {
+		usage = &StreamStats{StreamID: streamID}
+		c.streams[streamID] = usage
+	}
+	usage.Entries++
+	usage.Bytes += size
+	return true
+}
+
+// Delete removes the value cached under key
+func (c *Cache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// DeleteStream removes every value accounted to streamID
+func (c *Cache[V]) DeleteStream(streamID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*entry[V]).streamID == streamID {
+			c.remove(elem)
+			removed++
+		}
+		elem = next
+	}
+	return removed
+}
+
+// Sweep removes every expired entry and returns how many were removed
+func (c *Cache[V]) Sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	removed := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if !now.Before(elem.Value.(*entry[V]).expiresAt) {
+			c.remove(elem)
+			removed++
+		}
+		elem = next
+	}
+	c.expirations += uint64(removed)
+	return removed
+}
+
+// Stats returns the cache's current usage and counters, streams largest first
+func (c *Cache[V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := Stats{
+		Name:        c.name,
+		Entries:     len(c.entries),
+		Bytes:       c.bytes,
+		MaxBytes:    c.maxBytes,
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+		Streams:     make([]StreamStats, 0, len(c.streams)),
+	}
+	for _, usage := range c.streams {
+		stats.Streams = append(stats.Streams, *usage)
+	}
+	sort.Slice(stats.Streams, func(i, j int) bool {
+		if stats.Streams[i].Bytes != stats.Streams[j].Bytes {
+			return stats.Streams[i].Bytes > stats.Streams[j].Bytes
+		}
+		return stats.Streams[i].StreamID < stats.Streams[j].StreamID
+	})
+	return stats
+}
+
+// remove unlinks an entry and updates the accounting; c.mu must be held
+func (c *Cache[V]) remove(elem *list.Element) {
+	e := elem.Value.(*entry[V])
+	c.lru.Remove(elem)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+
+	if usage, ok := c.streams[e.streamID]; ok {
+		usage.Entries--
+		usage.Bytes -= e.size
+		if usage.Entries == 0 {
+			delete(c.streams, e.streamID)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestCache(maxBytes int64) (*Cache[string], *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := New[string]("test", maxBytes)
+	c.now = clock.Now
+	return c, clock
+}
+
+// entrySize is the accounted size of a value stored under a one-byte key
+func entrySize(valueSize int64) int64 {
+	return valueSize + 1 + entryOverhead
+}
+
+func TestGetSet(t *testing.T) {
+	c, _ := newTestCache(1 << 20)
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Expected miss on empty cache")
+	}
+	if !c.Set("a", "s1", "alpha", 5, time.Minute) {
+		t.Fatal("Expected value to be cached")
+	}
+	value, ok := c.Get("a")
+	if !ok || value != "alpha" {
+		t.Fatalf("Expected alpha, got %q (%v)", value, ok)
+	}
+
+	// Replacing a key keeps one entry
+	c.Set("a", "s1", "beta", 4, time.Minute)
+	stats := c.Stats()
+	if stats.Entries != 1 || stats.Bytes != entrySize(4) {
+		t.Errorf("Expected 1 entry of %d bytes, got %d entries of %d bytes", entrySize(4), stats.Entries, stats.Bytes)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %d and %d", stats.Hits, stats.Misses)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	// Room for exactly three 100-byte values
+	c, _ := newTestCache(3 * entrySize(100))
+
+	c.Set("a", "s1", "a", 100, time.Minute)
+	c.Set("b", "s1", "b", 100, time.Minute)
+	c.Set("c", "s2", "c", 100, time.Minute)
+
+	// Touch a, so b is the least recently used
+	c.Get("a")
+	c.Set("d", "s2", "d", 100, time.Minute)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("Expected %s to be cached", key)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Evictions != 1 {
+		t.Errorf("Expected 1 eviction, got %d", stats.Evictions)
+	}
+	if stats.Bytes > stats.MaxBytes {
+		t.Errorf("Cache uses %d bytes, over its budget of %d", stats.Bytes, stats.MaxBytes)
+	}
+}
+
+func TestOversizedValue(t *testing.T) {
+	c, _ := newTestCache(entrySize(100))
+
+	c.Set("a", "s1", "a", 50, time.Minute)
+	if c.Set("b", "s1", "b", 101, time.Minute) {
+		t.Error("Expected a value over the budget to be rejected")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Rejected value should not evict others")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c, clock := newTestCache(1 << 20)
+
+	c.Set("short", "s1", "x", 1, time.Second)
+	c.Set("long", "s1", "y", 1, time.Hour)
+
+	clock.now = clock.now.Add(2 * time.Second)
+	if _, ok := c.Get("short"); ok {
+		t.Error("Expected expired entry to miss")
+	}
+
+	c.Set("short2", "s1", "z", 1, time.Second)
+	clock.now = clock.now.Add(2 * time.Second)
+	if removed := c.Sweep(); removed != 1 {
+		t.Errorf("Expected sweep to remove 1 entry, removed %d", removed)
+	}
+
+	stats := c.Stats()
+	if stats.Entries != 1 || stats.Expirations != 2 {
+		t.Errorf("Expected 1 entry and 2 expirations, got %d and %d", stats.Entries, stats.Expirations)
+	}
+}
+
+func TestStreamAccounting(t *testing.T) {
+	c, _ := newTestCache(1 << 20)
+
+	c.Set("a", "s1", "a", 100, time.Minute)
+	c.Set("b", "s2", "b", 300, time.Minute)
+	c.Set("c", "s2", "c", 300, time.Minute)
+
+	stats := c.Stats()
+	if len(stats.Streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %d", len(stats.Streams))
+	}
+	if stats.Streams[0].StreamID != "s2" || stats.Streams[0].Entries != 2 || stats.Streams[0].Bytes != 2*entrySize(300) {
+		t.Errorf("Unexpected usage for s2: %+v", stats.Streams[0])
+	}
+
+	if removed := c.DeleteStream("s2"); removed != 2 {
+		t.Errorf("Expected 2 entries removed, got %d", removed)
+	}
+	stats = c.Stats()
+	if len(stats.Streams) != 1 || stats.Bytes != entrySize(100) {
+		t.Errorf("Expected only s1 to remain, got %+v", stats)
+	}
+}
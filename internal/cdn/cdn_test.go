@@ -0,0 +1,157 @@
+package cdn
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testURL = "https://cdn.example.com/stream/abc/hls/~b/0/seg12.ts"
+
+var testExpiry = time.Unix(1700000000, 0)
+
+func signQuery(t *testing.T, signer Signer) (*url.URL, url.Values) {
+	t.Helper()
+	signed, err := signer.Sign(testURL, testExpiry)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("Signed URL does not parse: %v", err)
+	}
+	if u.Path != "/stream/abc/hls/~b/0/seg12.ts" || u.Host != "cdn.example.com" {
+		t.Errorf("Signing changed the URL: %s", signed)
+	}
+	return u, u.Query()
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer, err := NewSigner(SchemeHMAC, "edge-secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, query := signQuery(t, signer)
+
+	mac := hmac.New(sha256.New, []byte("edge-secret"))
+	mac.Write([]byte("1700000000:/stream/abc/hls/~b/0/seg12.ts"))
+	if query.Get("expires") != "1700000000" || query.Get("signature") != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Unexpected token: %v", query)
+	}
+}
+
+func TestBunnySigner(t *testing.T) {
+	signer, err := NewSigner(SchemeBunny, "bunny-key", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, query := signQuery(t, signer)
+
+	sum := sha256.Sum256([]byte("bunny-key/stream/abc/hls/~b/0/seg12.ts1700000000"))
+	expected := strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(base64.StdEncoding.EncodeToString(sum[:])), "=")
+	if query.Get("token") != expected || query.Get("expires") != "1700000000" {
+		t.Errorf("Unexpected token: %v", query)
+	}
+}
+
+func TestAkamaiSigner(t *testing.T) {
+	if _, err := NewSigner(SchemeAkamai, "not-hex", "", nil); err == nil {
+		t.Error("Expected a non-hex Akamai key to be rejected")
+	}
+
+	signer, err := NewSigner(SchemeAkamai, "0a1b2c3d", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, query := signQuery(t, signer)
+
+	fields := "exp=1700000000~acl=/stream/abc/hls/%7eb/0/seg12.ts"
+	mac := hmac.New(sha256.New, []byte{0x0a, 0x1b, 0x2c, 0x3d})
+	mac.Write([]byte(fields))
+	if query.Get("hdnts") != fields+"~hmac="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Unexpected token: %s", query.Get("hdnts"))
+	}
+}
+
+func TestCloudFrontSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes})
+
+	if _, err := NewSigner(SchemeCloudFront, "", "", pkcs1); err == nil {
+		t.Error("Expected a missing key pair ID to be rejected")
+	}
+
+	for name, pemKey := range map[string][]byte{"pkcs1": pkcs1, "pkcs8": pkcs8} {
+		signer, err := NewSigner(SchemeCloudFront, "", "K2JCJMDEHXQW5F", pemKey)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, query := signQuery(t, signer)
+
+		if query.Get("Expires") != "1700000000" || query.Get("Key-Pair-Id") != "K2JCJMDEHXQW5F" {
+			t.Errorf("%s: unexpected query: %v", name, query)
+		}
+		raw := strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature"))
+		signature, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			t.Fatalf("%s: signature is not CloudFront Base64: %v", name, err)
+		}
+		digest := sha1.Sum([]byte(`{"Statement":[{"Resource":"` + testURL + `","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], signature); err != nil {
+			t.Errorf("%s: signature does not verify: %v", name, err)
+		}
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	if _, err := NewSigner("fastly", "key", "", nil); err == nil {
+		t.Error("Expected an unknown scheme to be rejected")
+	}
+}
+
+func TestOriginAuthorized(t *testing.T) {
+	origin := NewOrigin("X-Origin-Auth", "pull-secret")
+
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"correct secret", "pull-secret", true},
+		{"wrong secret", "pull-secreT", false},
+		{"missing header", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/stream/abc/hls/0/seg12.ts", nil)
+		if tt.value != "" {
+			r.Header.Set("X-Origin-Auth", tt.value)
+		}
+		if got := origin.Authorized(r); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if NewOrigin("X-Origin-Auth", "").Authorized(httptest.NewRequest("GET", "/", nil)) {
+		t.Error("An empty secret must not authorize requests without the header")
+	}
+}
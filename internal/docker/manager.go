@@ -28,6 +28,13 @@ const (
 	StatusError    ContainerStatus = "error"
 )
 
+// Labels set on the containers the manager creates
+const (
+	managedByLabel = "managed-by"
+	managedByValue = "stream-paywall"
+	slugLabel      = "stream-slug"
+)
+
 // Manager handles Docker container operations for Owncast instances
 type Manager struct {
 	client        *client.Client
@@ -122,7 +129,8 @@ func VolumeName(slug string) string {
 }
 
 // CreateAndStartContainer creates and starts an Owncast container for a stream
-func (m *Manager) CreateAndStartContainer(ctx context.Context, slug, streamKey string, rtmpPort int) error {
+// adminPassword is set on a new container's Owncast; "" keeps Owncast's own default.
+func (m *Manager) CreateAndStartContainer(ctx context.Context, slug, streamKey, adminPassword string, rtmpPort int) error {
 	containerName := ContainerName(slug)
 	volumeName := VolumeName(slug)
 
@@ -143,19 +151,24 @@ func (m *Manager) CreateAndStartContainer(ctx context.Context, slug, streamKey s
 		return m.client.ContainerStart(ctx, existing, container.StartOptions{})
 	}
 
+	cmd := []string{
+		"--streamkey", streamKey,
+	}
+	if adminPassword != "" {
+		cmd = append(cmd, "--adminpassword", adminPassword)
+	}
+
 	// Create container config
 	config := &container.Config{
 		Image: m.owncastImage,
-		Cmd: []string{
-			"--streamkey", streamKey,
-		},
+		Cmd:   cmd,
 		ExposedPorts: nat.PortSet{
 			"8080/tcp": struct{}{},
 			"1935/tcp": struct{}{},
 		},
 		Labels: map[string]string{
-			"managed-by":  "stream-paywall",
-			"stream-slug": slug,
+			managedByLabel: managedByValue,
+			slugLabel:      slug,
 		},
 	}
 
@@ -0,0 +1,439 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// reconcileGrace is how long a stream may disagree with Docker while starting or stopping
+	// Starting pulls the Owncast image first, which can take minutes.
+	reconcileGrace = 5 * time.Minute
+	// maxReconcileEvents is how many recent events a Reconciler keeps
+	maxReconcileEvents = 100
+)
+
+// API is the part of the Docker API the reconciler uses; *client.Client implements it
+type API interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	VolumeList(ctx context.Context, options volume.ListOptions) (volume.ListResponse, error)
+}
+
+// StreamStore is the part of the stream storage the reconciler uses
+type StreamStore interface {
+	ListStreams(ctx context.Context) ([]*models.Stream, error)
+	SetContainerStatusIf(ctx context.Context, id uuid.UUID, from, to models.ContainerStatus) (bool, error)
+}
+
+// EventKind is what a reconciler event reports
+type EventKind string
+
+const (
+	EventStatusCorrected EventKind = "status_corrected" // A stream's container status was changed to match Docker
+	EventOrphanContainer EventKind = "orphan_container" // A managed container has no stream
+	EventOrphanVolume    EventKind = "orphan_volume"    // An Owncast data volume has no stream
+)
+
+// Event is a correction or finding of the reconciler
+type Event struct {
+	Time     time.Time
+	Kind     EventKind
+	StreamID uuid.UUID // uuid.Nil for orphans
+	Slug     string
+	Name     string // Container or volume name
+	From     models.ContainerStatus
+	To       models.ContainerStatus
+	Detail   string // Why the container is in its state, e.g. "exited with code 137 (OOM killed)"
+}
+
+// Message describes the event for logs and alerts
+func (e Event) Message() string {
+	switch e.Kind {
+	case EventStatusCorrected:
+		message := fmt.Sprintf("Stream %s container status corrected from %s to %s", e.Slug, e.From, e.To)
+		if e.Detail != "" {
+			message += ": " + e.Detail
+		}
+		return message
+	case EventOrphanContainer:
+		return fmt.Sprintf("Container %s has no stream", e.Name)
+	case EventOrphanVolume:
+		return fmt.Sprintf("Volume %s has no stream", e.Name)
+	}
+	return string(e.Kind)
+}
+
+// ReconcileReport summarises a reconciliation pass
+type ReconcileReport struct {
+	Time             time.Time
+	Checked          int      // Streams with a container compared against Docker
+	Corrected        int      // Streams whose container status was corrected
+	Pending          int      // Starting or stopping streams that disagree with Docker, within the grace period
+	OrphanContainers []string // Managed containers without a stream
+	OrphanVolumes    []string // Owncast data volumes without a stream
+	Errors           int
+}
+
+// observation is the state of a stream's container as seen in Docker
+type observation struct {
+	status  models.ContainerStatus
+	missing bool
+	detail  string
+}
+
+// pendingMismatch is a starting or stopping stream that disagrees with Docker
+type pendingMismatch struct {
+	status models.ContainerStatus
+	since  time.Time
+}
+
+// Reconciler keeps streams.container_status in line with the containers in Docker
+// Only the page handlers that start and stop containers update the status, so
+// without it a crashed or OOM-killed container, or a restart in the middle of
+// starting one, would leave the stream running or starting forever.
+type Reconciler struct {
+	api      API
+	store    StreamStore
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	pending map[uuid.UUID]pendingMismatch
+	orphans map[string]bool // Orphans already reported, so each is an event once
+	report  *ReconcileReport
+	events  []Event
+}
+
+// NewReconciler creates a reconciler that checks every interval
+func NewReconciler(api API, store StreamStore, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		api:      api,
+		store:    store,
+		interval: interval,
+		now:      time.Now,
+		pending:  make(map[uuid.UUID]pendingMismatch),
+		orphans:  make(map[string]bool),
+	}
+}
+
+// Run reconciles at startup and then every interval until ctx is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.interval <= 0 {
+		log.Info().Msg("Container reconciliation disabled")
+		return
+	}
+
+	r.Reconcile(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reconcile(ctx)
+		}
+	}
+}
+
+// Reconcile compares every stream's container status with Docker and corrects it,
+// and reports managed containers and volumes that no stream owns
+func (r *Reconciler) Reconcile(ctx context.Context) *ReconcileReport {
+	report := &ReconcileReport{Time: r.now()}
+	defer r.finish(report)
+
+	containers, err := r.api.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", managedByLabel+"="+managedByValue)),
+	})
+	if err != nil {
+		// Without the container list every stream would look stopped
+		log.Error().Err(err).Msg("Failed to list containers")
+		report.Errors++
+		return report
+	}
+	streams, err := r.store.ListStreams(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list streams")
+		report.Errors++
+		return report
+	}
+
+	bySlug := make(map[string]*types.Container, len(containers))
+	for i := range containers {
+		bySlug[containerSlug(&containers[i])] = &containers[i]
+	}
+	slugs := make(map[string]bool, len(streams))
+	seen := make(map[uuid.UUID]bool, len(streams))
+
+	for _, stream := range streams {
+		slugs[stream.Slug] = true
+		// Streams on other ingest backends have no container to reconcile
+		if stream.ContainerName == "" || (stream.Backend != "" && stream.Backend != models.IngestBackendDocker) {
+			continue
+		}
+		seen[stream.ID] = true
+		report.Checked++
+
+		observed, err := r.observe(ctx, bySlug[stream.Slug])
+		if err != nil {
+			log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to inspect container")
+			report.Errors++
+			continue
+		}
+		r.reconcileStream(ctx, stream, observed, report)
+	}
+
+	// Forget mismatches of streams that were deleted
+	r.mu.Lock()
+	for id := range r.pending {
+		if !seen[id] {
+			delete(r.pending, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range containers {
+		if slug := containerSlug(&c); !slugs[slug] {
+			name := ContainerName(slug)
+			report.OrphanContainers = append(report.OrphanContainers, name)
+			r.reportOrphan(Event{Kind: EventOrphanContainer, Slug: slug, Name: name})
+		}
+	}
+
+	volumes, err := r.api.VolumeList(ctx, volume.ListOptions{})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list volumes")
+		report.Errors++
+		return report
+	}
+	for _, v := range volumes.Volumes {
+		slug, ok := volumeSlug(v.Name)
+		if ok && !slugs[slug] {
+			report.OrphanVolumes = append(report.OrphanVolumes, v.Name)
+			r.reportOrphan(Event{Kind: EventOrphanVolume, Slug: slug, Name: v.Name})
+		}
+	}
+	return report
+}
+
+// reconcileStream corrects one stream's container status if it disagrees with Docker
+func (r *Reconciler) reconcileStream(ctx context.Context, stream *models.Stream, observed observation, report *ReconcileReport) {
+	current := stream.ContainerStatus
+	target, ok := targetStatus(current, observed)
+	if !ok {
+		r.mu.Lock()
+		delete(r.pending, stream.ID)
+		r.mu.Unlock()
+		return
+	}
+
+	// The page handler may still be starting or stopping the container
+	if current == models.ContainerStatusStarting || current == models.ContainerStatusStopping {
+		r.mu.Lock()
+		mismatch, ok := r.pending[stream.ID]
+		if !ok || mismatch.status != current {
+			mismatch = pendingMismatch{status: current, since: report.Time}
+			r.pending[stream.ID] = mismatch
+		}
+		r.mu.Unlock()
+		if report.Time.Sub(mismatch.since) < reconcileGrace {
+			report.Pending++
+			return
+		}
+	}
+
+	changed, err := r.store.SetContainerStatusIf(ctx, stream.ID, current, target)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to correct container status")
+		report.Errors++
+		return
+	}
+	r.mu.Lock()
+	delete(r.pending, stream.ID)
+	r.mu.Unlock()
+	if !changed {
+		// Changed by an admin meanwhile; the next pass checks the new status
+		return
+	}
+
+	report.Corrected++
+	event := Event{
+		Time:     report.Time,
+		Kind:     EventStatusCorrected,
+		StreamID: stream.ID,
+		Slug:     stream.Slug,
+		Name:     stream.ContainerName,
+		From:     current,
+		To:       target,
+		Detail:   observed.detail,
+	}
+	log.Warn().
+		Str("stream_id", stream.ID.String()).
+		Str("slug", stream.Slug).
+		Str("from", string(current)).
+		Str("to", string(target)).
+		Str("detail", observed.detail).
+		Msg("Container status corrected")
+	r.addEvent(event)
+}
+
+// targetStatus returns the status a stream should be corrected to, if any
+// Stopped and error are only left for running: a container that was stopped
+// on purpose may well have exited with a non-zero code.
+func targetStatus(current models.ContainerStatus, observed observation) (models.ContainerStatus, bool) {
+	if current == observed.status && !observed.missing {
+		return "", false
+	}
+
+	switch current {
+	case models.ContainerStatusRunning, models.ContainerStatusStarting:
+		if observed.missing {
+			return models.ContainerStatusError, true
+		}
+		return observed.status, observed.status != current
+	case models.ContainerStatusStopping:
+		return observed.status, observed.status != current
+	case models.ContainerStatusStopped, models.ContainerStatusError:
+		if observed.status == models.ContainerStatusRunning {
+			return models.ContainerStatusRunning, true
+		}
+		return "", false
+	default:
+		return observed.status, true
+	}
+}
+
+// observe returns the state of a container; c is nil when the container does not exist
+func (r *Reconciler) observe(ctx context.Context, c *types.Container) (observation, error) {
+	if c == nil {
+		return observation{status: models.ContainerStatusStopped, missing: true, detail: "container missing"}, nil
+	}
+
+	switch c.State {
+	case "running":
+		return observation{status: models.ContainerStatusRunning}, nil
+	case "created":
+		return observation{status: models.ContainerStatusStarting}, nil
+	case "restarting":
+		return observation{status: models.ContainerStatusError, detail: "restarting after a crash"}, nil
+	case "exited", "dead":
+		inspect, err := r.api.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return observation{}, err
+		}
+		if inspect.ContainerJSONBase == nil || inspect.State == nil {
+			return observation{status: models.ContainerStatusStopped}, nil
+		}
+		state := inspect.State
+		switch {
+		case state.OOMKilled:
+			return observation{status: models.ContainerStatusError, detail: fmt.Sprintf("exited with code %d (OOM killed)", state.ExitCode)}, nil
+		case state.ExitCode != 0:
+			return observation{status: models.ContainerStatusError, detail: fmt.Sprintf("exited with code %d", state.ExitCode)}, nil
+		}
+		return observation{status: models.ContainerStatusStopped, detail: "exited"}, nil
+	default:
+		// paused, removing
+		return observation{status: models.ContainerStatusStopped, detail: c.State}, nil
+	}
+}
+
+// reportOrphan records an orphan the first time it is seen
+func (r *Reconciler) reportOrphan(event Event) {
+	r.mu.Lock()
+	known := r.orphans[event.Name]
+	r.orphans[event.Name] = true
+	r.mu.Unlock()
+	if known {
+		return
+	}
+
+	event.Time = r.now()
+	log.Warn().Str("name", event.Name).Str("kind", string(event.Kind)).Msg(event.Message())
+	r.addEvent(event)
+}
+
+// addEvent keeps an event, dropping the oldest beyond maxReconcileEvents
+func (r *Reconciler) addEvent(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	if len(r.events) > maxReconcileEvents {
+		r.events = r.events[len(r.events)-maxReconcileEvents:]
+	}
+}
+
+// finish stores the report of a pass and forgets orphans that are gone
+func (r *Reconciler) finish(report *ReconcileReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report = report
+
+	if report.Errors > 0 {
+		return
+	}
+	current := make(map[string]bool, len(report.OrphanContainers)+len(report.OrphanVolumes))
+	for _, name := range report.OrphanContainers {
+		current[name] = true
+	}
+	for _, name := range report.OrphanVolumes {
+		current[name] = true
+	}
+	for name := range r.orphans {
+		if !current[name] {
+			delete(r.orphans, name)
+		}
+	}
+}
+
+// LastReport returns the report of the latest pass, nil before the first
+func (r *Reconciler) LastReport() *ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report
+}
+
+// Events returns the recent events, oldest first
+func (r *Reconciler) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// containerSlug returns the stream slug of a managed container
+func containerSlug(c *types.Container) string {
+	if slug := c.Labels[slugLabel]; slug != "" {
+		return slug
+	}
+	for _, name := range c.Names {
+		if slug, ok := strings.CutPrefix(strings.TrimPrefix(name, "/"), "owncast-"); ok {
+			return slug
+		}
+	}
+	return ""
+}
+
+// volumeSlug returns the stream slug of an Owncast data volume, see VolumeName
+func volumeSlug(name string) (string, bool) {
+	slug, ok := strings.CutPrefix(name, "owncast-")
+	if !ok {
+		return "", false
+	}
+	slug, ok = strings.CutSuffix(slug, "-data")
+	return slug, ok && slug != ""
+}
@@ -0,0 +1,238 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// fakeAPI is a Docker API holding containers in memory
+type fakeAPI struct {
+	containers []types.Container
+	states     map[string]*types.ContainerState // By container ID
+	volumes    []string
+	listErr    error
+}
+
+func (f *fakeAPI) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	var managed []types.Container
+	for _, c := range f.containers {
+		if options.Filters.ExactMatch("label", managedByLabel+"="+managedByValue) && c.Labels[managedByLabel] == managedByValue {
+			managed = append(managed, c)
+		}
+	}
+	return managed, nil
+}
+
+func (f *fakeAPI) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	state, ok := f.states[containerID]
+	if !ok {
+		return types.ContainerJSON{}, errors.New("no such container")
+	}
+	return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: containerID, State: state}}, nil
+}
+
+func (f *fakeAPI) VolumeList(ctx context.Context, options volume.ListOptions) (volume.ListResponse, error) {
+	response := volume.ListResponse{}
+	for _, name := range f.volumes {
+		response.Volumes = append(response.Volumes, &volume.Volume{Name: name})
+	}
+	return response, nil
+}
+
+// add adds a managed container for a slug in a Docker state
+func (f *fakeAPI) add(slug, state string, exitCode int, oomKilled bool) {
+	id := "id-" + slug
+	f.containers = append(f.containers, types.Container{
+		ID:     id,
+		Names:  []string{"/" + ContainerName(slug)},
+		State:  state,
+		Labels: map[string]string{managedByLabel: managedByValue, slugLabel: slug},
+	})
+	if f.states == nil {
+		f.states = make(map[string]*types.ContainerState)
+	}
+	f.states[id] = &types.ContainerState{Status: state, ExitCode: exitCode, OOMKilled: oomKilled}
+}
+
+// fakeStore is a stream store holding streams in memory
+type fakeStore struct {
+	streams []*models.Stream
+}
+
+func (f *fakeStore) ListStreams(ctx context.Context) ([]*models.Stream, error) {
+	return f.streams, nil
+}
+
+func (f *fakeStore) SetContainerStatusIf(ctx context.Context, id uuid.UUID, from, to models.ContainerStatus) (bool, error) {
+	for _, s := range f.streams {
+		if s.ID == id && s.ContainerStatus == from {
+			s.ContainerStatus = to
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// add adds a stream with a container in a status
+func (f *fakeStore) add(slug string, status models.ContainerStatus) *models.Stream {
+	stream := &models.Stream{ID: uuid.New(), Slug: slug, ContainerName: ContainerName(slug), ContainerStatus: status}
+	f.streams = append(f.streams, stream)
+	return stream
+}
+
+func newTestReconciler(api *fakeAPI, store *fakeStore) (*Reconciler, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	r := NewReconciler(api, store, time.Minute)
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestReconcileCorrectsStatus(t *testing.T) {
+	api := &fakeAPI{}
+	store := &fakeStore{}
+
+	tests := []struct {
+		slug     string
+		status   models.ContainerStatus
+		state    string // "" for no container
+		exitCode int
+		oom      bool
+		want     models.ContainerStatus
+	}{
+		{"healthy", models.ContainerStatusRunning, "running", 0, false, models.ContainerStatusRunning},
+		{"oom", models.ContainerStatusRunning, "exited", 137, true, models.ContainerStatusError},
+		{"crashed", models.ContainerStatusRunning, "exited", 1, false, models.ContainerStatusError},
+		{"clean-exit", models.ContainerStatusRunning, "exited", 0, false, models.ContainerStatusStopped},
+		{"restarting", models.ContainerStatusRunning, "restarting", 0, false, models.ContainerStatusError},
+		{"removed", models.ContainerStatusRunning, "", 0, false, models.ContainerStatusError},
+		{"revived", models.ContainerStatusStopped, "running", 0, false, models.ContainerStatusRunning},
+		{"stopped-on-purpose", models.ContainerStatusStopped, "exited", 137, false, models.ContainerStatusStopped},
+		{"recovered", models.ContainerStatusError, "running", 0, false, models.ContainerStatusRunning},
+		{"never-created", models.ContainerStatusStopped, "", 0, false, models.ContainerStatusStopped},
+	}
+	streams := make(map[string]*models.Stream)
+	for _, tt := range tests {
+		streams[tt.slug] = store.add(tt.slug, tt.status)
+		if tt.state != "" {
+			api.add(tt.slug, tt.state, tt.exitCode, tt.oom)
+		}
+	}
+	// Streams without a container are left alone
+	store.streams = append(store.streams,
+		&models.Stream{ID: uuid.New(), Slug: "external", Backend: models.IngestBackendExternal, ContainerStatus: models.ContainerStatusRunning},
+		&models.Stream{ID: uuid.New(), Slug: "on-kubernetes", Backend: models.IngestBackendKubernetes, ContainerName: ContainerName("on-kubernetes"), ContainerStatus: models.ContainerStatusRunning},
+	)
+
+	r, _ := newTestReconciler(api, store)
+	report := r.Reconcile(context.Background())
+
+	for _, tt := range tests {
+		if got := streams[tt.slug].ContainerStatus; got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.slug, got, tt.want)
+		}
+	}
+	if report.Checked != len(tests) || report.Corrected != 7 || report.Errors != 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	events := r.Events()
+	if len(events) != 7 {
+		t.Fatalf("Expected 7 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event.Slug == "oom" && event.Detail != "exited with code 137 (OOM killed)" {
+			t.Errorf("Unexpected OOM detail: %q", event.Detail)
+		}
+	}
+
+	// A second pass finds nothing to correct
+	if report := r.Reconcile(context.Background()); report.Corrected != 0 {
+		t.Errorf("Expected no corrections on the second pass, got %d", report.Corrected)
+	}
+}
+
+func TestReconcileGracePeriod(t *testing.T) {
+	api := &fakeAPI{}
+	store := &fakeStore{}
+	starting := store.add("starting", models.ContainerStatusStarting)
+	stopping := store.add("stopping", models.ContainerStatusStopping)
+	api.add("stopping", "running", 0, false)
+
+	r, now := newTestReconciler(api, store)
+	report := r.Reconcile(context.Background())
+	if report.Pending != 2 || report.Corrected != 0 {
+		t.Fatalf("Expected 2 pending streams, got %+v", report)
+	}
+
+	*now = now.Add(reconcileGrace - time.Second)
+	r.Reconcile(context.Background())
+	if starting.ContainerStatus != models.ContainerStatusStarting || stopping.ContainerStatus != models.ContainerStatusStopping {
+		t.Fatal("Expected statuses to be kept within the grace period")
+	}
+
+	*now = now.Add(time.Second)
+	report = r.Reconcile(context.Background())
+	if starting.ContainerStatus != models.ContainerStatusError {
+		t.Errorf("Expected a container that never appeared to be an error, got %s", starting.ContainerStatus)
+	}
+	if stopping.ContainerStatus != models.ContainerStatusRunning {
+		t.Errorf("Expected a container that never stopped to be running, got %s", stopping.ContainerStatus)
+	}
+	if report.Corrected != 2 {
+		t.Errorf("Expected 2 corrections, got %d", report.Corrected)
+	}
+}
+
+func TestReconcileOrphans(t *testing.T) {
+	api := &fakeAPI{volumes: []string{"owncast-live-data", "owncast-gone-data", "postgres-data"}}
+	store := &fakeStore{}
+	store.add("live", models.ContainerStatusRunning)
+	api.add("live", "running", 0, false)
+	api.add("gone", "exited", 0, false)
+	// Containers not created by the paywall are ignored
+	api.containers = append(api.containers, types.Container{ID: "other", Names: []string{"/owncast-manual"}, State: "running"})
+
+	r, _ := newTestReconciler(api, store)
+	report := r.Reconcile(context.Background())
+	if len(report.OrphanContainers) != 1 || report.OrphanContainers[0] != "owncast-gone" {
+		t.Errorf("Unexpected orphan containers: %v", report.OrphanContainers)
+	}
+	if len(report.OrphanVolumes) != 1 || report.OrphanVolumes[0] != "owncast-gone-data" {
+		t.Errorf("Unexpected orphan volumes: %v", report.OrphanVolumes)
+	}
+	if len(r.Events()) != 2 {
+		t.Fatalf("Expected 2 orphan events, got %d", len(r.Events()))
+	}
+
+	// Orphans stay in the report but are only events once
+	report = r.Reconcile(context.Background())
+	if len(report.OrphanContainers) != 1 || len(report.OrphanVolumes) != 1 || len(r.Events()) != 2 {
+		t.Errorf("Expected orphans to be reported once, got %d events", len(r.Events()))
+	}
+}
+
+func TestReconcileListFailure(t *testing.T) {
+	api := &fakeAPI{listErr: errors.New("docker unavailable")}
+	store := &fakeStore{}
+	stream := store.add("live", models.ContainerStatusRunning)
+
+	r, _ := newTestReconciler(api, store)
+	report := r.Reconcile(context.Background())
+	if report.Errors != 1 || stream.ContainerStatus != models.ContainerStatusRunning {
+		t.Errorf("Expected nothing to change when Docker is unavailable, got %+v and %s", report, stream.ContainerStatus)
+	}
+	if r.LastReport() != report {
+		t.Error("Expected the failed pass to be the last report")
+	}
+}
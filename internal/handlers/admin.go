@@ -1,30 +1,49 @@
 package handlers
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/billing"
 	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
+	"github.com/laurikarhu/stream-paywall/internal/mail"
 	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
 	"github.com/rs/zerolog/log"
 )
 
 // AdminHandler handles admin API endpoints
 type AdminHandler struct {
-	cfg     *config.Config
-	pgStore *storage.PostgresStore
-	redis   *storage.RedisStore
+	cfg      *config.Config
+	pgStore  *storage.PostgresStore
+	redis    *storage.RedisStore
+	billing  *billing.Service
+	emails   *mail.Queue
+	backends *ingest.Registry
+	webhooks *ingest.Webhooks
+	creds    *ingest.Credentials
 }
 
 // NewAdminHandler creates a new admin handler
-func NewAdminHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore) *AdminHandler {
+func NewAdminHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore, backends *ingest.Registry, webhooks *ingest.Webhooks, creds *ingest.Credentials) *AdminHandler {
 	return &AdminHandler{
-		cfg:     cfg,
-		pgStore: pgStore,
-		redis:   redis,
+		cfg:      cfg,
+		pgStore:  pgStore,
+		redis:    redis,
+		billing:  billing.NewService(cfg, pgStore, redis, paytrail.NewClient(cfg.PaytrailAPIURL, cfg.PaytrailMerchantID, cfg.PaytrailSecretKey)),
+		emails:   mail.NewQueue(pgStore),
+		backends: backends,
+		webhooks: webhooks,
+		creds:    creds,
 	}
 }
 
@@ -60,7 +79,20 @@ func (h *AdminHandler) CreateStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create stream - container fields will be set by admin page handler
+	backendKind := models.IngestBackend(req.Backend)
+	if backendKind == "" {
+		backendKind = h.backends.Default()
+	}
+	if !backendKind.Valid() {
+		writeJSONError(w, http.StatusBadRequest, "backend must be docker, external or kubernetes")
+		return
+	}
+	backend, err := h.backends.Get(backendKind)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "The "+string(backendKind)+" ingest backend is not available")
+		return
+	}
+
 	stream := &models.Stream{
 		ID:              uuid.New(),
 		Slug:            req.Slug,
@@ -71,10 +103,22 @@ func (h *AdminHandler) CreateStream(w http.ResponseWriter, r *http.Request) {
 		EndTime:         req.EndTime,
 		Status:          models.StreamStatusScheduled,
 		MaxViewers:      req.MaxViewers,
+		Tags:            models.ParseTags(strings.Join(req.Tags, ",")),
+		MembersOnly:     req.MembersOnly,
+		WatermarkURL:    strings.TrimSuffix(strings.TrimSpace(req.WatermarkURL), "/"),
+		OwncastURL:      req.OwncastURL,
 		CreatedAt:       time.Now(),
+		Backend:         backendKind,
 		ContainerStatus: models.ContainerStatusStopped,
 	}
 
+	// Fill in the stream key, RTMP port, container name and Owncast URL
+	if err := backend.Provision(ctx, stream); err != nil {
+		log.Error().Err(err).Str("backend", string(backendKind)).Msg("Failed to provision stream")
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	if err := h.pgStore.CreateStream(ctx, stream); err != nil {
 		log.Error().Err(err).Msg("Failed to create stream")
 		writeJSONError(w, http.StatusInternalServerError, "Failed to create stream")
@@ -111,6 +155,11 @@ func (h *AdminHandler) GetStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	broadcast, err := h.redis.GetBroadcastState(ctx, id)
+	if err != nil {
+		log.Warn().Err(err).Str("stream_id", id.String()).Msg("Failed to get broadcast state")
+	}
+
 	// Include internal fields for admin (override json:"-")
 	response := map[string]interface{}{
 		"id":               stream.ID,
@@ -123,11 +172,27 @@ func (h *AdminHandler) GetStream(w http.ResponseWriter, r *http.Request) {
 		"status":           stream.Status,
 		"owncast_url":      stream.OwncastURL,
 		"max_viewers":      stream.MaxViewers,
+		"tags":             stream.Tags,
+		"members_only":     stream.MembersOnly,
+		"watermark_url":    stream.WatermarkURL,
 		"created_at":       stream.CreatedAt,
+		"backend":          stream.Backend,
+		"rtmp_url":         h.backends.RTMPURL(stream),
 		"stream_key":       stream.StreamKey,
 		"rtmp_port":        stream.RTMPPort,
 		"container_name":   stream.ContainerName,
 		"container_status": stream.ContainerStatus,
+		"webhook_url":      h.webhooks.URL(stream.ID),
+		"broadcast":        broadcast,
+
+		"owncast_provisioned_at": stream.OwncastProvisionedAt,
+	}
+	if stream.EncryptedAdminPassword != "" {
+		adminPassword, err := h.creds.AdminPassword(stream)
+		if err != nil {
+			log.Warn().Err(err).Str("stream_id", id.String()).Msg("Failed to open Owncast admin password")
+		}
+		response["owncast_admin_password"] = adminPassword
 	}
 
 	writeJSON(w, http.StatusOK, response)
@@ -158,6 +223,11 @@ func (h *AdminHandler) UpdateStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Tags != nil {
+		tags := models.ParseTags(strings.Join(*req.Tags, ","))
+		req.Tags = &tags
+	}
+
 	if err := h.pgStore.UpdateStream(ctx, id, &req); err != nil {
 		log.Error().Err(err).Msg("Failed to update stream")
 		writeJSONError(w, http.StatusInternalServerError, "Failed to update stream")
@@ -165,6 +235,7 @@ func (h *AdminHandler) UpdateStream(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Info().Str("id", id.String()).Msg("Stream updated")
+	publishStreamChange(ctx, h.redis, id)
 
 	// Return updated stream
 	stream, _ := h.pgStore.GetStreamByID(ctx, id)
@@ -208,6 +279,7 @@ func (h *AdminHandler) UpdateStreamStatus(w http.ResponseWriter, r *http.Request
 		Str("id", id.String()).
 		Str("status", req.Status).
 		Msg("Stream status updated")
+	publishStreamChange(ctx, h.redis, id)
 
 	writeJSON(w, http.StatusOK, models.APISuccess{Success: true, Message: "Status updated"})
 }
@@ -231,6 +303,7 @@ func (h *AdminHandler) DeleteStream(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Info().Str("id", id.String()).Msg("Stream deleted")
+	publishStreamChange(ctx, h.redis, id)
 
 	writeJSON(w, http.StatusOK, models.APISuccess{Success: true, Message: "Stream deleted"})
 }
@@ -262,6 +335,7 @@ func (h *AdminHandler) ListStreams(w http.ResponseWriter, r *http.Request) {
 			"owncast_url":      stream.OwncastURL,
 			"max_viewers":      stream.MaxViewers,
 			"created_at":       stream.CreatedAt,
+			"backend":          stream.Backend,
 			"stream_key":       stream.StreamKey,
 			"rtmp_port":        stream.RTMPPort,
 			"container_name":   stream.ContainerName,
@@ -317,7 +391,20 @@ func (h *AdminHandler) ListPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Sanitize payment data (hide full tokens)
+	writeJSON(w, http.StatusOK, sanitizePayments(payments))
+}
+
+// paymentIDs returns the IDs of payments
+func paymentIDs(payments []*models.Payment) []uuid.UUID {
+	ids := make([]uuid.UUID, len(payments))
+	for i, p := range payments {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+// sanitizePayments converts payments for API responses, hiding full tokens
+func sanitizePayments(payments []*models.Payment) []map[string]interface{} {
 	response := make([]map[string]interface{}, len(payments))
 	for i, p := range payments {
 		tokenPreview := ""
@@ -337,9 +424,57 @@ func (h *AdminHandler) ListPayments(w http.ResponseWriter, r *http.Request) {
 			"token_expiry":           p.TokenExpiry,
 			"created_at":             p.CreatedAt,
 		}
+		if p.IsBundle() {
+			delete(response[i], "stream_id")
+			response[i]["bundle_id"] = p.BundleID
+		}
+		if p.IsGift() {
+			response[i]["recipient_email"] = p.RecipientEmail
+			response[i]["gift_code"] = p.GiftCode
+			response[i]["gift_redeemed_at"] = p.GiftRedeemedAt
+		}
 	}
+	return response
+}
 
-	writeJSON(w, http.StatusOK, response)
+// RefundPayment refunds a payment through Paytrail and revokes its access
+// POST /admin/payments/{id}/refund
+func (h *AdminHandler) RefundPayment(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid payment ID")
+		return
+	}
+
+	ctx := r.Context()
+
+	payment, err := h.pgStore.GetPaymentByID(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get payment")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get payment")
+		return
+	}
+	if payment == nil {
+		writeJSONError(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+
+	refund, err := h.billing.RefundPayment(ctx, payment, "api")
+	switch {
+	case err == billing.ErrNotRefundable:
+		writeJSONError(w, http.StatusBadRequest, "Only completed Paytrail payments can be refunded")
+		return
+	case err == billing.ErrRefundInProgress:
+		writeJSONError(w, http.StatusConflict, "A refund is already in progress for this payment")
+		return
+	case err != nil:
+		log.Error().Err(err).Str("payment_id", id.String()).Msg("Failed to refund payment")
+		writeJSONError(w, http.StatusBadGateway, "Failed to refund payment")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, refund)
 }
 
 // GetStats returns overall stats
@@ -440,6 +575,14 @@ func (h *AdminHandler) AddToWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Re-adding an email only updates its notes; it is not emailed again
+	alreadyListed, err := h.pgStore.IsEmailWhitelisted(ctx, id, req.Email)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check whitelist")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to add to whitelist")
+		return
+	}
+
 	entry, err := h.pgStore.AddWhitelistEntry(ctx, id, req.Email, req.Notes)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to add to whitelist")
@@ -452,6 +595,16 @@ func (h *AdminHandler) AddToWhitelist(w http.ResponseWriter, r *http.Request) {
 		Str("email", req.Email).
 		Msg("Email added to whitelist")
 
+	if !alreadyListed {
+		data := map[string]any{
+			"Title":      stream.Title,
+			"RecoverURL": h.cfg.BaseURL + "/recover/" + stream.Slug,
+		}
+		if err := h.emails.Enqueue(ctx, req.Email, "whitelist", data); err != nil {
+			log.Error().Err(err).Str("email", req.Email).Msg("Failed to queue whitelist email")
+		}
+	}
+
 	writeJSON(w, http.StatusCreated, entry)
 }
 
@@ -487,3 +640,692 @@ func (h *AdminHandler) RemoveFromWhitelist(w http.ResponseWriter, r *http.Reques
 
 	writeJSON(w, http.StatusOK, models.APISuccess{Success: true, Message: "Email removed from whitelist"})
 }
+
+// --- Access Codes ---
+
+// ListAccessCodeBatches returns a stream's access code batches with their redeemed counts
+// GET /admin/streams/{id}/access-codes
+func (h *AdminHandler) ListAccessCodeBatches(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid stream ID")
+		return
+	}
+
+	batches, err := h.pgStore.ListAccessCodeBatchesByStream(r.Context(), id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list access code batches")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list access code batches")
+		return
+	}
+
+	if batches == nil {
+		batches = []*models.AccessCodeBatch{}
+	}
+
+	writeJSON(w, http.StatusOK, batches)
+}
+
+// CreateAccessCodeBatch generates a batch of single-use access codes for a stream
+// POST /admin/streams/{id}/access-codes
+func (h *AdminHandler) CreateAccessCodeBatch(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid stream ID")
+		return
+	}
+
+	var req models.AccessCodeBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Label = strings.TrimSpace(req.Label)
+	if req.Label == "" {
+		writeJSONError(w, http.StatusBadRequest, "label is required")
+		return
+	}
+	if req.Count < 1 || req.Count > billing.MaxAccessCodesPerBatch {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", billing.MaxAccessCodesPerBatch))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeJSONError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	ctx := r.Context()
+
+	stream, err := h.pgStore.GetStreamByID(ctx, id)
+	if err != nil || stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	batch, err := h.billing.CreateAccessCodeBatch(ctx, stream, req.Label, req.Count, req.ExpiresAt)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create access code batch")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create access code batch")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, batch)
+}
+
+// ExportAccessCodes downloads a batch's codes and their redemption status as CSV
+// GET /admin/access-codes/{id}/export
+func (h *AdminHandler) ExportAccessCodes(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid batch ID")
+		return
+	}
+
+	ctx := r.Context()
+
+	batch, err := h.pgStore.GetAccessCodeBatchByID(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get access code batch")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get access code batch")
+		return
+	}
+	if batch == nil {
+		writeJSONError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+
+	stream, err := h.pgStore.GetStreamByID(ctx, batch.StreamID)
+	if err != nil || stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	codes, err := h.pgStore.ListAccessCodes(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list access codes")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list access codes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-access-codes-%s.csv"`, stream.Slug, id.String()[:8]))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"code", "redeem_url", "redeemed_email", "redeemed_at"})
+	for _, code := range codes {
+		redeemedAt := ""
+		if code.RedeemedAt != nil {
+			redeemedAt = code.RedeemedAt.UTC().Format(time.RFC3339)
+		}
+		out.Write([]string{
+			code.Code,
+			h.cfg.BaseURL + "/stream/" + stream.Slug + "?code=" + url.QueryEscape(code.Code),
+			csvText(code.RedeemedEmail),
+			redeemedAt,
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Error().Err(err).Str("batch_id", idStr).Msg("Failed to write access code CSV")
+	}
+}
+
+// csvText neutralises viewer-entered text that spreadsheets would run as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// DeleteAccessCodeBatch deletes a batch so its unused codes stop working
+// Viewers who already redeemed a code keep their access.
+// DELETE /admin/access-codes/{id}
+func (h *AdminHandler) DeleteAccessCodeBatch(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid batch ID")
+		return
+	}
+
+	if err := h.pgStore.DeleteAccessCodeBatch(r.Context(), id); err != nil {
+		log.Error().Err(err).Msg("Failed to delete access code batch")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete access code batch")
+		return
+	}
+
+	log.Info().Str("batch_id", id.String()).Msg("Access code batch deleted")
+
+	writeJSON(w, http.StatusOK, models.APISuccess{Success: true, Message: "Access code batch deleted"})
+}
+
+// --- Promo Codes ---
+
+// ListPromoCodes returns all promo codes
+// GET /admin/promo-codes
+func (h *AdminHandler) ListPromoCodes(w http.ResponseWriter, r *http.Request) {
+	promos, err := h.pgStore.ListPromoCodes(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list promo codes")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list promo codes")
+		return
+	}
+
+	if promos == nil {
+		promos = []*models.PromoCode{}
+	}
+
+	writeJSON(w, http.StatusOK, promos)
+}
+
+// CreatePromoCode creates a new promo code
+// POST /admin/promo-codes
+func (h *AdminHandler) CreatePromoCode(w http.ResponseWriter, r *http.Request) {
+	var req models.PromoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ctx := r.Context()
+
+	if msg := h.validatePromoCodeRequest(ctx, &req); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Check if code is already taken
+	existing, _ := h.pgStore.GetPromoCodeByCode(ctx, req.Code)
+	if existing != nil {
+		writeJSONError(w, http.StatusConflict, "A promo code with this code already exists")
+		return
+	}
+
+	promo := &models.PromoCode{
+		ID:        uuid.New(),
+		Active:    true,
+		CreatedAt: time.Now(),
+	}
+	applyPromoCodeRequest(promo, &req)
+
+	if err := h.pgStore.CreatePromoCode(ctx, promo); err != nil {
+		log.Error().Err(err).Msg("Failed to create promo code")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create promo code")
+		return
+	}
+
+	log.Info().
+		Str("promo_code_id", promo.ID.String()).
+		Str("code", promo.Code).
+		Msg("Promo code created")
+
+	writeJSON(w, http.StatusCreated, promo)
+}
+
+// UpdatePromoCode replaces a promo code's settings
+// PUT /admin/promo-codes/{id}
+func (h *AdminHandler) UpdatePromoCode(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid promo code ID")
+		return
+	}
+
+	var req models.PromoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ctx := r.Context()
+
+	promo, err := h.pgStore.GetPromoCodeByID(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get promo code")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get promo code")
+		return
+	}
+	if promo == nil {
+		writeJSONError(w, http.StatusNotFound, "Promo code not found")
+		return
+	}
+
+	if msg := h.validatePromoCodeRequest(ctx, &req); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	existing, _ := h.pgStore.GetPromoCodeByCode(ctx, req.Code)
+	if existing != nil && existing.ID != id {
+		writeJSONError(w, http.StatusConflict, "A promo code with this code already exists")
+		return
+	}
+
+	applyPromoCodeRequest(promo, &req)
+
+	if err := h.pgStore.UpdatePromoCode(ctx, promo); err != nil {
+		log.Error().Err(err).Msg("Failed to update promo code")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update promo code")
+		return
+	}
+
+	log.Info().
+		Str("promo_code_id", id.String()).
+		Str("code", promo.Code).
+		Msg("Promo code updated")
+
+	writeJSON(w, http.StatusOK, promo)
+}
+
+// DeletePromoCode deletes a promo code
+// DELETE /admin/promo-codes/{id}
+func (h *AdminHandler) DeletePromoCode(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid promo code ID")
+		return
+	}
+
+	if err := h.pgStore.DeletePromoCode(r.Context(), id); err != nil {
+		log.Error().Err(err).Msg("Failed to delete promo code")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete promo code")
+		return
+	}
+
+	log.Info().Str("promo_code_id", id.String()).Msg("Promo code deleted")
+
+	writeJSON(w, http.StatusOK, models.APISuccess{Success: true, Message: "Promo code deleted"})
+}
+
+// validatePromoCodeRequest checks a promo code request and returns an error message, or "" if valid
+func (h *AdminHandler) validatePromoCodeRequest(ctx context.Context, req *models.PromoCodeRequest) string {
+	req.Code = storage.NormalizePromoCode(req.Code)
+	if req.Code == "" {
+		return "code is required"
+	}
+	if len(req.Code) > 50 {
+		return "code must be at most 50 characters"
+	}
+
+	switch req.DiscountType {
+	case models.DiscountTypePercent:
+		if req.DiscountValue < 1 || req.DiscountValue > 100 {
+			return "discount_value must be between 1 and 100 for percent discounts"
+		}
+	case models.DiscountTypeFixed:
+		if req.DiscountValue < 1 {
+			return "discount_value must be a positive amount in cents"
+		}
+	default:
+		return "discount_type must be 'percent' or 'fixed'"
+	}
+
+	if req.MaxUses < 0 || req.MaxUsesPerEmail < 0 {
+		return "usage limits must be non-negative"
+	}
+	if req.ValidFrom != nil && req.ValidUntil != nil && !req.ValidUntil.After(*req.ValidFrom) {
+		return "valid_until must be after valid_from"
+	}
+
+	if req.StreamID != nil {
+		stream, err := h.pgStore.GetStreamByID(ctx, *req.StreamID)
+		if err != nil || stream == nil {
+			return "Stream not found"
+		}
+	}
+
+	return ""
+}
+
+// applyPromoCodeRequest copies a validated request onto a promo code
+func applyPromoCodeRequest(promo *models.PromoCode, req *models.PromoCodeRequest) {
+	promo.Code = req.Code
+	promo.StreamID = req.StreamID
+	promo.DiscountType = req.DiscountType
+	promo.DiscountValue = req.DiscountValue
+	promo.MaxUses = req.MaxUses
+	promo.MaxUsesPerEmail = req.MaxUsesPerEmail
+	promo.ValidFrom = req.ValidFrom
+	promo.ValidUntil = req.ValidUntil
+	if req.Active != nil {
+		promo.Active = *req.Active
+	}
+}
+
+// ListBundles lists all bundles
+// GET /admin/bundles
+func (h *AdminHandler) ListBundles(w http.ResponseWriter, r *http.Request) {
+	bundles, err := h.pgStore.ListBundles(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list bundles")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list bundles")
+		return
+	}
+
+	if bundles == nil {
+		bundles = []*models.Bundle{}
+	}
+
+	writeJSON(w, http.StatusOK, bundles)
+}
+
+// CreateBundle creates a new bundle
+// POST /admin/bundles
+func (h *AdminHandler) CreateBundle(w http.ResponseWriter, r *http.Request) {
+	var req models.BundleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ctx := r.Context()
+
+	if msg := h.validateBundleRequest(ctx, &req); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Check if slug is already taken
+	existing, _ := h.pgStore.GetBundleBySlug(ctx, req.Slug)
+	if existing != nil {
+		writeJSONError(w, http.StatusConflict, "A bundle with this slug already exists")
+		return
+	}
+
+	bundle := &models.Bundle{
+		ID:        uuid.New(),
+		Active:    true,
+		CreatedAt: time.Now(),
+	}
+	applyBundleRequest(bundle, &req)
+
+	if err := h.pgStore.CreateBundle(ctx, bundle); err != nil {
+		log.Error().Err(err).Msg("Failed to create bundle")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create bundle")
+		return
+	}
+
+	log.Info().
+		Str("bundle_id", bundle.ID.String()).
+		Str("slug", bundle.Slug).
+		Msg("Bundle created")
+
+	writeJSON(w, http.StatusCreated, bundle)
+}
+
+// GetBundle retrieves a bundle by ID
+// GET /admin/bundles/{id}
+func (h *AdminHandler) GetBundle(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid bundle ID")
+		return
+	}
+
+	bundle, err := h.pgStore.GetBundleByID(r.Context(), id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get bundle")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get bundle")
+		return
+	}
+	if bundle == nil {
+		writeJSONError(w, http.StatusNotFound, "Bundle not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// UpdateBundle replaces a bundle's settings
+// PUT /admin/bundles/{id}
+func (h *AdminHandler) UpdateBundle(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid bundle ID")
+		return
+	}
+
+	var req models.BundleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ctx := r.Context()
+
+	bundle, err := h.pgStore.GetBundleByID(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get bundle")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get bundle")
+		return
+	}
+	if bundle == nil {
+		writeJSONError(w, http.StatusNotFound, "Bundle not found")
+		return
+	}
+
+	if msg := h.validateBundleRequest(ctx, &req); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	existing, _ := h.pgStore.GetBundleBySlug(ctx, req.Slug)
+	if existing != nil && existing.ID != id {
+		writeJSONError(w, http.StatusConflict, "A bundle with this slug already exists")
+		return
+	}
+
+	applyBundleRequest(bundle, &req)
+
+	if err := h.pgStore.UpdateBundle(ctx, bundle); err != nil {
+		log.Error().Err(err).Msg("Failed to update bundle")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update bundle")
+		return
+	}
+
+	log.Info().
+		Str("bundle_id", id.String()).
+		Str("slug", bundle.Slug).
+		Msg("Bundle updated")
+
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// DeleteBundle deletes a bundle that has never been sold
+// DELETE /admin/bundles/{id}
+func (h *AdminHandler) DeleteBundle(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid bundle ID")
+		return
+	}
+
+	err = h.pgStore.DeleteBundle(r.Context(), id)
+	if err == storage.ErrBundleHasPayments {
+		writeJSONError(w, http.StatusConflict, "This bundle has payments. Deactivate it instead.")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete bundle")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete bundle")
+		return
+	}
+
+	log.Info().Str("bundle_id", id.String()).Msg("Bundle deleted")
+
+	writeJSON(w, http.StatusOK, models.APISuccess{Success: true, Message: "Bundle deleted"})
+}
+
+// ListBundlePayments lists all payments for a bundle
+// GET /admin/bundles/{id}/payments
+func (h *AdminHandler) ListBundlePayments(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid bundle ID")
+		return
+	}
+
+	payments, err := h.pgStore.ListPaymentsByBundle(r.Context(), id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list bundle payments")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list payments")
+		return
+	}
+
+	// Bundle payments are refunded through POST /api/admin/payments/{id}/refund
+	refunds, err := h.pgStore.ListRefundsByPayments(r.Context(), paymentIDs(payments))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list bundle refunds")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list payments")
+		return
+	}
+
+	response := sanitizePayments(payments)
+	for i, p := range payments {
+		if refund := refunds[p.ID]; refund != nil {
+			response[i]["refund"] = refund
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// validateBundleRequest checks a bundle request and returns an error message, or "" if valid
+func (h *AdminHandler) validateBundleRequest(ctx context.Context, req *models.BundleRequest) string {
+	req.Slug = strings.TrimSpace(req.Slug)
+	req.Title = strings.TrimSpace(req.Title)
+	req.Tag = strings.ToLower(strings.TrimSpace(req.Tag))
+
+	if req.Slug == "" {
+		return "slug is required"
+	}
+	if req.Title == "" {
+		return "title is required"
+	}
+	if req.PriceCents < 0 {
+		return "price_cents must be non-negative"
+	}
+	if len(req.Tag) > 50 {
+		return "tag must be at most 50 characters"
+	}
+	if req.StartsAfter != nil && req.StartsBefore != nil && !req.StartsBefore.After(*req.StartsAfter) {
+		return "starts_before must be after starts_after"
+	}
+	if len(req.StreamIDs) == 0 && req.Tag == "" && req.StartsAfter == nil && req.StartsBefore == nil {
+		return "a bundle needs stream_ids, a tag or a date range"
+	}
+
+	for _, streamID := range req.StreamIDs {
+		stream, err := h.pgStore.GetStreamByID(ctx, streamID)
+		if err != nil || stream == nil {
+			return "Stream not found: " + streamID.String()
+		}
+	}
+
+	return ""
+}
+
+// applyBundleRequest copies a validated request onto a bundle
+func applyBundleRequest(bundle *models.Bundle, req *models.BundleRequest) {
+	bundle.Slug = req.Slug
+	bundle.Title = req.Title
+	bundle.Description = req.Description
+	bundle.PriceCents = req.PriceCents
+	bundle.StreamIDs = req.StreamIDs
+	if bundle.StreamIDs == nil {
+		bundle.StreamIDs = []uuid.UUID{}
+	}
+	bundle.Tag = req.Tag
+	bundle.StartsAfter = req.StartsAfter
+	bundle.StartsBefore = req.StartsBefore
+	if req.Active != nil {
+		bundle.Active = *req.Active
+	}
+}
+
+// ListSubscriptions lists memberships that got past signup
+// GET /admin/subscriptions
+func (h *AdminHandler) ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subs, err := h.pgStore.ListSubscriptions(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list subscriptions")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list subscriptions")
+		return
+	}
+
+	if subs == nil {
+		subs = []*models.Subscription{}
+	}
+
+	writeJSON(w, http.StatusOK, subs)
+}
+
+// ListSubscriptionCharges lists all charges made for a membership
+// GET /admin/subscriptions/{id}/charges
+func (h *AdminHandler) ListSubscriptionCharges(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return
+	}
+
+	charges, err := h.pgStore.ListSubscriptionCharges(r.Context(), id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list subscription charges")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list charges")
+		return
+	}
+
+	if charges == nil {
+		charges = []*models.SubscriptionCharge{}
+	}
+
+	writeJSON(w, http.StatusOK, charges)
+}
+
+// CancelSubscription ends a membership immediately and revokes its access
+// POST /admin/subscriptions/{id}/cancel
+func (h *AdminHandler) CancelSubscription(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return
+	}
+
+	ctx := r.Context()
+
+	sub, err := h.pgStore.GetSubscriptionByID(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get subscription")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get subscription")
+		return
+	}
+	if sub == nil {
+		writeJSONError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if !sub.IsLive() {
+		writeJSONError(w, http.StatusConflict, "Subscription has already ended")
+		return
+	}
+
+	if err := h.billing.EndSubscription(ctx, sub, models.SubscriptionStatusCanceled); err != nil {
+		log.Error().Err(err).Msg("Failed to cancel subscription")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to cancel subscription")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
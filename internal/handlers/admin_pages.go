@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"html/template"
 	"net/http"
 	"strconv"
@@ -8,10 +9,12 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/billing"
 	"github.com/laurikarhu/stream-paywall/internal/config"
-	"github.com/laurikarhu/stream-paywall/internal/docker"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
 	"github.com/laurikarhu/stream-paywall/internal/middleware"
 	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
 	"github.com/rs/zerolog/log"
 )
@@ -23,11 +26,15 @@ type AdminPageHandler struct {
 	redis       *storage.RedisStore
 	templates   *template.Template
 	sessionMw   *middleware.AdminSessionMiddleware
-	dockerMgr   *docker.Manager
+	backends    *ingest.Registry
+	webhooks    *ingest.Webhooks
+	provisioner *ingest.Provisioner
+	creds       *ingest.Credentials
+	billing     *billing.Service
 }
 
 // NewAdminPageHandler creates a new admin page handler
-func NewAdminPageHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore, templateDir string, sessionMw *middleware.AdminSessionMiddleware, dockerMgr *docker.Manager) (*AdminPageHandler, error) {
+func NewAdminPageHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore, templateDir string, sessionMw *middleware.AdminSessionMiddleware, backends *ingest.Registry, webhooks *ingest.Webhooks, provisioner *ingest.Provisioner, creds *ingest.Credentials) (*AdminPageHandler, error) {
 	// Parse admin templates
 	templates, err := template.ParseGlob(templateDir + "/admin/*.html")
 	if err != nil {
@@ -35,12 +42,16 @@ func NewAdminPageHandler(cfg *config.Config, pgStore *storage.PostgresStore, red
 	}
 
 	return &AdminPageHandler{
-		cfg:       cfg,
-		pgStore:   pgStore,
-		redis:     redis,
-		templates: templates,
-		sessionMw: sessionMw,
-		dockerMgr: dockerMgr,
+		cfg:         cfg,
+		pgStore:     pgStore,
+		redis:       redis,
+		templates:   templates,
+		sessionMw:   sessionMw,
+		backends:    backends,
+		webhooks:    webhooks,
+		provisioner: provisioner,
+		creds:       creds,
+		billing:     billing.NewService(cfg, pgStore, redis, paytrail.NewClient(cfg.PaytrailAPIURL, cfg.PaytrailMerchantID, cfg.PaytrailSecretKey)),
 	}, nil
 }
 
@@ -198,11 +209,15 @@ func (h *AdminPageHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get live streams and active viewers
-	var liveStreams []*models.Stream
+	broadcasts := h.broadcastStates(ctx, streams)
+	var liveStreams []StreamWithStats
 	var activeViewers int64 = 0
 	for _, stream := range streams {
 		if stream.Status == models.StreamStatusLive {
-			liveStreams = append(liveStreams, stream)
+			liveStreams = append(liveStreams, StreamWithStats{
+				Stream:    stream,
+				Broadcast: broadcasts[stream.ID],
+			})
 		}
 		count, _ := h.redis.CountActiveSessions(ctx, stream.ID)
 		activeViewers += count
@@ -211,7 +226,7 @@ func (h *AdminPageHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		AdminBaseData
 		Stats          DashboardStats
-		LiveStreams    []*models.Stream
+		LiveStreams    []StreamWithStats
 		RecentPayments []PaymentWithStream
 	}{
 		AdminBaseData: AdminBaseData{
@@ -240,7 +255,25 @@ func (h *AdminPageHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 type StreamWithStats struct {
 	*models.Stream
 	PriceEuros float64
-	RTMPURL    string // Full RTMP URL for OBS configuration
+	RTMPURL    string                 // Full RTMP URL for OBS configuration
+	Broadcast  *models.BroadcastState // nil until the stream's Owncast sends a webhook
+	WebhookURL string                 // Where the stream's Owncast sends its webhooks
+
+	OwncastAdminPassword string // The stream's own Owncast admin password ("" = OWNCAST_ADMIN_PASSWORD)
+}
+
+// broadcastStates returns the broadcast states of streams, none if Redis fails
+func (h *AdminPageHandler) broadcastStates(ctx context.Context, streams []*models.Stream) map[uuid.UUID]*models.BroadcastState {
+	ids := make([]uuid.UUID, len(streams))
+	for i, stream := range streams {
+		ids[i] = stream.ID
+	}
+	states, err := h.redis.GetBroadcastStates(ctx, ids)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get broadcast states")
+		return nil
+	}
+	return states
 }
 
 // ListStreams renders the streams list
@@ -255,13 +288,15 @@ func (h *AdminPageHandler) ListStreams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add price in euros and RTMP URL
+	// Add price in euros, RTMP URL and broadcast state
+	broadcasts := h.broadcastStates(ctx, streams)
 	var streamsWithStats []StreamWithStats
 	for _, s := range streams {
 		streamsWithStats = append(streamsWithStats, StreamWithStats{
 			Stream:     s,
 			PriceEuros: float64(s.PriceCents) / 100,
-			RTMPURL:    docker.GetRTMPURL(h.cfg.RTMPPublicHost, s.RTMPPort),
+			RTMPURL:    h.backends.RTMPURL(s),
+			Broadcast:  broadcasts[s.ID],
 		})
 	}
 
@@ -289,9 +324,11 @@ func (h *AdminPageHandler) NewStreamForm(w http.ResponseWriter, r *http.Request)
 
 	data := struct {
 		AdminBaseData
-		Stream *models.Stream
-		IsEdit bool
-		Error  string
+		Stream         *models.Stream
+		IsEdit         bool
+		Error          string
+		Backends       []models.IngestBackend
+		DefaultBackend models.IngestBackend
 	}{
 		AdminBaseData: AdminBaseData{
 			Title:      "New Stream",
@@ -300,7 +337,9 @@ func (h *AdminPageHandler) NewStreamForm(w http.ResponseWriter, r *http.Request)
 			Username:   session.Username,
 			Year:       time.Now().Year(),
 		},
-		IsEdit: false,
+		IsEdit:         false,
+		Backends:       h.backends.Available(),
+		DefaultBackend: h.backends.Default(),
 	}
 
 	h.render(w, "stream_form.html", data)
@@ -319,6 +358,11 @@ func (h *AdminPageHandler) CreateStream(w http.ResponseWriter, r *http.Request)
 	maxViewersStr := r.FormValue("max_viewers")
 	startTimeStr := r.FormValue("start_time")
 	endTimeStr := r.FormValue("end_time")
+	tags := models.ParseTags(r.FormValue("tags"))
+	membersOnly := r.FormValue("members_only") != ""
+	watermarkURL := strings.TrimSuffix(strings.TrimSpace(r.FormValue("watermark_url")), "/")
+	backendKind := models.IngestBackend(r.FormValue("backend"))
+	owncastURL := strings.TrimSpace(r.FormValue("owncast_url"))
 
 	// Validate
 	if slug == "" || title == "" {
@@ -362,24 +406,15 @@ func (h *AdminPageHandler) CreateStream(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Generate container-related fields
-	streamKey, err := docker.GenerateStreamKey()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to generate stream key")
-		h.renderStreamFormError(w, session, nil, false, "Failed to generate stream key.")
-		return
+	if backendKind == "" {
+		backendKind = h.backends.Default()
 	}
-
-	rtmpPort, err := h.pgStore.GetNextAvailablePort(ctx, h.cfg.RTMPPortStart)
+	backend, err := h.backends.Get(backendKind)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to allocate RTMP port")
-		h.renderStreamFormError(w, session, nil, false, "Failed to allocate RTMP port.")
+		h.renderStreamFormError(w, session, nil, false, "The "+string(backendKind)+" ingest backend is not available.")
 		return
 	}
 
-	containerName := docker.ContainerName(slug)
-	owncastURL := docker.GetInternalURL(containerName)
-
 	// Create stream
 	stream := &models.Stream{
 		ID:              uuid.New(),
@@ -393,10 +428,18 @@ func (h *AdminPageHandler) CreateStream(w http.ResponseWriter, r *http.Request)
 		OwncastURL:      owncastURL,
 		MaxViewers:      maxViewers,
 		CreatedAt:       time.Now(),
-		StreamKey:       streamKey,
-		RTMPPort:        rtmpPort,
-		ContainerName:   containerName,
+		Backend:         backendKind,
 		ContainerStatus: models.ContainerStatusStopped,
+		Tags:            tags,
+		MembersOnly:     membersOnly,
+		WatermarkURL:    watermarkURL,
+	}
+
+	// Fill in the stream key, RTMP port, container name and Owncast URL
+	if err := backend.Provision(ctx, stream); err != nil {
+		log.Error().Err(err).Str("backend", string(backendKind)).Msg("Failed to provision stream")
+		h.renderStreamFormError(w, session, nil, false, "Failed to set up the stream: "+err.Error())
+		return
 	}
 
 	if err := h.pgStore.CreateStream(ctx, stream); err != nil {
@@ -407,8 +450,9 @@ func (h *AdminPageHandler) CreateStream(w http.ResponseWriter, r *http.Request)
 
 	log.Info().
 		Str("slug", slug).
-		Str("container", containerName).
-		Int("rtmp_port", rtmpPort).
+		Str("backend", string(backendKind)).
+		Str("container", stream.ContainerName).
+		Int("rtmp_port", stream.RTMPPort).
 		Str("admin", session.Username).
 		Msg("Stream created")
 
@@ -433,6 +477,19 @@ func (h *AdminPageHandler) EditStreamForm(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	broadcast, err := h.redis.GetBroadcastState(ctx, id)
+	if err != nil {
+		log.Warn().Err(err).Str("stream_id", id.String()).Msg("Failed to get broadcast state")
+	}
+
+	adminPassword := ""
+	if stream.EncryptedAdminPassword != "" {
+		adminPassword, err = h.creds.AdminPassword(stream)
+		if err != nil {
+			log.Warn().Err(err).Str("stream_id", id.String()).Msg("Failed to open Owncast admin password")
+		}
+	}
+
 	data := struct {
 		AdminBaseData
 		Stream   *StreamWithStats
@@ -450,7 +507,11 @@ func (h *AdminPageHandler) EditStreamForm(w http.ResponseWriter, r *http.Request
 		Stream: &StreamWithStats{
 			Stream:     stream,
 			PriceEuros: float64(stream.PriceCents) / 100,
-			RTMPURL:    docker.GetRTMPURL(h.cfg.RTMPPublicHost, stream.RTMPPort),
+			RTMPURL:    h.backends.RTMPURL(stream),
+			Broadcast:  broadcast,
+			WebhookURL: h.webhooks.URL(stream.ID),
+
+			OwncastAdminPassword: adminPassword,
 		},
 		IsEdit:   true,
 		AdminKey: h.cfg.AdminAPIKey,
@@ -485,6 +546,9 @@ func (h *AdminPageHandler) UpdateStream(w http.ResponseWriter, r *http.Request)
 	startTimeStr := r.FormValue("start_time")
 	endTimeStr := r.FormValue("end_time")
 	statusStr := r.FormValue("status")
+	tags := models.ParseTags(r.FormValue("tags"))
+	membersOnly := r.FormValue("members_only") != ""
+	watermarkURL := strings.TrimSuffix(strings.TrimSpace(r.FormValue("watermark_url")), "/")
 
 	// Validate
 	if title == "" {
@@ -529,13 +593,16 @@ func (h *AdminPageHandler) UpdateStream(w http.ResponseWriter, r *http.Request)
 
 	// Update (note: owncast_url, stream_key, rtmp_port, container_name are immutable)
 	updates := &models.UpdateStreamRequest{
-		Title:       &title,
-		Description: &description,
-		PriceCents:  &priceCents,
-		StartTime:   startTime,
-		EndTime:     endTime,
-		Status:      &status,
-		MaxViewers:  &maxViewers,
+		Title:        &title,
+		Description:  &description,
+		PriceCents:   &priceCents,
+		StartTime:    startTime,
+		EndTime:      endTime,
+		Status:       &status,
+		MaxViewers:   &maxViewers,
+		Tags:         &tags,
+		MembersOnly:  &membersOnly,
+		WatermarkURL: &watermarkURL,
 	}
 
 	if err := h.pgStore.UpdateStream(ctx, id, updates); err != nil {
@@ -545,6 +612,7 @@ func (h *AdminPageHandler) UpdateStream(w http.ResponseWriter, r *http.Request)
 	}
 
 	log.Info().Str("id", id.String()).Str("admin", session.Username).Msg("Stream updated")
+	publishStreamChange(ctx, h.redis, id)
 
 	http.Redirect(w, r, "/admin/streams", http.StatusFound)
 }
@@ -568,6 +636,7 @@ func (h *AdminPageHandler) UpdateStreamStatus(w http.ResponseWriter, r *http.Req
 		log.Error().Err(err).Msg("Failed to update stream status")
 	} else {
 		log.Info().Str("id", id.String()).Str("status", statusStr).Str("admin", session.Username).Msg("Stream status updated")
+		publishStreamChange(ctx, h.redis, id)
 	}
 
 	// Redirect back to referrer or streams page
@@ -595,8 +664,10 @@ func (h *AdminPageHandler) DeleteStream(w http.ResponseWriter, r *http.Request)
 	stream, _ := h.pgStore.GetStreamByID(ctx, id)
 
 	// Remove container and volume if they exist
-	if stream != nil && stream.Slug != "" && h.dockerMgr != nil {
-		if err := h.dockerMgr.RemoveContainer(ctx, stream.Slug); err != nil {
+	if stream != nil && stream.Slug != "" {
+		if backend, err := h.backends.Get(stream.Backend); err != nil {
+			log.Warn().Err(err).Str("slug", stream.Slug).Msg("Container not removed")
+		} else if err := backend.Remove(ctx, stream); err != nil {
 			log.Warn().Err(err).Str("slug", stream.Slug).Msg("Failed to remove container")
 		}
 	}
@@ -605,6 +676,7 @@ func (h *AdminPageHandler) DeleteStream(w http.ResponseWriter, r *http.Request)
 		log.Error().Err(err).Msg("Failed to delete stream")
 	} else {
 		log.Info().Str("id", id.String()).Str("admin", session.Username).Msg("Stream deleted")
+		publishStreamChange(ctx, h.redis, id)
 	}
 
 	http.Redirect(w, r, "/admin/streams", http.StatusFound)
@@ -632,8 +704,8 @@ func (h *AdminPageHandler) StartContainer(w http.ResponseWriter, r *http.Request
 	h.pgStore.UpdateContainerStatus(ctx, id, models.ContainerStatusStarting)
 
 	// Start container
-	if h.dockerMgr != nil {
-		err = h.dockerMgr.CreateAndStartContainer(ctx, stream.Slug, stream.StreamKey, stream.RTMPPort)
+	if backend, err := h.backends.Get(stream.Backend); err == nil {
+		err = backend.Start(ctx, stream)
 		if err != nil {
 			log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to start container")
 			h.pgStore.UpdateContainerStatus(ctx, id, models.ContainerStatusError)
@@ -645,9 +717,10 @@ func (h *AdminPageHandler) StartContainer(w http.ResponseWriter, r *http.Request
 				Str("admin", session.Username).
 				Msg("Container started")
 			h.pgStore.UpdateContainerStatus(ctx, id, models.ContainerStatusRunning)
+			h.provisioner.ProvisionWhenReady(stream)
 		}
 	} else {
-		log.Warn().Msg("Docker manager not available")
+		log.Warn().Err(err).Str("slug", stream.Slug).Msg("Container not started")
 		h.pgStore.UpdateContainerStatus(ctx, id, models.ContainerStatusError)
 	}
 
@@ -682,8 +755,8 @@ func (h *AdminPageHandler) StopContainer(w http.ResponseWriter, r *http.Request)
 	h.pgStore.UpdateContainerStatus(ctx, id, models.ContainerStatusStopping)
 
 	// Stop container
-	if h.dockerMgr != nil {
-		err = h.dockerMgr.StopContainer(ctx, stream.ContainerName)
+	if backend, err := h.backends.Get(stream.Backend); err == nil {
+		err = backend.Stop(ctx, stream)
 		if err != nil {
 			log.Error().Err(err).Str("container", stream.ContainerName).Msg("Failed to stop container")
 			h.pgStore.UpdateContainerStatus(ctx, id, models.ContainerStatusError)
@@ -711,9 +784,11 @@ func (h *AdminPageHandler) StopContainer(w http.ResponseWriter, r *http.Request)
 func (h *AdminPageHandler) renderStreamFormError(w http.ResponseWriter, session *storage.AdminSession, stream *StreamWithStats, isEdit bool, errorMsg string) {
 	data := struct {
 		AdminBaseData
-		Stream *StreamWithStats
-		IsEdit bool
-		Error  string
+		Stream         *StreamWithStats
+		IsEdit         bool
+		Error          string
+		Backends       []models.IngestBackend
+		DefaultBackend models.IngestBackend
 	}{
 		AdminBaseData: AdminBaseData{
 			Title:      "Stream",
@@ -722,9 +797,11 @@ func (h *AdminPageHandler) renderStreamFormError(w http.ResponseWriter, session
 			Username:   session.Username,
 			Year:       time.Now().Year(),
 		},
-		Stream: stream,
-		IsEdit: isEdit,
-		Error:  errorMsg,
+		Stream:         stream,
+		IsEdit:         isEdit,
+		Error:          errorMsg,
+		Backends:       h.backends.Available(),
+		DefaultBackend: h.backends.Default(),
 	}
 	h.render(w, "stream_form.html", data)
 }
@@ -736,6 +813,8 @@ type PaymentView struct {
 	*models.Payment
 	AmountEuros  float64
 	TokenPreview string
+	Refund       *models.Refund // Latest refund attempt, if any
+	Refundable   bool
 }
 
 // StreamPayments renders the payments list for a stream
@@ -762,6 +841,12 @@ func (h *AdminPageHandler) StreamPayments(w http.ResponseWriter, r *http.Request
 		payments = []*models.Payment{}
 	}
 
+	refunds, err := h.pgStore.ListRefundsByPayments(ctx, paymentIDs(payments))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list refunds")
+		refunds = map[uuid.UUID]*models.Refund{}
+	}
+
 	// Convert to view models
 	var paymentViews []PaymentView
 	var totalRevenue float64
@@ -773,10 +858,16 @@ func (h *AdminPageHandler) StreamPayments(w http.ResponseWriter, r *http.Request
 			tokenPreview = p.AccessToken[:8] + "..."
 		}
 
+		refund := refunds[p.ID]
+		refundInProgress := refund != nil && refund.Status == models.RefundStatusPending
+
 		paymentViews = append(paymentViews, PaymentView{
 			Payment:      p,
 			AmountEuros:  float64(p.AmountCents) / 100,
 			TokenPreview: tokenPreview,
+			Refund:       refund,
+			Refundable: p.Status == models.PaymentStatusCompleted &&
+				p.PaytrailTransactionID != "" && p.AmountCents > 0 && !refundInProgress,
 		})
 
 		if p.Status == models.PaymentStatusCompleted {
@@ -792,6 +883,8 @@ func (h *AdminPageHandler) StreamPayments(w http.ResponseWriter, r *http.Request
 		TotalPayments     int
 		CompletedPayments int
 		TotalRevenue      float64
+		Notice            string
+		Error             string
 	}{
 		AdminBaseData: AdminBaseData{
 			Title:      "Payments - " + stream.Title,
@@ -805,11 +898,73 @@ func (h *AdminPageHandler) StreamPayments(w http.ResponseWriter, r *http.Request
 		TotalPayments:     len(payments),
 		CompletedPayments: completedCount,
 		TotalRevenue:      totalRevenue,
+		Notice:            refundNotices[r.URL.Query().Get("refund")],
+		Error:             refundErrors[r.URL.Query().Get("refund_error")],
 	}
 
 	h.render(w, "payments.html", data)
 }
 
+// refundNotices maps the ?refund= redirect parameter to a message
+var refundNotices = map[string]string{
+	"completed": "Payment refunded. The viewer's access has been revoked.",
+	"pending":   "Refund requested. Access will be revoked once Paytrail confirms the refund.",
+}
+
+// refundErrors maps the ?refund_error= redirect parameter to a message
+var refundErrors = map[string]string{
+	"not_refundable": "Only completed Paytrail payments can be refunded.",
+	"in_progress":    "A refund is already in progress for this payment.",
+	"failed":         "Paytrail refused the refund. Check the merchant panel for details.",
+}
+
+// RefundPayment issues a refund for a payment from the payments page
+func (h *AdminPageHandler) RefundPayment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := middleware.GetAdminSession(ctx)
+
+	streamID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/admin/streams", http.StatusFound)
+		return
+	}
+	paymentsURL := "/admin/streams/" + streamID.String() + "/payments"
+
+	paymentID, err := uuid.Parse(r.PathValue("paymentID"))
+	if err != nil {
+		http.Redirect(w, r, paymentsURL, http.StatusFound)
+		return
+	}
+
+	payment, err := h.pgStore.GetPaymentByID(ctx, paymentID)
+	if err != nil || payment == nil || payment.StreamID != streamID {
+		http.Redirect(w, r, paymentsURL, http.StatusFound)
+		return
+	}
+
+	refund, err := h.billing.RefundPayment(ctx, payment, session.Username)
+	switch {
+	case err == billing.ErrNotRefundable:
+		http.Redirect(w, r, paymentsURL+"?refund_error=not_refundable", http.StatusFound)
+		return
+	case err == billing.ErrRefundInProgress:
+		http.Redirect(w, r, paymentsURL+"?refund_error=in_progress", http.StatusFound)
+		return
+	case err != nil:
+		log.Error().Err(err).Str("payment_id", paymentID.String()).Msg("Failed to refund payment")
+		http.Redirect(w, r, paymentsURL+"?refund_error=failed", http.StatusFound)
+		return
+	}
+
+	log.Info().
+		Str("payment_id", paymentID.String()).
+		Str("status", string(refund.Status)).
+		Str("admin", session.Username).
+		Msg("Payment refund issued")
+
+	http.Redirect(w, r, paymentsURL+"?refund="+string(refund.Status), http.StatusFound)
+}
+
 // --- API Endpoints for Admin ---
 
 // GetViewerCountAPI returns viewer count as JSON
@@ -833,6 +988,72 @@ func (h *AdminPageHandler) GetViewerCountAPI(w http.ResponseWriter, r *http.Requ
 	})
 }
 
+// --- Promo Codes Page ---
+
+// PromoCodesPage renders the promo code management page
+// The page manages codes through the admin API, like the stream whitelist.
+func (h *AdminPageHandler) PromoCodesPage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := middleware.GetAdminSession(ctx)
+
+	streams, err := h.pgStore.ListStreams(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list streams")
+		streams = []*models.Stream{}
+	}
+
+	data := struct {
+		AdminBaseData
+		Streams  []*models.Stream
+		AdminKey string
+	}{
+		AdminBaseData: AdminBaseData{
+			Title:      "Promo Codes",
+			ActivePage: "promo-codes",
+			ShowNav:    true,
+			Username:   session.Username,
+			Year:       time.Now().Year(),
+		},
+		Streams:  streams,
+		AdminKey: h.cfg.AdminAPIKey,
+	}
+
+	h.render(w, "promo_codes.html", data)
+}
+
+// --- Bundles Page ---
+
+// BundlesPage renders the season pass / bundle management page
+// Like the promo code page, bundles are managed through the admin API.
+func (h *AdminPageHandler) BundlesPage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := middleware.GetAdminSession(ctx)
+
+	streams, err := h.pgStore.ListStreams(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list streams")
+		streams = []*models.Stream{}
+	}
+
+	data := struct {
+		AdminBaseData
+		Streams  []*models.Stream
+		AdminKey string
+	}{
+		AdminBaseData: AdminBaseData{
+			Title:      "Bundles",
+			ActivePage: "bundles",
+			ShowNav:    true,
+			Username:   session.Username,
+			Year:       time.Now().Year(),
+		},
+		Streams:  streams,
+		AdminKey: h.cfg.AdminAPIKey,
+	}
+
+	h.render(w, "bundles.html", data)
+}
+
 // --- Metrics Page ---
 
 // MetricsPage renders the metrics dashboard
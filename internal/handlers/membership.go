@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/billing"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// pendingMembershipCookieName holds the ID of the subscription whose card is being saved.
+// Only the browser that started the card flow may complete it and receive the access token.
+const pendingMembershipCookieName = "pending_membership"
+
+// membershipCookieMaxAge keeps the membership token across renewals; the server checks it on every use
+const membershipCookieMaxAge = 400 * 24 * 60 * 60
+
+// MembershipHandler handles membership signup, card and renewal endpoints
+type MembershipHandler struct {
+	cfg     *config.Config
+	pgStore *storage.PostgresStore
+	billing *billing.Service
+}
+
+// NewMembershipHandler creates a new membership handler
+func NewMembershipHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore) *MembershipHandler {
+	return &MembershipHandler{
+		cfg:     cfg,
+		pgStore: pgStore,
+		billing: billing.NewService(cfg, pgStore, redis, paytrail.NewClient(cfg.PaytrailAPIURL, cfg.PaytrailMerchantID, cfg.PaytrailSecretKey)),
+	}
+}
+
+// Subscribe starts a membership and returns the Paytrail form that saves the buyer's card
+// POST /api/membership/subscribe
+func (h *MembershipHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	var req models.SubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Email == "" {
+		writeJSONError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+
+	sub, form, err := h.billing.StartSubscription(r.Context(), req.Email)
+	switch {
+	case err == billing.ErrMembershipsDisabled:
+		writeJSONError(w, http.StatusNotFound, "Memberships are not available")
+		return
+	case err == billing.ErrAlreadyMember:
+		writeJSONError(w, http.StatusConflict, "This email already has a membership. Recover your access from a members-only stream's page.")
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to start membership")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to start membership")
+		return
+	}
+
+	log.Info().
+		Str("subscription_id", sub.ID.String()).
+		Str("email", req.Email).
+		Msg("Membership signup started")
+
+	h.setPendingCookie(w, r, sub.ID.String())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"subscription_id": sub.ID.String(),
+		"form":            form,
+	})
+}
+
+// UpdateCard returns the Paytrail form that replaces the member's saved card
+// A past-due membership is charged right away with the new card.
+// POST /api/membership/card
+func (h *MembershipHandler) UpdateCard(w http.ResponseWriter, r *http.Request) {
+	sub, ok := h.memberFromCookie(w, r)
+	if !ok {
+		return
+	}
+
+	h.setPendingCookie(w, r, sub.ID.String())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"form": h.billing.CardForm(sub),
+	})
+}
+
+// Cancel stops the member's membership from renewing
+// Access continues until the end of the paid period.
+// POST /api/membership/cancel
+func (h *MembershipHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	sub, ok := h.memberFromCookie(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.billing.CancelAtPeriodEnd(r.Context(), sub); err != nil {
+		log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to cancel membership")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to cancel membership")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"access_end": sub.CurrentPeriodEnd,
+	})
+}
+
+// HandleCardSuccess handles the browser redirect back from Paytrail's add card page
+// Saves the card and, for new or past-due memberships, charges the current period.
+// GET /api/membership/card/success
+func (h *MembershipHandler) HandleCardSuccess(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, query) {
+		log.Warn().Str("query", r.URL.RawQuery).Msg("Invalid add card redirect signature")
+		writeJSONError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+
+	sub, ok := h.pendingSubscription(w, r, query.Get("subscription"))
+	if !ok {
+		return
+	}
+
+	if err := h.billing.SaveCard(ctx, sub, query.Get("checkout-tokenization-id")); err != nil {
+		log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to save membership card")
+		http.Redirect(w, r, h.cfg.BaseURL+"/membership?result=card_failed", http.StatusFound)
+		return
+	}
+
+	// Active members only replaced their card
+	if sub.Status == models.SubscriptionStatusActive {
+		h.clearPendingCookie(w)
+		http.Redirect(w, r, h.cfg.BaseURL+"/membership?result=card_saved", http.StatusFound)
+		return
+	}
+
+	threeDSURL, err := h.billing.ChargeNow(ctx, sub)
+	if err != nil {
+		if !errors.Is(err, paytrail.ErrChargeDeclined) {
+			log.Error().Err(err).Str("subscription_id", sub.ID.String()).Msg("Failed to charge membership")
+		}
+		http.Redirect(w, r, h.cfg.BaseURL+"/membership?result=declined", http.StatusFound)
+		return
+	}
+	if threeDSURL != "" {
+		// The charge finishes on the charge return URL after 3-D Secure
+		http.Redirect(w, r, threeDSURL, http.StatusFound)
+		return
+	}
+
+	h.finishMembership(w, r, sub)
+}
+
+// HandleChargeReturn handles the browser redirect back from 3-D Secure
+// GET /api/membership/charge/return
+func (h *MembershipHandler) HandleChargeReturn(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, r.URL.Query()) {
+		log.Warn().Str("query", r.URL.RawQuery).Msg("Invalid membership charge redirect signature")
+		writeJSONError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+
+	params := paytrail.ExtractCallbackParams(r.URL.Query())
+	sub, err := h.billing.ProcessChargeCallback(ctx, params)
+	if err == billing.ErrChargeNotFound {
+		writeJSONError(w, http.StatusNotFound, "Charge not found")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to process membership charge")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to process payment")
+		return
+	}
+
+	cookie, err := r.Cookie(pendingMembershipCookieName)
+	if sub.Status != models.SubscriptionStatusActive || err != nil || cookie.Value != sub.ID.String() {
+		http.Redirect(w, r, h.cfg.BaseURL+"/membership?result=declined", http.StatusFound)
+		return
+	}
+
+	h.finishMembership(w, r, sub)
+}
+
+// HandleChargeCallback handles Paytrail's server-to-server callbacks for 3-D Secure charges
+// GET /api/membership/charge/callback
+func (h *MembershipHandler) HandleChargeCallback(w http.ResponseWriter, r *http.Request) {
+	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, r.URL.Query()) {
+		log.Warn().Str("query", r.URL.RawQuery).Msg("Invalid membership charge callback signature")
+		writeJSONError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+
+	params := paytrail.ExtractCallbackParams(r.URL.Query())
+	if _, err := h.billing.ProcessChargeCallback(r.Context(), params); err != nil {
+		if err == billing.ErrChargeNotFound {
+			writeJSONError(w, http.StatusNotFound, "Charge not found")
+			return
+		}
+		log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to process membership charge callback")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to process callback")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// finishMembership hands the paid membership's token to the browser that started the card flow
+func (h *MembershipHandler) finishMembership(w http.ResponseWriter, r *http.Request, sub *models.Subscription) {
+	h.clearPendingCookie(w)
+	setMembershipCookie(w, r, sub.AccessToken)
+	http.Redirect(w, r, h.cfg.BaseURL+"/membership?result=active", http.StatusFound)
+}
+
+// pendingSubscription loads the subscription named in a redirect, which must match the pending cookie
+func (h *MembershipHandler) pendingSubscription(w http.ResponseWriter, r *http.Request, id string) (*models.Subscription, bool) {
+	cookie, err := r.Cookie(pendingMembershipCookieName)
+	if err != nil || cookie.Value == "" || cookie.Value != id {
+		writeJSONError(w, http.StatusForbidden, "Membership signup was started in another browser")
+		return nil, false
+	}
+
+	subID, err := uuid.Parse(id)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return nil, false
+	}
+
+	sub, err := h.pgStore.GetSubscriptionByID(r.Context(), subID)
+	if err != nil {
+		log.Error().Err(err).Str("subscription_id", id).Msg("Failed to get subscription")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load membership")
+		return nil, false
+	}
+	if sub == nil || sub.Status == models.SubscriptionStatusCanceled || sub.Status == models.SubscriptionStatusExpired {
+		writeJSONError(w, http.StatusNotFound, "Membership not found")
+		return nil, false
+	}
+	return sub, true
+}
+
+// memberFromCookie loads the running membership for the request's access token
+func (h *MembershipHandler) memberFromCookie(w http.ResponseWriter, r *http.Request) (*models.Subscription, bool) {
+	cookie, err := r.Cookie("access_token")
+	if err != nil || cookie.Value == "" {
+		writeJSONError(w, http.StatusUnauthorized, "Missing access token")
+		return nil, false
+	}
+
+	sub, err := h.pgStore.GetSubscriptionByAccessToken(r.Context(), cookie.Value)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get subscription")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load membership")
+		return nil, false
+	}
+	if sub == nil || !sub.IsLive() {
+		writeJSONError(w, http.StatusUnauthorized, "No active membership")
+		return nil, false
+	}
+	return sub, true
+}
+
+// setPendingCookie marks this browser as the one completing a card flow
+func (h *MembershipHandler) setPendingCookie(w http.ResponseWriter, r *http.Request, subID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingMembershipCookieName,
+		Value:    subID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   3600,
+	})
+}
+
+// clearPendingCookie removes the pending card flow cookie
+func (h *MembershipHandler) clearPendingCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   pendingMembershipCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// setMembershipCookie sets the access token cookie for a membership token
+func setMembershipCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   membershipCookieMaxAge,
+	})
+}
@@ -1,16 +1,13 @@
 package handlers
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
-	"fmt"
-	"io"
 	"net/http"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
 	"github.com/laurikarhu/stream-paywall/internal/middleware"
 	"github.com/laurikarhu/stream-paywall/internal/models"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
@@ -18,24 +15,23 @@ import (
 )
 
 // OwncastAPIHandler handles Owncast API interactions
+// Each Owncast is called with its stream's own admin password.
 type OwncastAPIHandler struct {
 	cfg       *config.Config
 	pgStore   *storage.PostgresStore
 	redis     *storage.RedisStore
 	sessionMw *middleware.AdminSessionMiddleware
-	client    *http.Client
+	admin     *ingest.OwncastAdmin
 }
 
 // NewOwncastProxyHandler creates a new Owncast API handler
-func NewOwncastProxyHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore, sessionMw *middleware.AdminSessionMiddleware) *OwncastAPIHandler {
+func NewOwncastProxyHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore, sessionMw *middleware.AdminSessionMiddleware, admin *ingest.OwncastAdmin) *OwncastAPIHandler {
 	return &OwncastAPIHandler{
 		cfg:       cfg,
 		pgStore:   pgStore,
 		redis:     redis,
 		sessionMw: sessionMw,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		admin:     admin,
 	}
 }
 
@@ -84,7 +80,7 @@ func (h *OwncastAPIHandler) GetVideoSettings(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Fetch config from Owncast
-	config, err := h.fetchOwncastConfig(stream.OwncastURL)
+	config, err := h.fetchOwncastConfig(ctx, stream)
 	if err != nil {
 		log.Error().Err(err).Str("stream_id", id.String()).Msg("Failed to fetch Owncast config")
 		writeJSONError(w, http.StatusBadGateway, "Failed to fetch Owncast settings")
@@ -130,7 +126,7 @@ func (h *OwncastAPIHandler) UpdateVideoSettings(w http.ResponseWriter, r *http.R
 
 	// Update video variants
 	if len(req.Variants) > 0 {
-		err = h.updateOwncastVideoVariants(stream.OwncastURL, req.Variants)
+		err = h.updateOwncastVideoVariants(ctx, stream, req.Variants)
 		if err != nil {
 			log.Error().Err(err).Str("stream_id", id.String()).Msg("Failed to update video variants")
 			writeJSONError(w, http.StatusBadGateway, "Failed to update video settings")
@@ -140,7 +136,7 @@ func (h *OwncastAPIHandler) UpdateVideoSettings(w http.ResponseWriter, r *http.R
 
 	// Update latency level if provided
 	if req.LatencyLevel != nil {
-		err = h.updateOwncastLatency(stream.OwncastURL, *req.LatencyLevel)
+		err = h.updateOwncastLatency(ctx, stream, *req.LatencyLevel)
 		if err != nil {
 			log.Error().Err(err).Str("stream_id", id.String()).Msg("Failed to update latency level")
 			writeJSONError(w, http.StatusBadGateway, "Failed to update latency settings")
@@ -156,107 +152,20 @@ func (h *OwncastAPIHandler) UpdateVideoSettings(w http.ResponseWriter, r *http.R
 }
 
 // fetchOwncastConfig fetches the server config from Owncast
-func (h *OwncastAPIHandler) fetchOwncastConfig(owncastURL string) (*OwncastServerConfig, error) {
-	url := owncastURL + "/api/admin/serverconfig"
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	h.addBasicAuth(req)
-
-	resp, err := h.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("owncast returned status %d: %s", resp.StatusCode, string(body))
-	}
-
+func (h *OwncastAPIHandler) fetchOwncastConfig(ctx context.Context, stream *models.Stream) (*OwncastServerConfig, error) {
 	var config OwncastServerConfig
-	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+	if err := h.admin.Call(ctx, stream, http.MethodGet, "/api/admin/serverconfig", nil, &config); err != nil {
 		return nil, err
 	}
-
 	return &config, nil
 }
 
 // updateOwncastVideoVariants updates video quality variants
-func (h *OwncastAPIHandler) updateOwncastVideoVariants(owncastURL string, variants []OwncastVideoVariant) error {
-	url := owncastURL + "/api/admin/config/video/streamoutputvariants"
-
-	payload := map[string]interface{}{
-		"value": variants,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	h.addBasicAuth(req)
-
-	resp, err := h.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("owncast returned status %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	return nil
+func (h *OwncastAPIHandler) updateOwncastVideoVariants(ctx context.Context, stream *models.Stream, variants []OwncastVideoVariant) error {
+	return h.admin.SetConfig(ctx, stream, "video/streamoutputvariants", variants)
 }
 
 // updateOwncastLatency updates the latency level
-func (h *OwncastAPIHandler) updateOwncastLatency(owncastURL string, level int) error {
-	url := owncastURL + "/api/admin/config/video/streamlatencylevel"
-
-	payload := map[string]interface{}{
-		"value": level,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	h.addBasicAuth(req)
-
-	resp, err := h.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("owncast returned status %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	return nil
-}
-
-// addBasicAuth adds basic auth header to request
-func (h *OwncastAPIHandler) addBasicAuth(req *http.Request) {
-	auth := base64.StdEncoding.EncodeToString([]byte("admin:" + h.cfg.OwncastAdminPassword))
-	req.Header.Set("Authorization", "Basic "+auth)
+func (h *OwncastAPIHandler) updateOwncastLatency(ctx context.Context, stream *models.Stream, level int) error {
+	return h.admin.SetConfig(ctx, stream, "video/streamlatencylevel", level)
 }
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// maxWebhookBody is the largest webhook body read; chat messages are the biggest events
+const maxWebhookBody = 64 << 10
+
+// OwncastWebhookHandler receives the webhooks the streams' Owncast instances send
+type OwncastWebhookHandler struct {
+	pgStore  *storage.PostgresStore
+	redis    *storage.RedisStore
+	webhooks *ingest.Webhooks
+}
+
+// NewOwncastWebhookHandler creates a new Owncast webhook handler
+func NewOwncastWebhookHandler(pgStore *storage.PostgresStore, redis *storage.RedisStore, webhooks *ingest.Webhooks) *OwncastWebhookHandler {
+	return &OwncastWebhookHandler{
+		pgStore:  pgStore,
+		redis:    redis,
+		webhooks: webhooks,
+	}
+}
+
+// owncastEvent is the body of an Owncast webhook
+type owncastEvent struct {
+	Type      string `json:"type"`
+	EventData struct {
+		StreamTitle string `json:"streamTitle"`
+	} `json:"eventData"`
+}
+
+// Receive handles a webhook from a stream's Owncast
+// A started broadcast takes a scheduled stream live. A stopped one leaves the
+// stream live: viewers are told it is paused, and the scheduler or an admin
+// ends it.
+// POST /api/webhooks/owncast/{id}/{token}
+func (h *OwncastWebhookHandler) Receive(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil || !h.webhooks.Verify(id, r.PathValue("token")) {
+		writeJSONError(w, http.StatusForbidden, "Invalid webhook URL")
+		return
+	}
+
+	var event owncastEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBody)).Decode(&event); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid webhook body")
+		return
+	}
+
+	ctx := r.Context()
+	stream, err := h.pgStore.GetStreamByID(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Str("stream_id", id.String()).Msg("Failed to get stream for webhook")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get stream")
+		return
+	}
+	if stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	now := time.Now()
+	switch event.Type {
+	case ingest.EventStreamStarted:
+		err = h.redis.SetBroadcastOnline(ctx, id, true, now)
+		if err == nil && event.EventData.StreamTitle != "" {
+			err = h.redis.SetBroadcastTitle(ctx, id, event.EventData.StreamTitle, now)
+		}
+		if err == nil {
+			err = h.goLive(ctx, stream)
+		}
+		log.Info().Str("slug", stream.Slug).Msg("Broadcast started")
+	case ingest.EventStreamStopped:
+		err = h.redis.SetBroadcastOnline(ctx, id, false, now)
+		log.Info().Str("slug", stream.Slug).Msg("Broadcast stopped")
+	case ingest.EventStreamTitleUpdated:
+		err = h.redis.SetBroadcastTitle(ctx, id, event.EventData.StreamTitle, now)
+	case ingest.EventChat:
+		err = h.redis.RecordChatMessage(ctx, id, now)
+	case ingest.EventUserJoined:
+		err = h.redis.RecordChatUser(ctx, id, now)
+	default:
+		// Events added in the Owncast admin beyond WebhookEvents
+		log.Debug().Str("slug", stream.Slug).Str("type", event.Type).Msg("Ignoring Owncast webhook")
+	}
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Str("type", event.Type).Msg("Failed to handle Owncast webhook")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to handle webhook")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// goLive moves a scheduled stream live once its broadcast starts
+func (h *OwncastWebhookHandler) goLive(ctx context.Context, stream *models.Stream) error {
+	if stream.Status != models.StreamStatusScheduled {
+		return nil
+	}
+	changed, err := h.pgStore.SetStreamStatusIf(ctx, stream.ID, models.StreamStatusScheduled, models.StreamStatusLive)
+	if err != nil || !changed {
+		return err
+	}
+	log.Info().Str("slug", stream.Slug).Msg("Stream went live with its broadcast")
+	publishStreamChange(ctx, h.redis, stream.ID)
+	return nil
+}
+
+// broadcastOnAir reports whether viewers of a stream can expect video
+// Without a webhook from its Owncast yet, a live stream is assumed to be broadcasting.
+func broadcastOnAir(stream *models.Stream, state *models.BroadcastState) bool {
+	if stream.Status != models.StreamStatusLive {
+		return false
+	}
+	return state == nil || state.Online
+}
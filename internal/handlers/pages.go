@@ -8,17 +8,20 @@ import (
 
 	"github.com/laurikarhu/stream-paywall/internal/config"
 	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/security"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
 	"github.com/rs/zerolog/log"
 )
 
 // PageHandler handles page rendering
 type PageHandler struct {
-	cfg         *config.Config
-	pgStore     *storage.PostgresStore
-	redis       *storage.RedisStore
-	templates   *template.Template
-	templateDir string
+	cfg          *config.Config
+	pgStore      *storage.PostgresStore
+	redis        *storage.RedisStore
+	admission    *security.AdmissionController
+	entitlements *security.EntitlementChecker
+	templates    *template.Template
+	templateDir  string
 }
 
 // NewPageHandler creates a new page handler
@@ -31,11 +34,13 @@ func NewPageHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *s
 	}
 
 	return &PageHandler{
-		cfg:         cfg,
-		pgStore:     pgStore,
-		redis:       redis,
-		templates:   templates,
-		templateDir: templateDir,
+		cfg:          cfg,
+		pgStore:      pgStore,
+		redis:        redis,
+		admission:    security.NewAdmissionController(pgStore, redis, cfg.HeartbeatTimeout),
+		entitlements: security.NewEntitlementChecker(pgStore),
+		templates:    templates,
+		templateDir:  templateDir,
 	}, nil
 }
 
@@ -49,26 +54,62 @@ type BaseData struct {
 type HomeData struct {
 	BaseData
 	Streams []*models.Stream
+	Bundles []*models.Bundle
 }
 
 // StreamData contains data for the stream detail page
 type StreamData struct {
 	BaseData
-	Stream    *models.Stream
+	Stream          *models.Stream
+	HasAccess       bool
+	SoldOut         bool
+	MembershipPrice float64 // Euros per period; 0 when memberships are not sold
+	AccessCode      string  // Prefilled from a redeem link (?code=)
+}
+
+// BundleData contains data for the bundle detail/purchase page
+type BundleData struct {
+	BaseData
+	Bundle    *models.Bundle
+	Streams   []*models.Stream // Streams the bundle currently covers
 	HasAccess bool
 }
 
 // WatchData contains data for the watch page
 type WatchData struct {
 	BaseData
-	Stream      *models.Stream
-	PlaylistURL string
+	Stream         *models.Stream
+	PlaylistURL    string
+	OnAir          bool   // The broadcast is running; otherwise the player waits for it
+	BroadcastTitle string // Title set in Owncast for the current broadcast
 }
 
 // RecoverData contains data for the recovery page
 type RecoverData struct {
+	BaseData
+	Stream    *models.Stream
+	GiftCode  string // Prefilled from a gift link
+	LinkToken string // Set when the page is opened from an emailed recovery link
+}
+
+// PendingData contains data for the payment pending page
+// Exactly one of Stream and Bundle is set.
+type PendingData struct {
 	BaseData
 	Stream *models.Stream
+	Bundle *models.Bundle
+	Ref    string
+	Gift   bool // Bought for another email; the page shows the gift code instead of redirecting
+}
+
+// MembershipData contains data for the membership page
+type MembershipData struct {
+	BaseData
+	Enabled      bool
+	PriceEuros   float64
+	PeriodMonths int
+	Subscription *models.Subscription // The visitor's membership, if their token belongs to one
+	Result       string               // Outcome of a card or charge redirect
 }
 
 // ErrorData contains data for error pages
@@ -90,12 +131,19 @@ func (h *PageHandler) Home(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	bundles, err := h.pgStore.ListActiveBundles(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list bundles")
+		// Streams are still worth showing
+	}
+
 	data := HomeData{
 		BaseData: BaseData{
 			Title: "Available Streams",
 			Year:  time.Now().Year(),
 		},
 		Streams: streams,
+		Bundles: bundles,
 	}
 
 	h.render(w, "home.html", data)
@@ -125,9 +173,21 @@ func (h *PageHandler) Stream(w http.ResponseWriter, r *http.Request) {
 	// Check if user has access
 	hasAccess := false
 	if cookie, err := r.Cookie("access_token"); err == nil && cookie.Value != "" {
-		payment, err := h.pgStore.GetPaymentByAccessToken(ctx, cookie.Value)
-		if err == nil && payment != nil && payment.IsTokenValid() && payment.StreamID == stream.ID {
-			hasAccess = true
+		session, err := h.entitlements.ResolveToken(ctx, cookie.Value)
+		if err == nil && session != nil {
+			hasAccess, err = h.entitlements.SessionGrants(ctx, session, stream)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("slug", slug).Msg("Failed to check stream access")
+		}
+	}
+
+	// Check if tickets are still available (only matters for buyers)
+	soldOut := false
+	if !hasAccess && !stream.MembersOnly {
+		soldOut, err = h.admission.IsSoldOut(ctx, stream)
+		if err != nil {
+			log.Error().Err(err).Str("slug", slug).Msg("Failed to check ticket availability")
 		}
 	}
 
@@ -136,8 +196,11 @@ func (h *PageHandler) Stream(w http.ResponseWriter, r *http.Request) {
 			Title: stream.Title,
 			Year:  time.Now().Year(),
 		},
-		Stream:    stream,
-		HasAccess: hasAccess,
+		Stream:          stream,
+		HasAccess:       hasAccess,
+		SoldOut:         soldOut,
+		MembershipPrice: float64(h.cfg.MembershipPriceCents) / 100,
+		AccessCode:      r.URL.Query().Get("code"),
 	}
 
 	h.render(w, "stream.html", data)
@@ -187,8 +250,8 @@ func (h *PageHandler) Watch(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate token
-	payment, err := h.pgStore.GetPaymentByAccessToken(ctx, token)
-	if err != nil || payment == nil || !payment.IsTokenValid() {
+	session, err := h.entitlements.ResolveToken(ctx, token)
+	if err != nil || session == nil {
 		// Clear invalid cookie
 		http.SetCookie(w, &http.Cookie{
 			Name:   "access_token",
@@ -200,15 +263,47 @@ func (h *PageHandler) Watch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify token is for this stream
-	if payment.StreamID != stream.ID {
+	// Verify token is for this stream, directly, through a bundle or a membership
+	granted, err := h.entitlements.SessionGrants(ctx, session, stream)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("Failed to check stream access")
+		h.renderError(w, 500, "Failed to check access.", slug)
+		return
+	}
+	if !granted {
 		h.renderError(w, 403, "Access denied. You haven't purchased access to this stream.", slug)
 		return
 	}
 
+	// Membership tokens outlive the Redis session, so restore it for the player
+	if session.SubscriptionID != "" {
+		if existing, err := h.redis.GetSession(ctx, token); err == nil && existing == nil {
+			if err := h.redis.SetSession(ctx, token, session, h.cfg.SessionDuration); err != nil {
+				log.Error().Err(err).Str("slug", slug).Msg("Failed to restore membership session")
+			}
+		}
+	}
+
+	// Take a viewer seat (viewers who already hold one keep it)
+	admission, err := h.admission.AdmitViewer(ctx, stream, token)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("Seat admission failed")
+		h.renderError(w, 500, "Failed to check stream capacity.", slug)
+		return
+	}
+	if !admission.Admitted {
+		h.renderError(w, 503, "This stream is full right now. Please try again in a moment.", slug)
+		return
+	}
+
 	// Generate playlist URL (token validated via Redis, no signature needed)
 	playlistURL := fmt.Sprintf("%s/stream/%s/hls/stream.m3u8?token=%s", h.cfg.BaseURL, stream.ID.String(), token)
 
+	state, err := h.redis.GetBroadcastState(ctx, stream.ID)
+	if err != nil {
+		log.Warn().Err(err).Str("slug", slug).Msg("Failed to get broadcast state")
+	}
+
 	data := WatchData{
 		BaseData: BaseData{
 			Title: stream.Title,
@@ -216,11 +311,77 @@ func (h *PageHandler) Watch(w http.ResponseWriter, r *http.Request) {
 		},
 		Stream:      stream,
 		PlaylistURL: playlistURL,
+		OnAir:       broadcastOnAir(stream, state),
+	}
+	if state != nil {
+		data.BroadcastTitle = state.Title
 	}
 
 	h.render(w, "watch.html", data)
 }
 
+// Bundle renders the bundle detail/purchase page
+func (h *PageHandler) Bundle(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if slug == "" {
+		h.renderError(w, 404, "Bundle not found", "")
+		return
+	}
+
+	ctx := r.Context()
+
+	bundle, err := h.pgStore.GetBundleBySlug(ctx, slug)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("Failed to get bundle")
+		h.renderError(w, 500, "Failed to load bundle", "")
+		return
+	}
+	if bundle == nil {
+		h.renderError(w, 404, "Bundle not found", "")
+		return
+	}
+
+	streams, err := h.pgStore.ListStreams(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("Failed to list streams")
+		h.renderError(w, 500, "Failed to load bundle", "")
+		return
+	}
+	var covered []*models.Stream
+	for _, stream := range streams {
+		if bundle.Covers(stream) {
+			covered = append(covered, stream)
+		}
+	}
+
+	// Check if user already owns this bundle
+	hasAccess := false
+	if cookie, err := r.Cookie("access_token"); err == nil && cookie.Value != "" {
+		payment, err := h.pgStore.GetPaymentByAccessToken(ctx, cookie.Value)
+		if err == nil && payment != nil && payment.IsTokenValid() && payment.IsBundle() && *payment.BundleID == bundle.ID {
+			hasAccess = true
+		}
+	}
+
+	// Inactive bundles stay visible to their owners but are no longer sold
+	if !bundle.Active && !hasAccess {
+		h.renderError(w, 404, "Bundle not found", "")
+		return
+	}
+
+	data := BundleData{
+		BaseData: BaseData{
+			Title: bundle.Title,
+			Year:  time.Now().Year(),
+		},
+		Bundle:    bundle,
+		Streams:   covered,
+		HasAccess: hasAccess,
+	}
+
+	h.render(w, "bundle.html", data)
+}
+
 // Recover renders the token recovery page
 func (h *PageHandler) Recover(w http.ResponseWriter, r *http.Request) {
 	slug := r.PathValue("slug")
@@ -242,12 +403,89 @@ func (h *PageHandler) Recover(w http.ResponseWriter, r *http.Request) {
 			Title: "Recover Access",
 			Year:  time.Now().Year(),
 		},
-		Stream: stream,
+		Stream:    stream,
+		GiftCode:  r.URL.Query().Get("gift"),
+		LinkToken: r.URL.Query().Get("link"),
 	}
 
 	h.render(w, "recover.html", data)
 }
 
+// Membership renders the membership signup and management page
+func (h *PageHandler) Membership(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	data := MembershipData{
+		BaseData: BaseData{
+			Title: "Membership",
+			Year:  time.Now().Year(),
+		},
+		Enabled:      h.cfg.MembershipsEnabled(),
+		PriceEuros:   float64(h.cfg.MembershipPriceCents) / 100,
+		PeriodMonths: h.cfg.MembershipPeriodMonths,
+		Result:       r.URL.Query().Get("result"),
+	}
+
+	if cookie, err := r.Cookie("access_token"); err == nil && cookie.Value != "" {
+		sub, err := h.pgStore.GetSubscriptionByAccessToken(ctx, cookie.Value)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get subscription")
+		}
+		if sub != nil && sub.IsLive() {
+			data.Subscription = sub
+		}
+	}
+
+	h.render(w, "membership.html", data)
+}
+
+// PaymentPending renders the page shown while a payment awaits confirmation
+func (h *PageHandler) PaymentPending(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		h.renderError(w, 404, "Payment not found", "")
+		return
+	}
+
+	ctx := r.Context()
+
+	payment, err := h.pgStore.GetPaymentByPaytrailRef(ctx, ref)
+	if err != nil {
+		log.Error().Err(err).Str("stamp", ref).Msg("Failed to get payment")
+		h.renderError(w, 500, "Failed to load payment", "")
+		return
+	}
+	if payment == nil {
+		h.renderError(w, 404, "Payment not found", "")
+		return
+	}
+
+	data := PendingData{
+		BaseData: BaseData{
+			Title: "Payment Pending",
+			Year:  time.Now().Year(),
+		},
+		Ref:  ref,
+		Gift: payment.IsGift(),
+	}
+
+	if payment.IsBundle() {
+		data.Bundle, err = h.pgStore.GetBundleByID(ctx, *payment.BundleID)
+		if err != nil || data.Bundle == nil {
+			h.renderError(w, 404, "Bundle not found", "")
+			return
+		}
+	} else {
+		data.Stream, err = h.pgStore.GetStreamByID(ctx, payment.StreamID)
+		if err != nil || data.Stream == nil {
+			h.renderError(w, 404, "Stream not found", "")
+			return
+		}
+	}
+
+	h.render(w, "pending.html", data)
+}
+
 // render renders a template
 func (h *PageHandler) render(w http.ResponseWriter, name string, data interface{}) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
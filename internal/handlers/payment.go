@@ -1,35 +1,47 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/billing"
 	"github.com/laurikarhu/stream-paywall/internal/config"
 	"github.com/laurikarhu/stream-paywall/internal/models"
 	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/security"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
 	"github.com/rs/zerolog/log"
 )
 
+// pendingPaymentCookieName holds the stamp of a payment awaiting confirmation.
+// It ties the browser that went through checkout to the payment, so only that
+// browser receives the access token once the payment completes.
+const pendingPaymentCookieName = "pending_payment"
+
 // PaymentHandler handles payment-related endpoints
 type PaymentHandler struct {
 	cfg       *config.Config
 	pgStore   *storage.PostgresStore
 	redis     *storage.RedisStore
 	paytrail  *paytrail.Client
+	billing   *billing.Service
+	admission *security.AdmissionController
 }
 
 // NewPaymentHandler creates a new payment handler
 func NewPaymentHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore) *PaymentHandler {
+	paytrailClient := paytrail.NewClient(cfg.PaytrailAPIURL, cfg.PaytrailMerchantID, cfg.PaytrailSecretKey)
 	return &PaymentHandler{
-		cfg:      cfg,
-		pgStore:  pgStore,
-		redis:    redis,
-		paytrail: paytrail.NewClient(cfg.PaytrailMerchantID, cfg.PaytrailSecretKey),
+		cfg:       cfg,
+		pgStore:   pgStore,
+		redis:     redis,
+		paytrail:  paytrailClient,
+		billing:   billing.NewService(cfg, pgStore, redis, paytrailClient),
+		admission: security.NewAdmissionController(pgStore, redis, cfg.HeartbeatTimeout),
 	}
 }
 
@@ -51,6 +63,11 @@ func (h *PaymentHandler) CreatePayment(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "email is required")
 		return
 	}
+	req.GiftRecipient = strings.TrimSpace(req.GiftRecipient)
+	if req.GiftRecipient != "" && !strings.Contains(req.GiftRecipient, "@") {
+		writeJSONError(w, http.StatusBadRequest, "gift_recipient must be an email address")
+		return
+	}
 
 	ctx := r.Context()
 
@@ -72,53 +89,200 @@ func (h *PaymentHandler) CreatePayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate unique stamp for this payment
-	// Include random prefix to avoid collisions in shared test environments
+	// Members-only streams are not sold as single tickets
+	if stream.MembersOnly {
+		writeJSONError(w, http.StatusForbidden, "This stream is only available to members")
+		return
+	}
+
+	// Stop selling once all seats are taken
+	soldOut, err := h.admission.IsSoldOut(ctx, stream)
+	if err != nil {
+		log.Error().Err(err).Str("slug", req.StreamSlug).Msg("Failed to check ticket availability")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check availability")
+		return
+	}
+	if soldOut {
+		writeJSONError(w, http.StatusConflict, "This stream is sold out")
+		return
+	}
+
+	// Apply promo code, if given
+	var promo *models.PromoCode
+	if req.PromoCode != "" {
+		promo, err = h.billing.ResolvePromoCode(ctx, req.PromoCode, stream)
+		switch {
+		case err == billing.ErrPromoCodeInvalid:
+			writeJSONError(w, http.StatusBadRequest, "Invalid or expired promo code")
+			return
+		case err == billing.ErrPromoCodeNotApplicable:
+			writeJSONError(w, http.StatusBadRequest, "This promo code is not valid for this stream")
+			return
+		case err != nil:
+			log.Error().Err(err).Str("code", req.PromoCode).Msg("Failed to resolve promo code")
+			writeJSONError(w, http.StatusInternalServerError, "Failed to apply promo code")
+			return
+		}
+	}
+
 	paymentID := uuid.New()
-	randomPrefix, _ := generateAccessToken() // Reuse the secure random generator
-	stamp := randomPrefix[:8] + "-" + paymentID.String()
+	stamp := newPaymentStamp(paymentID)
+
+	// Create payment record in database
+	payment := &models.Payment{
+		ID:             paymentID,
+		StreamID:       stream.ID,
+		Email:          req.Email,
+		RecipientEmail: req.GiftRecipient,
+		Status:         models.PaymentStatusPending,
+		PaytrailRef:    stamp,
+		CreatedAt:      time.Now(),
+	}
+	billing.ApplyPromoCode(payment, stream, promo)
+
+	// Gifts carry a code the recipient redeems to get access
+	if payment.IsGift() {
+		payment.GiftCode, err = billing.GenerateGiftCode()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to generate gift code")
+			writeJSONError(w, http.StatusInternalServerError, "Failed to create payment")
+			return
+		}
+	}
+
+	// Nothing left to pay: grant access directly, like whitelisted emails
+	if payment.AmountCents == 0 && promo != nil {
+		payment.PaytrailRef = "promo"
+		if err := h.billing.GrantFreeAccess(ctx, payment, promo); err != nil {
+			h.writePaymentError(w, err)
+			return
+		}
+
+		log.Info().
+			Str("payment_id", paymentID.String()).
+			Str("stream", stream.Slug).
+			Str("email", req.Email).
+			Str("code", promo.Code).
+			Msg("Free access granted with promo code")
+
+		// The gift page shows the payer the code to pass on
+		if payment.IsGift() {
+			h.setPendingPaymentCookie(w, r, stamp)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"redirect_url": h.cfg.BaseURL + "/payment/pending?ref=" + stamp,
+				"payment_id":   paymentID.String(),
+			})
+			return
+		}
+
+		h.setAccessTokenCookie(w, r, payment.AccessToken)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"redirect_url": h.cfg.BaseURL + "/watch/" + stream.Slug,
+			"payment_id":   paymentID.String(),
+		})
+		return
+	}
+
+	if err := h.billing.CreatePayment(ctx, payment, promo); err != nil {
+		h.writePaymentError(w, err)
+		return
+	}
+
+	paytrailResp, err := h.startCheckout(r, payment, stream.Slug, "Access to: "+stream.Title)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create Paytrail payment")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to initiate payment")
+		return
+	}
 
 	log.Info().
-		Str("stamp", stamp).
 		Str("payment_id", paymentID.String()).
-		Str("random_prefix", randomPrefix[:8]).
-		Msg("Generated payment stamp")
+		Str("transaction_id", paytrailResp.TransactionID).
+		Str("stream", stream.Slug).
+		Str("email", req.Email).
+		Str("gift_recipient", req.GiftRecipient).
+		Msg("Payment initiated")
 
-	// Create payment record in database
+	// Return the payment redirect URL
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"redirect_url":   paytrailResp.Href,
+		"transaction_id": paytrailResp.TransactionID,
+		"payment_id":     paymentID.String(),
+	})
+}
+
+// CreateBundlePayment initiates a payment for a bundle
+// POST /api/payment/bundle
+func (h *PaymentHandler) CreateBundlePayment(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateBundlePaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// Validate request
+	if req.BundleSlug == "" {
+		writeJSONError(w, http.StatusBadRequest, "bundle_slug is required")
+		return
+	}
+	if req.Email == "" {
+		writeJSONError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+
+	ctx := r.Context()
+
+	bundle, err := h.pgStore.GetBundleBySlug(ctx, req.BundleSlug)
+	if err != nil {
+		log.Error().Err(err).Str("slug", req.BundleSlug).Msg("Failed to get bundle")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get bundle")
+		return
+	}
+	if bundle == nil || !bundle.Active {
+		writeJSONError(w, http.StatusNotFound, "Bundle not found")
+		return
+	}
+
+	paymentID := uuid.New()
+	bundleID := bundle.ID
 	payment := &models.Payment{
 		ID:          paymentID,
-		StreamID:    stream.ID,
+		BundleID:    &bundleID,
 		Email:       req.Email,
-		AmountCents: stream.PriceCents,
+		AmountCents: bundle.PriceCents,
 		Status:      models.PaymentStatusPending,
-		PaytrailRef: stamp,
+		PaytrailRef: newPaymentStamp(paymentID),
 		CreatedAt:   time.Now(),
 	}
 
-	if err := h.pgStore.CreatePayment(ctx, payment); err != nil {
-		log.Error().Err(err).Msg("Failed to create payment record")
-		writeJSONError(w, http.StatusInternalServerError, "Failed to create payment")
+	// Free bundles are granted directly, like fully discounted tickets
+	if payment.AmountCents == 0 {
+		payment.PaytrailRef = "free"
+		if err := h.billing.GrantFreeAccess(ctx, payment, nil); err != nil {
+			h.writeBundlePaymentError(w, err)
+			return
+		}
+
+		log.Info().
+			Str("payment_id", paymentID.String()).
+			Str("bundle", bundle.Slug).
+			Str("email", req.Email).
+			Msg("Free bundle access granted")
+
+		h.setAccessTokenCookie(w, r, payment.AccessToken)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"redirect_url": h.cfg.BaseURL + "/bundle/" + bundle.Slug,
+			"payment_id":   paymentID.String(),
+		})
 		return
 	}
 
-	// Create Paytrail payment
-	successURL := h.cfg.BaseURL + "/api/callback/success"
-	cancelURL := h.cfg.BaseURL + "/api/callback/cancel"
-	callbackURL := h.cfg.BaseURL + "/api/callback/success" // Server-to-server
-
-	paytrailReq := &paytrail.SimplePaymentRequest{
-		Stamp:       stamp,
-		Reference:   stream.Slug + "-" + stamp[:8],
-		Amount:      stream.PriceCents,
-		Description: "Access to: " + stream.Title,
-		Email:       req.Email,
-		SuccessURL:  successURL,
-		CancelURL:   cancelURL,
-		CallbackURL: callbackURL,
-		Language:    "FI",
+	if err := h.billing.CreatePayment(ctx, payment, nil); err != nil {
+		h.writeBundlePaymentError(w, err)
+		return
 	}
 
-	paytrailResp, err := h.paytrail.CreateSimplePayment(ctx, paytrailReq)
+	paytrailResp, err := h.startCheckout(r, payment, bundle.Slug, "Access to: "+bundle.Title)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create Paytrail payment")
 		writeJSONError(w, http.StatusInternalServerError, "Failed to initiate payment")
@@ -128,11 +292,10 @@ func (h *PaymentHandler) CreatePayment(w http.ResponseWriter, r *http.Request) {
 	log.Info().
 		Str("payment_id", paymentID.String()).
 		Str("transaction_id", paytrailResp.TransactionID).
-		Str("stream", stream.Slug).
+		Str("bundle", bundle.Slug).
 		Str("email", req.Email).
-		Msg("Payment initiated")
+		Msg("Bundle payment initiated")
 
-	// Return the payment redirect URL
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"redirect_url":   paytrailResp.Href,
 		"transaction_id": paytrailResp.TransactionID,
@@ -140,10 +303,84 @@ func (h *PaymentHandler) CreatePayment(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// HandleSuccessCallback handles successful payment callbacks
+// newPaymentStamp generates the unique Paytrail stamp for a payment
+// Includes a random prefix to avoid collisions in shared test environments.
+func newPaymentStamp(paymentID uuid.UUID) string {
+	randomPrefix, _ := billing.GenerateAccessToken() // Reuse the secure random generator
+	stamp := randomPrefix[:8] + "-" + paymentID.String()
+
+	log.Info().
+		Str("stamp", stamp).
+		Str("payment_id", paymentID.String()).
+		Str("random_prefix", randomPrefix[:8]).
+		Msg("Generated payment stamp")
+
+	return stamp
+}
+
+// startCheckout creates the Paytrail payment for a stored pending payment
+// slug prefixes the order reference shown to the buyer.
+func (h *PaymentHandler) startCheckout(r *http.Request, payment *models.Payment, slug, description string) (*paytrail.CreatePaymentResponse, error) {
+	ctx := r.Context()
+
+	successURL := h.cfg.BaseURL + "/api/callback/success"
+	cancelURL := h.cfg.BaseURL + "/api/callback/cancel"
+	callbackURL := h.cfg.BaseURL + "/api/callback/payment" // Server-to-server
+
+	paytrailReq := &paytrail.SimplePaymentRequest{
+		Stamp:       payment.PaytrailRef,
+		Reference:   slug + "-" + payment.PaytrailRef[:8],
+		Amount:      payment.AmountCents,
+		Description: description,
+		Email:       payment.Email,
+		SuccessURL:  successURL,
+		CancelURL:   cancelURL,
+		CallbackURL: callbackURL,
+		Language:    "FI",
+	}
+
+	paytrailResp, err := h.paytrail.CreateSimplePayment(ctx, paytrailReq)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the transaction ID so the reconciler can look the payment up if callbacks are lost
+	if err := h.pgStore.SetPaymentTransactionID(ctx, payment.ID, paytrailResp.TransactionID); err != nil {
+		log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to store Paytrail transaction ID")
+	}
+
+	return paytrailResp, nil
+}
+
+// writePaymentError writes the response for a failed payment insert
+func (h *PaymentHandler) writePaymentError(w http.ResponseWriter, err error) {
+	switch err {
+	case storage.ErrSoldOut:
+		writeJSONError(w, http.StatusConflict, "This stream is sold out")
+	case storage.ErrPromoCodeExhausted:
+		writeJSONError(w, http.StatusConflict, "This promo code has been fully redeemed")
+	case storage.ErrPromoCodeEmailLimit:
+		writeJSONError(w, http.StatusConflict, "You have already used this promo code")
+	default:
+		log.Error().Err(err).Msg("Failed to create payment record")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create payment")
+	}
+}
+
+// writeBundlePaymentError writes the response for a failed bundle payment insert
+func (h *PaymentHandler) writeBundlePaymentError(w http.ResponseWriter, err error) {
+	if err == storage.ErrSoldOut {
+		writeJSONError(w, http.StatusConflict, "A stream in this bundle is sold out")
+		return
+	}
+	h.writePaymentError(w, err)
+}
+
+// HandleSuccessCallback handles the browser redirect back from Paytrail
 // GET /api/callback/success
 func (h *PaymentHandler) HandleSuccessCallback(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	params := paytrail.ExtractCallbackParams(r.URL.Query())
 
 	// Verify signature
 	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, r.URL.Query()) {
@@ -152,115 +389,105 @@ func (h *PaymentHandler) HandleSuccessCallback(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// Extract callback params
-	params := paytrail.ExtractCallbackParams(r.URL.Query())
-
 	log.Info().
 		Str("stamp", params.Stamp).
 		Str("status", params.Status).
 		Str("transaction_id", params.TransactionID).
 		Msg("Payment callback received")
 
-	// Get payment by stamp
-	payment, err := h.pgStore.GetPaymentByPaytrailRef(ctx, params.Stamp)
-	if err != nil {
-		log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to get payment")
-		writeJSONError(w, http.StatusInternalServerError, "Failed to process callback")
-		return
-	}
-	if payment == nil {
+	payment, outcome, err := h.billing.ProcessPaymentCallback(ctx, params, models.CallbackSourceRedirect)
+	if err == billing.ErrPaymentNotFound {
 		log.Warn().Str("stamp", params.Stamp).Msg("Payment not found")
 		writeJSONError(w, http.StatusNotFound, "Payment not found")
 		return
 	}
-
-	// Check if already processed
-	if payment.Status == models.PaymentStatusCompleted {
-		log.Info().Str("payment_id", payment.ID.String()).Msg("Payment already completed")
-		// Redirect to watch page
-		stream, _ := h.pgStore.GetStreamByID(ctx, payment.StreamID)
-		if stream != nil {
-			h.redirectToWatch(w, r, stream.Slug, payment.AccessToken)
-			return
-		}
-		http.Redirect(w, r, h.cfg.BaseURL, http.StatusFound)
+	if err != nil {
+		log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to process callback")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to process payment")
 		return
 	}
 
-	// Process based on status
-	if params.IsSuccessful() {
-		// Generate access token
-		accessToken, err := generateAccessToken()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to generate access token")
-			writeJSONError(w, http.StatusInternalServerError, "Failed to process payment")
-			return
-		}
+	if outcome == models.CallbackOutcomeDuplicate {
+		log.Info().Str("payment_id", payment.ID.String()).Str("status", string(payment.Status)).Msg("Payment already processed")
+	}
 
-		// Set token expiry
-		tokenExpiry := time.Now().Add(h.cfg.SessionDuration)
-
-		// Update payment status
-		err = h.pgStore.UpdatePaymentStatus(
-			ctx,
-			payment.ID,
-			models.PaymentStatusCompleted,
-			params.TransactionID,
-			accessToken,
-			&tokenExpiry,
-		)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to update payment status")
-			writeJSONError(w, http.StatusInternalServerError, "Failed to process payment")
+	switch payment.Status {
+	case models.PaymentStatusCompleted:
+		// Gift buyers get the gift code on the pending page, not access
+		if payment.IsGift() {
+			h.setPendingPaymentCookie(w, r, params.Stamp)
+			http.Redirect(w, r, h.cfg.BaseURL+"/payment/pending?ref="+params.Stamp, http.StatusFound)
 			return
 		}
 
-		// Create session in Redis
-		session := &storage.SessionData{
-			Token:     accessToken,
-			StreamID:  payment.StreamID.String(),
-			Email:     payment.Email,
-			PaymentID: payment.ID.String(),
-			ExpiresAt: tokenExpiry,
-		}
-		if err := h.redis.SetSession(ctx, accessToken, session, h.cfg.SessionDuration); err != nil {
-			log.Error().Err(err).Msg("Failed to create session")
-			// Continue anyway - the database has the token
+		// Bundle buyers pick a stream on the bundle page
+		if payment.IsBundle() {
+			bundle, _ := h.pgStore.GetBundleByID(ctx, *payment.BundleID)
+			if bundle != nil {
+				h.setAccessTokenCookie(w, r, payment.AccessToken)
+				http.Redirect(w, r, h.cfg.BaseURL+"/bundle/"+bundle.Slug, http.StatusFound)
+				return
+			}
+			break
 		}
 
-		log.Info().
-			Str("payment_id", payment.ID.String()).
-			Str("stream_id", payment.StreamID.String()).
-			Msg("Payment completed successfully")
-
 		// Get stream and redirect to watch page
 		stream, _ := h.pgStore.GetStreamByID(ctx, payment.StreamID)
 		if stream != nil {
-			h.redirectToWatch(w, r, stream.Slug, accessToken)
+			h.redirectToWatch(w, r, stream.Slug, payment.AccessToken)
 			return
 		}
-	} else if params.IsPending() {
+	case models.PaymentStatusPending:
 		log.Info().Str("payment_id", payment.ID.String()).Msg("Payment pending")
-		// Show pending page
+		// Show pending page, which polls until the server-to-server callback completes the payment
+		h.setPendingPaymentCookie(w, r, params.Stamp)
 		http.Redirect(w, r, h.cfg.BaseURL+"/payment/pending?ref="+params.Stamp, http.StatusFound)
 		return
-	} else {
-		// Payment failed
-		err = h.pgStore.UpdatePaymentStatus(ctx, payment.ID, models.PaymentStatusFailed, params.TransactionID, "", nil)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to update payment status")
-		}
-		log.Info().Str("payment_id", payment.ID.String()).Msg("Payment failed")
 	}
 
 	// Default redirect
 	http.Redirect(w, r, h.cfg.BaseURL, http.StatusFound)
 }
 
+// HandleServerCallback handles Paytrail's server-to-server payment callbacks
+// Paytrail retries until it gets a 200, so only errors worth retrying return 5xx.
+// GET /api/callback/payment
+func (h *PaymentHandler) HandleServerCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	params := paytrail.ExtractCallbackParams(r.URL.Query())
+
+	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, r.URL.Query()) {
+		log.Warn().Str("query", r.URL.RawQuery).Msg("Invalid server callback signature")
+		writeJSONError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+
+	payment, outcome, err := h.billing.ProcessPaymentCallback(ctx, params, models.CallbackSourceServer)
+	if err == billing.ErrPaymentNotFound {
+		log.Warn().Str("stamp", params.Stamp).Msg("Server callback for unknown payment")
+		writeJSONError(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to process server callback")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to process callback")
+		return
+	}
+
+	log.Info().
+		Str("payment_id", payment.ID.String()).
+		Str("status", params.Status).
+		Str("outcome", string(outcome)).
+		Msg("Server callback processed")
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // HandleCancelCallback handles cancelled payment callbacks
 // GET /api/callback/cancel
 func (h *PaymentHandler) HandleCancelCallback(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	params := paytrail.ExtractCallbackParams(r.URL.Query())
 
 	// Always verify signature - Paytrail signs all callbacks
 	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, r.URL.Query()) {
@@ -269,18 +496,16 @@ func (h *PaymentHandler) HandleCancelCallback(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	params := paytrail.ExtractCallbackParams(r.URL.Query())
-
 	log.Info().
 		Str("stamp", params.Stamp).
 		Str("status", params.Status).
 		Msg("Payment cancelled")
 
 	// Update payment status if stamp is provided
+	// A cancel never overrides a payment that already completed
 	if params.Stamp != "" {
-		payment, err := h.pgStore.GetPaymentByPaytrailRef(ctx, params.Stamp)
-		if err == nil && payment != nil && payment.Status == models.PaymentStatusPending {
-			h.pgStore.UpdatePaymentStatus(ctx, payment.ID, models.PaymentStatusFailed, "", "", nil)
+		if _, _, err := h.billing.ProcessPaymentCallback(ctx, params, models.CallbackSourceRedirect); err != nil && err != billing.ErrPaymentNotFound {
+			log.Error().Err(err).Str("stamp", params.Stamp).Msg("Failed to process cancel callback")
 		}
 	}
 
@@ -289,29 +514,154 @@ func (h *PaymentHandler) HandleCancelCallback(w http.ResponseWriter, r *http.Req
 	http.Redirect(w, r, h.cfg.BaseURL, http.StatusFound)
 }
 
+// HandleRefundCallback handles server-to-server refund callbacks from Paytrail
+// GET /api/callback/refund/success
+// GET /api/callback/refund/cancel
+func (h *PaymentHandler) HandleRefundCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !paytrail.VerifyCallbackSignature(h.cfg.PaytrailSecretKey, r.URL.Query()) {
+		log.Warn().Str("query", r.URL.RawQuery).Msg("Invalid refund callback signature")
+		writeJSONError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+
+	params := paytrail.ExtractCallbackParams(r.URL.Query())
+
+	log.Info().
+		Str("refund_stamp", params.Stamp).
+		Str("status", params.Status).
+		Str("transaction_id", params.TransactionID).
+		Msg("Refund callback received")
+
+	refund, err := h.billing.HandleRefundCallback(ctx, params)
+	if err == billing.ErrRefundNotFound {
+		log.Warn().Str("refund_stamp", params.Stamp).Msg("Refund not found")
+		writeJSONError(w, http.StatusNotFound, "Refund not found")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("refund_stamp", params.Stamp).Msg("Failed to process refund callback")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to process callback")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"status":  refund.Status,
+	})
+}
+
+// GetPaymentStatus returns the status of a payment, looked up by its Paytrail stamp
+// GET /api/payment/status?ref=...
+func (h *PaymentHandler) GetPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		writeJSONError(w, http.StatusBadRequest, "ref is required")
+		return
+	}
+
+	ctx := r.Context()
+
+	payment, err := h.pgStore.GetPaymentByPaytrailRef(ctx, ref)
+	if err != nil {
+		log.Error().Err(err).Str("stamp", ref).Msg("Failed to get payment")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get payment status")
+		return
+	}
+	if payment == nil {
+		writeJSONError(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status": payment.Status,
+	}
+
+	// Where to send the buyer: the stream's watch page, or the bundle page to pick a stream
+	var watchURL, recoverURL, productURL string
+	if payment.IsBundle() {
+		bundle, err := h.pgStore.GetBundleByID(ctx, *payment.BundleID)
+		if err != nil || bundle == nil {
+			log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to get bundle for payment")
+			writeJSONError(w, http.StatusInternalServerError, "Failed to get payment status")
+			return
+		}
+		resp["bundle_slug"] = bundle.Slug
+		productURL = h.cfg.BaseURL + "/bundle/" + bundle.Slug
+		watchURL, recoverURL = productURL, productURL
+	} else {
+		stream, err := h.pgStore.GetStreamByID(ctx, payment.StreamID)
+		if err != nil || stream == nil {
+			log.Error().Err(err).Str("payment_id", payment.ID.String()).Msg("Failed to get stream for payment")
+			writeJSONError(w, http.StatusInternalServerError, "Failed to get payment status")
+			return
+		}
+		resp["stream_slug"] = stream.Slug
+		productURL = h.cfg.BaseURL + "/stream/" + stream.Slug
+		watchURL = h.cfg.BaseURL + "/watch/" + stream.Slug
+		recoverURL = h.cfg.BaseURL + "/recover/" + stream.Slug
+	}
+
+	switch payment.Status {
+	case models.PaymentStatusCompleted:
+		// Only the browser that went through checkout gets the token;
+		// anyone else holding the ref is sent to email recovery instead
+		cookie, err := r.Cookie(pendingPaymentCookieName)
+		if err == nil && cookie.Value == ref && payment.IsGift() {
+			// The payer gets the code to pass on; the recipient redeems it for access
+			resp["gift_code"] = payment.GiftCode
+			resp["gift_recipient"] = payment.RecipientEmail
+			resp["redeem_url"] = recoverURL + "?gift=" + url.QueryEscape(payment.GiftCode)
+		} else if err == nil && cookie.Value == ref && payment.IsTokenValid() {
+			h.setAccessTokenCookie(w, r, payment.AccessToken)
+			http.SetCookie(w, &http.Cookie{
+				Name:   pendingPaymentCookieName,
+				Value:  "",
+				Path:   "/",
+				MaxAge: -1,
+			})
+			resp["redirect_url"] = watchURL
+		} else {
+			resp["redirect_url"] = recoverURL
+		}
+	case models.PaymentStatusFailed, models.PaymentStatusRefunded:
+		resp["redirect_url"] = productURL
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
 // redirectToWatch sets the access token cookie and redirects to watch page
 func (h *PaymentHandler) redirectToWatch(w http.ResponseWriter, r *http.Request, slug, token string) {
-	// Set access token cookie
+	h.setAccessTokenCookie(w, r, token)
+	http.Redirect(w, r, h.cfg.BaseURL+"/watch/"+slug, http.StatusFound)
+}
+
+// setPendingPaymentCookie ties this browser to a payment awaiting confirmation
+func (h *PaymentHandler) setPendingPaymentCookie(w http.ResponseWriter, r *http.Request, stamp string) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    token,
+		Name:     pendingPaymentCookieName,
+		Value:    stamp,
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   r.TLS != nil,
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   int(h.cfg.SessionDuration.Seconds()),
 	})
-
-	http.Redirect(w, r, h.cfg.BaseURL+"/watch/"+slug, http.StatusFound)
 }
 
-// generateAccessToken generates a secure random access token
-func generateAccessToken() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(bytes), nil
+// setAccessTokenCookie sets the access token cookie
+func (h *PaymentHandler) setAccessTokenCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(h.cfg.SessionDuration.Seconds()),
+	})
 }
 
 // Helper functions for JSON responses
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/storage/storagetest"
+)
+
+const testPaytrailSecret = "test-paytrail-secret"
+
+// newTestPaymentHandler returns a payment handler on a test database and an in-memory Redis
+func newTestPaymentHandler(t *testing.T) (*PaymentHandler, *storage.PostgresStore) {
+	t.Helper()
+	pgStore := storagetest.NewPostgresStore(t)
+	_, redisStore := storagetest.NewRedisStore(t)
+	cfg := &config.Config{
+		BaseURL:           "https://paywall.example",
+		PaytrailSecretKey: testPaytrailSecret,
+		SessionDuration:   24 * time.Hour,
+		HeartbeatTimeout:  30 * time.Second,
+	}
+	return NewPaymentHandler(cfg, pgStore, redisStore), pgStore
+}
+
+// createPendingPayment stores a stream and a pending ticket for it, returning the payment
+func createPendingPayment(t *testing.T, pgStore *storage.PostgresStore) *models.Payment {
+	t.Helper()
+	ctx := context.Background()
+	stream := &models.Stream{
+		ID:              uuid.New(),
+		Slug:            "stream-" + uuid.New().String()[:8],
+		Title:           "Test stream",
+		PriceCents:      990,
+		Status:          models.StreamStatusScheduled,
+		ContainerStatus: models.ContainerStatusStopped,
+		Backend:         models.IngestBackendDocker,
+		CreatedAt:       time.Now(),
+	}
+	if err := pgStore.CreateStream(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	payment := &models.Payment{
+		ID:          uuid.New(),
+		StreamID:    stream.ID,
+		Email:       "viewer@example.com",
+		AmountCents: stream.PriceCents,
+		Status:      models.PaymentStatusPending,
+		PaytrailRef: uuid.New().String(),
+		CreatedAt:   time.Now(),
+	}
+	if err := pgStore.CreatePayment(ctx, payment); err != nil {
+		t.Fatal(err)
+	}
+	return payment
+}
+
+// signedCallbackQuery returns the query of a Paytrail callback for stamp, signed with secret
+func signedCallbackQuery(secret, stamp, status, transactionID string) url.Values {
+	params := map[string]string{
+		"checkout-account":        "375917",
+		"checkout-algorithm":      "sha256",
+		"checkout-amount":         "990",
+		"checkout-stamp":          stamp,
+		"checkout-reference":      stamp,
+		"checkout-transaction-id": transactionID,
+		"checkout-status":         status,
+		"checkout-provider":       "nordea",
+	}
+	query := url.Values{}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	query.Set("signature", paytrail.CalculateSignature(secret, params, ""))
+	return query
+}
+
+// serverCallback sends a Paytrail server-to-server callback and returns the response status
+func serverCallback(h *PaymentHandler, query url.Values) int {
+	rec := httptest.NewRecorder()
+	h.HandleServerCallback(rec, httptest.NewRequest(http.MethodGet, "/api/callback/payment?"+query.Encode(), nil))
+	return rec.Code
+}
+
+// getPaymentStatus polls the payment status as a browser holding the given pending_payment cookie, if any
+func getPaymentStatus(t *testing.T, h *PaymentHandler, ref, pendingCookie string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/payment/status?ref="+url.QueryEscape(ref), nil)
+	if pendingCookie != "" {
+		req.AddCookie(&http.Cookie{Name: pendingPaymentCookieName, Value: pendingCookie})
+	}
+	rec := httptest.NewRecorder()
+	h.GetPaymentStatus(rec, req)
+
+	var body map[string]interface{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid status response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec, body
+}
+
+// responseCookie returns the cookie the response sets under name, or nil
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestPaymentStatusGivesTokenOnlyToCheckoutBrowser(t *testing.T) {
+	h, pgStore := newTestPaymentHandler(t)
+	payment := createPendingPayment(t, pgStore)
+	ref := payment.PaytrailRef
+
+	// Pending: nothing to hand out yet
+	rec, body := getPaymentStatus(t, h, ref, ref)
+	if rec.Code != http.StatusOK || body["status"] != string(models.PaymentStatusPending) || body["redirect_url"] != nil {
+		t.Fatalf("pending payment: %d %v", rec.Code, body)
+	}
+	if responseCookie(rec, "access_token") != nil {
+		t.Fatal("pending payment set an access token")
+	}
+
+	if code := serverCallback(h, signedCallbackQuery(testPaytrailSecret, ref, "ok", "txn-1")); code != http.StatusOK {
+		t.Fatalf("server callback = %d", code)
+	}
+	completed, err := pgStore.GetPaymentByPaytrailRef(context.Background(), ref)
+	if err != nil || completed.AccessToken == "" {
+		t.Fatalf("completed payment = %+v, %v", completed, err)
+	}
+
+	// Anyone else holding the ref is sent to email recovery
+	for _, cookie := range []string{"", "another-ref"} {
+		rec, body := getPaymentStatus(t, h, ref, cookie)
+		if rec.Code != http.StatusOK || body["status"] != string(models.PaymentStatusCompleted) {
+			t.Fatalf("completed payment, cookie %q: %d %v", cookie, rec.Code, body)
+		}
+		if responseCookie(rec, "access_token") != nil {
+			t.Errorf("cookie %q: access token handed out", cookie)
+		}
+		if redirect, _ := body["redirect_url"].(string); !hasPathPrefix(redirect, "/recover/") {
+			t.Errorf("cookie %q: redirect_url = %q, want the recovery page", cookie, redirect)
+		}
+	}
+
+	// The checkout browser gets the token, once
+	rec, body = getPaymentStatus(t, h, ref, ref)
+	token := responseCookie(rec, "access_token")
+	if token == nil || token.Value != completed.AccessToken {
+		t.Fatalf("checkout browser got access token %v, want the payment's", token)
+	}
+	if pending := responseCookie(rec, pendingPaymentCookieName); pending == nil || pending.MaxAge >= 0 {
+		t.Errorf("pending_payment cookie = %v, want it cleared", pending)
+	}
+	if redirect, _ := body["redirect_url"].(string); !hasPathPrefix(redirect, "/watch/") {
+		t.Errorf("redirect_url = %q, want the watch page", redirect)
+	}
+}
+
+func TestPaymentStatusReportsFailedAndUnknownPayments(t *testing.T) {
+	h, pgStore := newTestPaymentHandler(t)
+	payment := createPendingPayment(t, pgStore)
+	ref := payment.PaytrailRef
+
+	if code := serverCallback(h, signedCallbackQuery(testPaytrailSecret, ref, "fail", "txn-1")); code != http.StatusOK {
+		t.Fatalf("server callback = %d", code)
+	}
+	rec, body := getPaymentStatus(t, h, ref, ref)
+	if rec.Code != http.StatusOK || body["status"] != string(models.PaymentStatusFailed) {
+		t.Fatalf("failed payment: %d %v", rec.Code, body)
+	}
+	if responseCookie(rec, "access_token") != nil {
+		t.Error("failed payment set an access token")
+	}
+	if redirect, _ := body["redirect_url"].(string); !hasPathPrefix(redirect, "/stream/") {
+		t.Errorf("redirect_url = %q, want the stream page to try again", redirect)
+	}
+
+	if rec, _ := getPaymentStatus(t, h, "unknown-ref", "unknown-ref"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown ref = %d, want 404", rec.Code)
+	}
+}
+
+// callbackOutcomes returns the outcomes recorded for the callbacks of a payment, oldest first
+func callbackOutcomes(t *testing.T, pgStore *storage.PostgresStore, paymentID uuid.UUID) []string {
+	t.Helper()
+	rows, err := pgStore.GetPool().Query(context.Background(),
+		`SELECT outcome FROM payment_callbacks WHERE payment_id = $1 ORDER BY received_at`, paymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outcomes
+}
+
+// countOutcome returns how many of outcomes equal outcome
+func countOutcome(outcomes []string, outcome models.CallbackOutcome) int {
+	n := 0
+	for _, o := range outcomes {
+		if o == string(outcome) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPaymentCallbacksCompleteOnce(t *testing.T) {
+	h, pgStore := newTestPaymentHandler(t)
+	ctx := context.Background()
+	payment := createPendingPayment(t, pgStore)
+	ref := payment.PaytrailRef
+
+	// Forged and tampered callbacks are refused before touching the payment
+	tampered := signedCallbackQuery(testPaytrailSecret, ref, "fail", "txn-1")
+	tampered.Set("checkout-status", "ok")
+	for name, query := range map[string]url.Values{
+		"forged":   signedCallbackQuery("wrong-secret", ref, "ok", "txn-1"),
+		"tampered": tampered,
+	} {
+		if code := serverCallback(h, query); code != http.StatusForbidden {
+			t.Errorf("%s callback = %d, want 403", name, code)
+		}
+	}
+	if current, _ := pgStore.GetPaymentByID(ctx, payment.ID); current.Status != models.PaymentStatusPending {
+		t.Fatalf("payment %s after refused callbacks, want pending", current.Status)
+	}
+
+	// Paytrail retries the server callback while the browser comes back through the redirect
+	ok := signedCallbackQuery(testPaytrailSecret, ref, "ok", "txn-1")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				if code := serverCallback(h, ok); code != http.StatusOK {
+					t.Errorf("server callback = %d", code)
+				}
+				return
+			}
+			rec := httptest.NewRecorder()
+			h.HandleSuccessCallback(rec, httptest.NewRequest(http.MethodGet, "/api/callback/success?"+ok.Encode(), nil))
+			if rec.Code != http.StatusFound {
+				t.Errorf("success redirect = %d", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	completed, err := pgStore.GetPaymentByID(ctx, payment.ID)
+	if err != nil || completed.Status != models.PaymentStatusCompleted || completed.AccessToken == "" {
+		t.Fatalf("payment after duplicate callbacks = %+v, %v; want completed", completed, err)
+	}
+
+	// The same callback again, then a late failure and a cancel, change nothing
+	if code := serverCallback(h, ok); code != http.StatusOK {
+		t.Errorf("replayed callback = %d", code)
+	}
+	if code := serverCallback(h, signedCallbackQuery(testPaytrailSecret, ref, "fail", "txn-2")); code != http.StatusOK {
+		t.Errorf("late failure = %d", code)
+	}
+	rec := httptest.NewRecorder()
+	h.HandleCancelCallback(rec, httptest.NewRequest(http.MethodGet, "/api/callback/cancel?"+signedCallbackQuery(testPaytrailSecret, ref, "fail", "txn-2").Encode(), nil))
+
+	current, err := pgStore.GetPaymentByID(ctx, payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Status != models.PaymentStatusCompleted || current.AccessToken != completed.AccessToken || current.PaytrailTransactionID != "txn-1" {
+		t.Errorf("payment after late callbacks = %s, token changed %v, transaction %q; want it untouched",
+			current.Status, current.AccessToken != completed.AccessToken, current.PaytrailTransactionID)
+	}
+
+	outcomes := callbackOutcomes(t, pgStore, payment.ID)
+	if len(outcomes) != 13 {
+		t.Errorf("recorded %d callbacks, want the 13 signed ones", len(outcomes))
+	}
+	if n := countOutcome(outcomes, models.CallbackOutcomeCompleted); n != 1 {
+		t.Errorf("payment completed %d times, want once (outcomes %v)", n, outcomes)
+	}
+	if n := countOutcome(outcomes, models.CallbackOutcomeFailed); n != 0 {
+		t.Errorf("payment failed %d times after completing, want never (outcomes %v)", n, outcomes)
+	}
+}
+
+// hasPathPrefix reports whether rawURL's path starts with prefix
+func hasPathPrefix(rawURL, prefix string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.HasPrefix(u.Path, prefix)
+}
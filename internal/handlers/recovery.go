@@ -3,33 +3,48 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/billing"
 	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/mail"
 	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/paytrail"
+	"github.com/laurikarhu/stream-paywall/internal/security"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
 	"github.com/rs/zerolog/log"
 )
 
 // RecoveryHandler handles token recovery endpoints
 type RecoveryHandler struct {
-	cfg     *config.Config
-	pgStore *storage.PostgresStore
-	redis   *storage.RedisStore
+	cfg          *config.Config
+	pgStore      *storage.PostgresStore
+	redis        *storage.RedisStore
+	billing      *billing.Service
+	entitlements *security.EntitlementChecker
+	emails       *mail.Queue
 }
 
 // NewRecoveryHandler creates a new recovery handler
 func NewRecoveryHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore) *RecoveryHandler {
 	return &RecoveryHandler{
-		cfg:     cfg,
-		pgStore: pgStore,
-		redis:   redis,
+		cfg:          cfg,
+		pgStore:      pgStore,
+		redis:        redis,
+		billing:      billing.NewService(cfg, pgStore, redis, paytrail.NewClient(cfg.PaytrailAPIURL, cfg.PaytrailMerchantID, cfg.PaytrailSecretKey)),
+		entitlements: security.NewEntitlementChecker(pgStore),
+		emails:       mail.NewQueue(pgStore),
 	}
 }
 
 // RecoverToken handles token recovery requests
+// Nothing changes yet: if the email has access, a single-use link is sent to it,
+// and the access token is only rotated when the link is confirmed. The response
+// is the same whether or not the email has access.
 // POST /api/payment/recover
 func (h *RecoveryHandler) RecoverToken(w http.ResponseWriter, r *http.Request) {
 	var req models.RecoverTokenRequest
@@ -88,49 +103,129 @@ func (h *RecoveryHandler) RecoverToken(w http.ResponseWriter, r *http.Request) {
 	stream, err := h.pgStore.GetStreamBySlug(ctx, req.StreamSlug)
 	if err != nil {
 		log.Error().Err(err).Str("slug", req.StreamSlug).Msg("Failed to get stream")
-		writeJSONError(w, http.StatusNotFound, "No active purchase found for this email.")
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
 		return
 	}
 	if stream == nil {
-		writeJSONError(w, http.StatusNotFound, "No active purchase found for this email.")
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	// A wrong gift code gets the same answer as an email without access
+	found, err := h.hasRecoverableAccess(ctx, stream, req.Email, req.GiftCode)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up access for recovery")
+	}
+
+	if found {
+		link := &storage.RecoveryLink{
+			Email:      req.Email,
+			StreamSlug: stream.Slug,
+			GiftCode:   req.GiftCode,
+		}
+		h.sendRecoveryLink(ctx, link, stream)
+	} else {
+		log.Info().
+			Str("email", req.Email).
+			Str("stream", req.StreamSlug).
+			Msg("No payment or whitelist entry found for recovery")
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("If this email has access to the stream, we sent it a link. The link works for %d minutes.", int(mail.RecoveryLinkTTL.Minutes())),
+	})
+}
+
+// ConfirmRecovery handles an opened recovery link and issues a new access token
+// The old token stops working, so a lost or shared session is logged out.
+// POST /api/payment/recover/confirm
+func (h *RecoveryHandler) ConfirmRecovery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		writeJSONError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+
+	ctx := r.Context()
+
+	link, err := h.redis.ConsumeRecoveryLink(ctx, req.Token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get recovery link")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to recover access.")
+		return
+	}
+	if link == nil {
+		writeJSONError(w, http.StatusGone, "This link has expired or was already used. Please request a new one.")
+		return
+	}
+
+	stream, err := h.pgStore.GetStreamBySlug(ctx, link.StreamSlug)
+	if err != nil || stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
 		return
 	}
 
+	// Members-only streams are recovered through the email's membership
+	if stream.MembersOnly {
+		h.recoverMembership(w, r, stream, link.Email)
+		return
+	}
+
+	h.recoverPayment(w, r, stream, link)
+}
+
+// recoverPayment issues a new access token for the payment that gives the email access
+func (h *RecoveryHandler) recoverPayment(w http.ResponseWriter, r *http.Request, stream *models.Stream, link *storage.RecoveryLink) {
+	ctx := r.Context()
+
 	// Look up completed payment for this email and stream
-	payment, err := h.pgStore.GetCompletedPaymentByEmailAndStream(ctx, req.Email, stream.ID)
+	payment, err := h.findPayment(ctx, stream, link.Email)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to look up payment")
 		writeJSONError(w, http.StatusNotFound, "No active purchase found for this email.")
 		return
 	}
 
+	// Redeem a gift addressed to this email; later recoveries find it by email
+	if payment == nil && link.GiftCode != "" {
+		payment, err = h.billing.RedeemGift(ctx, link.GiftCode, link.Email, stream)
+		if err == billing.ErrGiftNotFound {
+			writeJSONError(w, http.StatusNotFound, "This gift code is not valid for this email and stream.")
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to redeem gift")
+			writeJSONError(w, http.StatusInternalServerError, "Failed to redeem gift.")
+			return
+		}
+	}
+
 	// If no payment found, check if email is whitelisted
 	if payment == nil {
-		whitelisted, err := h.pgStore.IsEmailWhitelisted(ctx, stream.ID, req.Email)
+		whitelisted, err := h.pgStore.IsEmailWhitelisted(ctx, stream.ID, link.Email)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to check whitelist")
 		}
 
 		if whitelisted {
 			// Create a "whitelisted" payment record for this email
-			payment, err = h.createWhitelistedAccess(ctx, stream, req.Email)
+			payment, err = h.createWhitelistedAccess(ctx, stream, link.Email)
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to create whitelisted access")
 				writeJSONError(w, http.StatusInternalServerError, "Failed to grant access.")
 				return
 			}
 			log.Info().
-				Str("email", req.Email).
-				Str("stream", req.StreamSlug).
+				Str("email", link.Email).
+				Str("stream", stream.Slug).
 				Msg("Whitelisted access granted")
 		}
 	}
 
 	if payment == nil {
-		log.Info().
-			Str("email", req.Email).
-			Str("stream", req.StreamSlug).
-			Msg("No payment or whitelist entry found for recovery")
 		writeJSONError(w, http.StatusNotFound, "No active purchase found for this email.")
 		return
 	}
@@ -142,7 +237,7 @@ func (h *RecoveryHandler) RecoverToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate new access token (invalidates old one)
-	newToken, err := generateAccessToken()
+	newToken, err := billing.GenerateAccessToken()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to generate new access token")
 		writeJSONError(w, http.StatusInternalServerError, "Failed to recover access.")
@@ -166,13 +261,7 @@ func (h *RecoveryHandler) RecoverToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create new session in Redis
-	session := &storage.SessionData{
-		Token:     newToken,
-		StreamID:  stream.ID.String(),
-		Email:     payment.Email,
-		PaymentID: payment.ID.String(),
-		ExpiresAt: newExpiry,
-	}
+	session := storage.NewPaymentSession(payment, newToken, newExpiry)
 	if err := h.redis.SetSession(ctx, newToken, session, h.cfg.SessionDuration); err != nil {
 		log.Error().Err(err).Msg("Failed to create session")
 		// Continue anyway - database has the token
@@ -180,8 +269,8 @@ func (h *RecoveryHandler) RecoverToken(w http.ResponseWriter, r *http.Request) {
 
 	log.Info().
 		Str("payment_id", payment.ID.String()).
-		Str("email", req.Email).
-		Str("stream", req.StreamSlug).
+		Str("email", link.Email).
+		Str("stream", stream.Slug).
 		Msg("Token recovered successfully")
 
 	// Return success with token
@@ -203,6 +292,147 @@ func (h *RecoveryHandler) RecoverToken(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// RedeemAccessCode redeems a prepaid access code and starts the viewer's access
+// POST /api/payment/redeem
+func (h *RecoveryHandler) RedeemAccessCode(w http.ResponseWriter, r *http.Request) {
+	var req models.RedeemAccessCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.StreamSlug == "" {
+		writeJSONError(w, http.StatusBadRequest, "stream_slug is required")
+		return
+	}
+	if req.Email == "" {
+		writeJSONError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+	if req.Code == "" {
+		writeJSONError(w, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	ctx := r.Context()
+
+	// Guessing codes counts against the same limits as recovery attempts
+	clientIP := getClientIP(r)
+	allowed, err := h.redis.CheckRecoveryRateLimit(
+		ctx,
+		req.Email,
+		clientIP,
+		h.cfg.RecoveryRateLimitPerEmail,
+		h.cfg.RecoveryRateLimitPerIP,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check rate limit")
+	}
+	if !allowed {
+		log.Warn().
+			Str("email", req.Email).
+			Str("ip", clientIP).
+			Msg("Access code rate limit exceeded")
+		writeJSONError(w, http.StatusTooManyRequests, "Too many attempts. Please try again later.")
+		return
+	}
+
+	stream, err := h.pgStore.GetStreamBySlug(ctx, req.StreamSlug)
+	if err != nil || stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	// Emails that can already watch are not turned away: answering differently
+	// would tell anyone holding a code whether an email bought a ticket
+	payment, err := h.billing.RedeemAccessCode(ctx, req.Code, req.Email, stream)
+	switch {
+	case err == billing.ErrAccessCodeNotFound:
+		writeJSONError(w, http.StatusNotFound, "This access code is not valid for this stream.")
+		return
+	case err == billing.ErrAccessCodeRedeemed:
+		writeJSONError(w, http.StatusConflict, "This access code has already been used.")
+		return
+	case err == storage.ErrSoldOut:
+		writeJSONError(w, http.StatusConflict, "This stream is sold out.")
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to redeem access code")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to redeem access code.")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    payment.AccessToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(h.cfg.SessionDuration.Seconds()),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"message":      "Access code redeemed",
+		"redirect_url": h.cfg.BaseURL + "/watch/" + stream.Slug,
+	})
+}
+
+// recoverMembership issues a new access token for the email's membership
+// The old token stops working, like a recovered payment token.
+func (h *RecoveryHandler) recoverMembership(w http.ResponseWriter, r *http.Request, stream *models.Stream, email string) {
+	ctx := r.Context()
+
+	sub, err := h.pgStore.GetLiveSubscriptionByEmail(ctx, email)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up membership")
+		writeJSONError(w, http.StatusNotFound, "No active purchase found for this email.")
+		return
+	}
+	if sub == nil || !sub.HasAccessAt(time.Now()) {
+		writeJSONError(w, http.StatusNotFound, "No active purchase found for this email.")
+		return
+	}
+
+	newToken, err := billing.GenerateAccessToken()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate new access token")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to recover access.")
+		return
+	}
+
+	if err := h.pgStore.UpdateSubscriptionAccessToken(ctx, sub.ID, newToken); err != nil {
+		log.Error().Err(err).Msg("Failed to update access token")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to recover access.")
+		return
+	}
+
+	if sub.AccessToken != "" {
+		h.redis.DeleteSession(ctx, sub.AccessToken)
+		h.redis.DeleteActiveDevice(ctx, sub.AccessToken)
+	}
+
+	session := storage.NewSubscriptionSession(sub, newToken, *sub.CurrentPeriodEnd)
+	if err := h.redis.SetSession(ctx, newToken, session, h.cfg.SessionDuration); err != nil {
+		log.Error().Err(err).Msg("Failed to create session")
+		// Continue anyway - database has the token
+	}
+
+	log.Info().
+		Str("subscription_id", sub.ID.String()).
+		Str("email", email).
+		Str("stream", stream.Slug).
+		Msg("Membership token recovered successfully")
+
+	setMembershipCookie(w, r, newToken)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"message":      "Access recovered successfully",
+		"redirect_url": h.cfg.BaseURL + "/watch/" + stream.Slug,
+	})
+}
+
 // getClientIP extracts the client IP address from the request
 func getClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header (for proxies)
@@ -237,42 +467,126 @@ func getClientIP(r *http.Request) string {
 // createWhitelistedAccess creates a payment record for a whitelisted email
 // This allows whitelisted users to access streams without payment
 func (h *RecoveryHandler) createWhitelistedAccess(ctx context.Context, stream *models.Stream, email string) (*models.Payment, error) {
-	// Generate access token
-	token, err := generateAccessToken()
-	if err != nil {
-		return nil, err
-	}
-
-	expiry := time.Now().Add(h.cfg.SessionDuration)
-
 	payment := &models.Payment{
 		ID:          uuid.New(),
 		StreamID:    stream.ID,
 		Email:       email,
-		AmountCents: 0, // Free access
-		Status:      models.PaymentStatusCompleted,
 		PaytrailRef: "whitelist", // Indicates this is a whitelisted access
-		AccessToken: token,
-		TokenExpiry: &expiry,
 		CreatedAt:   time.Now(),
 	}
 
-	if err := h.pgStore.CreatePayment(ctx, payment); err != nil {
+	if err := h.billing.GrantWhitelistedAccess(ctx, payment); err != nil {
 		return nil, err
 	}
 
-	// Create session in Redis
-	session := &storage.SessionData{
-		Token:     token,
-		StreamID:  stream.ID.String(),
-		Email:     email,
-		PaymentID: payment.ID.String(),
-		ExpiresAt: expiry,
+	return payment, nil
+}
+
+// findBundlePayment returns the email's newest completed bundle payment that covers the stream
+// Payments whose access is still valid are preferred over expired ones.
+func (h *RecoveryHandler) findBundlePayment(ctx context.Context, email string, stream *models.Stream) (*models.Payment, error) {
+	payments, err := h.pgStore.ListCompletedBundlePaymentsByEmail(ctx, email)
+	if err != nil {
+		return nil, err
 	}
-	if err := h.redis.SetSession(ctx, token, session, h.cfg.SessionDuration); err != nil {
-		log.Error().Err(err).Msg("Failed to create session for whitelisted user")
-		// Continue anyway - database has the token
+
+	var found *models.Payment
+	for _, payment := range payments {
+		covers, err := h.entitlements.PaymentGrants(ctx, payment, stream)
+		if err != nil {
+			return nil, err
+		}
+		if !covers {
+			continue
+		}
+		if payment.IsTokenValid() {
+			return payment, nil
+		}
+		if found == nil {
+			found = payment
+		}
+	}
+	return found, nil
+}
+
+// findPayment returns the email's completed payment that covers the stream
+// A bundle purchase is used when there is no valid single-stream payment.
+func (h *RecoveryHandler) findPayment(ctx context.Context, stream *models.Stream, email string) (*models.Payment, error) {
+	payment, err := h.pgStore.GetCompletedPaymentByEmailAndStream(ctx, email, stream.ID)
+	if err != nil {
+		return nil, err
 	}
 
+	// Fall back to a bundle purchase that covers this stream
+	if payment == nil || !payment.IsTokenValid() {
+		bundlePayment, err := h.findBundlePayment(ctx, email, stream)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to look up bundle payments")
+		}
+		if bundlePayment != nil && (payment == nil || bundlePayment.IsTokenValid()) {
+			payment = bundlePayment
+		}
+	}
 	return payment, nil
 }
+
+// hasRecoverableAccess reports whether confirming a recovery link would give the email access
+// Nothing is changed; gifts are redeemed and whitelisted access is created on confirmation.
+func (h *RecoveryHandler) hasRecoverableAccess(ctx context.Context, stream *models.Stream, email, giftCode string) (bool, error) {
+	if stream.MembersOnly {
+		sub, err := h.pgStore.GetLiveSubscriptionByEmail(ctx, email)
+		if err != nil {
+			return false, err
+		}
+		return sub != nil && sub.HasAccessAt(time.Now()), nil
+	}
+
+	payment, err := h.findPayment(ctx, stream, email)
+	if err != nil {
+		return false, err
+	}
+	if payment != nil {
+		return payment.TokenExpiry == nil || time.Now().Before(*payment.TokenExpiry), nil
+	}
+
+	if giftCode != "" {
+		_, err := h.billing.LookupGift(ctx, giftCode, email, stream)
+		if err == nil {
+			return true, nil
+		}
+		if err != billing.ErrGiftNotFound {
+			log.Error().Err(err).Msg("Failed to look up gift")
+		}
+	}
+
+	return h.pgStore.IsEmailWhitelisted(ctx, stream.ID, email)
+}
+
+// sendRecoveryLink stores a single-use recovery link and queues an email with it to the link's address
+func (h *RecoveryHandler) sendRecoveryLink(ctx context.Context, link *storage.RecoveryLink, stream *models.Stream) {
+	token, err := billing.GenerateAccessToken()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate recovery link token")
+		return
+	}
+	if err := h.redis.SetRecoveryLink(ctx, token, link, mail.RecoveryLinkTTL); err != nil {
+		log.Error().Err(err).Msg("Failed to store recovery link")
+		return
+	}
+
+	linkURL := h.cfg.BaseURL + "/recover/" + stream.Slug + "?link=" + url.QueryEscape(token)
+	data := map[string]any{
+		"Title":          stream.Title,
+		"LinkURL":        linkURL,
+		"ExpiresMinutes": int(mail.RecoveryLinkTTL.Minutes()),
+	}
+	if err := h.emails.Enqueue(ctx, link.Email, "recovery_link", data); err != nil {
+		log.Error().Err(err).Str("email", link.Email).Msg("Failed to queue recovery link")
+		return
+	}
+
+	log.Info().
+		Str("email", link.Email).
+		Str("stream", stream.Slug).
+		Msg("Recovery link queued")
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/mail"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/storage/storagetest"
+)
+
+// newTestRecoveryHandler returns a recovery handler on a test database and an in-memory Redis
+func newTestRecoveryHandler(t *testing.T) (*RecoveryHandler, *storage.PostgresStore, *miniredis.Miniredis) {
+	t.Helper()
+	pgStore := storagetest.NewPostgresStore(t)
+	mr, redisStore := storagetest.NewRedisStore(t)
+	cfg := &config.Config{
+		BaseURL:                   "https://paywall.example",
+		SessionDuration:           24 * time.Hour,
+		RecoveryRateLimitPerEmail: 5,
+		RecoveryRateLimitPerIP:    20,
+	}
+	return NewRecoveryHandler(cfg, pgStore, redisStore), pgStore, mr
+}
+
+// createCompletedPayment stores a paid ticket for viewer@example.com and returns it with its stream
+func createCompletedPayment(t *testing.T, pgStore *storage.PostgresStore) (*models.Payment, *models.Stream) {
+	t.Helper()
+	ctx := context.Background()
+	payment := createPendingPayment(t, pgStore)
+	expiry := time.Now().Add(24 * time.Hour)
+	if _, err := pgStore.CompletePendingPayment(ctx, payment.ID, "txn-1", "original-token", &expiry); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := pgStore.GetStreamByID(ctx, payment.StreamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err = pgStore.GetPaymentByID(ctx, payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payment, stream
+}
+
+// postJSON sends body as JSON to handler and returns the response
+func postJSON(t *testing.T, handler http.HandlerFunc, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data)))
+	return rec
+}
+
+// recoveryLinkTokens returns the tokens of the recovery links emailed to email, oldest first
+func recoveryLinkTokens(t *testing.T, pgStore *storage.PostgresStore, email string) []string {
+	t.Helper()
+	rows, err := pgStore.GetPool().Query(context.Background(),
+		`SELECT data->>'LinkURL' FROM outbound_emails WHERE to_email = $1 AND template = 'recovery_link' ORDER BY created_at`, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var tokens []string
+	for rows.Next() {
+		var linkURL string
+		if err := rows.Scan(&linkURL); err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(linkURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, u.Query().Get("link"))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestRecoverTokenRevealsNothingAboutTheEmail(t *testing.T) {
+	h, pgStore, _ := newTestRecoveryHandler(t)
+	_, stream := createCompletedPayment(t, pgStore)
+
+	requests := []models.RecoverTokenRequest{
+		{StreamSlug: stream.Slug, Email: "viewer@example.com"},
+		{StreamSlug: stream.Slug, Email: "stranger@example.com"},
+		{StreamSlug: stream.Slug, Email: "stranger@example.com", GiftCode: "GIFT-AAAA-BBBB-CCCC"},
+	}
+	var first string
+	for i, req := range requests {
+		start := time.Now()
+		rec := postJSON(t, h.RecoverToken, "/api/payment/recover", req)
+		if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+			t.Errorf("%s: answered in %v, want at least 500ms", req.Email, elapsed)
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", req.Email, rec.Code)
+		}
+		if i == 0 {
+			first = rec.Body.String()
+		} else if rec.Body.String() != first {
+			t.Errorf("%s: response %q differs from %q", req.Email, rec.Body.String(), first)
+		}
+	}
+
+	if tokens := recoveryLinkTokens(t, pgStore, "viewer@example.com"); len(tokens) != 1 {
+		t.Errorf("viewer got %d recovery links, want 1", len(tokens))
+	}
+	if tokens := recoveryLinkTokens(t, pgStore, "stranger@example.com"); len(tokens) != 0 {
+		t.Errorf("stranger got %d recovery links, want none", len(tokens))
+	}
+}
+
+func TestRecoveryLinkRotatesTokenOnce(t *testing.T) {
+	h, pgStore, _ := newTestRecoveryHandler(t)
+	payment, stream := createCompletedPayment(t, pgStore)
+
+	postJSON(t, h.RecoverToken, "/api/payment/recover", models.RecoverTokenRequest{StreamSlug: stream.Slug, Email: payment.Email})
+	tokens := recoveryLinkTokens(t, pgStore, payment.Email)
+	if len(tokens) != 1 || tokens[0] == "" {
+		t.Fatalf("recovery links = %q, want one", tokens)
+	}
+
+	// Asking for a link changes nothing yet
+	if current, _ := pgStore.GetPaymentByID(context.Background(), payment.ID); current.AccessToken != payment.AccessToken {
+		t.Fatal("access token rotated before the link was opened")
+	}
+
+	confirm := map[string]string{"token": tokens[0]}
+	rec := postJSON(t, h.ConfirmRecovery, "/api/payment/recover/confirm", confirm)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("confirm = %d %s", rec.Code, rec.Body.String())
+	}
+	current, err := pgStore.GetPaymentByID(context.Background(), payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := responseCookie(rec, "access_token")
+	if current.AccessToken == payment.AccessToken || cookie == nil || cookie.Value != current.AccessToken {
+		t.Errorf("access token cookie = %v, want the rotated token", cookie)
+	}
+
+	if rec := postJSON(t, h.ConfirmRecovery, "/api/payment/recover/confirm", confirm); rec.Code != http.StatusGone {
+		t.Errorf("second use = %d, want 410", rec.Code)
+	}
+}
+
+func TestRecoveryLinkExpiresAfterTTL(t *testing.T) {
+	h, pgStore, mr := newTestRecoveryHandler(t)
+	payment, stream := createCompletedPayment(t, pgStore)
+
+	postJSON(t, h.RecoverToken, "/api/payment/recover", models.RecoverTokenRequest{StreamSlug: stream.Slug, Email: payment.Email})
+	tokens := recoveryLinkTokens(t, pgStore, payment.Email)
+	if len(tokens) != 1 {
+		t.Fatalf("recovery links = %q, want one", tokens)
+	}
+
+	mr.FastForward(mail.RecoveryLinkTTL + time.Second)
+	rec := postJSON(t, h.ConfirmRecovery, "/api/payment/recover/confirm", map[string]string{"token": tokens[0]})
+	if rec.Code != http.StatusGone {
+		t.Errorf("expired link = %d, want 410", rec.Code)
+	}
+	if current, _ := pgStore.GetPaymentByID(context.Background(), payment.ID); current.AccessToken != payment.AccessToken {
+		t.Error("expired link rotated the access token")
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"sync"
+)
+
+// segmentFetch is one upstream segment download shared by every viewer requesting it
+// Viewers that join while it runs get the bytes received so far and then follow
+// along as more arrive, so a partial segment that upstream is still producing
+// reaches all of them as it is written.
+type segmentFetch struct {
+	mu          sync.Mutex
+	data        []byte
+	contentType string
+	started     bool
+	done        bool
+	err         error
+	updated     chan struct{}
+}
+
+// segmentFetchState is a snapshot of a fetch, taken by readers
+type segmentFetchState struct {
+	contentType string
+	chunk       []byte // Bytes after the reader's offset
+	started     bool   // Upstream answered and contentType is set
+	done        bool
+	err         error
+	updated     <-chan struct{} // Closed on the next change
+}
+
+func newSegmentFetch() *segmentFetch {
+	return &segmentFetch{updated: make(chan struct{})}
+}
+
+// start records the upstream response's content type
+func (f *segmentFetch) start(contentType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.contentType = contentType
+	f.started = true
+	f.notify()
+}
+
+// write appends received bytes
+func (f *segmentFetch) write(p []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, p...)
+	f.notify()
+}
+
+// finish ends the fetch; err is nil when the whole segment was received
+func (f *segmentFetch) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	f.err = err
+	f.notify()
+}
+
+// notify wakes every reader waiting for a change; f.mu must be held
+func (f *segmentFetch) notify() {
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+// read returns the state of the fetch with the bytes after offset
+// data is only ever appended to, so the returned chunk stays valid without the lock.
+func (f *segmentFetch) read(offset int) segmentFetchState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return segmentFetchState{
+		contentType: f.contentType,
+		chunk:       f.data[offset:],
+		started:     f.started,
+		done:        f.done,
+		err:         f.err,
+		updated:     f.updated,
+	}
+}
+
+// segmentFetchGroup deduplicates concurrent segment downloads by upstream URL
+type segmentFetchGroup struct {
+	mu      sync.Mutex
+	fetches map[string]*segmentFetch
+}
+
+// join returns the running fetch for url, or starts fetch for it in the background
+// The download does not belong to any one viewer, so it keeps going when the
+// viewer that started it disconnects.
+func (g *segmentFetchGroup) join(url string, fetch func(f *segmentFetch)) *segmentFetch {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.fetches[url]; ok {
+		return f
+	}
+	if g.fetches == nil {
+		g.fetches = make(map[string]*segmentFetch)
+	}
+
+	f := newSegmentFetch()
+	g.fetches[url] = f
+	go func() {
+		fetch(f)
+		g.mu.Lock()
+		delete(g.fetches, url)
+		g.mu.Unlock()
+	}()
+	return f
+}
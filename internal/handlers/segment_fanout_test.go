@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/m3u8"
+)
+
+// blockingOwncast serves one segment in two halves, holding the second back until released
+// With fail set, it breaks off the response instead of sending the second half.
+type blockingOwncast struct {
+	*httptest.Server
+	requests atomic.Int32
+	release  chan struct{}
+}
+
+func newBlockingOwncast(t *testing.T, fail bool) *blockingOwncast {
+	t.Helper()
+	o := &blockingOwncast{release: make(chan struct{})}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.requests.Add(1)
+		w.Header().Set("Content-Type", "video/mp2t")
+		if fail {
+			w.Header().Set("Content-Length", "100") // More than is sent, so the body ends early
+		}
+		w.Write([]byte("first half;"))
+		w.(http.Flusher).Flush()
+		<-o.release
+		if !fail {
+			w.Write([]byte("second half"))
+		}
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+// getSegmentConcurrently requests target from n viewers at once and returns their bodies and errors
+// Owncast is released once every viewer has received the first half of the
+// segment, so all of them are known to share the one download.
+func getSegmentConcurrently(t *testing.T, proxyURL string, owncast *blockingOwncast, n int) ([]string, []error) {
+	t.Helper()
+	bodies := make([]string, n)
+	errs := make([]error, n)
+	var joined, finished sync.WaitGroup
+	joined.Add(n)
+	finished.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer finished.Done()
+			resp, err := http.Get(proxyURL)
+			if err != nil {
+				errs[i] = err
+				joined.Done()
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				errs[i] = fmt.Errorf("status %d", resp.StatusCode)
+				joined.Done()
+				return
+			}
+
+			first := make([]byte, len("first half;"))
+			_, err = io.ReadFull(resp.Body, first)
+			joined.Done()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			rest, err := io.ReadAll(resp.Body)
+			bodies[i] = string(first) + string(rest)
+			errs[i] = err
+		}()
+	}
+
+	joined.Wait()
+	close(owncast.release)
+	finished.Wait()
+	return bodies, errs
+}
+
+func TestConcurrentSegmentRequestsShareOneFetch(t *testing.T) {
+	owncast := newBlockingOwncast(t, false)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+	proxy := httptest.NewServer(http.HandlerFunc(h.ServeHLS))
+	defer proxy.Close()
+
+	ref := rewriteTestPlaylist(t, h, stream, "viewer-token")[0]
+	bodies, errs := getSegmentConcurrently(t, proxy.URL+ref, owncast, 20)
+
+	for i := range bodies {
+		if errs[i] != nil || bodies[i] != "first half;second half" {
+			t.Errorf("viewer %d got %q, %v; want the whole segment", i, bodies[i], errs[i])
+		}
+	}
+	if n := owncast.requests.Load(); n != 1 {
+		t.Errorf("Owncast got %d requests, want 1", n)
+	}
+
+	// Later viewers are served from the cache
+	if rec := getHLS(h, ref); rec.Code != http.StatusOK || owncast.requests.Load() != 1 {
+		t.Errorf("cached GET = %d after %d Owncast requests, want 200 after 1", rec.Code, owncast.requests.Load())
+	}
+}
+
+func TestSegmentFetchErrorReachesEveryViewer(t *testing.T) {
+	owncast := newBlockingOwncast(t, true)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+	proxy := httptest.NewServer(http.HandlerFunc(h.ServeHLS))
+	defer proxy.Close()
+
+	ref := rewriteTestPlaylist(t, h, stream, "viewer-token")[0]
+	bodies, errs := getSegmentConcurrently(t, proxy.URL+ref, owncast, 10)
+
+	for i := range bodies {
+		if errs[i] == nil {
+			t.Errorf("viewer %d got %q without an error, want a broken download", i, bodies[i])
+		}
+	}
+	if n := owncast.requests.Load(); n != 1 {
+		t.Errorf("Owncast got %d requests, want 1", n)
+	}
+
+	// The failed segment is not cached, so the next viewer tries again
+	if _, ok := h.segmentCache.Get(owncast.URL + "/hls/0/seg10.ts"); ok {
+		t.Error("a failed segment was cached")
+	}
+}
+
+func TestSegmentFetchGroupSharesResult(t *testing.T) {
+	var g segmentFetchGroup
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(f *segmentFetch) {
+		fetches.Add(1)
+		<-release
+		f.finish(errors.New("owncast returned status 500"))
+	}
+
+	first := g.join("http://owncast/hls/0/seg1.ts", fetch)
+	for i := 0; i < 5; i++ {
+		if f := g.join("http://owncast/hls/0/seg1.ts", fetch); f != first {
+			t.Fatal("a concurrent request started a second fetch")
+		}
+	}
+	state := first.read(0)
+	close(release)
+	<-state.updated
+
+	if state := first.read(0); !state.done || state.err == nil {
+		t.Errorf("state = %+v, want the upstream error", state)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+// lowLatencyOwncast serves an LL-HLS playlist whose last segment the test advances
+type lowLatencyOwncast struct {
+	*httptest.Server
+	last atomic.Int64
+}
+
+func newLowLatencyOwncast(t *testing.T, last int64) *lowLatencyOwncast {
+	t.Helper()
+	o := &lowLatencyOwncast{}
+	o.last.Store(last)
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last := o.last.Load()
+		var b strings.Builder
+		fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:1\n")
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=0.2\n#EXT-X-MEDIA-SEQUENCE:%d\n", last-1)
+		fmt.Fprintf(&b, "#EXTINF:1.0,\nseg%d.m4s\n#EXTINF:1.0,\nseg%d.m4s\n", last-1, last)
+		w.Write([]byte(b.String()))
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func TestWaitForPlaylist(t *testing.T) {
+	owncast := newLowLatencyOwncast(t, 10)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+	streamID := stream.ID.String()
+	playlistURL := owncast.URL + "/hls/0/stream.m3u8"
+
+	current, err := h.fetchPlaylist(context.Background(), streamID, playlistURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Already in the playlist
+	if entry, err := h.waitForPlaylist(context.Background(), streamID, playlistURL, current, &m3u8.BlockingReload{MSN: 10, Part: -1}); err != nil || entry != current {
+		t.Errorf("satisfied reload = %v, %v; want the current playlist", entry, err)
+	}
+
+	// Too far ahead to wait for
+	if _, err := h.waitForPlaylist(context.Background(), streamID, playlistURL, current, &m3u8.BlockingReload{MSN: 13, Part: -1}); !errors.Is(err, errReloadTooFar) {
+		t.Errorf("reload 3 segments ahead: error = %v, want errReloadTooFar", err)
+	}
+
+	// Held until the playlist advances
+	time.AfterFunc(300*time.Millisecond, func() { owncast.last.Store(11) })
+	start := time.Now()
+	entry, err := h.waitForPlaylist(context.Background(), streamID, playlistURL, current, &m3u8.BlockingReload{MSN: 11, Part: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(entry.content, "seg11.m4s") {
+		t.Errorf("returned playlist does not have segment 11:\n%s", entry.content)
+	}
+	if waited := time.Since(start); waited < 250*time.Millisecond || waited > 2*time.Second {
+		t.Errorf("waited %v, want about 300ms", waited)
+	}
+
+	// Canceled with the viewer's request
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := h.waitForPlaylist(ctx, streamID, playlistURL, entry, &m3u8.BlockingReload{MSN: 12, Part: -1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("canceled reload: error = %v, want the context's error", err)
+	}
+
+	// Given up after three target durations
+	start = time.Now()
+	if _, err := h.waitForPlaylist(context.Background(), streamID, playlistURL, entry, &m3u8.BlockingReload{MSN: 12, Part: -1}); !errors.Is(err, errReloadTimeout) {
+		t.Errorf("stalled reload: error = %v, want errReloadTimeout", err)
+	}
+	if waited := time.Since(start); waited < 3*time.Second || waited > 4*time.Second {
+		t.Errorf("timed out after %v, want 3s", waited)
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// originLockTTL bounds how long one instance holds the right to fetch an upstream URL
+	// It outlasts the HTTP client's timeout, so a lock only expires while held when
+	// the instance holding it died.
+	originLockTTL = 35 * time.Second
+	// originPollInterval is how soon instances waiting for another's fetch first check the shared cache
+	// The wait doubles after every check, up to originMaxPollInterval.
+	originPollInterval = 20 * time.Millisecond
+	// originMaxPollInterval is the longest wait between checks of the shared cache
+	originMaxPollInterval = 250 * time.Millisecond
+)
+
+// originFetch downloads an object from Owncast, returning it with how long it may be shared
+// A TTL of 0 keeps the object out of the shared cache.
+type originFetch func() (*storage.OriginObject, time.Duration, error)
+
+// fetchOrigin downloads an object from Owncast with fetch, through the shared cache when enabled
+// With SHARED_CACHE=redis, objects are taken from the shared cache in Redis, and
+// only one paywall instance at a time goes to Owncast for a URL. Instances that
+// lose the race poll the shared cache, backing off, until the object shows up.
+// If the fetching instance fails or dies, each of them fetches the object itself,
+// and Redis errors fall back to fetching directly: the shared tier saves upstream
+// requests but is never the reason a viewer's request fails.
+// Waiting stops with ctx's error once nobody is left to receive the object.
+func (h *StreamHandler) fetchOrigin(ctx context.Context, upstreamURL string, fetch originFetch) (*storage.OriginObject, time.Duration, error) {
+	if !h.shared {
+		return fetch()
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, originLockTTL)
+	defer cancel()
+
+	object, ttl, err := h.redis.GetOriginObject(ctx, upstreamURL)
+	if err != nil {
+		log.Warn().Err(err).Msg("Shared cache unavailable, fetching from Owncast")
+		return fetch()
+	}
+	if object != nil {
+		return object, ttl, nil
+	}
+
+	owner, err := h.redis.AcquireOriginLock(ctx, upstreamURL, originLockTTL)
+	if err != nil {
+		log.Warn().Err(err).Msg("Shared cache unavailable, fetching from Owncast")
+		return fetch()
+	}
+	if owner != "" {
+		// Other instances are waiting for the object even if this request is gone
+		shareCtx := context.WithoutCancel(ctx)
+		defer func() {
+			if err := h.redis.ReleaseOriginLock(shareCtx, upstreamURL, owner); err != nil {
+				log.Warn().Err(err).Msg("Failed to release shared cache lock")
+			}
+		}()
+
+		object, ttl, err := fetch()
+		if err != nil || ttl <= 0 {
+			return object, ttl, err
+		}
+		if err := h.redis.SetOriginObject(shareCtx, upstreamURL, object, ttl); err != nil {
+			log.Warn().Err(err).Msg("Failed to share fetched object")
+		}
+		return object, ttl, nil
+	}
+
+	// Another instance is fetching it
+	wait := originPollInterval
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			if err := parent.Err(); err != nil {
+				return nil, 0, err
+			}
+			// The lock outlived its holder
+			return fetch()
+		}
+
+		object, ttl, held, err := h.redis.PollOriginObject(ctx, upstreamURL)
+		if err != nil {
+			if err := parent.Err(); err != nil {
+				return nil, 0, err
+			}
+			log.Warn().Err(err).Msg("Shared cache unavailable, fetching from Owncast")
+			return fetch()
+		}
+		if object != nil {
+			return object, ttl, nil
+		}
+		if !held {
+			// The fetch failed, or its object was not shared
+			return fetch()
+		}
+
+		wait = min(2*wait, originMaxPollInterval)
+		timer.Reset(wait)
+	}
+}
+
+// publishStreamChange tells every instance to drop its cached copy of a stream
+// A failure is only logged: the copies expire within a minute anyway.
+func publishStreamChange(ctx context.Context, redis *storage.RedisStore, id uuid.UUID) {
+	if err := redis.PublishStreamChange(ctx, id); err != nil {
+		log.Warn().Err(err).Str("id", id.String()).Msg("Failed to publish stream change")
+	}
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/storage/storagetest"
+)
+
+const testOriginURL = "http://owncast:8080/hls/0/seg10.ts"
+
+// newSharedOriginInstances returns n paywall instances sharing one in-memory Redis
+func newSharedOriginInstances(t *testing.T, n int) (*miniredis.Miniredis, []*StreamHandler) {
+	t.Helper()
+	mr, _ := storagetest.NewRedisStore(t)
+	instances := make([]*StreamHandler, n)
+	for i := range instances {
+		redis, err := storage.NewRedisStore(context.Background(), "redis://"+mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { redis.Close() })
+		instances[i] = &StreamHandler{redis: redis, shared: true}
+	}
+	return mr, instances
+}
+
+// countedFetch returns an originFetch answering with data after release is closed, and its call count
+func countedFetch(data string, err error, release <-chan struct{}) (originFetch, *atomic.Int32) {
+	calls := &atomic.Int32{}
+	return func() (*storage.OriginObject, time.Duration, error) {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return &storage.OriginObject{ContentType: "video/mp2t", Data: []byte(data)}, 10 * time.Second, nil
+	}, calls
+}
+
+// originResult is what a fetchOrigin call running in the background returned
+type originResult struct {
+	object *storage.OriginObject
+	err    error
+}
+
+// fetchOriginAsync runs fetchOrigin in the background
+func fetchOriginAsync(ctx context.Context, h *StreamHandler, fetch originFetch) <-chan originResult {
+	done := make(chan originResult, 1)
+	go func() {
+		object, _, err := h.fetchOrigin(ctx, testOriginURL, fetch)
+		done <- originResult{object, err}
+	}()
+	return done
+}
+
+// waitForOriginLock waits until an instance holds the fetch lock
+func waitForOriginLock(t *testing.T, mr *miniredis.Miniredis) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, key := range mr.Keys() {
+			if strings.HasPrefix(key, "origin_lock:") {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no instance took the fetch lock")
+}
+
+// awaitOrigin returns the result of a background fetchOrigin call
+func awaitOrigin(t *testing.T, done <-chan originResult) originResult {
+	t.Helper()
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchOrigin did not return")
+		return originResult{}
+	}
+}
+
+func TestFetchOriginSharesTheFetch(t *testing.T) {
+	mr, instances := newSharedOriginInstances(t, 2)
+	ctx := context.Background()
+
+	fetch, calls := countedFetch("segment", nil, nil)
+	object, ttl, err := instances[0].fetchOrigin(ctx, testOriginURL, fetch)
+	if err != nil || string(object.Data) != "segment" || ttl != 10*time.Second {
+		t.Fatalf("owner got %v, %v, %v", object, ttl, err)
+	}
+
+	otherFetch, otherCalls := countedFetch("other", nil, nil)
+	object, ttl, err = instances[1].fetchOrigin(ctx, testOriginURL, otherFetch)
+	if err != nil || string(object.Data) != "segment" || ttl <= 0 {
+		t.Fatalf("second instance got %v, %v, %v; want the shared object", object, ttl, err)
+	}
+	if calls.Load() != 1 || otherCalls.Load() != 0 {
+		t.Errorf("fetched %d + %d times, want once", calls.Load(), otherCalls.Load())
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "origin_lock:") {
+			t.Error("fetch lock still held after the fetch")
+		}
+	}
+}
+
+func TestFetchOriginWaiterGetsTheSharedObject(t *testing.T) {
+	mr, instances := newSharedOriginInstances(t, 2)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	ownerFetch, _ := countedFetch("segment", nil, release)
+	owner := fetchOriginAsync(ctx, instances[0], ownerFetch)
+	waitForOriginLock(t, mr)
+
+	waiterFetch, waiterCalls := countedFetch("other", nil, nil)
+	waiter := fetchOriginAsync(ctx, instances[1], waiterFetch)
+
+	// The waiter backs off instead of polling at a fixed rate
+	commands := mr.CommandCount()
+	time.Sleep(time.Second)
+	if n := mr.CommandCount() - commands; n > 40 {
+		t.Errorf("waiting a second sent %d Redis commands", n)
+	}
+	close(release)
+
+	if result := awaitOrigin(t, owner); result.err != nil || string(result.object.Data) != "segment" {
+		t.Fatalf("owner got %+v", result)
+	}
+	if result := awaitOrigin(t, waiter); result.err != nil || string(result.object.Data) != "segment" {
+		t.Fatalf("waiter got %+v, want the owner's object", result)
+	}
+	if waiterCalls.Load() != 0 {
+		t.Error("waiter fetched from Owncast itself")
+	}
+}
+
+func TestFetchOriginWaiterFetchesWhenOwnerFails(t *testing.T) {
+	mr, instances := newSharedOriginInstances(t, 2)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	ownerFetch, _ := countedFetch("", errors.New("owncast returned status 502"), release)
+	owner := fetchOriginAsync(ctx, instances[0], ownerFetch)
+	waitForOriginLock(t, mr)
+
+	waiterFetch, waiterCalls := countedFetch("segment", nil, nil)
+	waiter := fetchOriginAsync(ctx, instances[1], waiterFetch)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if result := awaitOrigin(t, owner); result.err == nil {
+		t.Error("owner's failed fetch returned no error")
+	}
+	if result := awaitOrigin(t, waiter); result.err != nil || string(result.object.Data) != "segment" {
+		t.Fatalf("waiter got %+v, want its own fetch", result)
+	}
+	if waiterCalls.Load() != 1 {
+		t.Errorf("waiter fetched %d times, want once", waiterCalls.Load())
+	}
+}
+
+func TestFetchOriginWaiterStopsWithItsRequest(t *testing.T) {
+	mr, instances := newSharedOriginInstances(t, 2)
+
+	release := make(chan struct{})
+	ownerFetch, _ := countedFetch("segment", nil, release)
+	owner := fetchOriginAsync(context.Background(), instances[0], ownerFetch)
+	waitForOriginLock(t, mr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiterFetch, waiterCalls := countedFetch("other", nil, nil)
+	waiter := fetchOriginAsync(ctx, instances[1], waiterFetch)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if result := awaitOrigin(t, waiter); !errors.Is(result.err, context.Canceled) {
+		t.Errorf("waiter got %+v after its request ended, want context.Canceled", result)
+	}
+	if waiterCalls.Load() != 0 {
+		t.Error("waiter fetched for a request that had ended")
+	}
+	close(release)
+	awaitOrigin(t, owner)
+}
+
+func TestFetchOriginWithoutRedisFetchesDirectly(t *testing.T) {
+	mr, instances := newSharedOriginInstances(t, 1)
+	mr.Close()
+
+	fetch, calls := countedFetch("segment", nil, nil)
+	object, _, err := instances[0].fetchOrigin(context.Background(), testOriginURL, fetch)
+	if err != nil || string(object.Data) != "segment" || calls.Load() != 1 {
+		t.Errorf("got %v, %v after %d fetches; want a direct fetch", object, err, calls.Load())
+	}
+}
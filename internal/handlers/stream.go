@@ -1,28 +1,76 @@
 package handlers
 
 import (
-	"bufio"
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/cache"
+	"github.com/laurikarhu/stream-paywall/internal/cdn"
 	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/m3u8"
 	"github.com/laurikarhu/stream-paywall/internal/models"
 	"github.com/laurikarhu/stream-paywall/internal/security"
 	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/watermark"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/singleflight"
 )
 
-// hlsURLRegex matches HLS segment and playlist URLs (compiled once at package level)
-var hlsURLRegex = regexp.MustCompile(`^[^#].*\.(ts|m4s|m3u8)(\?.*)?$`)
+// watermarkVariantPrefix marks segment paths served from a stream's watermark (B) rendition
+// It is part of the signed path, so viewers cannot swap a B segment for its A twin.
+const watermarkVariantPrefix = "~b/"
+
+const (
+	// minLowLatencyCacheTTL is the shortest time an LL-HLS playlist is cached or polled
+	minLowLatencyCacheTTL = 50 * time.Millisecond
+	// defaultReloadTimeout limits a blocking reload of a playlist without a target duration
+	defaultReloadTimeout = 12 * time.Second
+)
+
+var (
+	// errReloadTooFar is returned for blocking reloads more than two segments ahead of the playlist
+	errReloadTooFar = errors.New("blocking reload too far ahead")
+	// errReloadTimeout is returned when a blocking reload is not satisfied within three target durations
+	errReloadTimeout = errors.New("blocking reload timed out")
+	// errUpstreamReference is returned for playlists referring to the upstream host outside /hls/
+	errUpstreamReference = errors.New("playlist refers to the upstream outside /hls/")
+)
+
+// proxyParams are the query parameters the proxy and CDN signers add to resource URLs
+// The rest of a resource URL's query is the upstream's own and is passed on to it.
+var proxyParams = []string{"token", "expires", "sig", "key", "device", "signature", "hdnts", "Expires", "Signature", "Key-Pair-Id", "Policy"}
+
+// upstreamQuery returns the parameters of a raw query that are not proxyParams, in canonical order
+func upstreamQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	query, _ := url.ParseQuery(rawQuery)
+	for _, name := range proxyParams {
+		query.Del(name)
+	}
+	return query.Encode()
+}
+
+// withQuery appends a raw query to a URL or path, if there is one
+func withQuery(u, rawQuery string) string {
+	if rawQuery == "" {
+		return u
+	}
+	return u + "?" + rawQuery
+}
 
 // streamCacheEntry holds cached stream data with expiry
 type streamCacheEntry struct {
@@ -30,6 +78,15 @@ type streamCacheEntry struct {
 	expiresAt time.Time
 }
 
+const (
+	// cacheJanitorInterval is how often expired playlists and segments are removed from the caches
+	cacheJanitorInterval = 10 * time.Second
+	// segmentCacheTTL is how long segments are cached
+	segmentCacheTTL = 30 * time.Second
+	// maxCachedSegmentSize is the size from which segments are not cached
+	maxCachedSegmentSize = 5 * 1024 * 1024
+)
+
 // playlistCacheEntry holds cached HLS playlist data with short TTL
 type playlistCacheEntry struct {
 	content   string
@@ -40,7 +97,6 @@ type playlistCacheEntry struct {
 type segmentCacheEntry struct {
 	data        []byte
 	contentType string
-	expiresAt   time.Time
 }
 
 // StreamHandler handles stream-related endpoints
@@ -49,22 +105,38 @@ type StreamHandler struct {
 	pgStore        *storage.PostgresStore
 	redis          *storage.RedisStore
 	sessionManager *security.SessionManager
+	admission      *security.AdmissionController
+	entitlements   *security.EntitlementChecker
+	signer         *security.URLSigner
+	keys           *security.SegmentKeys
 	client         *http.Client
-	streamCache    sync.Map            // uuid.UUID -> *streamCacheEntry
-	playlistCache  sync.Map            // string (owncastURL) -> *playlistCacheEntry
-	rewrittenCache sync.Map            // string (streamID:token:hlsPath) -> *playlistCacheEntry
-	segmentCache   sync.Map            // string (owncastURL) -> *segmentCacheEntry
-	playlistFlight singleflight.Group  // deduplicates concurrent playlist fetches
-	segmentFlight  singleflight.Group  // deduplicates concurrent segment fetches
+	shared         bool                              // Owncast fetches go through the shared cache in Redis
+	edge           cdn.Signer                        // Signs CDN segment URLs, nil when the paywall serves segments
+	origin         *cdn.Origin                       // Recognizes the CDN's origin pulls
+	edgeURLs       *cache.Cache[string]              // proxyPath@expires -> signed CDN URL
+	streamCache    sync.Map                          // uuid.UUID -> *streamCacheEntry
+	playlistCache  *cache.Cache[*playlistCacheEntry] // owncastURL -> upstream playlist
+	rewrittenCache *cache.Cache[*playlistCacheEntry] // streamID:token:device:hlsPath -> rewritten playlist
+	segmentCache   *cache.Cache[*segmentCacheEntry]  // owncastURL -> segment
+	playlistFlight singleflight.Group                // deduplicates concurrent playlist fetches
+	segmentFetches segmentFetchGroup                 // deduplicates and fans out concurrent segment fetches
 }
 
 // NewStreamHandler creates a new stream handler
-func NewStreamHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore) *StreamHandler {
-	return &StreamHandler{
+func NewStreamHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis *storage.RedisStore) (*StreamHandler, error) {
+	h := &StreamHandler{
 		cfg:            cfg,
 		pgStore:        pgStore,
 		redis:          redis,
 		sessionManager: security.NewSessionManager(redis, cfg.SessionDuration, cfg.HeartbeatTimeout),
+		admission:      security.NewAdmissionController(pgStore, redis, cfg.HeartbeatTimeout),
+		entitlements:   security.NewEntitlementChecker(pgStore),
+		signer:         security.NewURLSigner(cfg.SigningSecret, cfg.SignatureValidity),
+		keys:           security.NewSegmentKeys(cfg.SigningSecret, cfg.HLSKeyRotation),
+		playlistCache:  cache.New[*playlistCacheEntry]("playlists", int64(cfg.PlaylistCacheMB)<<20),
+		rewrittenCache: cache.New[*playlistCacheEntry]("rewritten_playlists", int64(cfg.PlaylistCacheMB)<<20),
+		segmentCache:   cache.New[*segmentCacheEntry]("segments", int64(cfg.SegmentCacheMB)<<20),
+		shared:         cfg.SharedCache == "redis",
 		client: &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConns:        1000,            // Increased for high viewer counts
@@ -76,6 +148,93 @@ func NewStreamHandler(cfg *config.Config, pgStore *storage.PostgresStore, redis
 			Timeout: 30 * time.Second,
 		},
 	}
+
+	if cfg.CDNEnabled() {
+		var privateKey []byte
+		if cfg.CDNPrivateKeyFile != "" {
+			var err error
+			privateKey, err = os.ReadFile(cfg.CDNPrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CDN private key: %w", err)
+			}
+		}
+		edge, err := cdn.NewSigner(cfg.CDNSigning, cfg.CDNSigningKey, cfg.CDNKeyPairID, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		h.edge = edge
+		h.origin = cdn.NewOrigin(cfg.CDNOriginHeader, cfg.CDNOriginSecret)
+		h.edgeURLs = cache.New[string]("edge_urls", int64(cfg.PlaylistCacheMB)<<20)
+	}
+	return h, nil
+}
+
+// encrypting reports whether media is encrypted per session
+// Segments delivered through a CDN are cached there once for every viewer, so they are not.
+func (h *StreamHandler) encrypting() bool {
+	return h.keys.Enabled() && h.edge == nil
+}
+
+// RunCacheJanitor removes expired playlists and segments every cacheJanitorInterval until ctx is canceled
+// Without it, entries nobody requests again would only leave the caches when evicted.
+func (h *StreamHandler) RunCacheJanitor(ctx context.Context) {
+	ticker := time.NewTicker(cacheJanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.playlistCache.Sweep()
+			h.rewrittenCache.Sweep()
+			h.segmentCache.Sweep()
+			if h.edgeURLs != nil {
+				h.edgeURLs.Sweep()
+			}
+		}
+	}
+}
+
+// RunStreamChanges drops streams from the stream cache when an admin changes them, until ctx is canceled
+// Every instance runs it, so status changes apply everywhere at once instead of
+// when each instance's cached copy expires. The playlists rewritten for the
+// stream's viewers are dropped too, as they may be from a stream's old settings.
+func (h *StreamHandler) RunStreamChanges(ctx context.Context) {
+	sub := h.redis.SubscribeStreamChanges(ctx)
+	defer sub.Close()
+
+	changes := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-changes:
+			if !ok {
+				return
+			}
+			id, err := uuid.Parse(msg.Payload)
+			if err != nil {
+				log.Warn().Str("payload", msg.Payload).Msg("Ignoring invalid stream change")
+				continue
+			}
+			h.streamCache.Delete(id)
+			h.rewrittenCache.DeleteStream(id.String())
+		}
+	}
+}
+
+// CacheStats returns the usage and counters of the proxy's caches
+func (h *StreamHandler) CacheStats() []cache.Stats {
+	stats := []cache.Stats{
+		h.playlistCache.Stats(),
+		h.rewrittenCache.Stats(),
+		h.segmentCache.Stats(),
+	}
+	if h.edgeURLs != nil {
+		stats = append(stats, h.edgeURLs.Stats())
+	}
+	return stats
 }
 
 // getStreamCached returns a stream from cache or fetches from DB
@@ -95,7 +254,7 @@ func (h *StreamHandler) getStreamCached(ctx context.Context, id uuid.UUID) (*mod
 		return stream, err
 	}
 
-	// Cache for 60 seconds
+	// Cache for 60 seconds, or until RunStreamChanges hears the stream changed
 	h.streamCache.Store(id, &streamCacheEntry{
 		stream:    stream,
 		expiresAt: time.Now().Add(60 * time.Second),
@@ -147,6 +306,22 @@ func (h *StreamHandler) ServeHLS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// With a CDN, media is pulled by the CDN, which checked the viewer's edge
+	// token; its pulls carry the origin secret instead of a session or signature
+	if h.edge != nil && m3u8.IsMedia(hlsPath) {
+		if !h.origin.Authorized(r) {
+			http.Error(w, "Segments are served through the CDN", http.StatusForbidden)
+			return
+		}
+		owncastURL, ok := upstreamSegmentURL(stream, hlsPath)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		h.serveSegment(w, r, stream.ID.String(), withQuery(owncastURL, upstreamQuery(r.URL.RawQuery)), nil, nil)
+		return
+	}
+
 	// Extract token from query params
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -155,11 +330,12 @@ func (h *StreamHandler) ServeHLS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Determine content type based on file extension
-	isPlaylist := strings.HasSuffix(hlsPath, ".m3u8")
+	isPlaylist := m3u8.IsPlaylist(hlsPath)
 
 	// For playlist requests, validate session in Redis (fast, real-time validation)
-	// Segments don't need validation - they're useless without a valid playlist,
-	// and the playlist request already validated the session.
+	// Segments carry a short-lived signature from the playlist that listed them,
+	// bound to the stream, token and path, so a leaked segment URL soon stops working.
+	var mark []byte
 	if isPlaylist {
 		session, err := h.redis.GetSession(ctx, token)
 		if err != nil || session == nil {
@@ -171,116 +347,159 @@ func (h *StreamHandler) ServeHLS(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Verify token is for this stream
-		if session.StreamID != streamID {
+		// Verify token is for this stream, directly or through a bundle
+		granted, err := h.entitlements.SessionGrants(ctx, session, stream)
+		if err != nil {
+			log.Error().Err(err).Str("stream_id", streamID).Msg("Failed to check stream access")
+			http.Error(w, "Failed to check access", http.StatusInternalServerError)
+			return
+		}
+		if !granted {
 			http.Error(w, "Token not valid for this stream", http.StatusForbidden)
 			return
 		}
-	}
 
-	// Build internal Owncast URL
-	owncastURL := strings.TrimSuffix(stream.OwncastURL, "/") + "/hls/" + hlsPath
+		// Enforce viewer cap - playlist reloads keep an admitted viewer's seat alive
+		if stream.MaxViewers > 0 {
+			result, err := h.admission.AdmitSession(ctx, stream, token, session)
+			if err != nil {
+				log.Error().Err(err).Str("stream_id", streamID).Msg("Seat admission failed")
+				http.Error(w, "Failed to check stream capacity", http.StatusInternalServerError)
+				return
+			}
+			if !result.Admitted {
+				http.Error(w, "Stream is full", http.StatusServiceUnavailable)
+				return
+			}
+		}
 
-	if isPlaylist {
-		h.servePlaylist(w, r, stream, owncastURL, token, hlsPath)
-	} else {
-		h.serveSegment(w, r, owncastURL)
+		if stream.WatermarkURL != "" {
+			mark = watermarkCodeword(session)
+		}
+	} else if err := h.signer.VerifyURLFromRequest(stream.ID.String(), withQuery(r.URL.Path, upstreamQuery(r.URL.RawQuery)), r.URL.Query()); err != nil {
+		log.Debug().
+			Err(err).
+			Str("stream_id", streamID).
+			Str("path", hlsPath).
+			Msg("Rejected segment request")
+		http.Error(w, "Invalid or expired segment URL", http.StatusForbidden)
+		return
 	}
-}
 
-// servePlaylist fetches and rewrites an HLS playlist
-func (h *StreamHandler) servePlaylist(w http.ResponseWriter, r *http.Request, stream *models.Stream, owncastURL, token string, hlsPath string) {
-	streamID := stream.ID.String()
+	if isPlaylist {
+		// Build internal Owncast URL
+		owncastURL := strings.TrimSuffix(stream.OwncastURL, "/") + "/hls/" + hlsPath
+		h.servePlaylist(w, r, stream, owncastURL, token, hlsPath, mark)
+		return
+	}
 
-	// Check rewritten playlist cache first (per-token cache)
-	// This avoids re-running the rewrite for the same user's repeated requests
-	rewrittenKey := streamID + ":" + token + ":" + hlsPath
-	if entry, ok := h.rewrittenCache.Load(rewrittenKey); ok {
-		e := entry.(*playlistCacheEntry)
-		if time.Now().Before(e.expiresAt) {
-			// Cache hit - serve directly
-			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-			w.Write([]byte(e.content))
+	owncastURL, ok := upstreamSegmentURL(stream, hlsPath)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	owncastURL = withQuery(owncastURL, upstreamQuery(r.URL.RawQuery))
+
+	// Encrypt media with the key of the period the playlist listed it in
+	var key, iv []byte
+	if h.encrypting() && m3u8.IsMedia(hlsPath) {
+		epoch, err := strconv.ParseInt(r.URL.Query().Get("key"), 10, 64)
+		if err != nil || !h.keys.IsCurrent(epoch, time.Now()) {
+			http.Error(w, "Invalid or expired segment URL", http.StatusForbidden)
 			return
 		}
-		h.rewrittenCache.Delete(rewrittenKey)
-	}
-
-	// Determine the base directory for this playlist (for relative URL resolution)
-	baseDir := ""
-	if idx := strings.LastIndex(hlsPath, "/"); idx > 0 {
-		baseDir = hlsPath[:idx+1] // Include trailing slash
+		key = h.keys.Key(stream.ID.String(), token, epoch)
+		iv = security.SegmentIV(r.URL.Path)
 	}
+	h.serveSegment(w, r, stream.ID.String(), owncastURL, key, iv)
+}
 
-	// Try to get original playlist from cache (reduces load on Owncast for concurrent viewers)
-	var originalPlaylist string
-	if entry, ok := h.playlistCache.Load(owncastURL); ok {
-		e := entry.(*playlistCacheEntry)
-		if time.Now().Before(e.expiresAt) {
-			originalPlaylist = e.content
-		} else {
-			h.playlistCache.Delete(owncastURL)
+// upstreamSegmentURL returns the Owncast URL of a segment
+// Watermarked segments come from the B rendition; false means the stream has none.
+func upstreamSegmentURL(stream *models.Stream, hlsPath string) (string, bool) {
+	if variantPath, ok := strings.CutPrefix(hlsPath, watermarkVariantPrefix); ok {
+		if stream.WatermarkURL == "" {
+			return "", false
 		}
+		return stream.WatermarkURL + "/hls/" + variantPath, true
 	}
+	return strings.TrimSuffix(stream.OwncastURL, "/") + "/hls/" + hlsPath, true
+}
 
-	// If not in cache, fetch from Owncast using singleflight to deduplicate concurrent requests
-	if originalPlaylist == "" {
-		result, err, _ := h.playlistFlight.Do(owncastURL, func() (interface{}, error) {
-			// Double-check cache (another goroutine might have populated it)
-			if entry, ok := h.playlistCache.Load(owncastURL); ok {
-				e := entry.(*playlistCacheEntry)
-				if time.Now().Before(e.expiresAt) {
-					return e.content, nil
-				}
-			}
-
-			resp, err := h.client.Get(owncastURL)
-			if err != nil {
-				return nil, err
-			}
-			defer resp.Body.Close()
+// servePlaylist fetches and rewrites an HLS playlist
+// mark is the viewer's watermark codeword, nil when the stream is not watermarked.
+// LL-HLS blocking reloads (_HLS_msn, _HLS_part) are held until the playlist has what they wait for.
+func (h *StreamHandler) servePlaylist(w http.ResponseWriter, r *http.Request, stream *models.Stream, owncastURL, token string, hlsPath string, mark []byte) {
+	streamID := stream.ID.String()
 
-			if resp.StatusCode != http.StatusOK {
-				return nil, fmt.Errorf("owncast returned status %d", resp.StatusCode)
-			}
+	// The player's device ID is passed on to the key URLs, which need it
+	device := r.URL.Query().Get("device")
 
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, err
-			}
-			content := string(body)
+	reload, err := m3u8.ParseBlockingReload(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid _HLS_msn or _HLS_part", http.StatusBadRequest)
+		return
+	}
 
-			// Cache for 4 seconds (HLS segments are typically 2-6 seconds)
-			h.playlistCache.Store(owncastURL, &playlistCacheEntry{
-				content:   content,
-				expiresAt: time.Now().Add(4 * time.Second),
-			})
+	// Check rewritten playlist cache first (per-token cache)
+	// This avoids re-running the rewrite for the same user's repeated requests
+	rewrittenKey := streamID + ":" + token + ":" + device + ":" + hlsPath
+	if reload != nil {
+		rewrittenKey += "?" + reload.Query()
+	}
+	if e, ok := h.rewrittenCache.Get(rewrittenKey); ok {
+		// Cache hit - serve directly
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Write([]byte(e.content))
+		return
+	}
 
-			return content, nil
-		})
+	// References in the playlist are resolved against its upstream URL
+	root := strings.TrimSuffix(stream.OwncastURL, "/") + "/hls/"
 
-		if err != nil {
-			log.Error().Err(err).Str("url", owncastURL).Msg("Failed to fetch playlist")
-			http.Error(w, "Failed to fetch stream", http.StatusBadGateway)
+	original, err := h.fetchPlaylist(r.Context(), streamID, owncastURL)
+	if err != nil {
+		log.Error().Err(err).Str("url", owncastURL).Msg("Failed to fetch playlist")
+		http.Error(w, "Failed to fetch stream", http.StatusBadGateway)
+		return
+	}
+	if reload != nil {
+		original, err = h.waitForPlaylist(r.Context(), streamID, owncastURL, original, reload)
+		switch {
+		case errors.Is(err, errReloadTooFar):
+			http.Error(w, "Requested segment is too far ahead", http.StatusBadRequest)
+			return
+		case errors.Is(err, errReloadTimeout):
+			http.Error(w, "Requested segment is not available", http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			if r.Context().Err() == nil {
+				log.Error().Err(err).Str("url", owncastURL).Msg("Failed to fetch playlist")
+				http.Error(w, "Failed to fetch stream", http.StatusBadGateway)
+			}
 			return
 		}
-		originalPlaylist = result.(string)
 	}
 
 	// Rewrite playlist with token URLs
-	rewritten, err := h.rewritePlaylist(strings.NewReader(originalPlaylist), streamID, token, baseDir)
+	rewritten, err := h.rewritePlaylist(strings.NewReader(original.content), streamID, token, device, owncastURL, root, mark)
+	if errors.Is(err, errUpstreamReference) {
+		log.Error().Err(err).Str("stream_id", streamID).Str("url", owncastURL).Msg("Refusing upstream playlist")
+		http.Error(w, "Failed to fetch stream", http.StatusBadGateway)
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to rewrite playlist")
 		http.Error(w, "Failed to process stream", http.StatusInternalServerError)
 		return
 	}
 
-	// Cache the rewritten playlist for this token (reduces rewrite operations)
-	h.rewrittenCache.Store(rewrittenKey, &playlistCacheEntry{
+	// Cache the rewritten playlist for this token as long as the original is cached
+	h.rewrittenCache.Set(rewrittenKey, streamID, &playlistCacheEntry{
 		content:   rewritten,
-		expiresAt: time.Now().Add(4 * time.Second),
-	})
+		expiresAt: original.expiresAt,
+	}, int64(len(rewritten)), time.Until(original.expiresAt))
 
 	// Set headers
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
@@ -289,125 +508,499 @@ func (h *StreamHandler) servePlaylist(w http.ResponseWriter, r *http.Request, st
 	w.Write([]byte(rewritten))
 }
 
-// rewritePlaylist rewrites all URLs in an HLS playlist to point to our proxy
-// baseDir is the directory prefix for relative URLs (e.g., "0/" for variant playlists)
-func (h *StreamHandler) rewritePlaylist(body io.Reader, streamID, token, baseDir string) (string, error) {
-	var result strings.Builder
-	scanner := bufio.NewScanner(body)
+// fetchPlaylist returns an upstream playlist from the cache, or fetches it from Owncast
+// using singleflight to deduplicate concurrent requests (reduces load on Owncast for concurrent viewers)
+func (h *StreamHandler) fetchPlaylist(ctx context.Context, streamID, upstreamURL string) (*playlistCacheEntry, error) {
+	if e, ok := h.playlistCache.Get(upstreamURL); ok {
+		return e, nil
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	result, err, shared := h.playlistFlight.Do(upstreamURL, func() (interface{}, error) {
+		// Double-check cache (another goroutine might have populated it)
+		if e, ok := h.playlistCache.Get(upstreamURL); ok {
+			return e, nil
+		}
 
-		// Check if this line is a URL (segment or nested playlist)
-		if hlsURLRegex.MatchString(line) {
-			// Extract the filename/path
-			originalPath := line
-			
-			// Remove any existing query params
-			if idx := strings.Index(originalPath, "?"); idx != -1 {
-				originalPath = originalPath[:idx]
-			}
-			
-			// Handle relative paths - prepend the base directory
-			if !strings.HasPrefix(originalPath, "/") && !strings.HasPrefix(originalPath, "http") {
-				originalPath = baseDir + originalPath
+		object, ttl, err := h.fetchOrigin(ctx, upstreamURL, func() (*storage.OriginObject, time.Duration, error) {
+			return h.downloadPlaylist(upstreamURL)
+		})
+		if err != nil {
+			return nil, err
+		}
+		content := string(object.Data)
+
+		entry := &playlistCacheEntry{
+			content:   content,
+			expiresAt: time.Now().Add(ttl),
+		}
+		h.playlistCache.Set(upstreamURL, streamID, entry, int64(len(content)), ttl)
+		return entry, nil
+	})
+	if shared && errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		// The viewer whose request ran the shared fetch left; fetch again for this one
+		return h.fetchPlaylist(ctx, streamID, upstreamURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.(*playlistCacheEntry), nil
+}
+
+// downloadPlaylist fetches a playlist from Owncast, returning it with how long it is cached
+func (h *StreamHandler) downloadPlaylist(upstreamURL string) (*storage.OriginObject, time.Duration, error) {
+	resp, err := h.client.Get(upstreamURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("owncast returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	object := &storage.OriginObject{
+		ContentType: "application/vnd.apple.mpegurl",
+		Data:        body,
+	}
+	return object, playlistCacheTTL(string(body)), nil
+}
+
+// playlistCacheTTL returns how long an upstream playlist is cached
+// 4 seconds for regular playlists (HLS segments are typically 2-6 seconds);
+// LL-HLS playlists only for half a part, so new parts show up promptly.
+func playlistCacheTTL(content string) time.Duration {
+	playlist, err := m3u8.Parse(strings.NewReader(content))
+	if err != nil {
+		return 4 * time.Second
+	}
+	if partTarget := playlist.PartTarget(); partTarget > 0 {
+		return max(partTarget/2, minLowLatencyCacheTTL)
+	}
+	return 4 * time.Second
+}
+
+// waitForPlaylist holds a blocking reload until the playlist satisfies it
+// The request is passed on to Owncast, which answers when the part exists if
+// it supports blocking reloads; otherwise the playlist is polled. Either way,
+// every viewer waiting for the same part shares the upstream requests.
+func (h *StreamHandler) waitForPlaylist(ctx context.Context, streamID, owncastURL string, current *playlistCacheEntry, reload *m3u8.BlockingReload) (*playlistCacheEntry, error) {
+	playlist, err := m3u8.Parse(strings.NewReader(current.content))
+	if err != nil {
+		return nil, err
+	}
+	if playlist.Satisfies(reload) {
+		return current, nil
+	}
+	if reload.MSN > playlist.LastSequence()+2 {
+		return nil, errReloadTooFar
+	}
+
+	timeout := defaultReloadTimeout
+	if target := playlist.TargetDuration(); target > 0 {
+		timeout = 3 * target
+	}
+	deadline := time.Now().Add(timeout)
+	blockingURL := owncastURL + "?" + reload.Query()
+
+	for {
+		entry, err := h.fetchPlaylist(ctx, streamID, blockingURL)
+		if err != nil {
+			return nil, err
+		}
+		playlist, err := m3u8.Parse(strings.NewReader(entry.content))
+		if err != nil {
+			return nil, err
+		}
+		if playlist.Satisfies(reload) {
+			return entry, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errReloadTimeout
+		}
+
+		// Poll again once the cached copy expires
+		wait := max(time.Until(entry.expiresAt), minLowLatencyCacheTTL)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// rewritePlaylist rewrites every URI in an HLS playlist to point to our proxy
+// References are resolved against playlistURL; those below root (the upstream
+// /hls/ directory) are proxied, keeping their query, and those on other hosts
+// are left as they are. A reference to the upstream host outside root fails
+// the rewrite rather than hand viewers an internal address.
+// When encryption is enabled, each media resource is preceded by an EXT-X-KEY tag for
+// the session's key of the current rotation period. With a watermark mark, each
+// segment is taken from rendition A or B by the mark's bit for its media sequence number.
+func (h *StreamHandler) rewritePlaylist(body io.Reader, streamID, token, device, playlistURL, root string, mark []byte) (string, error) {
+	playlist, err := m3u8.Parse(body)
+	if err != nil {
+		return "", err
+	}
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return "", err
+	}
+	rootURL, err := url.Parse(root)
+	if err != nil {
+		return "", err
+	}
+
+	deviceParam := ""
+	if device != "" {
+		deviceParam = "&device=" + url.QueryEscape(device)
+	}
+	epoch := int64(0)
+	if h.encrypting() {
+		epoch = h.keys.Epoch(time.Now())
+	}
+
+	rewritten := &m3u8.Playlist{Lines: make([]*m3u8.Line, 0, len(playlist.Lines))}
+	for _, line := range playlist.Lines {
+		// Partial segments cannot be decrypted on their own, so encrypted streams are served without LL-HLS
+		if h.encrypting() && m3u8.IsLowLatency(line) {
+			continue
+		}
+
+		ref, ok := line.Reference()
+		if !ok {
+			rewritten.Lines = append(rewritten.Lines, line)
+			continue
+		}
+		resolved := m3u8.Resolve(rootURL, base, ref)
+		switch resolved.Location {
+		case m3u8.ExternalHost:
+			// Served by a third party, not through the proxy
+			rewritten.Lines = append(rewritten.Lines, line)
+			continue
+		case m3u8.UpstreamHost, m3u8.Invalid:
+			return "", fmt.Errorf("%w: %q", errUpstreamReference, ref)
+		}
+		hlsPath := resolved.Path
+
+		proxyPath := "/stream/" + streamID + "/hls/" + hlsPath
+		if line.Kind == m3u8.KindPlaylist {
+			// Nested playlists are validated via Redis on every request. Their query
+			// is not passed on: it is not signed, so viewers could vary it to get
+			// past the playlist cache.
+			line.SetReference(proxyPath + "?token=" + token + deviceParam)
+			rewritten.Lines = append(rewritten.Lines, line)
+			continue
+		}
+
+		if (line.Kind == m3u8.KindSegment || line.Kind == m3u8.KindPart) && mark != nil && m3u8.IsMedia(hlsPath) && watermark.Bit(mark, line.Sequence) == 1 {
+			proxyPath = "/stream/" + streamID + "/hls/" + watermarkVariantPrefix + hlsPath
+		}
+
+		// The upstream query is signed with the path, so viewers cannot change what is fetched
+		resourcePath := withQuery(proxyPath, upstreamQuery(resolved.RawQuery))
+
+		if h.edge != nil && m3u8.IsMedia(hlsPath) {
+			edgeURL, err := h.edgeURL(streamID, resourcePath)
+			if err != nil {
+				return "", err
 			}
-			
-			// Build the proxy URL with token (no signature needed - validated via Redis)
-			proxyPath := "/stream/" + streamID + "/hls/" + originalPath + "?token=" + token
+			line.SetReference(edgeURL)
+			rewritten.Lines = append(rewritten.Lines, line)
+			continue
+		}
 
-			result.WriteString(proxyPath)
-		} else {
-			result.WriteString(line)
+		signedURL := h.signer.SignURL(streamID, token, resourcePath)
+		if h.encrypting() && m3u8.IsMedia(hlsPath) {
+			keyURI := fmt.Sprintf("/stream/%s/key/%d?token=%s%s", streamID, epoch, token, deviceParam)
+			rewritten.Lines = append(rewritten.Lines, m3u8.NewTag("EXT-X-KEY",
+				m3u8.Attribute{Name: "METHOD", Value: "AES-128"},
+				m3u8.Attribute{Name: "URI", Value: keyURI, Quoted: true},
+				m3u8.Attribute{Name: "IV", Value: "0x" + hex.EncodeToString(security.SegmentIV(proxyPath))},
+			))
+			signedURL += "&key=" + strconv.FormatInt(epoch, 10)
 		}
-		result.WriteString("\n")
+		line.SetReference(signedURL)
+		rewritten.Lines = append(rewritten.Lines, line)
 	}
-	
-	if err := scanner.Err(); err != nil {
+
+	return rewritten.String(), nil
+}
+
+// edgeURL returns the CDN URL of a proxied media resource, signed for the CDN
+// Expiry times are rounded up to a multiple of the signature validity, so every
+// viewer gets the same URL for a resource for a while and it is signed once
+// rather than on every playlist reload; CloudFront's RSA signatures would be
+// too slow to compute per viewer.
+func (h *StreamHandler) edgeURL(streamID, proxyPath string) (string, error) {
+	validity := h.cfg.SignatureValidity
+	now := time.Now()
+	expires := now.Add(validity).Truncate(validity).Add(validity)
+
+	key := proxyPath + "@" + strconv.FormatInt(expires.Unix(), 10)
+	if signed, ok := h.edgeURLs.Get(key); ok {
+		return signed, nil
+	}
+	signed, err := h.edge.Sign(h.cfg.CDNBaseURL+proxyPath, expires)
+	if err != nil {
 		return "", err
 	}
-	
-	return result.String(), nil
+	// Handed out while it is valid for at least the signature validity
+	h.edgeURLs.Set(key, streamID, signed, int64(len(signed)), expires.Sub(now)-validity)
+	return signed, nil
 }
 
 // serveSegment proxies a video segment from Owncast with server-side caching
-func (h *StreamHandler) serveSegment(w http.ResponseWriter, r *http.Request, owncastURL string) {
+// The cache holds plain segments shared by all viewers; a non-nil key encrypts
+// the copy sent to this viewer. On a cache miss, one download is shared by every
+// viewer requesting the segment, and plain copies are streamed to them as the
+// bytes arrive, so LL-HLS partial segments are not held back until complete.
+func (h *StreamHandler) serveSegment(w http.ResponseWriter, r *http.Request, streamID, owncastURL string, key, iv []byte) {
 	// Try to get segment from cache (reduces load on Owncast for concurrent viewers)
-	if entry, ok := h.segmentCache.Load(owncastURL); ok {
-		e := entry.(*segmentCacheEntry)
-		if time.Now().Before(e.expiresAt) {
-			// Cache hit - serve from memory
-			w.Header().Set("Content-Type", e.contentType)
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(e.data)))
-			w.Header().Set("Cache-Control", "public, max-age=86400")
-			w.Write(e.data)
-			return
-		}
-		// Expired, delete it
-		h.segmentCache.Delete(owncastURL)
+	if e, ok := h.segmentCache.Get(owncastURL); ok {
+		// Cache hit - serve from memory
+		h.writeSegment(w, e, key, iv)
+		return
 	}
 
-	// Cache miss - use singleflight to deduplicate concurrent fetches
-	// When 10,000 viewers request the same new segment simultaneously,
-	// only ONE request fetches from Owncast, others wait and share the result
-	result, err, _ := h.segmentFlight.Do(owncastURL, func() (interface{}, error) {
-		// Double-check cache (another goroutine might have populated it)
-		if entry, ok := h.segmentCache.Load(owncastURL); ok {
-			e := entry.(*segmentCacheEntry)
-			if time.Now().Before(e.expiresAt) {
-				return e, nil
+	// Cache miss - when 10,000 viewers request the same new segment simultaneously,
+	// only ONE request fetches from Owncast, others join it
+	fetch := h.segmentFetches.join(owncastURL, func(f *segmentFetch) {
+		h.fetchSegment(streamID, owncastURL, f)
+	})
+
+	offset := 0
+	wroteHeader := false
+	flusher, _ := w.(http.Flusher)
+	for {
+		state := fetch.read(offset)
+
+		if state.err != nil {
+			log.Error().Err(state.err).Str("url", owncastURL).Msg("Failed to fetch segment")
+			if wroteHeader {
+				// Abort so the player sees a failed download rather than a short segment
+				panic(http.ErrAbortHandler)
 			}
+			http.Error(w, "Failed to fetch segment", http.StatusBadGateway)
+			return
 		}
 
-		// Fetch from Owncast
-		resp, err := h.client.Get(owncastURL)
-		if err != nil {
-			return nil, err
+		// Encryption needs the whole segment
+		if key != nil {
+			if state.done {
+				h.writeSegment(w, &segmentCacheEntry{data: state.chunk, contentType: state.contentType}, key, iv)
+				return
+			}
+		} else if state.started {
+			if !wroteHeader {
+				w.Header().Set("Content-Type", state.contentType)
+				w.Header().Set("Cache-Control", "public, max-age=86400")
+				wroteHeader = true
+			}
+			if len(state.chunk) > 0 {
+				w.Write(state.chunk)
+				offset += len(state.chunk)
+			}
+			if state.done {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("owncast returned status %d", resp.StatusCode)
+		select {
+		case <-state.updated:
+		case <-r.Context().Done():
+			return
 		}
+	}
+}
+
+// fetchSegment fetches a segment into f and caches it once complete
+func (h *StreamHandler) fetchSegment(streamID, owncastURL string, f *segmentFetch) {
+	// Double-check cache (a fetch that just finished might have populated it)
+	if e, ok := h.segmentCache.Get(owncastURL); ok {
+		f.start(e.contentType)
+		f.write(e.data)
+		f.finish(nil)
+		return
+	}
 
-		// Read the segment into memory
-		data, err := io.ReadAll(resp.Body)
+	// The fetch is shared by every viewer that joins it, so no one request's context bounds it
+	object, _, err := h.fetchOrigin(context.Background(), owncastURL, func() (*storage.OriginObject, time.Duration, error) {
+		return h.downloadSegment(owncastURL, f)
+	})
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	if !f.read(0).started {
+		// Fetched by another instance, so nothing was streamed yet
+		f.start(object.ContentType)
+		f.write(object.Data)
+	}
+
+	// Cache if under 5MB, before the fetch ends so no request misses both
+	if len(object.Data) < maxCachedSegmentSize {
+		h.segmentCache.Set(owncastURL, streamID, &segmentCacheEntry{
+			data:        object.Data,
+			contentType: object.ContentType,
+		}, int64(len(object.Data)), segmentCacheTTL)
+	}
+	f.finish(nil)
+}
+
+// downloadSegment streams a segment from Owncast into f as it arrives
+// The complete segment is returned with how long it is cached, 0 if it is too large.
+func (h *StreamHandler) downloadSegment(owncastURL string, f *segmentFetch) (*storage.OriginObject, time.Duration, error) {
+	resp, err := h.client.Get(owncastURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("owncast returned status %d", resp.StatusCode)
+	}
+
+	// Determine content type
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = m3u8.ContentType(owncastURL)
+	}
+	f.start(contentType)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			f.write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
+	}
 
-		// Determine content type
-		contentType := resp.Header.Get("Content-Type")
-		if contentType == "" {
-			contentType = "video/mp2t"
-		}
+	object := &storage.OriginObject{ContentType: contentType, Data: f.read(0).chunk}
+	if len(object.Data) >= maxCachedSegmentSize {
+		return object, 0, nil
+	}
+	return object, segmentCacheTTL, nil
+}
 
-		entry := &segmentCacheEntry{
-			data:        data,
-			contentType: contentType,
-			expiresAt:   time.Now().Add(30 * time.Second),
-		}
+// watermarkCodeword returns the watermark that identifies a session's payment or membership
+func watermarkCodeword(session *storage.SessionData) []byte {
+	id := session.PaymentID
+	if id == "" {
+		id = session.SubscriptionID
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil
+	}
+	return watermark.Codeword(parsed)
+}
 
-		// Cache if under 5MB
-		if len(data) < 5*1024*1024 {
-			h.segmentCache.Store(owncastURL, entry)
+// writeSegment writes a segment, encrypted with key when it is not nil
+func (h *StreamHandler) writeSegment(w http.ResponseWriter, entry *segmentCacheEntry, key, iv []byte) {
+	data := entry.data
+	cacheControl := "public, max-age=86400"
+	if key != nil {
+		encrypted, err := security.EncryptSegment(key, iv, data)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to encrypt segment")
+			http.Error(w, "Failed to process segment", http.StatusInternalServerError)
+			return
 		}
+		data = encrypted
+		cacheControl = "private, max-age=86400" // Encrypted for one session
+	}
 
-		return entry, nil
-	})
+	w.Header().Set("Content-Type", entry.contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Write(data)
+}
+
+// ServeKey hands out a segment encryption key
+// Only a live session for the stream gets it, on the device currently watching.
+// GET /stream/{id}/key/{epoch}?token=...&device=...
+func (h *StreamHandler) ServeKey(w http.ResponseWriter, r *http.Request) {
+	if !h.encrypting() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 
+	streamUUID, err := uuid.Parse(r.PathValue("id"))
 	if err != nil {
-		log.Error().Err(err).Str("url", owncastURL).Msg("Failed to fetch segment")
-		http.Error(w, "Failed to fetch segment", http.StatusBadGateway)
+		http.Error(w, "Invalid stream ID", http.StatusBadRequest)
+		return
+	}
+	epoch, err := strconv.ParseInt(r.PathValue("epoch"), 10, 64)
+	if err != nil || !h.keys.IsCurrent(epoch, time.Now()) {
+		http.Error(w, "Key expired", http.StatusForbidden)
 		return
 	}
 
-	// Serve the segment from the result
-	entry := result.(*segmentCacheEntry)
-	w.Header().Set("Content-Type", entry.contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(entry.data)))
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	w.Write(entry.data)
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+	deviceID := r.URL.Query().Get("device")
+	if deviceID == "" {
+		deviceID = r.Header.Get("X-Device-ID")
+	}
+	if deviceID == "" {
+		http.Error(w, "Missing device ID", http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+
+	stream, err := h.getStreamCached(ctx, streamUUID)
+	if err != nil || stream == nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+
+	session, err := h.redis.GetSession(ctx, token)
+	if err != nil || session == nil {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	granted, err := h.entitlements.SessionGrants(ctx, session, stream)
+	if err != nil {
+		log.Error().Err(err).Str("stream_id", stream.ID.String()).Msg("Failed to check stream access")
+		http.Error(w, "Failed to check access", http.StatusInternalServerError)
+		return
+	}
+	if !granted {
+		http.Error(w, "Token not valid for this stream", http.StatusForbidden)
+		return
+	}
+
+	result, err := h.sessionManager.ValidateDevice(ctx, token, deviceID, getClientIP(r), r.Header.Get("User-Agent"))
+	if err != nil {
+		log.Error().Err(err).Str("token", token[:8]+"...").Msg("Device validation error")
+		http.Error(w, "Device validation failed", http.StatusInternalServerError)
+		return
+	}
+	if !result.Allowed {
+		http.Error(w, "Another device is currently watching this stream", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(h.keys.Key(stream.ID.String(), token, epoch))
 }
 
 // GetStreamInfo returns public stream information
@@ -435,6 +1028,39 @@ func (h *StreamHandler) GetStreamInfo(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, stream)
 }
 
+// GetBroadcastStatus tells the player whether a stream is broadcasting
+// The watch page polls it while the broadcast has not started or is paused.
+// GET /api/streams/{slug}/broadcast
+func (h *StreamHandler) GetBroadcastStatus(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	ctx := r.Context()
+	stream, err := h.pgStore.GetStreamBySlug(ctx, slug)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("Failed to get stream")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get stream")
+		return
+	}
+	if stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	state, err := h.redis.GetBroadcastState(ctx, stream.ID)
+	if err != nil {
+		log.Warn().Err(err).Str("slug", slug).Msg("Failed to get broadcast state")
+	}
+	title := ""
+	if state != nil {
+		title = state.Title
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": stream.Status,
+		"on_air": broadcastOnAir(stream, state),
+		"title":  title,
+	})
+}
+
 // ListStreams returns all available streams
 // GET /api/streams
 func (h *StreamHandler) ListStreams(w http.ResponseWriter, r *http.Request) {
@@ -492,28 +1118,36 @@ func (h *StreamHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify stream ID matches
-	if streamID != session.StreamID {
-		writeJSONError(w, http.StatusForbidden, "Token not valid for this stream")
+	// Parse stream UUID for active session tracking
+	streamUUID, err := uuid.Parse(streamID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid stream ID")
 		return
 	}
 
-	// Parse stream UUID for active session tracking
-	streamUUID, err := uuid.Parse(session.StreamID)
+	stream, err := h.getStreamCached(ctx, streamUUID)
+	if err != nil || stream == nil {
+		writeJSONError(w, http.StatusNotFound, "Stream not found")
+		return
+	}
+
+	// Verify token is for this stream, directly or through a bundle
+	granted, err := h.entitlements.SessionGrants(ctx, session, stream)
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "Invalid stream ID in session")
+		log.Error().Err(err).Str("stream_id", streamID).Msg("Failed to check stream access")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check access")
+		return
+	}
+	if !granted {
+		writeJSONError(w, http.StatusForbidden, "Token not valid for this stream")
 		return
 	}
 
 	// Validate device if device ID is provided
 	if req.DeviceID != "" {
-		ip := r.RemoteAddr
-		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-			ip = forwarded
-		}
 		userAgent := r.Header.Get("User-Agent")
 
-		result, err := h.sessionManager.ValidateDevice(ctx, token, req.DeviceID, ip, userAgent)
+		result, err := h.sessionManager.ValidateDevice(ctx, token, req.DeviceID, getClientIP(r), userAgent)
 		if err != nil {
 			log.Error().Err(err).Str("token", token[:8]+"...").Msg("Device validation error")
 			writeJSONError(w, http.StatusInternalServerError, "Device validation failed")
@@ -532,19 +1166,40 @@ func (h *StreamHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Take or keep a viewer seat (also tracks the session for viewer counts)
+	admission, err := h.admission.AdmitViewer(ctx, stream, token)
+	if err != nil {
+		log.Error().Err(err).Str("stream_id", streamID).Msg("Seat admission failed")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check stream capacity")
+		return
+	}
+	if !admission.Admitted {
+		log.Warn().
+			Str("stream_id", streamID).
+			Int64("active_viewers", admission.ActiveViewers).
+			Int("max_viewers", admission.MaxViewers).
+			Msg("Viewer rejected - stream is full")
+		writeJSONError(w, http.StatusServiceUnavailable, "This stream is full. Please try again later.")
+		return
+	}
+
 	// Refresh session TTL
 	h.redis.RefreshSession(ctx, token, h.cfg.SessionDuration)
 
-	// Track active session for viewer count (TTL slightly longer than heartbeat interval)
-	h.redis.TrackActiveSession(ctx, streamUUID, token, 45*time.Second)
-
 	// Generate playlist URL for the client (token validated via Redis, no signature needed)
 	playlistURL := fmt.Sprintf("%s/stream/%s/hls/stream.m3u8?token=%s", h.cfg.BaseURL, streamID, token)
 
+	// Tell the player when the broadcast pauses, so viewers are not left with a frozen picture
+	state, err := h.redis.GetBroadcastState(ctx, streamUUID)
+	if err != nil {
+		log.Warn().Err(err).Str("stream_id", streamID).Msg("Failed to get broadcast state")
+	}
+
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"success":      true,
 		"message":      "Heartbeat received",
 		"playlist_url": playlistURL,
+		"on_air":       broadcastOnAir(stream, state),
 	})
 }
 
@@ -573,14 +1228,20 @@ func (h *StreamHandler) GetPlaylistURL(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Validate token
-	payment, err := h.pgStore.GetPaymentByAccessToken(ctx, token)
-	if err != nil || payment == nil || !payment.IsTokenValid() {
+	session, err := h.entitlements.ResolveToken(ctx, token)
+	if err != nil || session == nil {
 		writeJSONError(w, http.StatusUnauthorized, "Invalid or expired token")
 		return
 	}
 	
-	// Verify token is for this stream
-	if payment.StreamID != stream.ID {
+	// Verify token is for this stream, directly, through a bundle or a membership
+	granted, err := h.entitlements.SessionGrants(ctx, session, stream)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("Failed to check stream access")
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check access")
+		return
+	}
+	if !granted {
 		writeJSONError(w, http.StatusForbidden, "Token not valid for this stream")
 		return
 	}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/security"
+)
+
+const testPlaylist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:2.0,
+seg10.ts
+#EXTINF:2.0,
+seg11.ts
+`
+
+// fakeOwncast serves testPlaylist and a segment for any other path, counting requests
+type fakeOwncast struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newFakeOwncast(t *testing.T) *fakeOwncast {
+	t.Helper()
+	f := &fakeOwncast{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests.Add(1)
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			w.Write([]byte(testPlaylist))
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write([]byte("segment " + r.URL.RequestURI()))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// newTestStreamHandler returns a handler with a cached live stream whose Owncast is at owncastURL
+// There is no database or Redis, which segment requests and playlist rewriting do not need.
+func newTestStreamHandler(t *testing.T, cfg *config.Config, owncastURL string) (*StreamHandler, *models.Stream) {
+	t.Helper()
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	cfg.SigningSecret = "test-signing-secret"
+	if cfg.SignatureValidity == 0 {
+		cfg.SignatureValidity = 30 * time.Second
+	}
+	cfg.SegmentCacheMB = 8
+	cfg.PlaylistCacheMB = 8
+
+	h, err := NewStreamHandler(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &models.Stream{
+		ID:         uuid.New(),
+		Status:     models.StreamStatusLive,
+		OwncastURL: owncastURL,
+	}
+	h.streamCache.Store(stream.ID, &streamCacheEntry{stream: stream, expiresAt: time.Now().Add(time.Hour)})
+	return h, stream
+}
+
+// rewriteTestPlaylist rewrites testPlaylist as served from the stream's Owncast
+func rewriteTestPlaylist(t *testing.T, h *StreamHandler, stream *models.Stream, token string) []string {
+	t.Helper()
+	refs, err := rewriteReferences(h, stream, token, testPlaylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+// rewriteReferences rewrites a playlist served from the stream's Owncast at /hls/0/stream.m3u8
+// and returns the references in it
+func rewriteReferences(h *StreamHandler, stream *models.Stream, token, content string) ([]string, error) {
+	root := stream.OwncastURL + "/hls/"
+	rewritten, err := h.rewritePlaylist(strings.NewReader(content), stream.ID.String(), token, "", root+"0/stream.m3u8", root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, line := range strings.Split(rewritten, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			refs = append(refs, line)
+		}
+	}
+	return refs, nil
+}
+
+// getHLS requests target from the handler and returns the response
+func getHLS(h *StreamHandler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHLS(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestRewritePlaylistSignsSegments(t *testing.T) {
+	owncast := newFakeOwncast(t)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+
+	refs := rewriteTestPlaylist(t, h, stream, "viewer-token")
+	if len(refs) != 2 {
+		t.Fatalf("rewritten references = %v, want two segments", refs)
+	}
+
+	for i, ref := range refs {
+		u, err := url.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment := fmt.Sprintf("0/seg%d.ts", 10+i)
+		wantPath := "/stream/" + stream.ID.String() + "/hls/" + segment
+		if u.Path != wantPath {
+			t.Errorf("segment path = %s, want %s", u.Path, wantPath)
+		}
+		if u.Query().Get("token") != "viewer-token" || u.Query().Get("sig") == "" || u.Query().Get("expires") == "" {
+			t.Errorf("segment URL %s is not signed for the viewer", ref)
+		}
+		if err := h.signer.VerifyURLFromRequest(stream.ID.String(), u.Path, u.Query()); err != nil {
+			t.Errorf("segment URL %s does not verify: %v", ref, err)
+		}
+
+		rec := getHLS(h, ref)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d, want 200", ref, rec.Code)
+		}
+		if body := rec.Body.String(); body != "segment /hls/"+segment {
+			t.Errorf("GET %s body = %q", ref, body)
+		}
+	}
+}
+
+func TestServeHLSRejectsUnsignedSegments(t *testing.T) {
+	owncast := newFakeOwncast(t)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+	refs := rewriteTestPlaylist(t, h, stream, "viewer-token")
+	signed, _ := url.Parse(refs[0])
+	other, _ := url.Parse(refs[1])
+
+	expiredSigner := security.NewURLSigner("test-signing-secret", -time.Minute)
+	expired := expiredSigner.SignURL(stream.ID.String(), "viewer-token", signed.Path)
+	foreignSigner := security.NewURLSigner("another-secret", time.Minute)
+	foreign := foreignSigner.SignURL(stream.ID.String(), "viewer-token", signed.Path)
+
+	withQuery := func(u *url.URL, key, value string) string {
+		query := u.Query()
+		query.Set(key, value)
+		return u.Path + "?" + query.Encode()
+	}
+
+	tests := map[string]string{
+		"unsigned":           signed.Path + "?token=viewer-token",
+		"tampered signature": withQuery(signed, "sig", strings.Repeat("0", 64)),
+		"other token":        withQuery(signed, "token", "someone-else"),
+		"extended expiry":    withQuery(signed, "expires", "9999999999"),
+		"other segment":      other.Path + "?" + signed.RawQuery,
+		"expired":            expired,
+		"other secret":       foreign,
+	}
+
+	for name, target := range tests {
+		if rec := getHLS(h, target); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: GET %s = %d, want 403", name, target, rec.Code)
+		}
+	}
+	if n := owncast.requests.Load(); n != 0 {
+		t.Errorf("Owncast got %d requests for rejected segments, want none", n)
+	}
+}
+
+func TestRewritePlaylistRejectsUpstreamReferences(t *testing.T) {
+	owncast := newFakeOwncast(t)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+	upstream, _ := url.Parse(owncast.URL)
+
+	refs := []string{
+		"/api/admin/config",
+		"../../admin/",
+		owncast.URL + "/hls/",
+		"http://" + upstream.Hostname() + ":1/hls/0/seg12.ts",
+	}
+	for _, ref := range refs {
+		_, err := rewriteReferences(h, stream, "viewer-token", testPlaylist+"#EXTINF:2.0,\n"+ref+"\n")
+		if !errors.Is(err, errUpstreamReference) {
+			t.Errorf("%s: error = %v, want errUpstreamReference", ref, err)
+		}
+	}
+
+	// Other hosts are left alone
+	external := "https://cdn.example.com/live/seg12.ts?tok=abc"
+	got, err := rewriteReferences(h, stream, "viewer-token", testPlaylist+"#EXTINF:2.0,\n"+external+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[len(got)-1] != external {
+		t.Errorf("external reference rewritten to %s", got[len(got)-1])
+	}
+}
+
+func TestSegmentQueryIsSignedAndPassedOn(t *testing.T) {
+	owncast := newFakeOwncast(t)
+	h, stream := newTestStreamHandler(t, nil, owncast.URL)
+
+	refs, err := rewriteReferences(h, stream, "viewer-token", testPlaylist+"#EXTINF:2.0,\nseg12.ts?v=2&part=1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := refs[len(refs)-1]
+	u, _ := url.Parse(ref)
+	if u.Query().Get("v") != "2" || u.Query().Get("part") != "1" {
+		t.Fatalf("rewritten reference %s lost the upstream query", ref)
+	}
+
+	rec := getHLS(h, ref)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d, want 200", ref, rec.Code)
+	}
+	if body := rec.Body.String(); body != "segment /hls/0/seg12.ts?part=1&v=2" {
+		t.Errorf("Owncast was asked for %q, want the upstream query", body)
+	}
+
+	// The query is covered by the signature
+	query := u.Query()
+	query.Set("v", "3")
+	if rec := getHLS(h, u.Path+"?"+query.Encode()); rec.Code != http.StatusForbidden {
+		t.Errorf("changed upstream query: GET = %d, want 403", rec.Code)
+	}
+}
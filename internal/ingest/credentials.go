@@ -0,0 +1,53 @@
+package ingest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/security"
+)
+
+// Credentials hands out the Owncast admin password of each stream
+// Streams created by a managed backend get their own generated password, stored
+// sealed with the stream. Older streams and external Owncast instances use the
+// global fallback password.
+type Credentials struct {
+	box      *security.SecretBox
+	fallback string
+}
+
+// NewCredentials creates a credential store sealing passwords with box
+func NewCredentials(box *security.SecretBox, fallback string) *Credentials {
+	return &Credentials{
+		box:      box,
+		fallback: fallback,
+	}
+}
+
+// Generate gives a new stream a random admin password
+func (c *Credentials) Generate(stream *models.Stream) error {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("failed to generate admin password: %w", err)
+	}
+	sealed, err := c.box.Seal(base64.RawURLEncoding.EncodeToString(raw))
+	if err != nil {
+		return fmt.Errorf("failed to seal admin password: %w", err)
+	}
+	stream.EncryptedAdminPassword = sealed
+	return nil
+}
+
+// AdminPassword returns the admin password of a stream's Owncast
+func (c *Credentials) AdminPassword(stream *models.Stream) (string, error) {
+	if stream.EncryptedAdminPassword == "" {
+		return c.fallback, nil
+	}
+	password, err := c.box.Open(stream.EncryptedAdminPassword)
+	if err != nil {
+		return "", fmt.Errorf("failed to open admin password of %s: %w", stream.Slug, err)
+	}
+	return password, nil
+}
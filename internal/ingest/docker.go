@@ -0,0 +1,90 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/laurikarhu/stream-paywall/internal/docker"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// DockerBackend runs each stream's Owncast in a container on the paywall's Docker host
+type DockerBackend struct {
+	mgr            *docker.Manager
+	ports          PortAllocator
+	creds          *Credentials
+	rtmpPortStart  int
+	rtmpPublicHost string
+}
+
+// NewDockerBackend creates a backend for a Docker manager
+// RTMP ports are allocated from rtmpPortStart and published on rtmpPublicHost.
+func NewDockerBackend(mgr *docker.Manager, ports PortAllocator, creds *Credentials, rtmpPortStart int, rtmpPublicHost string) *DockerBackend {
+	return &DockerBackend{
+		mgr:            mgr,
+		ports:          ports,
+		creds:          creds,
+		rtmpPortStart:  rtmpPortStart,
+		rtmpPublicHost: rtmpPublicHost,
+	}
+}
+
+// Provision implements Backend
+func (b *DockerBackend) Provision(ctx context.Context, stream *models.Stream) error {
+	streamKey, err := docker.GenerateStreamKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate stream key: %w", err)
+	}
+	rtmpPort, err := b.ports.GetNextAvailablePort(ctx, b.rtmpPortStart)
+	if err != nil {
+		return fmt.Errorf("failed to allocate RTMP port: %w", err)
+	}
+	if err := b.creds.Generate(stream); err != nil {
+		return err
+	}
+
+	stream.StreamKey = streamKey
+	stream.RTMPPort = rtmpPort
+	stream.ContainerName = docker.ContainerName(stream.Slug)
+	stream.OwncastURL = b.InternalURL(stream)
+	return nil
+}
+
+// Start implements Backend
+func (b *DockerBackend) Start(ctx context.Context, stream *models.Stream) error {
+	adminPassword := ""
+	if stream.EncryptedAdminPassword != "" {
+		password, err := b.creds.AdminPassword(stream)
+		if err != nil {
+			return err
+		}
+		adminPassword = password
+	}
+	return b.mgr.CreateAndStartContainer(ctx, stream.Slug, stream.StreamKey, adminPassword, stream.RTMPPort)
+}
+
+// Stop implements Backend
+func (b *DockerBackend) Stop(ctx context.Context, stream *models.Stream) error {
+	return b.mgr.StopContainer(ctx, stream.ContainerName)
+}
+
+// Remove implements Backend
+func (b *DockerBackend) Remove(ctx context.Context, stream *models.Stream) error {
+	return b.mgr.RemoveContainer(ctx, stream.Slug)
+}
+
+// Status implements Backend
+func (b *DockerBackend) Status(ctx context.Context, stream *models.Stream) (models.ContainerStatus, error) {
+	status, err := b.mgr.GetContainerStatus(ctx, stream.ContainerName)
+	return models.ContainerStatus(status), err
+}
+
+// InternalURL implements Backend
+func (b *DockerBackend) InternalURL(stream *models.Stream) string {
+	return docker.GetInternalURL(stream.ContainerName)
+}
+
+// RTMPURL implements Backend
+func (b *DockerBackend) RTMPURL(stream *models.Stream) string {
+	return docker.GetRTMPURL(b.rtmpPublicHost, stream.RTMPPort)
+}
@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// ExternalBackend uses an Owncast instance run outside the paywall
+// The stream's Owncast URL is given when it is created. Its RTMP endpoint and
+// stream key are configured in that Owncast, so the paywall only checks that it
+// is reachable: starting a stream fails if it is not, and stopping does nothing.
+type ExternalBackend struct {
+	client *http.Client
+}
+
+// NewExternalBackend creates a backend for externally run Owncast instances
+func NewExternalBackend() *ExternalBackend {
+	return &ExternalBackend{
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Provision implements Backend
+func (b *ExternalBackend) Provision(ctx context.Context, stream *models.Stream) error {
+	owncastURL := strings.TrimSuffix(strings.TrimSpace(stream.OwncastURL), "/")
+	if owncastURL == "" {
+		return errors.New("an Owncast URL is required for an external stream")
+	}
+	u, err := url.Parse(owncastURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid Owncast URL %q", owncastURL)
+	}
+
+	stream.OwncastURL = owncastURL
+	stream.StreamKey = ""
+	stream.RTMPPort = 0
+	stream.ContainerName = ""
+	return nil
+}
+
+// Start implements Backend
+func (b *ExternalBackend) Start(ctx context.Context, stream *models.Stream) error {
+	status, err := b.Status(ctx, stream)
+	if err != nil {
+		return err
+	}
+	if status != models.ContainerStatusRunning {
+		return fmt.Errorf("owncast at %s is not reachable", stream.OwncastURL)
+	}
+	return nil
+}
+
+// Stop implements Backend
+func (b *ExternalBackend) Stop(ctx context.Context, stream *models.Stream) error {
+	return nil
+}
+
+// Remove implements Backend
+func (b *ExternalBackend) Remove(ctx context.Context, stream *models.Stream) error {
+	return nil
+}
+
+// Status implements Backend
+// An Owncast that does not answer its status API is an error, not stopped:
+// the paywall cannot tell whether it was stopped on purpose.
+func (b *ExternalBackend) Status(ctx context.Context, stream *models.Stream) (models.ContainerStatus, error) {
+	if _, err := GetOwncastStatus(ctx, b.client, stream.OwncastURL); err != nil {
+		return models.ContainerStatusError, nil
+	}
+	return models.ContainerStatusRunning, nil
+}
+
+// InternalURL implements Backend
+func (b *ExternalBackend) InternalURL(stream *models.Stream) string {
+	return stream.OwncastURL
+}
+
+// RTMPURL implements Backend
+func (b *ExternalBackend) RTMPURL(stream *models.Stream) string {
+	return ""
+}
@@ -0,0 +1,96 @@
+// Package ingest runs the Owncast instances streams are broadcast to
+// A Backend provisions, starts and stops a stream's Owncast wherever it runs:
+// a container next to the paywall, an instance run elsewhere, or Kubernetes.
+// Each stream is stored with the backend it was created on.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// ErrUnavailable is returned for a backend that is not configured on this server
+var ErrUnavailable = errors.New("ingest backend not available")
+
+// Backend manages the Owncast instances of the streams created on it
+type Backend interface {
+	// Provision fills in a new stream's backend fields (container name, stream key,
+	// RTMP port, Owncast URL) before it is stored. Nothing is started yet.
+	Provision(ctx context.Context, stream *models.Stream) error
+	// Start starts the stream's Owncast, creating it on first start
+	Start(ctx context.Context, stream *models.Stream) error
+	// Stop stops the stream's Owncast, keeping its data
+	Stop(ctx context.Context, stream *models.Stream) error
+	// Remove deletes the stream's Owncast and its data
+	Remove(ctx context.Context, stream *models.Stream) error
+	// Status returns the current state of the stream's Owncast
+	Status(ctx context.Context, stream *models.Stream) (models.ContainerStatus, error)
+	// InternalURL is where the paywall reaches the stream's Owncast
+	InternalURL(stream *models.Stream) string
+	// RTMPURL is where OBS sends the stream ("" when it is not managed by the paywall)
+	RTMPURL(stream *models.Stream) string
+}
+
+// PortAllocator hands out RTMP ports; *storage.PostgresStore implements it
+type PortAllocator interface {
+	GetNextAvailablePort(ctx context.Context, basePort int) (int, error)
+}
+
+// Registry holds the backends configured on this server
+type Registry struct {
+	backends map[models.IngestBackend]Backend
+	fallback models.IngestBackend
+}
+
+// NewRegistry creates a registry whose new streams use fallback unless told otherwise
+func NewRegistry(fallback models.IngestBackend) *Registry {
+	return &Registry{
+		backends: make(map[models.IngestBackend]Backend),
+		fallback: fallback,
+	}
+}
+
+// Register makes a backend available
+func (r *Registry) Register(kind models.IngestBackend, backend Backend) {
+	r.backends[kind] = backend
+}
+
+// Default returns the backend of streams created without one
+func (r *Registry) Default() models.IngestBackend {
+	return r.fallback
+}
+
+// Get returns the backend of a kind; "" is the default backend
+func (r *Registry) Get(kind models.IngestBackend) (Backend, error) {
+	if kind == "" {
+		kind = r.fallback
+	}
+	backend, ok := r.backends[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, kind)
+	}
+	return backend, nil
+}
+
+// Available returns the kinds of the registered backends
+func (r *Registry) Available() []models.IngestBackend {
+	kinds := make([]models.IngestBackend, 0, len(r.backends))
+	for kind := range r.backends {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+	return kinds
+}
+
+// RTMPURL returns where OBS sends a stream, "" if its backend is not available
+func (r *Registry) RTMPURL(stream *models.Stream) string {
+	backend, err := r.Get(stream.Backend)
+	if err != nil {
+		return ""
+	}
+	return backend.RTMPURL(stream)
+}
@@ -0,0 +1,498 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/security"
+)
+
+// fakePorts hands out consecutive ports
+type fakePorts struct {
+	next int
+}
+
+func (p *fakePorts) GetNextAvailablePort(ctx context.Context, basePort int) (int, error) {
+	if p.next < basePort {
+		p.next = basePort
+	}
+	port := p.next
+	p.next++
+	return port, nil
+}
+
+func newTestCredentials(t *testing.T, fallback string) *Credentials {
+	t.Helper()
+	box, err := security.NewSecretBox("test-credentials-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCredentials(box, fallback)
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(models.IngestBackendDocker)
+	external := NewExternalBackend()
+	registry.Register(models.IngestBackendExternal, external)
+
+	if _, err := registry.Get(""); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected the unregistered default backend to be unavailable, got %v", err)
+	}
+	if backend, err := registry.Get(models.IngestBackendExternal); err != nil || backend != external {
+		t.Errorf("Expected the external backend, got %v (%v)", backend, err)
+	}
+	if kinds := registry.Available(); len(kinds) != 1 || kinds[0] != models.IngestBackendExternal {
+		t.Errorf("Unexpected available backends: %v", kinds)
+	}
+	if url := registry.RTMPURL(&models.Stream{Backend: models.IngestBackendDocker, RTMPPort: 19350}); url != "" {
+		t.Errorf("Expected no RTMP URL without the backend, got %q", url)
+	}
+}
+
+func TestExternalBackend(t *testing.T) {
+	healthy := true
+	owncast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" || !healthy {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"online":false}`))
+	}))
+	defer owncast.Close()
+
+	backend := NewExternalBackend()
+	ctx := context.Background()
+
+	for _, invalid := range []string{"", "owncast:8080", "ftp://owncast"} {
+		if err := backend.Provision(ctx, &models.Stream{OwncastURL: invalid}); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	stream := &models.Stream{Slug: "elsewhere", OwncastURL: owncast.URL + "/"}
+	if err := backend.Provision(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.OwncastURL != owncast.URL || stream.ContainerName != "" || stream.RTMPPort != 0 {
+		t.Errorf("Unexpected provisioned stream: %+v", stream)
+	}
+	if backend.RTMPURL(stream) != "" {
+		t.Error("Expected no RTMP URL for an external Owncast")
+	}
+
+	if err := backend.Start(ctx, stream); err != nil {
+		t.Errorf("Expected a reachable Owncast to start: %v", err)
+	}
+	healthy = false
+	if status, _ := backend.Status(ctx, stream); status != models.ContainerStatusError {
+		t.Errorf("Expected an unhealthy Owncast to be an error, got %s", status)
+	}
+	if err := backend.Start(ctx, stream); err == nil {
+		t.Error("Expected an unreachable Owncast not to start")
+	}
+}
+
+// fakeKubernetes is an API server holding resources in memory
+type fakeKubernetes struct {
+	mu        sync.Mutex
+	resources map[string]map[string]any // By path
+	token     string
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var resource map[string]any
+		json.NewDecoder(r.Body).Decode(&resource)
+		path := r.URL.Path + "/" + resource["metadata"].(map[string]any)["name"].(string)
+		if _, ok := f.resources[path]; ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"message": "already exists"})
+			return
+		}
+		f.resources[path] = resource
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPatch:
+		resource, ok := f.resources[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var patch map[string]any
+		json.NewDecoder(r.Body).Decode(&patch)
+		resource["spec"].(map[string]any)["replicas"] = patch["spec"].(map[string]any)["replicas"]
+	case http.MethodGet:
+		resource, ok := f.resources[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(resource)
+	case http.MethodDelete:
+		if _, ok := f.resources[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.resources, r.URL.Path)
+	}
+}
+
+func newKubernetesTest(t *testing.T) (*KubernetesBackend, *fakeKubernetes) {
+	t.Helper()
+	api := &fakeKubernetes{resources: make(map[string]map[string]any), token: "sa-token"}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewKubernetesBackend(KubernetesConfig{
+		APIURL:         server.URL,
+		Namespace:      "streams",
+		TokenFile:      tokenFile,
+		VolumeSize:     "1Gi",
+		ServiceType:    "LoadBalancer",
+		Image:          "owncast/owncast:latest",
+		CPULimit:       2,
+		MemoryLimit:    2048,
+		RTMPPortStart:  19350,
+		RTMPPublicHost: "rtmp.example.com",
+	}, &fakePorts{}, newTestCredentials(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, api
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	backend, api := newKubernetesTest(t)
+	ctx := context.Background()
+	const deploymentPath = "/apis/apps/v1/namespaces/streams/deployments/owncast-finals"
+
+	stream := &models.Stream{Slug: "finals"}
+	if err := backend.Provision(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.ContainerName != "owncast-finals" || stream.RTMPPort != 19350 || stream.StreamKey == "" || stream.EncryptedAdminPassword == "" {
+		t.Errorf("Unexpected provisioned stream: %+v", stream)
+	}
+	if stream.OwncastURL != "http://owncast-finals.streams.svc:8080" {
+		t.Errorf("Unexpected Owncast URL: %s", stream.OwncastURL)
+	}
+	if backend.RTMPURL(stream) != "rtmp://rtmp.example.com:19350/live" {
+		t.Errorf("Unexpected RTMP URL: %s", backend.RTMPURL(stream))
+	}
+
+	if status, err := backend.Status(ctx, stream); err != nil || status != models.ContainerStatusStopped {
+		t.Errorf("Expected a stream that never started to be stopped, got %s (%v)", status, err)
+	}
+
+	if err := backend.Start(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		"/api/v1/namespaces/streams/persistentvolumeclaims/owncast-finals-data",
+		"/api/v1/namespaces/streams/services/owncast-finals",
+		"/api/v1/namespaces/streams/services/owncast-finals-rtmp",
+		"/api/v1/namespaces/streams/secrets/owncast-finals-admin",
+		deploymentPath,
+	} {
+		if _, ok := api.resources[path]; !ok {
+			t.Errorf("Expected %s to be created", path)
+		}
+	}
+	container := api.resources[deploymentPath]["spec"].(map[string]any)["template"].(map[string]any)["spec"].(map[string]any)["containers"].([]any)[0].(map[string]any)
+	if args := container["args"].([]any); args[1] != stream.StreamKey || args[3] != "$(OWNCAST_ADMIN_PASSWORD)" {
+		t.Errorf("Expected the stream key and admin password in the container args, got %v", args)
+	}
+	password, _ := backend.creds.AdminPassword(stream)
+	secret := api.resources["/api/v1/namespaces/streams/secrets/owncast-finals-admin"]
+	if data := secret["stringData"].(map[string]any); data["password"] != password {
+		t.Errorf("Expected the admin password in the secret, got %v", data)
+	}
+	if spec := api.resources["/api/v1/namespaces/streams/services/owncast-finals"]["spec"].(map[string]any); spec["type"] != "ClusterIP" || len(spec["ports"].([]any)) != 1 {
+		t.Errorf("Expected Owncast's web UI to stay inside the cluster, got %v", spec)
+	}
+	if spec := api.resources["/api/v1/namespaces/streams/services/owncast-finals-rtmp"]["spec"].(map[string]any); spec["type"] != "LoadBalancer" {
+		t.Errorf("Expected RTMP behind a load balancer, got %v", spec["type"])
+	}
+
+	if status, _ := backend.Status(ctx, stream); status != models.ContainerStatusStarting {
+		t.Errorf("Expected a deployment without ready pods to be starting, got %s", status)
+	}
+	api.resources[deploymentPath]["status"] = map[string]any{"replicas": 1, "readyReplicas": 1}
+	if status, _ := backend.Status(ctx, stream); status != models.ContainerStatusRunning {
+		t.Errorf("Expected a ready deployment to be running, got %s", status)
+	}
+
+	// Stopping scales down and keeps the data; starting again scales back up
+	if err := backend.Stop(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := backend.Status(ctx, stream); status != models.ContainerStatusStopping {
+		t.Errorf("Expected a deployment with pods left to be stopping, got %s", status)
+	}
+	if err := backend.Start(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if replicas := api.resources[deploymentPath]["spec"].(map[string]any)["replicas"]; replicas != float64(1) {
+		t.Errorf("Expected the deployment to be scaled up, got %v replicas", replicas)
+	}
+
+	if err := backend.Remove(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.resources) != 0 {
+		t.Errorf("Expected every resource to be deleted, %d left", len(api.resources))
+	}
+	// Removing again finds nothing to delete
+	if err := backend.Remove(ctx, stream); err != nil {
+		t.Errorf("Expected removing a removed stream to succeed: %v", err)
+	}
+}
+
+func TestKubernetesProgressDeadline(t *testing.T) {
+	backend, api := newKubernetesTest(t)
+	ctx := context.Background()
+
+	stream := &models.Stream{Slug: "stuck"}
+	backend.Provision(ctx, stream)
+	if err := backend.Start(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	for path, resource := range api.resources {
+		if strings.HasSuffix(path, "/deployments/owncast-stuck") {
+			resource["status"] = map[string]any{
+				"replicas":   1,
+				"conditions": []map[string]any{{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"}},
+			}
+		}
+	}
+	if status, _ := backend.Status(ctx, stream); status != models.ContainerStatusError {
+		t.Errorf("Expected a deployment past its progress deadline to be an error, got %s", status)
+	}
+}
+
+// fakeOwncast is an Owncast admin API keeping webhooks and config values in memory
+type fakeOwncast struct {
+	mu       sync.Mutex
+	password string
+	webhooks []owncastWebhook
+	config   map[string]any
+}
+
+func (f *fakeOwncast) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != f.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/admin/webhooks":
+		json.NewEncoder(w).Encode(f.webhooks)
+	case r.URL.Path == "/api/admin/webhooks/create":
+		var webhook owncastWebhook
+		json.NewDecoder(r.Body).Decode(&webhook)
+		f.webhooks = append(f.webhooks, webhook)
+		json.NewEncoder(w).Encode(webhook)
+	case strings.HasPrefix(r.URL.Path, "/api/admin/config/"):
+		var body struct {
+			Value any `json:"value"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.config[strings.TrimPrefix(r.URL.Path, "/api/admin/config/")] = body.Value
+		json.NewEncoder(w).Encode(map[string]any{"success": true})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFakeOwncast(t *testing.T, password string) (*fakeOwncast, string) {
+	t.Helper()
+	owncast := &fakeOwncast{password: password, config: make(map[string]any)}
+	server := httptest.NewServer(owncast)
+	t.Cleanup(server.Close)
+	return owncast, server.URL
+}
+
+func TestCredentials(t *testing.T) {
+	creds := newTestCredentials(t, "global-password")
+
+	legacy := &models.Stream{Slug: "legacy"}
+	if password, err := creds.AdminPassword(legacy); err != nil || password != "global-password" {
+		t.Errorf("Expected a stream without its own password to use the global one, got %q (%v)", password, err)
+	}
+
+	a, b := &models.Stream{Slug: "a"}, &models.Stream{Slug: "b"}
+	if err := creds.Generate(a); err != nil {
+		t.Fatal(err)
+	}
+	creds.Generate(b)
+	passwordA, err := creds.AdminPassword(a)
+	if err != nil || len(passwordA) < 24 || passwordA == "global-password" {
+		t.Fatalf("Expected a generated password, got %q (%v)", passwordA, err)
+	}
+	if strings.Contains(a.EncryptedAdminPassword, passwordA) {
+		t.Error("Expected the password to be stored encrypted")
+	}
+	if passwordB, _ := creds.AdminPassword(b); passwordB == passwordA {
+		t.Error("Expected every stream to get its own password")
+	}
+
+	// Sealed with another secret
+	box, _ := security.NewSecretBox("rotated-secret")
+	if _, err := NewCredentials(box, "").AdminPassword(a); err == nil {
+		t.Error("Expected a password sealed with another secret not to open")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	creds := newTestCredentials(t, "owncast-admin")
+	owncast, owncastURL := newFakeOwncast(t, "owncast-admin")
+
+	webhooks := NewWebhooks("http://paywall:3000", "test-secret", NewOwncastAdmin(creds))
+	stream := &models.Stream{ID: uuid.New(), Slug: "final", OwncastURL: owncastURL}
+
+	token := webhooks.Token(stream.ID)
+	if !webhooks.Verify(stream.ID, token) {
+		t.Error("Expected the stream's own token to verify")
+	}
+	if webhooks.Verify(uuid.New(), token) {
+		t.Error("Expected a token not to verify for another stream")
+	}
+	if NewWebhooks("http://paywall:3000", "other-secret", nil).Verify(stream.ID, token) {
+		t.Error("Expected tokens to depend on the secret")
+	}
+	if url := webhooks.URL(stream.ID); url != "http://paywall:3000/api/webhooks/owncast/"+stream.ID.String()+"/"+token {
+		t.Errorf("Unexpected webhook URL: %s", url)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := webhooks.Configure(ctx, stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if created := owncast.webhooks; len(created) != 1 || created[0].URL != webhooks.URL(stream.ID) || !subscribes(created[0].Events) {
+		t.Errorf("Expected the webhook to be created once with every event, got %+v", created)
+	}
+
+	wrong := NewWebhooks("http://paywall:3000", "test-secret", NewOwncastAdmin(newTestCredentials(t, "wrong")))
+	if err := wrong.Configure(ctx, stream); err == nil {
+		t.Error("Expected a wrong admin password to fail")
+	}
+}
+
+func TestParseVideoVariants(t *testing.T) {
+	variants, err := ParseVideoVariants(" 1080p@6000, 720p@3000 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 2 || variants[0].Name != "1080p" || variants[0].ScaledHeight != 1080 || variants[0].VideoBitrate != 6000 || variants[1].VideoBitrate != 3000 {
+		t.Errorf("Unexpected variants: %+v", variants)
+	}
+
+	for _, spec := range []string{"", "720p", "720@3000", "720p@fast", "0p@3000", "720p@-1"} {
+		if _, err := ParseVideoVariants(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+// fakeProvisionStore records provisioned streams
+type fakeProvisionStore struct {
+	provisioned []uuid.UUID
+}
+
+func (f *fakeProvisionStore) MarkOwncastProvisioned(ctx context.Context, id uuid.UUID) error {
+	f.provisioned = append(f.provisioned, id)
+	return nil
+}
+
+func TestProvisioner(t *testing.T) {
+	creds := newTestCredentials(t, "")
+	stream := &models.Stream{ID: uuid.New(), Slug: "final", Title: "The Final", Description: "Live from the arena", Tags: []string{"finals"}}
+	creds.Generate(stream)
+	password, _ := creds.AdminPassword(stream)
+	owncast, owncastURL := newFakeOwncast(t, password)
+	stream.OwncastURL = owncastURL
+
+	admin := NewOwncastAdmin(creds)
+	store := &fakeProvisionStore{}
+	variants, _ := ParseVideoVariants("720p@3000")
+	provisioner := NewProvisioner(admin, NewWebhooks("http://paywall:3000", "test-secret", admin), store, "https://tickets.example.com/", variants, 2)
+
+	ctx := context.Background()
+	if err := provisioner.provision(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.provisioned) != 1 || stream.OwncastProvisionedAt == nil {
+		t.Fatalf("Expected the stream to be marked provisioned, got %v", store.provisioned)
+	}
+	for key, want := range map[string]any{
+		"name":                     "The Final",
+		"serversummary":            "Live from the arena",
+		"serverurl":                "https://tickets.example.com/watch/final",
+		"video/streamlatencylevel": float64(2),
+		"directoryenabled":         false,
+		"federation/enable":        false,
+		"disablesearchindexing":    true,
+		"hideviewercount":          true,
+	} {
+		if got := owncast.config[key]; got != want {
+			t.Errorf("Expected %s to be %v, got %v", key, want, got)
+		}
+	}
+	if got := owncast.config["video/streamoutputvariants"].([]any); len(got) != 1 || got[0].(map[string]any)["scaledHeight"] != float64(720) {
+		t.Errorf("Unexpected video variants: %v", got)
+	}
+	if len(owncast.webhooks) != 1 {
+		t.Errorf("Expected the webhook to be configured, got %d", len(owncast.webhooks))
+	}
+
+	// Later starts leave settings changed in Owncast alone
+	owncast.config = make(map[string]any)
+	if err := provisioner.provision(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(owncast.config) != 0 || len(store.provisioned) != 1 {
+		t.Errorf("Expected a provisioned Owncast not to be configured again, set %v", owncast.config)
+	}
+
+	// An external Owncast gets its webhook, with the fallback password, but keeps its settings
+	fallbackCreds := newTestCredentials(t, "fallback-password")
+	external, externalURL := newFakeOwncast(t, "fallback-password")
+	fallbackAdmin := NewOwncastAdmin(fallbackCreds)
+	provisioner = NewProvisioner(fallbackAdmin, NewWebhooks("http://paywall:3000", "test-secret", fallbackAdmin), store, "https://tickets.example.com/", variants, 2)
+	externalStream := &models.Stream{ID: uuid.New(), Slug: "external", Title: "External", Backend: models.IngestBackendExternal, OwncastURL: externalURL}
+	if err := provisioner.provision(ctx, externalStream); err != nil {
+		t.Fatal(err)
+	}
+	if len(external.config) != 0 || len(store.provisioned) != 1 {
+		t.Errorf("Expected an external Owncast's settings to be left alone, set %v", external.config)
+	}
+	if len(external.webhooks) != 1 {
+		t.Errorf("Expected the external Owncast's webhook to be configured, got %d", len(external.webhooks))
+	}
+}
@@ -0,0 +1,468 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/docker"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// KubernetesConfig holds the settings of the Kubernetes backend
+type KubernetesConfig struct {
+	APIURL       string // API server URL, e.g. https://kubernetes.default.svc
+	Namespace    string // Namespace the Owncast resources are created in
+	TokenFile    string // Bearer token, re-read on every request as projected tokens rotate ("" = none)
+	CAFile       string // CA certificate of the API server ("" = system roots)
+	StorageClass string // Storage class of data volumes ("" = cluster default)
+	VolumeSize   string // Size of each data volume, e.g. 1Gi
+	ServiceType  string // LoadBalancer, or ClusterIP behind an ingress controller that forwards TCP
+	Image        string // Owncast image
+	CPULimit     int64  // CPU limit in cores
+	MemoryLimit  int64  // Memory limit in MB
+
+	RTMPPortStart  int    // First RTMP port handed out
+	RTMPPublicHost string // Host OBS reaches the Services' RTMP ports on
+}
+
+// KubernetesBackend runs each stream's Owncast as a Deployment with Services and a PersistentVolumeClaim
+// It talks to the API server's REST API directly. The paywall's service account
+// needs create, get, patch and delete on deployments, services, secrets and
+// persistentvolumeclaims in the namespace.
+// Owncast's web UI is only reachable inside the cluster; the RTMP port gets a
+// Service of its own with the configured type.
+type KubernetesBackend struct {
+	cfg    KubernetesConfig
+	ports  PortAllocator
+	creds  *Credentials
+	client *http.Client
+}
+
+// NewKubernetesBackend creates a Kubernetes backend
+func NewKubernetesBackend(cfg KubernetesConfig, ports PortAllocator, creds *Credentials) (*KubernetesBackend, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("kubernetes CA file contains no certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if cfg.TokenFile != "" {
+		if _, err := os.Stat(cfg.TokenFile); err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes token: %w", err)
+		}
+	}
+
+	return &KubernetesBackend{
+		cfg:    cfg,
+		ports:  ports,
+		creds:  creds,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}, nil
+}
+
+// kubernetesError is an API server response other than 2xx
+type kubernetesError struct {
+	status  int
+	message string
+}
+
+func (e *kubernetesError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.status, e.message)
+}
+
+// isStatus reports whether err is an API server response with status
+func isStatus(err error, status int) bool {
+	var apiErr *kubernetesError
+	return errors.As(err, &apiErr) && apiErr.status == status
+}
+
+// do sends a request to the API server and decodes the response into out, if not nil
+func (b *KubernetesBackend) do(ctx context.Context, method, path, contentType string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(b.cfg.APIURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if b.cfg.TokenFile != "" {
+		token, err := os.ReadFile(b.cfg.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read kubernetes token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&status)
+		return &kubernetesError{status: resp.StatusCode, message: status.Message}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// create creates a resource, leaving an existing one as it is
+func (b *KubernetesBackend) create(ctx context.Context, path string, resource any) (bool, error) {
+	err := b.do(ctx, http.MethodPost, path, "application/json", resource, nil)
+	if isStatus(err, http.StatusConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// remove deletes a resource if it exists
+func (b *KubernetesBackend) remove(ctx context.Context, path string) error {
+	err := b.do(ctx, http.MethodDelete, path+"?propagationPolicy=Background", "", nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// scale sets the replicas of a stream's Deployment
+func (b *KubernetesBackend) scale(ctx context.Context, stream *models.Stream, replicas int) error {
+	patch := map[string]any{"spec": map[string]any{"replicas": replicas}}
+	return b.do(ctx, http.MethodPatch, b.deploymentPath(stream.ContainerName), "application/merge-patch+json", patch, nil)
+}
+
+func (b *KubernetesBackend) deploymentPath(name string) string {
+	path := "/apis/apps/v1/namespaces/" + b.cfg.Namespace + "/deployments"
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+func (b *KubernetesBackend) corePath(resource, name string) string {
+	path := "/api/v1/namespaces/" + b.cfg.Namespace + "/" + resource
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// labels returns the labels of a stream's resources
+func labels(stream *models.Stream) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       "owncast",
+		"app.kubernetes.io/managed-by": "stream-paywall",
+		"stream-slug":                  stream.Slug,
+	}
+}
+
+// selector returns the labels that select a stream's Owncast pod
+func selector(stream *models.Stream) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name": "owncast",
+		"stream-slug":            stream.Slug,
+	}
+}
+
+func (b *KubernetesBackend) volumeClaim(stream *models.Stream) map[string]any {
+	spec := map[string]any{
+		"accessModes": []string{"ReadWriteOnce"},
+		"resources":   map[string]any{"requests": map[string]string{"storage": b.cfg.VolumeSize}},
+	}
+	if b.cfg.StorageClass != "" {
+		spec["storageClassName"] = b.cfg.StorageClass
+	}
+	return map[string]any{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata":   map[string]any{"name": docker.VolumeName(stream.Slug), "labels": labels(stream)},
+		"spec":       spec,
+	}
+}
+
+// rtmpServiceName is the name of the Service exposing a stream's RTMP port
+func rtmpServiceName(stream *models.Stream) string {
+	return stream.ContainerName + "-rtmp"
+}
+
+// adminSecretName is the name of the Secret holding a stream's Owncast admin password
+func adminSecretName(stream *models.Stream) string {
+	return stream.ContainerName + "-admin"
+}
+
+// service is the in-cluster Service the paywall reaches Owncast's HTTP port through
+func (b *KubernetesBackend) service(stream *models.Stream) map[string]any {
+	return map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]any{"name": stream.ContainerName, "labels": labels(stream)},
+		"spec": map[string]any{
+			"type":     "ClusterIP",
+			"selector": selector(stream),
+			"ports": []map[string]any{
+				{"name": "http", "port": 8080, "targetPort": 8080},
+			},
+		},
+	}
+}
+
+// rtmpService is the Service OBS reaches the stream's RTMP port through
+func (b *KubernetesBackend) rtmpService(stream *models.Stream) map[string]any {
+	return map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]any{"name": rtmpServiceName(stream), "labels": labels(stream)},
+		"spec": map[string]any{
+			"type":     b.cfg.ServiceType,
+			"selector": selector(stream),
+			"ports": []map[string]any{
+				{"name": "rtmp", "port": stream.RTMPPort, "targetPort": 1935},
+			},
+		},
+	}
+}
+
+func (b *KubernetesBackend) adminSecret(stream *models.Stream, password string) map[string]any {
+	return map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"name": adminSecretName(stream), "labels": labels(stream)},
+		"type":       "Opaque",
+		"stringData": map[string]string{"password": password},
+	}
+}
+
+func (b *KubernetesBackend) deployment(stream *models.Stream) map[string]any {
+	resources := map[string]string{}
+	if b.cfg.CPULimit > 0 {
+		resources["cpu"] = fmt.Sprintf("%d", b.cfg.CPULimit)
+	}
+	if b.cfg.MemoryLimit > 0 {
+		resources["memory"] = fmt.Sprintf("%dMi", b.cfg.MemoryLimit)
+	}
+
+	container := map[string]any{
+		"name":  "owncast",
+		"image": b.cfg.Image,
+		"args":  []string{"--streamkey", stream.StreamKey},
+		"ports": []map[string]any{
+			{"name": "http", "containerPort": 8080},
+			{"name": "rtmp", "containerPort": 1935},
+		},
+		"resources":    map[string]any{"limits": resources},
+		"volumeMounts": []map[string]any{{"name": "data", "mountPath": "/app/data"}},
+	}
+	if stream.EncryptedAdminPassword != "" {
+		// Read from the Secret, so the password does not show in the Deployment
+		container["env"] = []map[string]any{{
+			"name": "OWNCAST_ADMIN_PASSWORD",
+			"valueFrom": map[string]any{
+				"secretKeyRef": map[string]any{"name": adminSecretName(stream), "key": "password"},
+			},
+		}}
+		container["args"] = []string{"--streamkey", stream.StreamKey, "--adminpassword", "$(OWNCAST_ADMIN_PASSWORD)"}
+	}
+
+	return map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": stream.ContainerName, "labels": labels(stream)},
+		"spec": map[string]any{
+			"replicas": 1,
+			// The data volume is ReadWriteOnce, so the old pod must be gone before a new one starts
+			"strategy": map[string]any{"type": "Recreate"},
+			"selector": map[string]any{"matchLabels": selector(stream)},
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": labels(stream)},
+				"spec": map[string]any{
+					"containers": []map[string]any{container},
+					"volumes": []map[string]any{{
+						"name":                  "data",
+						"persistentVolumeClaim": map[string]any{"claimName": docker.VolumeName(stream.Slug)},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// Provision implements Backend
+func (b *KubernetesBackend) Provision(ctx context.Context, stream *models.Stream) error {
+	streamKey, err := docker.GenerateStreamKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate stream key: %w", err)
+	}
+	rtmpPort, err := b.ports.GetNextAvailablePort(ctx, b.cfg.RTMPPortStart)
+	if err != nil {
+		return fmt.Errorf("failed to allocate RTMP port: %w", err)
+	}
+	if err := b.creds.Generate(stream); err != nil {
+		return err
+	}
+
+	stream.StreamKey = streamKey
+	stream.RTMPPort = rtmpPort
+	stream.ContainerName = docker.ContainerName(stream.Slug)
+	stream.OwncastURL = b.InternalURL(stream)
+	return nil
+}
+
+// Start implements Backend
+// The volume claim, Services and admin Secret are created on first start and
+// kept when the stream is stopped; the Deployment is scaled back up if it exists.
+func (b *KubernetesBackend) Start(ctx context.Context, stream *models.Stream) error {
+	if stream.EncryptedAdminPassword != "" {
+		password, err := b.creds.AdminPassword(stream)
+		if err != nil {
+			return err
+		}
+		if _, err := b.create(ctx, b.corePath("secrets", ""), b.adminSecret(stream, password)); err != nil {
+			return fmt.Errorf("failed to create admin secret: %w", err)
+		}
+	}
+	if _, err := b.create(ctx, b.corePath("persistentvolumeclaims", ""), b.volumeClaim(stream)); err != nil {
+		return fmt.Errorf("failed to create volume claim: %w", err)
+	}
+	if _, err := b.create(ctx, b.corePath("services", ""), b.service(stream)); err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	if _, err := b.create(ctx, b.corePath("services", ""), b.rtmpService(stream)); err != nil {
+		return fmt.Errorf("failed to create RTMP service: %w", err)
+	}
+
+	created, err := b.create(ctx, b.deploymentPath(""), b.deployment(stream))
+	if err != nil {
+		return fmt.Errorf("failed to create deployment: %w", err)
+	}
+	if created {
+		log.Info().Str("deployment", stream.ContainerName).Str("namespace", b.cfg.Namespace).Msg("Deployment created")
+		return nil
+	}
+
+	if err := b.scale(ctx, stream, 1); err != nil {
+		return fmt.Errorf("failed to scale deployment: %w", err)
+	}
+	log.Info().Str("deployment", stream.ContainerName).Str("namespace", b.cfg.Namespace).Msg("Deployment scaled up")
+	return nil
+}
+
+// Stop implements Backend
+func (b *KubernetesBackend) Stop(ctx context.Context, stream *models.Stream) error {
+	err := b.scale(ctx, stream, 0)
+	if isStatus(err, http.StatusNotFound) {
+		return nil // Never started
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scale deployment: %w", err)
+	}
+	log.Info().Str("deployment", stream.ContainerName).Str("namespace", b.cfg.Namespace).Msg("Deployment scaled down")
+	return nil
+}
+
+// Remove implements Backend
+func (b *KubernetesBackend) Remove(ctx context.Context, stream *models.Stream) error {
+	if err := b.remove(ctx, b.deploymentPath(stream.ContainerName)); err != nil {
+		return fmt.Errorf("failed to delete deployment: %w", err)
+	}
+	if err := b.remove(ctx, b.corePath("services", stream.ContainerName)); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+	if err := b.remove(ctx, b.corePath("services", rtmpServiceName(stream))); err != nil {
+		return fmt.Errorf("failed to delete RTMP service: %w", err)
+	}
+	if err := b.remove(ctx, b.corePath("secrets", adminSecretName(stream))); err != nil {
+		return fmt.Errorf("failed to delete admin secret: %w", err)
+	}
+	if err := b.remove(ctx, b.corePath("persistentvolumeclaims", docker.VolumeName(stream.Slug))); err != nil {
+		return fmt.Errorf("failed to delete volume claim: %w", err)
+	}
+	log.Info().Str("deployment", stream.ContainerName).Str("namespace", b.cfg.Namespace).Msg("Deployment removed")
+	return nil
+}
+
+// deploymentState is the part of a Deployment that tells its state
+type deploymentState struct {
+	Spec struct {
+		Replicas *int `json:"replicas"`
+	} `json:"spec"`
+	Status struct {
+		Replicas      int `json:"replicas"`
+		ReadyReplicas int `json:"readyReplicas"`
+		Conditions    []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// Status implements Backend
+func (b *KubernetesBackend) Status(ctx context.Context, stream *models.Stream) (models.ContainerStatus, error) {
+	var deployment deploymentState
+	err := b.do(ctx, http.MethodGet, b.deploymentPath(stream.ContainerName), "", nil, &deployment)
+	if isStatus(err, http.StatusNotFound) {
+		return models.ContainerStatusStopped, nil
+	}
+	if err != nil {
+		return models.ContainerStatusError, err
+	}
+
+	if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == 0 {
+		if deployment.Status.Replicas > 0 {
+			return models.ContainerStatusStopping, nil
+		}
+		return models.ContainerStatusStopped, nil
+	}
+	if deployment.Status.ReadyReplicas > 0 {
+		return models.ContainerStatusRunning, nil
+	}
+	for _, condition := range deployment.Status.Conditions {
+		// Set once the pod has not become ready within the progress deadline
+		if condition.Type == "Progressing" && condition.Status == "False" {
+			return models.ContainerStatusError, nil
+		}
+	}
+	return models.ContainerStatusStarting, nil
+}
+
+// InternalURL implements Backend
+func (b *KubernetesBackend) InternalURL(stream *models.Stream) string {
+	return fmt.Sprintf("http://%s.%s.svc:8080", stream.ContainerName, b.cfg.Namespace)
+}
+
+// RTMPURL implements Backend
+func (b *KubernetesBackend) RTMPURL(stream *models.Stream) string {
+	return docker.GetRTMPURL(b.cfg.RTMPPublicHost, stream.RTMPPort)
+}
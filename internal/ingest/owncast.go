@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// OwncastStatus is the part of Owncast's /api/status response the paywall uses
+type OwncastStatus struct {
+	Online      bool `json:"online"` // A broadcaster is sending video
+	ViewerCount int  `json:"viewerCount"`
+}
+
+// GetOwncastStatus asks an Owncast instance whether it is receiving a stream
+func GetOwncastStatus(ctx context.Context, client *http.Client, owncastURL string) (*OwncastStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, owncastURL+"/api/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("owncast status returned %d", resp.StatusCode)
+	}
+	var status OwncastStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode owncast status: %w", err)
+	}
+	return &status, nil
+}
+
+// OwncastAdmin calls the admin API of the streams' Owncast instances
+type OwncastAdmin struct {
+	creds  *Credentials
+	client *http.Client
+}
+
+// NewOwncastAdmin creates an admin API client authenticating with each stream's own password
+func NewOwncastAdmin(creds *Credentials) *OwncastAdmin {
+	return &OwncastAdmin{
+		creds:  creds,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Call calls an admin API path of a stream's Owncast, decoding the response into out if given
+func (a *OwncastAdmin) Call(ctx context.Context, stream *models.Stream, method, path string, in, out any) error {
+	password, err := a.creds.AdminPassword(stream)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, stream.OwncastURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth("admin", password)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("owncast returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// SetConfig sets one admin config value, e.g. "name" or "video/streamlatencylevel"
+func (a *OwncastAdmin) SetConfig(ctx context.Context, stream *models.Stream, key string, value any) error {
+	err := a.Call(ctx, stream, http.MethodPost, "/api/admin/config/"+key, map[string]any{"value": value}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", key, err)
+	}
+	return nil
+}
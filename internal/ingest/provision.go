@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// provisionReadyTimeout is how long a started Owncast is given to answer its admin API
+	provisionReadyTimeout = 5 * time.Minute
+	// provisionRetryInterval is how often provisioning is retried meanwhile
+	provisionRetryInterval = 5 * time.Second
+)
+
+// VideoVariant is an output rendition as Owncast's admin API takes it
+type VideoVariant struct {
+	Name             string `json:"name"`
+	VideoBitrate     int    `json:"videoBitrate"`
+	AudioBitrate     int    `json:"audioBitrate"`
+	ScaledHeight     int    `json:"scaledHeight"`
+	Framerate        int    `json:"framerate"`
+	CPUUsageLevel    int    `json:"cpuUsageLevel"`
+	VideoPassthrough bool   `json:"videoPassthrough"`
+	AudioPassthrough bool   `json:"audioPassthrough"`
+}
+
+// ParseVideoVariants parses a comma-separated list of {height}p@{kbps} renditions
+// Example: "1080p@6000,720p@3000,480p@1200"
+func ParseVideoVariants(spec string) ([]VideoVariant, error) {
+	var variants []VideoVariant
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		resolution, bitrate, ok := strings.Cut(item, "@")
+		height, heightErr := strconv.Atoi(strings.TrimSuffix(resolution, "p"))
+		kbps, bitrateErr := strconv.Atoi(bitrate)
+		if !ok || !strings.HasSuffix(resolution, "p") || heightErr != nil || bitrateErr != nil || height <= 0 || kbps <= 0 {
+			return nil, fmt.Errorf("invalid video variant %q, expected e.g. 720p@3000", item)
+		}
+		variants = append(variants, VideoVariant{
+			Name:          resolution,
+			VideoBitrate:  kbps,
+			AudioBitrate:  128,
+			ScaledHeight:  height,
+			Framerate:     30,
+			CPUUsageLevel: 2,
+		})
+	}
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no video variants given")
+	}
+	return variants, nil
+}
+
+// ProvisionStore records provisioned streams; *storage.PostgresStore implements it
+type ProvisionStore interface {
+	MarkOwncastProvisioned(ctx context.Context, id uuid.UUID) error
+}
+
+// Provisioner sets up a stream's Owncast once it has started
+// On first boot it pushes the stream's title, description and tags, the default
+// video renditions and latency, and turns off everything that would advertise
+// the Owncast outside the paywall: the public directory, federation, search
+// indexing and the viewer count. Its webhook is (re)configured on every start.
+// Externally run Owncast instances only get their webhook; their settings are
+// left to whoever runs them.
+type Provisioner struct {
+	admin     *OwncastAdmin
+	webhooks  *Webhooks
+	store     ProvisionStore
+	publicURL string
+	variants  []VideoVariant
+	latency   int
+}
+
+// NewProvisioner creates a provisioner
+// publicURL is the paywall's public base URL, which the Owncast pages link to.
+func NewProvisioner(admin *OwncastAdmin, webhooks *Webhooks, store ProvisionStore, publicURL string, variants []VideoVariant, latency int) *Provisioner {
+	return &Provisioner{
+		admin:     admin,
+		webhooks:  webhooks,
+		store:     store,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		variants:  variants,
+		latency:   latency,
+	}
+}
+
+// Configure pushes the stream's settings to its Owncast
+// Every value is set on its own, so a repeated call after a partial failure is harmless.
+func (p *Provisioner) Configure(ctx context.Context, stream *models.Stream) error {
+	watchURL := p.publicURL + "/watch/" + stream.Slug
+	tags := stream.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	settings := []struct {
+		key   string
+		value any
+	}{
+		{"name", stream.Title},
+		{"streamtitle", stream.Title},
+		{"serversummary", stream.Description},
+		{"tags", tags},
+		{"serverurl", watchURL},
+		{"pagecontent", fmt.Sprintf("Watch this stream at [%s](%s).", watchURL, watchURL)},
+		{"video/streamoutputvariants", p.variants},
+		{"video/streamlatencylevel", p.latency},
+		{"directoryenabled", false},
+		{"federation/enable", false},
+		{"disablesearchindexing", true},
+		{"hideviewercount", true},
+	}
+	for _, setting := range settings {
+		if err := p.admin.SetConfig(ctx, stream, setting.key, setting.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provision configures a stream's Owncast on first boot and its webhook on every start
+func (p *Provisioner) provision(ctx context.Context, stream *models.Stream) error {
+	if stream.OwncastProvisionedAt == nil && stream.Backend != models.IngestBackendExternal {
+		if err := p.Configure(ctx, stream); err != nil {
+			return err
+		}
+		if err := p.store.MarkOwncastProvisioned(ctx, stream.ID); err != nil {
+			return fmt.Errorf("failed to mark stream provisioned: %w", err)
+		}
+		now := time.Now()
+		stream.OwncastProvisionedAt = &now
+		log.Info().Str("slug", stream.Slug).Msg("Owncast settings pushed")
+	}
+	if err := p.webhooks.Configure(ctx, stream); err != nil {
+		return fmt.Errorf("failed to configure webhook: %w", err)
+	}
+	return nil
+}
+
+// ProvisionWhenReady provisions a just started Owncast in the background
+// Owncast takes a while to answer after it starts, so this retries for a few
+// minutes. If an external Owncast cannot be reached with OWNCAST_ADMIN_PASSWORD,
+// its webhook has to be added by hand, which the log says.
+func (p *Provisioner) ProvisionWhenReady(stream *models.Stream) {
+	copied := *stream // Provisioning marks its own copy
+	stream = &copied
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), provisionReadyTimeout)
+		defer cancel()
+
+		ticker := time.NewTicker(provisionRetryInterval)
+		defer ticker.Stop()
+
+		for {
+			err := p.provision(ctx, stream)
+			if err == nil {
+				log.Info().Str("slug", stream.Slug).Msg("Owncast provisioned and webhook configured")
+				return
+			}
+			select {
+			case <-ctx.Done():
+				if stream.Backend == models.IngestBackendExternal {
+					log.Warn().Err(err).Str("slug", stream.Slug).Msg("Failed to configure the webhook of the external Owncast; add it by hand from the stream's edit page")
+					return
+				}
+				log.Warn().Err(err).Str("slug", stream.Slug).Msg("Failed to provision Owncast")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package ingest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// Owncast webhook event types the paywall handles
+const (
+	EventStreamStarted      = "STREAM_STARTED"
+	EventStreamStopped      = "STREAM_STOPPED"
+	EventStreamTitleUpdated = "STREAM_TITLE_UPDATED"
+	EventChat               = "CHAT"
+	EventUserJoined         = "USER_JOINED"
+)
+
+// WebhookEvents are the events each Owncast is configured to send
+var WebhookEvents = []string{EventStreamStarted, EventStreamStopped, EventStreamTitleUpdated, EventChat, EventUserJoined}
+
+// Webhooks configures the Owncast instances to report to the paywall
+// Owncast does not sign its webhooks, so each stream gets its own URL with a
+// token derived from the signing secret; a URL only works for its stream.
+type Webhooks struct {
+	baseURL string
+	secret  string
+	admin   *OwncastAdmin
+}
+
+// NewWebhooks creates a webhook configurer
+// baseURL is where the Owncast instances reach the paywall.
+func NewWebhooks(baseURL, secret string, admin *OwncastAdmin) *Webhooks {
+	return &Webhooks{
+		baseURL: baseURL,
+		secret:  secret,
+		admin:   admin,
+	}
+}
+
+// Token returns the token in a stream's webhook URL
+// Input format: owncast-webhook:{streamID}
+func (w *Webhooks) Token(streamID uuid.UUID) string {
+	h := hmac.New(sha256.New, []byte(w.secret))
+	h.Write([]byte("owncast-webhook:" + streamID.String()))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Verify reports whether a token belongs to a stream
+func (w *Webhooks) Verify(streamID uuid.UUID, token string) bool {
+	return hmac.Equal([]byte(token), []byte(w.Token(streamID)))
+}
+
+// URL returns the webhook URL of a stream
+func (w *Webhooks) URL(streamID uuid.UUID) string {
+	return fmt.Sprintf("%s/api/webhooks/owncast/%s/%s", w.baseURL, streamID, w.Token(streamID))
+}
+
+// owncastWebhook is a webhook as listed by the Owncast admin API
+type owncastWebhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// Configure adds the stream's webhook to its Owncast, unless it is already there
+func (w *Webhooks) Configure(ctx context.Context, stream *models.Stream) error {
+	webhookURL := w.URL(stream.ID)
+
+	var existing []owncastWebhook
+	if err := w.admin.Call(ctx, stream, http.MethodGet, "/api/admin/webhooks", nil, &existing); err != nil {
+		return err
+	}
+	for _, webhook := range existing {
+		if webhook.URL == webhookURL && subscribes(webhook.Events) {
+			return nil
+		}
+	}
+
+	return w.admin.Call(ctx, stream, http.MethodPost, "/api/admin/webhooks/create", owncastWebhook{
+		URL:    webhookURL,
+		Events: WebhookEvents,
+	}, nil)
+}
+
+// subscribes reports whether a webhook's events include all of WebhookEvents
+func subscribes(events []string) bool {
+	subscribed := make(map[string]bool, len(events))
+	for _, event := range events {
+		subscribed[event] = true
+	}
+	for _, event := range WebhookEvents {
+		if !subscribed[event] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package m3u8
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockingReload is a playlist request that waits for a segment or part (LL-HLS)
+// Part is -1 when only the segment was asked for.
+type BlockingReload struct {
+	MSN  int64
+	Part int64
+}
+
+// ErrInvalidBlockingReload is returned for malformed _HLS_msn and _HLS_part parameters
+var ErrInvalidBlockingReload = errors.New("invalid blocking playlist reload")
+
+// ParseBlockingReload reads the _HLS_msn and _HLS_part query parameters
+// Returns nil when the request does not block.
+func ParseBlockingReload(query url.Values) (*BlockingReload, error) {
+	msnValue, partValue := query.Get("_HLS_msn"), query.Get("_HLS_part")
+	if msnValue == "" {
+		if partValue != "" {
+			return nil, ErrInvalidBlockingReload
+		}
+		return nil, nil
+	}
+
+	reload := &BlockingReload{Part: -1}
+	msn, err := strconv.ParseInt(msnValue, 10, 64)
+	if err != nil || msn < 0 {
+		return nil, ErrInvalidBlockingReload
+	}
+	reload.MSN = msn
+	if partValue != "" {
+		part, err := strconv.ParseInt(partValue, 10, 64)
+		if err != nil || part < 0 {
+			return nil, ErrInvalidBlockingReload
+		}
+		reload.Part = part
+	}
+	return reload, nil
+}
+
+// Query formats the reload's query parameters, e.g. to pass it upstream
+func (b *BlockingReload) Query() string {
+	query := "_HLS_msn=" + strconv.FormatInt(b.MSN, 10)
+	if b.Part >= 0 {
+		query += "&_HLS_part=" + strconv.FormatInt(b.Part, 10)
+	}
+	return query
+}
+
+// TargetDuration returns the playlist's EXT-X-TARGETDURATION, 0 when it has none
+func (p *Playlist) TargetDuration() time.Duration {
+	for _, line := range p.Lines {
+		if line.Type == Tag && line.Name == "EXT-X-TARGETDURATION" {
+			return parseSeconds(line.Value)
+		}
+	}
+	return 0
+}
+
+// PartTarget returns the playlist's PART-TARGET, 0 when it has no partial segments
+func (p *Playlist) PartTarget() time.Duration {
+	for _, line := range p.Lines {
+		if line.Type == Tag && line.Name == "EXT-X-PART-INF" {
+			value, _ := line.Attr("PART-TARGET")
+			return parseSeconds(value)
+		}
+	}
+	return 0
+}
+
+// LastSequence returns the media sequence number of the last complete segment, -1 when there is none
+func (p *Playlist) LastSequence() int64 {
+	last := int64(-1)
+	for _, line := range p.Lines {
+		if line.Kind == KindSegment {
+			last = line.Sequence
+		}
+	}
+	return last
+}
+
+// Satisfies reports whether the playlist contains what a blocking reload waits for:
+// segment MSN, or part Part of segment MSN
+// A later segment, or segment MSN itself when waiting for a part, also satisfies it.
+func (p *Playlist) Satisfies(reload *BlockingReload) bool {
+	last := p.LastSequence()
+	if last >= reload.MSN {
+		return true
+	}
+	if reload.Part < 0 {
+		return false
+	}
+
+	parts := int64(0)
+	for _, line := range p.Lines {
+		if line.Kind == KindPart && line.Name == "EXT-X-PART" && line.Sequence == reload.MSN {
+			parts++
+		}
+	}
+	return parts > reload.Part
+}
+
+// IsLowLatency reports whether a tag only makes sense to players fetching partial segments
+func IsLowLatency(line *Line) bool {
+	if line.Type != Tag {
+		return false
+	}
+	switch line.Name {
+	case "EXT-X-PART", "EXT-X-PRELOAD-HINT", "EXT-X-PART-INF":
+		return true
+	}
+	return false
+}
+
+// parseSeconds parses a decimal number of seconds
+func parseSeconds(s string) time.Duration {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
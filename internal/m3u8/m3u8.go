@@ -0,0 +1,328 @@
+// Package m3u8 parses and serializes HLS playlists (RFC 8216)
+// Playlists are kept as a list of lines so that a parsed playlist serializes
+// back unchanged, apart from the references a caller rewrites.
+package m3u8
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNotPlaylist is returned when the input does not start with #EXTM3U
+var ErrNotPlaylist = errors.New("not an M3U8 playlist")
+
+// maxLineLength limits a single playlist line
+const maxLineLength = 1024 * 1024
+
+// LineType is the kind of a playlist line
+type LineType int
+
+const (
+	// Blank is an empty line
+	Blank LineType = iota
+	// Comment is a line starting with # that is not a tag
+	Comment
+	// Tag is a line starting with #EXT
+	Tag
+	// URI is a line holding a media segment or variant playlist URI
+	URI
+)
+
+// Kind is the resource a line refers to
+type Kind int
+
+const (
+	// KindNone is a line without a reference
+	KindNone Kind = iota
+	// KindPlaylist is a variant, rendition or I-frame playlist
+	KindPlaylist
+	// KindSegment is a media segment
+	KindSegment
+	// KindMap is a media initialization section (EXT-X-MAP)
+	KindMap
+	// KindPart is a partial segment or a preload hint for one (LL-HLS)
+	KindPart
+	// KindKey is a decryption key (EXT-X-KEY, EXT-X-SESSION-KEY)
+	KindKey
+	// KindData is session data (EXT-X-SESSION-DATA)
+	KindData
+)
+
+// referenceTags maps the tags whose URI attribute refers to a resource to its kind
+var referenceTags = map[string]Kind{
+	"EXT-X-MAP":                KindMap,
+	"EXT-X-KEY":                KindKey,
+	"EXT-X-SESSION-KEY":        KindKey,
+	"EXT-X-MEDIA":              KindPlaylist,
+	"EXT-X-I-FRAME-STREAM-INF": KindPlaylist,
+	"EXT-X-RENDITION-REPORT":   KindPlaylist,
+	"EXT-X-PART":               KindPart,
+	"EXT-X-PRELOAD-HINT":       KindPart,
+	"EXT-X-SESSION-DATA":       KindData,
+}
+
+// attributeTags lists the other tags whose value is an attribute list
+var attributeTags = map[string]bool{
+	"EXT-X-STREAM-INF":       true,
+	"EXT-X-DATERANGE":        true,
+	"EXT-X-SERVER-CONTROL":   true,
+	"EXT-X-PART-INF":         true,
+	"EXT-X-SKIP":             true,
+	"EXT-X-START":            true,
+	"EXT-X-DEFINE":           true,
+	"EXT-X-CONTENT-STEERING": true,
+}
+
+// Attribute is one NAME=VALUE pair of a tag's attribute list
+type Attribute struct {
+	Name  string
+	Value string
+	// Quoted is set for quoted-string values; Value holds them without the quotes
+	Quoted bool
+}
+
+// Line is one line of a playlist
+type Line struct {
+	Type LineType
+	// Text is the raw text of blank and comment lines
+	Text string
+	// Name is a tag's name without the leading #, e.g. EXT-X-MAP
+	Name string
+	// Value is the text after a tag's colon, for tags that are not attribute lists
+	Value string
+	// Attrs is the attribute list of attribute list tags
+	Attrs []Attribute
+	// URI is the URI of a URI line
+	URI string
+	// Kind is the resource the line refers to
+	Kind Kind
+	// Sequence is the media sequence number of a segment, or of the segment a part belongs to
+	Sequence int64
+
+	hasValue bool
+}
+
+// NewTag creates an attribute list tag
+func NewTag(name string, attrs ...Attribute) *Line {
+	return &Line{Type: Tag, Name: name, Attrs: attrs, hasValue: true}
+}
+
+// Attr returns the value of a tag's attribute
+func (l *Line) Attr(name string) (string, bool) {
+	for _, attr := range l.Attrs {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetAttr sets the value of a tag's attribute, keeping its quoting; new attributes are quoted
+func (l *Line) SetAttr(name, value string) {
+	for i := range l.Attrs {
+		if l.Attrs[i].Name == name {
+			l.Attrs[i].Value = value
+			return
+		}
+	}
+	l.Attrs = append(l.Attrs, Attribute{Name: name, Value: value, Quoted: true})
+	l.hasValue = true
+}
+
+// Reference returns the URI a line refers to: a URI line's URI or a tag's URI attribute
+func (l *Line) Reference() (string, bool) {
+	switch l.Type {
+	case URI:
+		return l.URI, true
+	case Tag:
+		if _, ok := referenceTags[l.Name]; ok {
+			return l.Attr("URI")
+		}
+	}
+	return "", false
+}
+
+// SetReference replaces the URI a line refers to
+func (l *Line) SetReference(uri string) {
+	if l.Type == URI {
+		l.URI = uri
+		return
+	}
+	l.SetAttr("URI", uri)
+}
+
+// String formats the line as it appears in a playlist
+func (l *Line) String() string {
+	switch l.Type {
+	case URI:
+		return l.URI
+	case Tag:
+		if l.Attrs == nil && l.Value == "" && !l.hasValue {
+			return "#" + l.Name
+		}
+		if l.Attrs == nil {
+			return "#" + l.Name + ":" + l.Value
+		}
+		parts := make([]string, len(l.Attrs))
+		for i, attr := range l.Attrs {
+			if attr.Quoted {
+				parts[i] = attr.Name + "=\"" + attr.Value + "\""
+			} else {
+				parts[i] = attr.Name + "=" + attr.Value
+			}
+		}
+		return "#" + l.Name + ":" + strings.Join(parts, ",")
+	default:
+		return l.Text
+	}
+}
+
+// Playlist is a parsed master or media playlist
+type Playlist struct {
+	Lines []*Line
+}
+
+// String formats the playlist, one line per Line
+func (p *Playlist) String() string {
+	var b strings.Builder
+	for _, line := range p.Lines {
+		b.WriteString(line.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Parse reads a playlist
+// Segments and parts are numbered from EXT-X-MEDIA-SEQUENCE, so callers see
+// the media sequence number of every segment without tracking tags themselves.
+func Parse(r io.Reader) (*Playlist, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+
+	playlist := &Playlist{}
+	sequence := int64(0)
+	variant := false
+	header := false
+
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+
+		line, err := parseLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if !header {
+			if line.Type == Blank {
+				continue
+			}
+			if line.Type != Tag || line.Name != "EXTM3U" {
+				return nil, ErrNotPlaylist
+			}
+			header = true
+		}
+
+		switch line.Type {
+		case Tag:
+			switch line.Name {
+			case "EXT-X-MEDIA-SEQUENCE":
+				value, err := strconv.ParseInt(strings.TrimSpace(line.Value), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid media sequence %q", n, line.Value)
+				}
+				sequence = value
+			case "EXT-X-STREAM-INF":
+				variant = true
+			}
+			if kind, ok := referenceTags[line.Name]; ok {
+				if _, ok := line.Attr("URI"); ok {
+					line.Kind = kind
+					if kind == KindPart {
+						line.Sequence = sequence
+					}
+				}
+			}
+		case URI:
+			if variant {
+				line.Kind = KindPlaylist
+				variant = false
+			} else {
+				line.Kind = KindSegment
+				line.Sequence = sequence
+				sequence++
+			}
+		}
+		playlist.Lines = append(playlist.Lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, ErrNotPlaylist
+	}
+	return playlist, nil
+}
+
+// parseLine classifies a line and splits tags into name and value
+func parseLine(text string) (*Line, error) {
+	trimmed := strings.TrimSpace(text)
+	switch {
+	case trimmed == "":
+		return &Line{Type: Blank, Text: text}, nil
+	case strings.HasPrefix(trimmed, "#EXT"):
+		// Tag, split below
+	case strings.HasPrefix(trimmed, "#"):
+		return &Line{Type: Comment, Text: text}, nil
+	default:
+		return &Line{Type: URI, URI: trimmed}, nil
+	}
+
+	name, value, hasValue := strings.Cut(trimmed[1:], ":")
+	line := &Line{Type: Tag, Name: name, hasValue: hasValue}
+	_, isReference := referenceTags[name]
+	if !hasValue || (!isReference && !attributeTags[name]) {
+		line.Value = value
+		return line, nil
+	}
+
+	attrs, err := parseAttributes(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	line.Attrs = attrs
+	return line, nil
+}
+
+// parseAttributes parses an attribute list: NAME=VALUE pairs separated by commas,
+// where quoted-string values may contain commas
+func parseAttributes(s string) ([]Attribute, error) {
+	attrs := []Attribute{}
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid attribute %q", s)
+		}
+		attr := Attribute{Name: strings.TrimSpace(name)}
+
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted value for %s", attr.Name)
+			}
+			attr.Value = rest[1 : end+1]
+			attr.Quoted = true
+			rest = rest[end+2:]
+			if rest != "" && !strings.HasPrefix(rest, ",") {
+				return nil, fmt.Errorf("unexpected text after quoted value for %s", attr.Name)
+			}
+			s = strings.TrimPrefix(rest, ",")
+		} else {
+			attr.Value, s, _ = strings.Cut(rest, ",")
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
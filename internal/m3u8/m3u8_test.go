@@ -0,0 +1,361 @@
+package m3u8
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const masterPlaylist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="English",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English, CC",LANGUAGE="en",URI="subs/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="audio",SUBTITLES="subs"
+0/stream.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=150000,URI="0/iframes.m3u8"
+`
+
+const tsPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:120
+# Owncast output
+#EXTINF:4.000000,
+stream-120.ts
+#EXTINF:4.000000,
+stream-121.ts?cache=1
+`
+
+const fmp4Playlist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:2.0,
+seg-7.m4s
+#EXTINF:2.0,
+http://owncast:8080/hls/0/seg-8.m4s
+`
+
+const llhlsPlaylist = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.0
+#EXT-X-PART-INF:PART-TARGET=0.333
+#EXT-X-MEDIA-SEQUENCE:50
+#EXTINF:4.0,
+seg-50.ts
+#EXT-X-PART:DURATION=0.333,URI="seg-51.0.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.333,URI="seg-51.1.ts"
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg-51.2.ts"
+#EXT-X-RENDITION-REPORT:URI="../1/stream.m3u8",LAST-MSN=50,LAST-PART=1
+`
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"master", masterPlaylist},
+		{"mpeg-ts", tsPlaylist},
+		{"fmp4", fmp4Playlist},
+		{"ll-hls", llhlsPlaylist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlist, err := Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if got := playlist.String(); got != tt.input {
+				t.Errorf("Round trip changed the playlist:\n%s\nwant:\n%s", got, tt.input)
+			}
+		})
+	}
+}
+
+func TestReferences(t *testing.T) {
+	type reference struct {
+		uri      string
+		kind     Kind
+		sequence int64
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  []reference
+	}{
+		{
+			name:  "master",
+			input: masterPlaylist,
+			want: []reference{
+				{"audio/en.m3u8", KindPlaylist, 0},
+				{"subs/en.m3u8", KindPlaylist, 0},
+				{"0/stream.m3u8", KindPlaylist, 0},
+				{"0/iframes.m3u8", KindPlaylist, 0},
+			},
+		},
+		{
+			name:  "mpeg-ts",
+			input: tsPlaylist,
+			want: []reference{
+				{"stream-120.ts", KindSegment, 120},
+				{"stream-121.ts?cache=1", KindSegment, 121},
+			},
+		},
+		{
+			name:  "fmp4",
+			input: fmp4Playlist,
+			want: []reference{
+				{"init.mp4", KindMap, 0},
+				{"seg-7.m4s", KindSegment, 7},
+				{"http://owncast:8080/hls/0/seg-8.m4s", KindSegment, 8},
+			},
+		},
+		{
+			name:  "ll-hls",
+			input: llhlsPlaylist,
+			want: []reference{
+				{"seg-50.ts", KindSegment, 50},
+				{"seg-51.0.ts", KindPart, 51},
+				{"seg-51.1.ts", KindPart, 51},
+				{"seg-51.2.ts", KindPart, 51},
+				{"../1/stream.m3u8", KindPlaylist, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlist, err := Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			var got []reference
+			for _, line := range playlist.Lines {
+				if uri, ok := line.Reference(); ok {
+					got = append(got, reference{uri, line.Kind, line.Sequence})
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d references, got %d: %v", len(tt.want), len(got), got)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("Reference %d: expected %+v, got %+v", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSetReference(t *testing.T) {
+	playlist, err := Parse(strings.NewReader(masterPlaylist))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	for _, line := range playlist.Lines {
+		if uri, ok := line.Reference(); ok {
+			line.SetReference("/proxy/" + uri + "?token=abc")
+		}
+	}
+
+	got := playlist.String()
+	for _, want := range []string{
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English, CC",LANGUAGE="en",URI="/proxy/subs/en.m3u8?token=abc"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="audio",SUBTITLES="subs"` + "\n/proxy/0/stream.m3u8?token=abc\n",
+		`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=150000,URI="/proxy/0/iframes.m3u8?token=abc"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Rewritten playlist is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestNewTag(t *testing.T) {
+	tag := NewTag("EXT-X-KEY",
+		Attribute{Name: "METHOD", Value: "AES-128"},
+		Attribute{Name: "URI", Value: "/key/1", Quoted: true},
+		Attribute{Name: "IV", Value: "0x00"},
+	)
+	want := `#EXT-X-KEY:METHOD=AES-128,URI="/key/1",IV=0x00`
+	if got := tag.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		notList bool
+	}{
+		{"empty", "", true},
+		{"html", "<html></html>\n", true},
+		{"segment before header", "stream-1.ts\n#EXTM3U\n", true},
+		{"unterminated quote", "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\n", false},
+		{"text after quote", "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"x\n", false},
+		{"bad media sequence", "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:abc\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if errors.Is(err, ErrNotPlaylist) != tt.notList {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	root, _ := url.Parse("http://owncast:8080/hls/")
+	base, _ := url.Parse("http://owncast:8080/hls/0/stream.m3u8")
+
+	tests := []struct {
+		ref  string
+		want Resolved
+	}{
+		{"stream-1.ts", Resolved{InsideRoot, "0/stream-1.ts", ""}},
+		{"stream-1.ts?cache=1", Resolved{InsideRoot, "0/stream-1.ts", "cache=1"}},
+		{"../1/stream.m3u8", Resolved{InsideRoot, "1/stream.m3u8", ""}},
+		{"/hls/2/init.mp4", Resolved{InsideRoot, "2/init.mp4", ""}},
+		{"http://owncast:8080/hls/0/seg.m4s", Resolved{InsideRoot, "0/seg.m4s", ""}},
+		{"../../admin", Resolved{Location: UpstreamHost}},
+		{"/other/seg.ts", Resolved{Location: UpstreamHost}},
+		{"http://owncast:8080/hls/", Resolved{Location: UpstreamHost}},
+		{"http://owncast:8080/api/admin/config", Resolved{Location: UpstreamHost}},
+		{"http://OWNCAST:9000/hls/0/seg.ts", Resolved{Location: UpstreamHost}},
+		{"https://owncast/hls/0/seg.ts", Resolved{Location: UpstreamHost}},
+		{"https://cdn.example.com/hls/0/seg.ts", Resolved{Location: ExternalHost}},
+		{"http://[::1", Resolved{Location: Invalid}},
+	}
+
+	for _, tt := range tests {
+		if got := Resolve(root, base, tt.ref); got != tt.want {
+			t.Errorf("Resolve(%q) = %+v; expected %+v", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestResourceTypes(t *testing.T) {
+	tests := []struct {
+		path        string
+		contentType string
+		media       bool
+		playlist    bool
+	}{
+		{"0/stream.m3u8", "application/vnd.apple.mpegurl", false, true},
+		{"0/stream-1.ts", "video/mp2t", true, false},
+		{"0/seg-1.m4s", "video/iso.segment", true, false},
+		{"0/init.mp4", "video/mp4", true, false},
+		{"audio/seg-1.AAC", "audio/aac", true, false},
+		{"subs/seg-1.vtt", "text/vtt", false, false},
+		{"keys/key.bin", "application/octet-stream", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := ContentType(tt.path); got != tt.contentType {
+			t.Errorf("ContentType(%q) = %q, expected %q", tt.path, got, tt.contentType)
+		}
+		if got := IsMedia(tt.path); got != tt.media {
+			t.Errorf("IsMedia(%q) = %v, expected %v", tt.path, got, tt.media)
+		}
+		if got := IsPlaylist(tt.path); got != tt.playlist {
+			t.Errorf("IsPlaylist(%q) = %v, expected %v", tt.path, got, tt.playlist)
+		}
+	}
+}
+
+func TestParseBlockingReload(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *BlockingReload
+		err   bool
+	}{
+		{"", nil, false},
+		{"token=abc", nil, false},
+		{"_HLS_msn=51", &BlockingReload{MSN: 51, Part: -1}, false},
+		{"_HLS_msn=51&_HLS_part=2", &BlockingReload{MSN: 51, Part: 2}, false},
+		{"_HLS_part=2", nil, true},
+		{"_HLS_msn=-1", nil, true},
+		{"_HLS_msn=51&_HLS_part=x", nil, true},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := ParseBlockingReload(query)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseBlockingReload(%q) error = %v", tt.query, err)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("ParseBlockingReload(%q) = %+v, expected %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestBlockingReloadQuery(t *testing.T) {
+	if got := (&BlockingReload{MSN: 51, Part: -1}).Query(); got != "_HLS_msn=51" {
+		t.Errorf("Unexpected query %q", got)
+	}
+	if got := (&BlockingReload{MSN: 51, Part: 0}).Query(); got != "_HLS_msn=51&_HLS_part=0" {
+		t.Errorf("Unexpected query %q", got)
+	}
+}
+
+func TestLowLatencyPlaylist(t *testing.T) {
+	playlist, err := Parse(strings.NewReader(llhlsPlaylist))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if got := playlist.TargetDuration(); got != 4*time.Second {
+		t.Errorf("Expected target duration 4s, got %v", got)
+	}
+	if got := playlist.PartTarget(); got != 333*time.Millisecond {
+		t.Errorf("Expected part target 333ms, got %v", got)
+	}
+	if got := playlist.LastSequence(); got != 50 {
+		t.Errorf("Expected last sequence 50, got %d", got)
+	}
+
+	tests := []struct {
+		reload BlockingReload
+		want   bool
+	}{
+		{BlockingReload{MSN: 50, Part: -1}, true},
+		{BlockingReload{MSN: 51, Part: -1}, false},
+		{BlockingReload{MSN: 51, Part: 0}, true},
+		{BlockingReload{MSN: 51, Part: 1}, true},
+		{BlockingReload{MSN: 51, Part: 2}, false}, // Only hinted
+		{BlockingReload{MSN: 40, Part: 5}, true},
+	}
+	for _, tt := range tests {
+		if got := playlist.Satisfies(&tt.reload); got != tt.want {
+			t.Errorf("Satisfies(%+v) = %v, expected %v", tt.reload, got, tt.want)
+		}
+	}
+
+	tsPlaylist, _ := Parse(strings.NewReader(tsPlaylist))
+	if got := tsPlaylist.PartTarget(); got != 0 {
+		t.Errorf("Expected no part target, got %v", got)
+	}
+
+	lowLatency := 0
+	for _, line := range playlist.Lines {
+		if IsLowLatency(line) {
+			lowLatency++
+		}
+	}
+	if lowLatency != 4 {
+		t.Errorf("Expected 4 LL-HLS tags, got %d", lowLatency)
+	}
+}
@@ -0,0 +1,99 @@
+package m3u8
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// contentTypes maps the file extensions of HLS resources to their content types
+var contentTypes = map[string]string{
+	".m3u8":   "application/vnd.apple.mpegurl",
+	".ts":     "video/mp2t",
+	".m4s":    "video/iso.segment",
+	".mp4":    "video/mp4",
+	".aac":    "audio/aac",
+	".m4a":    "audio/mp4",
+	".vtt":    "text/vtt",
+	".webvtt": "text/vtt",
+}
+
+// ContentType returns the content type of an HLS resource by its extension
+func ContentType(p string) string {
+	if contentType, ok := contentTypes[extension(p)]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// IsPlaylist reports whether p names a playlist
+func IsPlaylist(p string) bool {
+	return extension(p) == ".m3u8"
+}
+
+// IsMedia reports whether p names an audio or video segment or initialization section
+// Subtitles, keys and playlists are not media.
+func IsMedia(p string) bool {
+	switch extension(p) {
+	case ".ts", ".m4s", ".mp4", ".aac", ".m4a":
+		return true
+	}
+	return false
+}
+
+// extension returns the lower-case extension of a path, ignoring any query
+func extension(p string) string {
+	if idx := strings.IndexAny(p, "?#"); idx != -1 {
+		p = p[:idx]
+	}
+	return strings.ToLower(path.Ext(p))
+}
+
+// Location is where a playlist reference points, relative to the upstream root
+type Location int
+
+const (
+	// InsideRoot references are below the root and are proxied
+	InsideRoot Location = iota
+	// UpstreamHost references are on the root's host but outside the root; they must not reach viewers
+	UpstreamHost
+	// ExternalHost references are on another host, e.g. a CDN, and are left as they are
+	ExternalHost
+	// Invalid references cannot be parsed
+	Invalid
+)
+
+// Resolved is a playlist reference resolved against the upstream root
+type Resolved struct {
+	Location Location
+	Path     string // Below root, set for InsideRoot
+	RawQuery string // The reference's query, set for InsideRoot
+}
+
+// Resolve resolves a reference in the playlist at base against root
+// Relative, host-relative and absolute references are all accepted. Any
+// reference to root's host name outside root, on whatever scheme or port, is
+// UpstreamHost, so proxying cannot be used to reach the rest of the upstream.
+func Resolve(root, base *url.URL, ref string) Resolved {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return Resolved{Location: Invalid}
+	}
+	resolved := base.ResolveReference(u)
+	if !strings.EqualFold(resolved.Hostname(), root.Hostname()) {
+		return Resolved{Location: ExternalHost}
+	}
+	if resolved.Scheme != root.Scheme || resolved.Host != root.Host {
+		return Resolved{Location: UpstreamHost}
+	}
+
+	rootPath := root.Path
+	if !strings.HasSuffix(rootPath, "/") {
+		rootPath += "/"
+	}
+	rel, ok := strings.CutPrefix(resolved.Path, rootPath)
+	if !ok || rel == "" {
+		return Resolved{Location: UpstreamHost}
+	}
+	return Resolved{Location: InsideRoot, Path: rel, RawQuery: resolved.RawQuery}
+}
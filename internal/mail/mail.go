@@ -0,0 +1,215 @@
+// Package mail sends transactional email to viewers
+// Emails are queued in the database and delivered by a background worker
+// through one of the transports below.
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To       string
+	Subject  string
+	Body     string
+	Template string // Name of the template the message was rendered from
+}
+
+// Transport delivers email messages
+type Transport interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// NewTransport returns the transport selected by MAIL_TRANSPORT
+// Without MAIL_TRANSPORT, SMTP is used when SMTP_HOST is set and the log otherwise;
+// config.Load refuses the log fallback in production.
+func NewTransport(cfg *config.Config) Transport {
+	switch cfg.MailTransport {
+	case "file":
+		return NewFileTransport(cfg.MailFileDir, cfg.MailFrom)
+	case "log":
+		return &LogTransport{}
+	}
+
+	if cfg.SMTPHost == "" {
+		log.Warn().Msg("SMTP_HOST not set, emails are not sent and only their recipients are logged")
+		return &LogTransport{}
+	}
+	return NewSMTPTransport(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+}
+
+// SMTPTransport sends email through an SMTP server
+// The connection is upgraded with STARTTLS when the server offers it.
+type SMTPTransport struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPTransport creates a new SMTP transport; username "" sends without authentication
+func NewSMTPTransport(host string, port int, username, password, from string) *SMTPTransport {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPTransport{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		host: host,
+		auth: auth,
+		from: from,
+	}
+}
+
+// Send delivers a message
+func (t *SMTPTransport) Send(ctx context.Context, msg *Message) error {
+	from, to, err := parseAddresses(t.from, msg.To)
+	if err != nil {
+		return err
+	}
+
+	if err := t.send(ctx, from.Address, to.Address, buildMessage(from, to, msg)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// send runs one SMTP session like smtp.SendMail, but gives up when ctx is done
+// A server that stalls must not hold the send past the queue's claim on the email,
+// or another pass would send it again.
+func (t *SMTPTransport) send(ctx context.Context, from, to string, data []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancelling ctx interrupts a read or write in progress
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: t.host}); err != nil {
+			return err
+		}
+	}
+	if t.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support AUTH")
+		}
+		if err := c.Auth(t.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// FileTransport writes each message to its own .eml file (development and tests)
+type FileTransport struct {
+	dir  string
+	from string
+}
+
+// NewFileTransport creates a new file transport writing to dir
+func NewFileTransport(dir, from string) *FileTransport {
+	return &FileTransport{dir: dir, from: from}
+}
+
+// Send writes a message to a new file in the transport's directory
+func (t *FileTransport) Send(ctx context.Context, msg *Message) error {
+	from, to, err := parseAddresses(t.from, msg.To)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	name := time.Now().UTC().Format("20060102T150405") + "-" + uuid.NewString() + ".eml"
+	if err := os.WriteFile(filepath.Join(t.dir, name), buildMessage(from, to, msg), 0o644); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	return nil
+}
+
+// LogTransport logs who messages are for instead of sending them (development)
+// Bodies are left out: they hold recovery links and gift codes.
+type LogTransport struct{}
+
+// Send logs a message's recipient and template
+func (t *LogTransport) Send(ctx context.Context, msg *Message) error {
+	log.Info().
+		Str("to", msg.To).
+		Str("template", msg.Template).
+		Msg("Email not sent, only logged")
+	return nil
+}
+
+// parseAddresses parses the sender and recipient of a message
+func parseAddresses(fromAddr, toAddr string) (*netmail.Address, *netmail.Address, error) {
+	from, err := netmail.ParseAddress(fromAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+	to, err := netmail.ParseAddress(toAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+	return from, to, nil
+}
+
+// buildMessage formats a message with the headers mail clients expect
+func buildMessage(from, to *netmail.Address, msg *Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from.String() + "\r\n")
+	b.WriteString("To: " + to.String() + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,276 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for attempts := 1; attempts <= len(retryDelays); attempts++ {
+		delay, ok := retryDelay(attempts)
+		if !ok {
+			t.Fatalf("attempt %d: expected a retry", attempts)
+		}
+		if attempts > 1 {
+			previous, _ := retryDelay(attempts - 1)
+			if delay <= previous {
+				t.Errorf("attempt %d: delay %v should be longer than %v", attempts, delay, previous)
+			}
+		}
+	}
+
+	if _, ok := retryDelay(len(retryDelays) + 1); ok {
+		t.Error("expected no retry after the last delay")
+	}
+}
+
+func TestNextAttemptStopsAtMaxAge(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	receipt := &models.OutboundEmail{Template: "receipt", Attempts: 4, CreatedAt: now.Add(-time.Hour)}
+	if retryAt, ok := nextAttempt(receipt, now); !ok || !retryAt.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("receipt retry = %v, %v; want in 2 hours", retryAt, ok)
+	}
+
+	recovery := &models.OutboundEmail{Template: "recovery_link", Attempts: 2, CreatedAt: now.Add(-2 * time.Minute)}
+	if retryAt, ok := nextAttempt(recovery, now); !ok || !retryAt.Equal(now.Add(5*time.Minute)) {
+		t.Errorf("recovery link retry = %v, %v; want in 5 minutes", retryAt, ok)
+	}
+
+	// The 30 minute retry would land after the link expires
+	recovery.Attempts = 3
+	if _, ok := nextAttempt(recovery, now); ok {
+		t.Error("expected no retry past the recovery link's lifetime")
+	}
+
+	if expired(recovery, now.Add(10*time.Minute)) {
+		t.Error("recovery link expired before its max age")
+	}
+	if !expired(recovery, now.Add(14*time.Minute)) {
+		t.Error("expected the recovery link to expire after its max age")
+	}
+	if expired(receipt, now.Add(30*24*time.Hour)) {
+		t.Error("receipts should not expire")
+	}
+}
+
+// TestRenderTemplates renders every template in web/templates/email with the data its callers send
+func TestRenderTemplates(t *testing.T) {
+	dir := filepath.Join("..", "..", "web", "templates", "email")
+	tests := []struct {
+		name string
+		data map[string]any
+		want string
+	}{
+		{"receipt", map[string]any{
+			"Title": "Finals", "Amount": "9.90", "Date": "1.2.2026", "PaymentID": "abc",
+			"WatchURL": "https://example.com/watch/finals", "RecoverURL": "https://example.com/recover/finals",
+			"GiftCode": "", "GiftRecipient": "", "RedeemURL": "",
+		}, "https://example.com/watch/finals"},
+		{"receipt", map[string]any{
+			"Title": "Finals", "Amount": "9.90", "Date": "1.2.2026", "PaymentID": "abc",
+			"WatchURL": "https://example.com/watch/finals", "RecoverURL": "https://example.com/recover/finals",
+			"GiftCode": "GIFT-AAAA-BBBB-CCCC", "GiftRecipient": "friend@example.com",
+			"RedeemURL": "https://example.com/recover/finals?gift=GIFT-AAAA-BBBB-CCCC",
+		}, "GIFT-AAAA-BBBB-CCCC"},
+		{"gift", map[string]any{
+			"Title": "Finals", "Payer": "payer@example.com", "GiftCode": "GIFT-AAAA-BBBB-CCCC",
+			"RedeemURL": "https://example.com/recover/finals?gift=GIFT-AAAA-BBBB-CCCC",
+		}, "payer@example.com"},
+		{"whitelist", map[string]any{
+			"Title": "Finals", "RecoverURL": "https://example.com/recover/finals",
+		}, "https://example.com/recover/finals"},
+		{"recovery_link", map[string]any{
+			"Title": "Finals", "LinkURL": "https://example.com/recover/finals?link=xyz", "ExpiresMinutes": 15,
+		}, "?link=xyz"},
+	}
+
+	for _, tt := range tests {
+		subject, body, err := Render(dir, tt.name, tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.Contains(subject, "Finals") {
+			t.Errorf("%s: subject %q should name the product", tt.name, subject)
+		}
+		if !strings.Contains(body, tt.want) {
+			t.Errorf("%s: body should contain %q:\n%s", tt.name, tt.want, body)
+		}
+	}
+}
+
+func TestRenderRejectsBadNames(t *testing.T) {
+	for _, name := range []string{"", "../base", "receipt.txt", `a\b`} {
+		if _, _, err := Render(t.TempDir(), name, nil); err == nil {
+			t.Errorf("Render(%q) should fail", name)
+		}
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	transport := NewFileTransport(dir, "Stream Paywall <noreply@example.com>")
+
+	msg := &Message{To: "viewer@example.com", Subject: "Tervetuloa", Body: "Line one\nLine two\n"}
+	if err := transport.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Fatalf("expected one .eml file, got %v", files)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: <viewer@example.com>\r\n", "Subject: Tervetuloa\r\n", "\r\n\r\nLine one\r\nLine two\r\n"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("message should contain %q:\n%s", want, content)
+		}
+	}
+
+	if err := transport.Send(context.Background(), &Message{To: "not an address"}); err == nil {
+		t.Error("expected an error for an invalid recipient")
+	}
+}
+
+// fakeSMTPServer accepts SMTP sessions without STARTTLS or AUTH and keeps the data of each message
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				messages <- string(data)
+				tp.PrintfLine("250 Queued")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+// newTestSMTPTransport returns an SMTP transport sending to addr
+func newTestSMTPTransport(t *testing.T, addr string) *SMTPTransport {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	return NewSMTPTransport(host, portNum, "", "", "Stream Paywall <noreply@example.com>")
+}
+
+func TestSMTPTransport(t *testing.T) {
+	addr, messages := fakeSMTPServer(t)
+	transport := newTestSMTPTransport(t, addr)
+
+	msg := &Message{To: "viewer@example.com", Subject: "Tervetuloa", Body: "Line one\n"}
+	if err := transport.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-messages:
+		if !strings.Contains(data, "Subject: Tervetuloa") || !strings.Contains(data, "Line one") {
+			t.Errorf("server received:\n%s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server received no message")
+	}
+}
+
+func TestSMTPTransportGivesUpOnStalledServer(t *testing.T) {
+	// Accepts connections but never greets, like a server that hangs
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	transport := newTestSMTPTransport(t, ln.Addr().String())
+	msg := &Message{To: "viewer@example.com", Subject: "Tervetuloa", Body: "Line one\n"}
+
+	deadlineCtx, cancelDeadline := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelDeadline()
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	for name, ctx := range map[string]context.Context{"deadline": deadlineCtx, "cancel": cancelCtx} {
+		start := time.Now()
+		err := transport.Send(ctx, msg)
+		if err == nil {
+			t.Errorf("%s: Send to a stalled server succeeded", name)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: Send returned after %v, want it to stop when the context is done", name, elapsed)
+		}
+	}
+}
+
+func TestLogTransportLeavesOutBody(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&buf)
+
+	msg := &Message{To: "viewer@example.com", Subject: "Recover access", Body: "https://paywall.example/recover/final?link=secret-link", Template: "recovery_link"}
+	if err := (&LogTransport{}).Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "secret-link") || !strings.Contains(out, "viewer@example.com") || !strings.Contains(out, "recovery_link") {
+		t.Errorf("log output = %s, want the recipient and template only", out)
+	}
+}
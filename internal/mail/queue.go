@@ -0,0 +1,252 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// claimBatchSize is how many due emails one queue pass sends
+	claimBatchSize = 10
+	// sendTimeout limits a single delivery attempt
+	sendTimeout = 30 * time.Second
+	// claimLease is how long a claimed email is hidden from other passes
+	claimLease = 10 * time.Minute
+)
+
+// RecoveryLinkTTL is how long an emailed recovery link can be used
+const RecoveryLinkTTL = 15 * time.Minute
+
+// retryDelays is the wait before each retry of a failed send; after the last one the email fails
+var retryDelays = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	6 * time.Hour,
+}
+
+// templateMaxAge is how long emails from a template stay worth sending after they are queued
+// Recovery links expire RecoveryLinkTTL after they are issued, so a later send
+// would only deliver a dead link. Templates not listed retry through all of retryDelays.
+var templateMaxAge = map[string]time.Duration{
+	"recovery_link": RecoveryLinkTTL,
+}
+
+// retryDelay returns how long to wait after the given number of failed attempts
+// Returns false when no attempts are left.
+func retryDelay(attempts int) (time.Duration, bool) {
+	if attempts < 1 || attempts > len(retryDelays) {
+		return 0, false
+	}
+	return retryDelays[attempts-1], true
+}
+
+// expired returns true if the email is past its template's max age at the given time
+func expired(email *models.OutboundEmail, at time.Time) bool {
+	maxAge, ok := templateMaxAge[email.Template]
+	return ok && at.Sub(email.CreatedAt) > maxAge
+}
+
+// nextAttempt returns when to retry a failed send
+// Returns false when no attempts are left or the retry would come too late.
+func nextAttempt(email *models.OutboundEmail, now time.Time) (time.Time, bool) {
+	delay, ok := retryDelay(email.Attempts)
+	if !ok || expired(email, now.Add(delay)) {
+		return time.Time{}, false
+	}
+	return now.Add(delay), true
+}
+
+// Queue adds emails to the outbound queue
+// Enqueuing only writes to the database, so it is safe to call from request handlers.
+type Queue struct {
+	pgStore *storage.PostgresStore
+}
+
+// NewQueue creates a new outbound email queue
+func NewQueue(pgStore *storage.PostgresStore) *Queue {
+	return &Queue{pgStore: pgStore}
+}
+
+// Enqueue queues an email rendered from the named template in web/templates/email
+// data must encode to a JSON object; the template reads its fields by name.
+func (q *Queue) Enqueue(ctx context.Context, to, templateName string, data map[string]any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode email data: %w", err)
+	}
+	if err := q.pgStore.EnqueueEmail(ctx, to, templateName, encoded); err != nil {
+		return fmt.Errorf("failed to queue email: %w", err)
+	}
+	return nil
+}
+
+// Worker delivers queued emails
+type Worker struct {
+	cfg         *config.Config
+	pgStore     *storage.PostgresStore
+	transport   Transport
+	templateDir string
+}
+
+// NewWorker creates a new worker rendering templates from templateDir/email
+func NewWorker(cfg *config.Config, pgStore *storage.PostgresStore, transport Transport, templateDir string) *Worker {
+	return &Worker{
+		cfg:         cfg,
+		pgStore:     pgStore,
+		transport:   transport,
+		templateDir: templateDir,
+	}
+}
+
+// Run sends due emails every cfg.MailQueueInterval until ctx is canceled
+func (w *Worker) Run(ctx context.Context) {
+	if w.cfg.MailQueueInterval <= 0 {
+		log.Info().Msg("Outbound email queue disabled")
+		return
+	}
+
+	ticker := time.NewTicker(w.cfg.MailQueueInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.SendDue(ctx)
+		}
+	}
+}
+
+// SendDue sends every email that is due, one batch at a time
+func (w *Worker) SendDue(ctx context.Context) {
+	for {
+		emails, err := w.pgStore.ClaimDueEmails(ctx, claimBatchSize, time.Now().Add(claimLease))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to claim queued emails")
+			return
+		}
+
+		for _, email := range emails {
+			w.send(ctx, email)
+		}
+
+		if len(emails) < claimBatchSize {
+			return
+		}
+	}
+}
+
+// send delivers one claimed email and records the result
+func (w *Worker) send(ctx context.Context, email *models.OutboundEmail) {
+	if expired(email, time.Now()) {
+		log.Warn().
+			Str("email_id", email.ID.String()).
+			Str("to", email.ToEmail).
+			Str("template", email.Template).
+			Msg("Dropping expired email")
+		if err := w.pgStore.FailEmail(ctx, email.ID, "expired before it could be sent"); err != nil {
+			log.Error().Err(err).Str("email_id", email.ID.String()).Msg("Failed to record email failure")
+		}
+		return
+	}
+
+	msg, err := w.render(email)
+	if err != nil {
+		// Retrying will not fix a broken template or data
+		log.Error().Err(err).Str("email_id", email.ID.String()).Str("template", email.Template).Msg("Failed to render email")
+		if err := w.pgStore.FailEmail(ctx, email.ID, err.Error()); err != nil {
+			log.Error().Err(err).Str("email_id", email.ID.String()).Msg("Failed to record email failure")
+		}
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+	err = w.transport.Send(sendCtx, msg)
+	cancel()
+
+	if err == nil {
+		if err := w.pgStore.MarkEmailSent(ctx, email.ID); err != nil {
+			log.Error().Err(err).Str("email_id", email.ID.String()).Msg("Failed to record sent email")
+			return
+		}
+		log.Info().
+			Str("email_id", email.ID.String()).
+			Str("to", email.ToEmail).
+			Str("template", email.Template).
+			Msg("Email sent")
+		return
+	}
+
+	retryAt, ok := nextAttempt(email, time.Now())
+	if !ok {
+		log.Error().Err(err).
+			Str("email_id", email.ID.String()).
+			Str("to", email.ToEmail).
+			Int("attempts", email.Attempts).
+			Msg("Giving up on email")
+		if err := w.pgStore.FailEmail(ctx, email.ID, err.Error()); err != nil {
+			log.Error().Err(err).Str("email_id", email.ID.String()).Msg("Failed to record email failure")
+		}
+		return
+	}
+
+	log.Warn().Err(err).
+		Str("email_id", email.ID.String()).
+		Str("to", email.ToEmail).
+		Int("attempts", email.Attempts).
+		Time("retry_at", retryAt).
+		Msg("Failed to send email, will retry")
+	if err := w.pgStore.RetryEmail(ctx, email.ID, retryAt, err.Error()); err != nil {
+		log.Error().Err(err).Str("email_id", email.ID.String()).Msg("Failed to schedule email retry")
+	}
+}
+
+// render builds the message for a queued email from its template
+func (w *Worker) render(email *models.OutboundEmail) (*Message, error) {
+	var data map[string]any
+	if err := json.Unmarshal(email.Data, &data); err != nil {
+		return nil, fmt.Errorf("invalid email data: %w", err)
+	}
+
+	subject, body, err := Render(filepath.Join(w.templateDir, "email"), email.Template, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{To: email.ToEmail, Subject: subject, Body: body, Template: email.Template}, nil
+}
+
+// Render executes dir/name.txt, which defines a "subject" and a "body" template
+// Templates are parsed on every call so edits apply without a restart.
+func Render(dir, name string, data any) (string, string, error) {
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return "", "", fmt.Errorf("invalid email template name %q", name)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").ParseFiles(filepath.Join(dir, name+".txt"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse email template: %w", err)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", "", fmt.Errorf("failed to render email subject: %w", err)
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return "", "", fmt.Errorf("failed to render email body: %w", err)
+	}
+	return strings.TrimSpace(subject.String()), strings.TrimSpace(body.String()) + "\n", nil
+}
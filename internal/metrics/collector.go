@@ -11,6 +11,8 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/laurikarhu/stream-paywall/internal/cache"
+	"github.com/laurikarhu/stream-paywall/internal/docker"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
@@ -68,6 +70,52 @@ type GoRuntimeMetrics struct {
 	NumGC       uint32  `json:"numGC"`
 }
 
+// CacheMetrics represents the usage of one of the server's in-memory caches
+type CacheMetrics struct {
+	Name         string               `json:"name"`
+	Entries      int                  `json:"entries"`
+	SizeMB       float64              `json:"sizeMB"`
+	MaxSizeMB    float64              `json:"maxSizeMB"`
+	UsagePercent float64              `json:"usagePercent"`
+	Hits         uint64               `json:"hits"`
+	Misses       uint64               `json:"misses"`
+	HitRate      float64              `json:"hitRate"`
+	Evictions    uint64               `json:"evictions"`
+	Expirations  uint64               `json:"expirations"`
+	Streams      []StreamCacheMetrics `json:"streams"`
+}
+
+// StreamCacheMetrics represents the share of a cache used by one stream
+type StreamCacheMetrics struct {
+	StreamID string  `json:"streamId"`
+	Entries  int     `json:"entries"`
+	SizeMB   float64 `json:"sizeMB"`
+}
+
+// CacheSource reports the usage of a component's caches
+type CacheSource interface {
+	CacheStats() []cache.Stats
+}
+
+// ReconcileSource reports the container reconciler's findings
+type ReconcileSource interface {
+	LastReport() *docker.ReconcileReport
+	Events() []docker.Event
+}
+
+// ReconcileMetrics represents the latest container reconciliation pass
+type ReconcileMetrics struct {
+	LastRun          time.Time `json:"lastRun"`
+	Checked          int       `json:"checked"`
+	Corrected        int       `json:"corrected"`
+	OrphanContainers []string  `json:"orphanContainers"`
+	OrphanVolumes    []string  `json:"orphanVolumes"`
+	Errors           int       `json:"errors"`
+}
+
+// reconcileAlertWindow is how long a container status correction stays an alert
+const reconcileAlertWindow = 15 * time.Minute
+
 // Alert represents a system alert
 type Alert struct {
 	Level     HealthStatus `json:"level"`
@@ -84,6 +132,8 @@ type SystemMetrics struct {
 	Redis             RedisMetrics       `json:"redis"`
 	Postgres          PostgresMetrics    `json:"postgres"`
 	GoRuntime         GoRuntimeMetrics   `json:"goRuntime"`
+	Caches            []CacheMetrics     `json:"caches"`
+	Reconcile         *ReconcileMetrics  `json:"reconcile,omitempty"`
 	Alerts            []Alert            `json:"alerts"`
 }
 
@@ -109,6 +159,8 @@ type Collector struct {
 	cpuStatsCache     map[string]*cpuStatsCache     // container ID -> previous CPU stats
 	networkStatsCache map[string]*networkStatsCache // container ID -> previous network stats
 	cacheMu           sync.Mutex
+	cacheSources      []CacheSource
+	reconcileSource   ReconcileSource
 }
 
 // NewCollector creates a new metrics collector
@@ -122,6 +174,18 @@ func NewCollector(dockerClient *client.Client, redisClient *redis.Client, pgPool
 	}
 }
 
+// AddCacheSource adds a component whose caches are reported with the metrics
+// Sources must be added before metrics are collected.
+func (c *Collector) AddCacheSource(source CacheSource) {
+	c.cacheSources = append(c.cacheSources, source)
+}
+
+// SetReconcileSource sets the container reconciler whose findings are reported with the metrics
+// It must be set before metrics are collected.
+func (c *Collector) SetReconcileSource(source ReconcileSource) {
+	c.reconcileSource = source
+}
+
 // Collect gathers all metrics
 func (c *Collector) Collect(ctx context.Context) (*SystemMetrics, error) {
 	metrics := &SystemMetrics{
@@ -155,6 +219,16 @@ func (c *Collector) Collect(ctx context.Context) (*SystemMetrics, error) {
 	// Collect Go runtime metrics
 	metrics.GoRuntime = c.collectGoRuntimeMetrics()
 
+	// Collect cache metrics
+	metrics.Caches = c.collectCacheMetrics()
+
+	// Collect container reconciliation findings
+	if c.reconcileSource != nil {
+		reconcileMetrics, reconcileAlerts := c.collectReconcileMetrics(metrics.Timestamp)
+		metrics.Reconcile = reconcileMetrics
+		metrics.Alerts = append(metrics.Alerts, reconcileAlerts...)
+	}
+
 	// Determine overall status based on alerts
 	for _, alert := range metrics.Alerts {
 		if alert.Level == HealthStatusCritical {
@@ -530,3 +604,89 @@ func (c *Collector) collectGoRuntimeMetrics() GoRuntimeMetrics {
 		NumGC:       memStats.NumGC,
 	}
 }
+
+// collectCacheMetrics collects the usage and hit/miss/eviction counters of every cache
+func (c *Collector) collectCacheMetrics() []CacheMetrics {
+	caches := []CacheMetrics{}
+	for _, source := range c.cacheSources {
+		for _, stats := range source.CacheStats() {
+			m := CacheMetrics{
+				Name:        stats.Name,
+				Entries:     stats.Entries,
+				SizeMB:      float64(stats.Bytes) / (1024 * 1024),
+				MaxSizeMB:   float64(stats.MaxBytes) / (1024 * 1024),
+				Hits:        stats.Hits,
+				Misses:      stats.Misses,
+				Evictions:   stats.Evictions,
+				Expirations: stats.Expirations,
+				Streams:     make([]StreamCacheMetrics, 0, len(stats.Streams)),
+			}
+			if stats.MaxBytes > 0 {
+				m.UsagePercent = float64(stats.Bytes) / float64(stats.MaxBytes) * 100
+			}
+			if stats.Hits+stats.Misses > 0 {
+				m.HitRate = float64(stats.Hits) / float64(stats.Hits+stats.Misses) * 100
+			}
+			for _, stream := range stats.Streams {
+				m.Streams = append(m.Streams, StreamCacheMetrics{
+					StreamID: stream.StreamID,
+					Entries:  stream.Entries,
+					SizeMB:   float64(stream.Bytes) / (1024 * 1024),
+				})
+			}
+			caches = append(caches, m)
+		}
+	}
+	return caches
+}
+
+// collectReconcileMetrics reports the latest reconciliation pass
+// Orphans are alerts for as long as they exist, corrections for reconcileAlertWindow.
+func (c *Collector) collectReconcileMetrics(now time.Time) (*ReconcileMetrics, []Alert) {
+	var alerts []Alert
+
+	report := c.reconcileSource.LastReport()
+	if report == nil {
+		return nil, alerts
+	}
+	m := &ReconcileMetrics{
+		LastRun:          report.Time,
+		Checked:          report.Checked,
+		Corrected:        report.Corrected,
+		OrphanContainers: append([]string{}, report.OrphanContainers...),
+		OrphanVolumes:    append([]string{}, report.OrphanVolumes...),
+		Errors:           report.Errors,
+	}
+
+	for _, event := range c.reconcileSource.Events() {
+		if event.Kind == docker.EventStatusCorrected && now.Sub(event.Time) <= reconcileAlertWindow {
+			alerts = append(alerts, Alert{
+				Level:     HealthStatusWarning,
+				Component: "reconciler",
+				Message:   event.Message(),
+			})
+		}
+	}
+	for _, name := range report.OrphanContainers {
+		alerts = append(alerts, Alert{
+			Level:     HealthStatusWarning,
+			Component: "reconciler",
+			Message:   "Container " + name + " has no stream",
+		})
+	}
+	for _, name := range report.OrphanVolumes {
+		alerts = append(alerts, Alert{
+			Level:     HealthStatusWarning,
+			Component: "reconciler",
+			Message:   "Volume " + name + " has no stream",
+		})
+	}
+	if report.Errors > 0 {
+		alerts = append(alerts, Alert{
+			Level:     HealthStatusWarning,
+			Component: "reconciler",
+			Message:   "Container reconciliation failed, see the server logs",
+		})
+	}
+	return m, alerts
+}
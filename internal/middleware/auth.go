@@ -73,13 +73,7 @@ func (m *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
 		}
 
 		// Recreate session in Redis for future requests
-		session = &storage.SessionData{
-			Token:     token,
-			StreamID:  payment.StreamID.String(),
-			Email:     payment.Email,
-			PaymentID: payment.ID.String(),
-			ExpiresAt: *payment.TokenExpiry,
-		}
+		session = storage.NewPaymentSession(payment, token, *payment.TokenExpiry)
 		if err := m.redis.SetSession(ctx, token, session, m.cfg.SessionDuration); err != nil {
 			log.Warn().Err(err).Msg("Failed to cache session in Redis")
 		}
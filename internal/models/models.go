@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,25 +27,51 @@ const (
 	ContainerStatusError    ContainerStatus = "error"
 )
 
+// IngestBackend is where a stream's Owncast instance runs
+type IngestBackend string
+
+const (
+	IngestBackendDocker     IngestBackend = "docker"     // A container started by the paywall through the Docker socket
+	IngestBackendExternal   IngestBackend = "external"   // An Owncast instance run elsewhere, reached at OwncastURL
+	IngestBackendKubernetes IngestBackend = "kubernetes" // A Deployment, Service and PVC in the paywall's namespace
+)
+
+// Valid reports whether b is a known ingest backend
+func (b IngestBackend) Valid() bool {
+	switch b {
+	case IngestBackendDocker, IngestBackendExternal, IngestBackendKubernetes:
+		return true
+	}
+	return false
+}
+
 // Stream represents a paywall-protected video stream
 type Stream struct {
-	ID          uuid.UUID    `json:"id"`
-	Slug        string       `json:"slug"`
-	Title       string       `json:"title"`
-	Description string       `json:"description,omitempty"`
-	PriceCents  int          `json:"price_cents"` // Price in cents (e.g., 990 = 9.90€)
-	StartTime   *time.Time   `json:"start_time,omitempty"`
-	EndTime     *time.Time   `json:"end_time,omitempty"`
-	Status      StreamStatus `json:"status"`
-	OwncastURL  string       `json:"-"` // Never expose to clients (auto-generated)
-	MaxViewers  int          `json:"max_viewers,omitempty"` // 0 = unlimited
-	CreatedAt   time.Time    `json:"created_at"`
+	ID           uuid.UUID    `json:"id"`
+	Slug         string       `json:"slug"`
+	Title        string       `json:"title"`
+	Description  string       `json:"description,omitempty"`
+	PriceCents   int          `json:"price_cents"` // Price in cents (e.g., 990 = 9.90€)
+	StartTime    *time.Time   `json:"start_time,omitempty"`
+	EndTime      *time.Time   `json:"end_time,omitempty"`
+	Status       StreamStatus `json:"status"`
+	OwncastURL   string       `json:"-"`                     // Never expose to clients (auto-generated)
+	MaxViewers   int          `json:"max_viewers,omitempty"` // Seats: tickets sold and tokens watching at once; 0 = unlimited
+	Tags         []string     `json:"tags,omitempty"`        // Lower-case labels used by bundles
+	MembersOnly  bool         `json:"members_only"`          // Watchable with a membership only; no single tickets
+	WatermarkURL string       `json:"-"`                     // Marked B rendition for forensic watermarking ("" = off)
+	CreatedAt    time.Time    `json:"created_at"`
 
 	// Dynamic Owncast container fields
+	Backend         IngestBackend   `json:"backend"`            // Where the Owncast instance runs
 	StreamKey       string          `json:"-"`                  // OBS stream key (never expose)
 	RTMPPort        int             `json:"rtmp_port"`          // Assigned RTMP port
 	ContainerName   string          `json:"-"`                  // Docker container name
 	ContainerStatus ContainerStatus `json:"container_status"`   // Container state
+
+	// Owncast admin fields
+	EncryptedAdminPassword string     `json:"-"` // Sealed Owncast admin password ("" = OWNCAST_ADMIN_PASSWORD)
+	OwncastProvisionedAt   *time.Time `json:"-"` // When the Owncast was configured (nil = on its next start)
 }
 
 // PriceEuros returns the price formatted in euros
@@ -52,6 +79,87 @@ func (s *Stream) PriceEuros() float64 {
 	return float64(s.PriceCents) / 100
 }
 
+// HasTag checks whether the stream carries a tag (case-insensitive)
+func (s *Stream) HasTag(tag string) bool {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTags splits a comma-separated tag list into normalized, de-duplicated tags
+func ParseTags(s string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+// Bundle is a product that grants access to several streams for one price,
+// e.g. a season pass. A stream is included if it is listed in StreamIDs, or
+// if the bundle has a tag and/or date range and the stream matches all of them.
+type Bundle struct {
+	ID           uuid.UUID   `json:"id"`
+	Slug         string      `json:"slug"`
+	Title        string      `json:"title"`
+	Description  string      `json:"description,omitempty"`
+	PriceCents   int         `json:"price_cents"`
+	StreamIDs    []uuid.UUID `json:"stream_ids"`              // Explicitly included streams
+	Tag          string      `json:"tag,omitempty"`           // Include streams with this tag
+	StartsAfter  *time.Time  `json:"starts_after,omitempty"`  // Include streams starting at or after this time
+	StartsBefore *time.Time  `json:"starts_before,omitempty"` // Include streams starting before this time
+	Active       bool        `json:"active"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+// PriceEuros returns the price formatted in euros
+func (b *Bundle) PriceEuros() float64 {
+	return float64(b.PriceCents) / 100
+}
+
+// HasRule reports whether the bundle selects streams by tag or date range
+func (b *Bundle) HasRule() bool {
+	return b.Tag != "" || b.StartsAfter != nil || b.StartsBefore != nil
+}
+
+// Covers checks whether the bundle grants access to a stream
+func (b *Bundle) Covers(stream *Stream) bool {
+	for _, id := range b.StreamIDs {
+		if id == stream.ID {
+			return true
+		}
+	}
+
+	if !b.HasRule() {
+		return false
+	}
+	if b.Tag != "" && !stream.HasTag(b.Tag) {
+		return false
+	}
+	if b.StartsAfter != nil || b.StartsBefore != nil {
+		if stream.StartTime == nil {
+			return false
+		}
+		if b.StartsAfter != nil && stream.StartTime.Before(*b.StartsAfter) {
+			return false
+		}
+		if b.StartsBefore != nil && !stream.StartTime.Before(*b.StartsBefore) {
+			return false
+		}
+	}
+	return true
+}
+
 // PaymentStatus represents the state of a payment
 type PaymentStatus string
 
@@ -63,9 +171,12 @@ const (
 )
 
 // Payment represents a payment for stream access
+// A payment buys either a single stream (StreamID) or a bundle (BundleID);
+// StreamID is uuid.Nil for bundle payments.
 type Payment struct {
 	ID                   uuid.UUID     `json:"id"`
 	StreamID             uuid.UUID     `json:"stream_id"`
+	BundleID             *uuid.UUID    `json:"bundle_id,omitempty"`
 	Email                string        `json:"email"`
 	AmountCents          int           `json:"amount_cents"`
 	Status               PaymentStatus `json:"status"`
@@ -73,20 +184,304 @@ type Payment struct {
 	PaytrailTransactionID string       `json:"paytrail_transaction_id,omitempty"`
 	AccessToken          string        `json:"-"` // Never expose directly
 	TokenExpiry          *time.Time    `json:"token_expiry,omitempty"`
+	PromoCodeID          *uuid.UUID    `json:"promo_code_id,omitempty"`
+	DiscountCents        int           `json:"discount_cents,omitempty"`
+	RecipientEmail       string        `json:"recipient_email,omitempty"` // Gift recipient; Email is the payer
+	GiftCode             string        `json:"-"`
+	GiftRedeemedAt       *time.Time    `json:"gift_redeemed_at,omitempty"`
 	CreatedAt            time.Time     `json:"created_at"`
 }
 
 // IsTokenValid checks if the access token is still valid
+// Gifts grant no access until the recipient redeems them.
 func (p *Payment) IsTokenValid() bool {
 	if p.Status != PaymentStatusCompleted {
 		return false
 	}
+	if p.IsGift() && p.GiftRedeemedAt == nil {
+		return false
+	}
 	if p.TokenExpiry == nil {
 		return false
 	}
 	return time.Now().Before(*p.TokenExpiry)
 }
 
+// IsGift reports whether the payment was bought for another email
+func (p *Payment) IsGift() bool {
+	return p.RecipientEmail != ""
+}
+
+// ViewerEmail returns the email the payment's access belongs to
+func (p *Payment) ViewerEmail() string {
+	if p.IsGift() {
+		return p.RecipientEmail
+	}
+	return p.Email
+}
+
+// IsBundle reports whether the payment bought a bundle rather than a single stream
+func (p *Payment) IsBundle() bool {
+	return p.BundleID != nil
+}
+
+// SubscriptionStatus represents the lifecycle state of a membership
+type SubscriptionStatus string
+
+const (
+	SubscriptionStatusIncomplete SubscriptionStatus = "incomplete" // Waiting for a card and the first charge
+	SubscriptionStatusActive     SubscriptionStatus = "active"
+	SubscriptionStatusPastDue    SubscriptionStatus = "past_due" // Renewal failed; dunning is retrying the charge
+	SubscriptionStatusCanceled   SubscriptionStatus = "canceled" // Ended by the member or an admin
+	SubscriptionStatusExpired    SubscriptionStatus = "expired"  // Ended after dunning gave up
+)
+
+// Subscription is a recurring membership that grants access to members-only streams
+// Renewals charge the saved card token every PeriodMonths.
+type Subscription struct {
+	ID                 uuid.UUID          `json:"id"`
+	Email              string             `json:"email"`
+	Status             SubscriptionStatus `json:"status"`
+	PriceCents         int                `json:"price_cents"`
+	PeriodMonths       int                `json:"period_months"`
+	CurrentPeriodStart *time.Time         `json:"current_period_start,omitempty"`
+	CurrentPeriodEnd   *time.Time         `json:"current_period_end,omitempty"`
+	NextChargeAt       *time.Time         `json:"next_charge_at,omitempty"`
+	CancelAtPeriodEnd  bool               `json:"cancel_at_period_end"`
+	FailedCharges      int                `json:"failed_charges"`
+	CardToken          string             `json:"-"` // Never expose
+	CardType           string             `json:"card_type,omitempty"`
+	CardLast4          string             `json:"card_last4,omitempty"`
+	CardExpiry         string             `json:"card_expiry,omitempty"` // MM/YYYY
+	AccessToken        string             `json:"-"`                     // Never expose directly
+	CreatedAt          time.Time          `json:"created_at"`
+	CanceledAt         *time.Time         `json:"canceled_at,omitempty"`
+}
+
+// PriceEuros returns the price formatted in euros
+func (s *Subscription) PriceEuros() float64 {
+	return float64(s.PriceCents) / 100
+}
+
+// HasAccessAt checks whether the membership grants access at time t
+// Past-due members keep access while dunning retries the charge.
+func (s *Subscription) HasAccessAt(t time.Time) bool {
+	switch s.Status {
+	case SubscriptionStatusActive:
+		if s.CancelAtPeriodEnd {
+			return s.CurrentPeriodEnd != nil && t.Before(*s.CurrentPeriodEnd)
+		}
+		return true
+	case SubscriptionStatusPastDue:
+		return true
+	}
+	return false
+}
+
+// IsLive reports whether the membership is running (active or in dunning)
+func (s *Subscription) IsLive() bool {
+	return s.Status == SubscriptionStatusActive || s.Status == SubscriptionStatusPastDue
+}
+
+// NextPeriod returns the billing period that follows one ending at end
+// A period that would already be over at now starts from now instead.
+func (s *Subscription) NextPeriod(end, now time.Time) (time.Time, time.Time) {
+	start := end
+	if !start.AddDate(0, s.PeriodMonths, 0).After(now) {
+		start = now
+	}
+	return start, start.AddDate(0, s.PeriodMonths, 0)
+}
+
+// ChargeStatus represents the state of a subscription charge
+type ChargeStatus string
+
+const (
+	ChargeStatusPending   ChargeStatus = "pending"
+	ChargeStatusCompleted ChargeStatus = "completed"
+	ChargeStatusFailed    ChargeStatus = "failed"
+)
+
+// SubscriptionCharge is a single charge against a subscription's saved card
+type SubscriptionCharge struct {
+	ID                    uuid.UUID    `json:"id"`
+	SubscriptionID        uuid.UUID    `json:"subscription_id"`
+	AmountCents           int          `json:"amount_cents"`
+	Status                ChargeStatus `json:"status"`
+	Initiator             string       `json:"initiator"` // cit or mit
+	PaytrailStamp         string       `json:"paytrail_stamp"`
+	PaytrailTransactionID string       `json:"paytrail_transaction_id,omitempty"`
+	Error                 string       `json:"error,omitempty"`
+	CreatedAt             time.Time    `json:"created_at"`
+	CompletedAt           *time.Time   `json:"completed_at,omitempty"`
+}
+
+// RefundStatus represents the state of a refund
+type RefundStatus string
+
+const (
+	RefundStatusPending   RefundStatus = "pending"
+	RefundStatusCompleted RefundStatus = "completed"
+	RefundStatusFailed    RefundStatus = "failed"
+)
+
+// Refund represents a refund request sent to Paytrail for a payment
+type Refund struct {
+	ID                    uuid.UUID    `json:"id"`
+	PaymentID             uuid.UUID    `json:"payment_id"`
+	AmountCents           int          `json:"amount_cents"`
+	Status                RefundStatus `json:"status"`
+	RefundStamp           string       `json:"refund_stamp"`
+	PaytrailTransactionID string       `json:"paytrail_transaction_id,omitempty"`
+	RequestedBy           string       `json:"requested_by,omitempty"`
+	CreatedAt             time.Time    `json:"created_at"`
+	CompletedAt           *time.Time   `json:"completed_at,omitempty"`
+}
+
+// DiscountType is how a promo code reduces the price
+type DiscountType string
+
+const (
+	DiscountTypePercent DiscountType = "percent" // DiscountValue is a percentage (1-100)
+	DiscountTypeFixed   DiscountType = "fixed"   // DiscountValue is an amount in cents
+)
+
+// PromoCode is a discount code applied at checkout
+type PromoCode struct {
+	ID              uuid.UUID    `json:"id"`
+	Code            string       `json:"code"`
+	StreamID        *uuid.UUID   `json:"stream_id,omitempty"` // nil = valid for every stream
+	DiscountType    DiscountType `json:"discount_type"`
+	DiscountValue   int          `json:"discount_value"`
+	MaxUses         int          `json:"max_uses"`           // 0 = unlimited
+	MaxUsesPerEmail int          `json:"max_uses_per_email"` // 0 = unlimited
+	ValidFrom       *time.Time   `json:"valid_from,omitempty"`
+	ValidUntil      *time.Time   `json:"valid_until,omitempty"`
+	Active          bool         `json:"active"`
+	TimesUsed       int          `json:"times_used"` // Completed payments using this code
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// DiscountFor returns the discount in cents this code gives on the given price
+// The discount never exceeds the price.
+func (p *PromoCode) DiscountFor(priceCents int) int {
+	var discount int
+	switch p.DiscountType {
+	case DiscountTypePercent:
+		discount = priceCents * p.DiscountValue / 100
+	case DiscountTypeFixed:
+		discount = p.DiscountValue
+	}
+	if discount > priceCents {
+		discount = priceCents
+	}
+	if discount < 0 {
+		discount = 0
+	}
+	return discount
+}
+
+// IsValidAt checks whether the code is active and inside its validity window
+func (p *PromoCode) IsValidAt(t time.Time) bool {
+	if !p.Active {
+		return false
+	}
+	if p.ValidFrom != nil && t.Before(*p.ValidFrom) {
+		return false
+	}
+	if p.ValidUntil != nil && !t.Before(*p.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// AppliesTo checks whether the code can be used for a stream
+func (p *PromoCode) AppliesTo(streamID uuid.UUID) bool {
+	return p.StreamID == nil || *p.StreamID == streamID
+}
+
+// AccessCodeBatch is a set of prepaid single-use codes for one stream,
+// typically seats a company buys for its staff and pays by invoice
+type AccessCodeBatch struct {
+	ID            uuid.UUID  `json:"id"`
+	StreamID      uuid.UUID  `json:"stream_id"`
+	Label         string     `json:"label"`
+	CodeCount     int        `json:"count"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // nil = codes never expire
+	RedeemedCount int        `json:"redeemed"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// IsExpiredAt checks whether the batch's codes can no longer be redeemed
+func (b *AccessCodeBatch) IsExpiredAt(t time.Time) bool {
+	return b.ExpiresAt != nil && !t.Before(*b.ExpiresAt)
+}
+
+// AccessCode is a single-use code from a batch
+type AccessCode struct {
+	ID            uuid.UUID  `json:"id"`
+	BatchID       uuid.UUID  `json:"batch_id"`
+	Code          string     `json:"code"`
+	RedeemedEmail string     `json:"redeemed_email,omitempty"`
+	RedeemedAt    *time.Time `json:"redeemed_at,omitempty"`
+	PaymentID     *uuid.UUID `json:"payment_id,omitempty"`
+}
+
+// EmailStatus represents the delivery state of a queued email
+type EmailStatus string
+
+const (
+	EmailStatusPending EmailStatus = "pending"
+	EmailStatusSent    EmailStatus = "sent"
+	EmailStatusFailed  EmailStatus = "failed" // Gave up after the last retry
+)
+
+// OutboundEmail is a transactional email in the outbound queue
+// The template is rendered with Data when the email is sent.
+type OutboundEmail struct {
+	ID            uuid.UUID   `json:"id"`
+	ToEmail       string      `json:"to_email"`
+	Template      string      `json:"template"`
+	Data          []byte      `json:"-"`
+	Status        EmailStatus `json:"status"`
+	Attempts      int         `json:"attempts"`
+	NextAttemptAt time.Time   `json:"next_attempt_at"`
+	LastError     string      `json:"last_error,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	SentAt        *time.Time  `json:"sent_at,omitempty"`
+}
+
+// CallbackSource identifies how a payment status update reached the server
+type CallbackSource string
+
+const (
+	CallbackSourceRedirect CallbackSource = "redirect" // Browser returning from Paytrail
+	CallbackSourceServer   CallbackSource = "server"   // Paytrail server-to-server callback
+)
+
+// CallbackOutcome describes what processing a callback did to the payment
+type CallbackOutcome string
+
+const (
+	CallbackOutcomeCompleted CallbackOutcome = "completed" // Payment moved pending -> completed
+	CallbackOutcomeFailed    CallbackOutcome = "failed"    // Payment moved pending -> failed
+	CallbackOutcomePending   CallbackOutcome = "pending"   // Paytrail still reports pending
+	CallbackOutcomeDuplicate CallbackOutcome = "duplicate" // Payment already left pending; nothing changed
+	CallbackOutcomeNotFound  CallbackOutcome = "not_found" // No payment with this stamp
+)
+
+// PaymentCallback is an audit record of a Paytrail payment callback
+type PaymentCallback struct {
+	ID            uuid.UUID       `json:"id"`
+	PaymentID     *uuid.UUID      `json:"payment_id,omitempty"`
+	Stamp         string          `json:"stamp"`
+	TransactionID string          `json:"transaction_id,omitempty"`
+	Status        string          `json:"status"` // Status reported by Paytrail
+	Source        CallbackSource  `json:"source"`
+	Outcome       CallbackOutcome `json:"outcome"`
+	ReceivedAt    time.Time       `json:"received_at"`
+}
+
 // ActiveSession represents a currently active viewing session
 type ActiveSession struct {
 	Token     string    `json:"token"`
@@ -105,16 +500,32 @@ type DeviceInfo struct {
 	LastSeen  time.Time `json:"last_seen"`
 }
 
+// BroadcastState is what a stream's Owncast last reported through its webhooks
+type BroadcastState struct {
+	Online       bool       `json:"online"`          // OBS is publishing
+	Since        time.Time  `json:"since"`           // When the broadcast started or stopped
+	Title        string     `json:"title,omitempty"` // Owncast's stream title
+	ChatMessages int64      `json:"chat_messages"`   // Chat messages during the current broadcast
+	ChatUsers    int64      `json:"chat_users"`      // Chatters who joined during the current broadcast
+	LastChatAt   *time.Time `json:"last_chat_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
 // CreateStreamRequest is the request body for creating a stream
 type CreateStreamRequest struct {
-	Slug        string     `json:"slug"`
-	Title       string     `json:"title"`
-	Description string     `json:"description,omitempty"`
-	PriceCents  int        `json:"price_cents"`
-	StartTime   *time.Time `json:"start_time,omitempty"`
-	EndTime     *time.Time `json:"end_time,omitempty"`
-	MaxViewers  int        `json:"max_viewers,omitempty"`
-	// Note: OwncastURL, StreamKey, RTMPPort, ContainerName are auto-generated
+	Slug         string     `json:"slug"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description,omitempty"`
+	PriceCents   int        `json:"price_cents"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	EndTime      *time.Time `json:"end_time,omitempty"`
+	MaxViewers   int        `json:"max_viewers,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	MembersOnly  bool       `json:"members_only,omitempty"`
+	WatermarkURL string     `json:"watermark_url,omitempty"` // Marked B rendition base URL
+	Backend      string     `json:"backend,omitempty"`       // docker, external or kubernetes (default: INGEST_BACKEND)
+	OwncastURL   string     `json:"owncast_url,omitempty"`   // Required for the external backend
+	// Note: StreamKey, RTMPPort, ContainerName are auto-generated
 }
 
 // UpdateStreamRequest is the request body for updating a stream
@@ -126,19 +537,76 @@ type UpdateStreamRequest struct {
 	EndTime         *time.Time       `json:"end_time,omitempty"`
 	Status          *StreamStatus    `json:"status,omitempty"`
 	MaxViewers      *int             `json:"max_viewers,omitempty"`
+	Tags            *[]string        `json:"tags,omitempty"`
+	MembersOnly     *bool            `json:"members_only,omitempty"`
+	WatermarkURL    *string          `json:"watermark_url,omitempty"`
 	ContainerStatus *ContainerStatus `json:"container_status,omitempty"`
 }
 
 // CreatePaymentRequest is the request body for initiating a payment
 type CreatePaymentRequest struct {
-	StreamSlug string `json:"stream_slug"`
+	StreamSlug    string `json:"stream_slug"`
+	Email         string `json:"email"`
+	PromoCode     string `json:"promo_code,omitempty"`
+	GiftRecipient string `json:"gift_recipient,omitempty"` // Buy as a gift for this email
+}
+
+// CreateBundlePaymentRequest is the request body for buying a bundle
+type CreateBundlePaymentRequest struct {
+	BundleSlug string `json:"bundle_slug"`
 	Email      string `json:"email"`
 }
 
+// SubscribeRequest is the request body for starting a membership
+type SubscribeRequest struct {
+	Email string `json:"email"`
+}
+
+// BundleRequest is the request body for creating or updating a bundle
+type BundleRequest struct {
+	Slug         string      `json:"slug"`
+	Title        string      `json:"title"`
+	Description  string      `json:"description,omitempty"`
+	PriceCents   int         `json:"price_cents"`
+	StreamIDs    []uuid.UUID `json:"stream_ids,omitempty"`
+	Tag          string      `json:"tag,omitempty"`
+	StartsAfter  *time.Time  `json:"starts_after,omitempty"`
+	StartsBefore *time.Time  `json:"starts_before,omitempty"`
+	Active       *bool       `json:"active,omitempty"` // Defaults to true on create
+}
+
+// PromoCodeRequest is the request body for creating or updating a promo code
+type PromoCodeRequest struct {
+	Code            string       `json:"code"`
+	StreamID        *uuid.UUID   `json:"stream_id,omitempty"`
+	DiscountType    DiscountType `json:"discount_type"`
+	DiscountValue   int          `json:"discount_value"`
+	MaxUses         int          `json:"max_uses"`
+	MaxUsesPerEmail int          `json:"max_uses_per_email"`
+	ValidFrom       *time.Time   `json:"valid_from,omitempty"`
+	ValidUntil      *time.Time   `json:"valid_until,omitempty"`
+	Active          *bool        `json:"active,omitempty"` // Defaults to true on create
+}
+
 // RecoverTokenRequest is the request body for token recovery
 type RecoverTokenRequest struct {
 	StreamSlug string `json:"stream_slug"`
 	Email      string `json:"email"`
+	GiftCode   string `json:"gift_code,omitempty"` // Redeems a gift addressed to Email
+}
+
+// AccessCodeBatchRequest is the request body for generating an access code batch
+type AccessCodeBatchRequest struct {
+	Label     string     `json:"label"`
+	Count     int        `json:"count"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// RedeemAccessCodeRequest is the request body for redeeming an access code
+type RedeemAccessCodeRequest struct {
+	StreamSlug string `json:"stream_slug"`
+	Email      string `json:"email"`
+	Code       string `json:"code"`
 }
 
 // PaymentCallbackParams are the query parameters from Paytrail callback
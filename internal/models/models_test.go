@@ -0,0 +1,233 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPromoCodeDiscountFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		typ       DiscountType
+		value     int
+		price     int
+		wantCents int
+	}{
+		{"percent", DiscountTypePercent, 20, 990, 198},
+		{"percent rounds down", DiscountTypePercent, 15, 999, 149},
+		{"full percent", DiscountTypePercent, 100, 990, 990},
+		{"fixed", DiscountTypeFixed, 500, 990, 500},
+		{"fixed capped at price", DiscountTypeFixed, 1500, 990, 990},
+		{"free stream", DiscountTypePercent, 50, 0, 0},
+	}
+
+	for _, tt := range tests {
+		promo := &PromoCode{DiscountType: tt.typ, DiscountValue: tt.value}
+		if got := promo.DiscountFor(tt.price); got != tt.wantCents {
+			t.Errorf("%s: DiscountFor(%d) = %d, want %d", tt.name, tt.price, got, tt.wantCents)
+		}
+	}
+}
+
+func TestPromoCodeIsValidAt(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		promo PromoCode
+		want  bool
+	}{
+		{"no window", PromoCode{Active: true}, true},
+		{"inactive", PromoCode{Active: false}, false},
+		{"inside window", PromoCode{Active: true, ValidFrom: &past, ValidUntil: &future}, true},
+		{"not started", PromoCode{Active: true, ValidFrom: &future}, false},
+		{"ended", PromoCode{Active: true, ValidUntil: &past}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.promo.IsValidAt(now); got != tt.want {
+			t.Errorf("%s: IsValidAt() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPromoCodeAppliesTo(t *testing.T) {
+	streamID := uuid.New()
+	otherID := uuid.New()
+
+	global := &PromoCode{}
+	if !global.AppliesTo(streamID) {
+		t.Error("Expected global code to apply to any stream")
+	}
+
+	scoped := &PromoCode{StreamID: &streamID}
+	if !scoped.AppliesTo(streamID) {
+		t.Error("Expected scoped code to apply to its stream")
+	}
+	if scoped.AppliesTo(otherID) {
+		t.Error("Expected scoped code not to apply to another stream")
+	}
+}
+
+func TestBundleCovers(t *testing.T) {
+	june := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	july := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	midJune := time.Date(2024, 6, 15, 18, 0, 0, 0, time.UTC)
+	august := time.Date(2024, 8, 1, 18, 0, 0, 0, time.UTC)
+
+	listed := &Stream{ID: uuid.New()}
+	final := &Stream{ID: uuid.New(), Tags: []string{"cup-2024"}, StartTime: &midJune}
+	lateFinal := &Stream{ID: uuid.New(), Tags: []string{"cup-2024"}, StartTime: &august}
+	untimed := &Stream{ID: uuid.New(), Tags: []string{"cup-2024"}}
+	other := &Stream{ID: uuid.New(), Tags: []string{"league"}, StartTime: &midJune}
+
+	tests := []struct {
+		name   string
+		bundle *Bundle
+		stream *Stream
+		want   bool
+	}{
+		{"listed stream", &Bundle{StreamIDs: []uuid.UUID{listed.ID}}, listed, true},
+		{"unlisted stream without rules", &Bundle{StreamIDs: []uuid.UUID{listed.ID}}, final, false},
+		{"tag match", &Bundle{Tag: "cup-2024"}, final, true},
+		{"tag mismatch", &Bundle{Tag: "cup-2024"}, other, false},
+		{"tag and range match", &Bundle{Tag: "cup-2024", StartsAfter: &june, StartsBefore: &july}, final, true},
+		{"tag match outside range", &Bundle{Tag: "cup-2024", StartsAfter: &june, StartsBefore: &july}, lateFinal, false},
+		{"range needs start time", &Bundle{StartsAfter: &june}, untimed, false},
+		{"open-ended range", &Bundle{StartsAfter: &june}, lateFinal, true},
+		{"range end is exclusive", &Bundle{StartsBefore: &midJune}, final, false},
+		{"listed stream outside rules", &Bundle{Tag: "cup-2024", StreamIDs: []uuid.UUID{other.ID}}, other, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.bundle.Covers(tt.stream); got != tt.want {
+			t.Errorf("%s: Covers() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"cup-2024", []string{"cup-2024"}},
+		{" Cup-2024 , finals,,cup-2024 ", []string{"cup-2024", "finals"}},
+	}
+
+	for _, tt := range tests {
+		got := ParseTags(tt.in)
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseTags(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseTags(%q) = %v, want %v", tt.in, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSubscriptionHasAccessAt(t *testing.T) {
+	now := time.Now()
+	periodEnd := now.Add(24 * time.Hour)
+	pastEnd := now.Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		sub  *Subscription
+		want bool
+	}{
+		{"active", &Subscription{Status: SubscriptionStatusActive, CurrentPeriodEnd: &pastEnd}, true},
+		{"past due keeps access", &Subscription{Status: SubscriptionStatusPastDue, CurrentPeriodEnd: &pastEnd}, true},
+		{"canceling inside period", &Subscription{Status: SubscriptionStatusActive, CancelAtPeriodEnd: true, CurrentPeriodEnd: &periodEnd}, true},
+		{"canceling after period", &Subscription{Status: SubscriptionStatusActive, CancelAtPeriodEnd: true, CurrentPeriodEnd: &pastEnd}, false},
+		{"incomplete", &Subscription{Status: SubscriptionStatusIncomplete}, false},
+		{"canceled", &Subscription{Status: SubscriptionStatusCanceled, CurrentPeriodEnd: &periodEnd}, false},
+		{"expired", &Subscription{Status: SubscriptionStatusExpired}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sub.HasAccessAt(now); got != tt.want {
+			t.Errorf("%s: HasAccessAt() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionNextPeriod(t *testing.T) {
+	sub := &Subscription{PeriodMonths: 1}
+	jan31 := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	feb15 := time.Date(2024, 2, 15, 12, 0, 0, 0, time.UTC)
+	jun1 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		end, now  time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"renews from period end", jan31, jan31, jan31, jan31.AddDate(0, 1, 0)},
+		{"late retry keeps anchor", jan31, feb15, jan31, jan31.AddDate(0, 1, 0)},
+		{"lapsed period restarts now", jan31, jun1, jun1, jun1.AddDate(0, 1, 0)},
+	}
+
+	for _, tt := range tests {
+		start, end := sub.NextPeriod(tt.end, tt.now)
+		if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+			t.Errorf("%s: NextPeriod() = %v - %v, want %v - %v", tt.name, start, end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
+
+func TestPaymentIsTokenValid(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Hour)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		payment *Payment
+		want    bool
+	}{
+		{"completed", &Payment{Status: PaymentStatusCompleted, TokenExpiry: &future}, true},
+		{"expired", &Payment{Status: PaymentStatusCompleted, TokenExpiry: &past}, false},
+		{"pending", &Payment{Status: PaymentStatusPending, TokenExpiry: &future}, false},
+		{"unredeemed gift", &Payment{Status: PaymentStatusCompleted, TokenExpiry: &future, RecipientEmail: "friend@example.com"}, false},
+		{"redeemed gift", &Payment{Status: PaymentStatusCompleted, TokenExpiry: &future, RecipientEmail: "friend@example.com", GiftRedeemedAt: &now}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.payment.IsTokenValid(); got != tt.want {
+			t.Errorf("%s: IsTokenValid() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAccessCodeBatchIsExpiredAt(t *testing.T) {
+	expiry := time.Date(2024, 3, 31, 23, 59, 59, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		batch *AccessCodeBatch
+		at    time.Time
+		want  bool
+	}{
+		{"no expiry", &AccessCodeBatch{}, expiry.Add(24 * time.Hour), false},
+		{"before expiry", &AccessCodeBatch{ExpiresAt: &expiry}, expiry.Add(-time.Second), false},
+		{"at expiry", &AccessCodeBatch{ExpiresAt: &expiry}, expiry, true},
+		{"after expiry", &AccessCodeBatch{ExpiresAt: &expiry}, expiry.Add(time.Second), true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.batch.IsExpiredAt(tt.at); got != tt.want {
+			t.Errorf("%s: IsExpiredAt() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,7 +16,7 @@ import (
 )
 
 const (
-	// PaytrailAPIURL is the Paytrail API endpoint
+	// PaytrailAPIURL is the default Paytrail API endpoint
 	PaytrailAPIURL = "https://services.paytrail.com"
 
 	// Algorithm used for HMAC
@@ -23,14 +25,20 @@ const (
 
 // Client is a Paytrail API client
 type Client struct {
+	baseURL    string
 	merchantID string
 	secretKey  string
 	httpClient *http.Client
 }
 
 // NewClient creates a new Paytrail client
-func NewClient(merchantID, secretKey string) *Client {
+// baseURL defaults to PaytrailAPIURL when empty; override it to point at a fake server in tests
+func NewClient(baseURL, merchantID, secretKey string) *Client {
+	if baseURL == "" {
+		baseURL = PaytrailAPIURL
+	}
 	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
 		merchantID: merchantID,
 		secretKey:  secretKey,
 		httpClient: &http.Client{
@@ -119,10 +127,6 @@ type FormField struct {
 
 // CreatePayment creates a new payment
 func (c *Client) CreatePayment(ctx context.Context, req *CreatePaymentRequest) (*CreatePaymentResponse, error) {
-	// Generate nonce and timestamp
-	nonce := uuid.New().String()
-	timestamp := time.Now().UTC().Format(time.RFC3339)
-
 	// Serialize request body
 	body, err := json.Marshal(req)
 	if err != nil {
@@ -136,63 +140,93 @@ func (c *Client) CreatePayment(ctx context.Context, req *CreatePaymentRequest) (
 		Str("body", string(body)).
 		Msg("Sending Paytrail payment request")
 
-	// Build headers for signature
-	headers := map[string]string{
+	respBody, status, err := c.do(ctx, "POST", "/payments", "", body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for errors
+	if status != http.StatusOK && status != http.StatusCreated {
+		log.Error().
+			Int("status", status).
+			Str("response", string(respBody)).
+			Str("stamp", req.Stamp).
+			Msg("Paytrail API error")
+		return nil, fmt.Errorf("paytrail API error: status=%d body=%s", status, string(respBody))
+	}
+
+	// Parse response
+	var result CreatePaymentResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// do sends a signed request to the Paytrail API and returns the raw response body and status
+// transactionID is included in the signed headers for requests that target a single transaction
+func (c *Client) do(ctx context.Context, method, path, transactionID string, body []byte) ([]byte, int, error) {
+	var extra map[string]string
+	if transactionID != "" {
+		extra = map[string]string{"checkout-transaction-id": transactionID}
+	}
+	return c.doWithHeaders(ctx, method, path, extra, body)
+}
+
+// checkoutHeaders returns the signed checkout-* headers common to every request
+func (c *Client) checkoutHeaders(method string) map[string]string {
+	return map[string]string{
 		"checkout-account":   c.merchantID,
 		"checkout-algorithm": Algorithm,
-		"checkout-method":    "POST",
-		"checkout-nonce":     nonce,
-		"checkout-timestamp": timestamp,
+		"checkout-method":    method,
+		"checkout-nonce":     uuid.New().String(),
+		"checkout-timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// doWithHeaders is like do, but signs and sends any extra checkout-* headers
+func (c *Client) doWithHeaders(ctx context.Context, method, path string, extra map[string]string, body []byte) ([]byte, int, error) {
+	// Build headers for signature
+	headers := c.checkoutHeaders(method)
+	for k, v := range extra {
+		headers[k] = v
 	}
 
 	// Calculate signature
 	signature := CalculateSignature(c.secretKey, headers, string(body))
 
 	// Create HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", PaytrailAPIURL+"/payments", bytes.NewReader(body))
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
 	httpReq.Header.Set("Content-Type", "application/json; charset=utf-8")
-	httpReq.Header.Set("checkout-account", c.merchantID)
-	httpReq.Header.Set("checkout-algorithm", Algorithm)
-	httpReq.Header.Set("checkout-method", "POST")
-	httpReq.Header.Set("checkout-nonce", nonce)
-	httpReq.Header.Set("checkout-timestamp", timestamp)
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
 	httpReq.Header.Set("signature", signature)
 
 	// Send request
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, 0, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response body
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, 0, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Check for errors
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Error().
-			Int("status", resp.StatusCode).
-			Str("response", string(respBody)).
-			Str("stamp", req.Stamp).
-			Msg("Paytrail API error")
-		return nil, fmt.Errorf("paytrail API error: status=%d body=%s", resp.StatusCode, string(respBody))
-	}
-
-	// Parse response
-	var result CreatePaymentResponse
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
-	}
-
-	return &result, nil
+	return respBody, resp.StatusCode, nil
 }
 
 // SimplePaymentRequest is a simplified payment request for common use cases
@@ -252,3 +286,131 @@ func (c *Client) CreateSimplePayment(ctx context.Context, req *SimplePaymentRequ
 
 	return c.CreatePayment(ctx, fullReq)
 }
+
+// RefundRequest is the request body for refunding a payment
+type RefundRequest struct {
+	Amount          int           `json:"amount"`
+	Email           string        `json:"email,omitempty"`
+	RefundStamp     string        `json:"refundStamp"`
+	RefundReference string        `json:"refundReference,omitempty"`
+	CallbackURLs    *CallbackURLs `json:"callbackUrls"`
+}
+
+// RefundResponse is the response from a refund request
+type RefundResponse struct {
+	Provider      string `json:"provider"`
+	Status        string `json:"status"` // ok, pending or fail
+	TransactionID string `json:"transactionId"`
+}
+
+// IsSuccessful returns true if the refund was completed immediately
+func (r *RefundResponse) IsSuccessful() bool {
+	return r.Status == "ok"
+}
+
+// IsPending returns true if the refund result arrives later via callback
+func (r *RefundResponse) IsPending() bool {
+	return r.Status == "pending"
+}
+
+// ErrRefundRejected is returned when Paytrail refuses a refund request
+var ErrRefundRejected = errors.New("paytrail refund rejected")
+
+// RefundPayment refunds a payment (fully or partially) by its Paytrail transaction ID
+// Paytrail reports the final result to req.CallbackURLs unless the refund completes immediately.
+// Returns ErrRefundRejected (wrapped) when Paytrail refuses the request; other errors
+// leave it unknown whether Paytrail received the refund.
+func (c *Client) RefundPayment(ctx context.Context, transactionID string, req *RefundRequest) (*RefundResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	log.Debug().
+		Str("transaction_id", transactionID).
+		Str("refund_stamp", req.RefundStamp).
+		Int("amount", req.Amount).
+		Msg("Sending Paytrail refund request")
+
+	respBody, status, err := c.do(ctx, "POST", "/payments/"+transactionID+"/refund", transactionID, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK && status != http.StatusCreated {
+		log.Error().
+			Int("status", status).
+			Str("response", string(respBody)).
+			Str("transaction_id", transactionID).
+			Msg("Paytrail refund API error")
+		if status >= 400 && status < 500 {
+			return nil, fmt.Errorf("%w: status=%d body=%s", ErrRefundRejected, status, string(respBody))
+		}
+		return nil, fmt.Errorf("paytrail API error: status=%d body=%s", status, string(respBody))
+	}
+
+	var result RefundResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// PaymentStatusResponse is the response from a payment status query
+type PaymentStatusResponse struct {
+	TransactionID string `json:"transactionId"`
+	Status        string `json:"status"` // new, ok, fail, pending or delayed
+	Amount        int    `json:"amount"`
+	Currency      string `json:"currency"`
+	Stamp         string `json:"stamp"`
+	Reference     string `json:"reference"`
+	Provider      string `json:"provider,omitempty"`
+	CreatedAt     string `json:"createdAt"`
+	PaidAt        string `json:"paidAt,omitempty"`
+}
+
+// IsSuccessful returns true if the payment has been paid
+func (r *PaymentStatusResponse) IsSuccessful() bool {
+	return r.Status == "ok"
+}
+
+// IsFailed returns true if the payment failed or was cancelled
+func (r *PaymentStatusResponse) IsFailed() bool {
+	return r.Status == "fail"
+}
+
+// IsNew returns true if the buyer never completed the payment at the provider
+func (r *PaymentStatusResponse) IsNew() bool {
+	return r.Status == "new"
+}
+
+// ErrPaymentNotFound is returned when Paytrail does not know the transaction
+var ErrPaymentNotFound = errors.New("paytrail payment not found")
+
+// GetPayment fetches the current status of a payment by its Paytrail transaction ID
+func (c *Client) GetPayment(ctx context.Context, transactionID string) (*PaymentStatusResponse, error) {
+	respBody, status, err := c.do(ctx, "GET", "/payments/"+transactionID, transactionID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == http.StatusNotFound {
+		return nil, ErrPaymentNotFound
+	}
+	if status != http.StatusOK {
+		log.Error().
+			Int("status", status).
+			Str("response", string(respBody)).
+			Str("transaction_id", transactionID).
+			Msg("Paytrail payment status API error")
+		return nil, fmt.Errorf("paytrail API error: status=%d body=%s", status, string(respBody))
+	}
+
+	var result PaymentStatusResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,123 @@
+package paytrail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFakePaytrail starts a fake Paytrail API that checks request signatures
+func newFakePaytrail(t *testing.T, secret string, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Signature is calculated over lowercase checkout-* header names
+		headers := make(map[string]string)
+		for k := range r.Header {
+			headers[strings.ToLower(k)] = r.Header.Get(k)
+		}
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if got, want := r.Header.Get("signature"), CalculateSignature(secret, headers, string(body)); got != want {
+			t.Errorf("signature = %s, want %s", got, want)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetPayment(t *testing.T) {
+	secret := "SAIPPUAKAUPPIAS"
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantErr    error
+		wantStatus string
+	}{
+		{"paid", http.StatusOK, `{"transactionId":"tx-1","status":"ok","amount":990,"stamp":"s-1"}`, nil, "ok"},
+		{"never paid", http.StatusOK, `{"transactionId":"tx-1","status":"new","amount":990,"stamp":"s-1"}`, nil, "new"},
+		{"unknown", http.StatusNotFound, `{"status":"error","message":"Not found"}`, ErrPaymentNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakePaytrail(t, secret, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/payments/tx-1" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				if got := r.Header.Get("checkout-transaction-id"); got != "tx-1" {
+					t.Errorf("checkout-transaction-id = %q, want tx-1", got)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			client := NewClient(server.URL, "375917", secret)
+			resp, err := client.GetPayment(context.Background(), "tx-1")
+			if err != tt.wantErr {
+				t.Fatalf("GetPayment() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && resp.Status != tt.wantStatus {
+				t.Errorf("Status = %q, want %q", resp.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestChargeToken(t *testing.T) {
+	secret := "SAIPPUAKAUPPIAS"
+
+	tests := []struct {
+		name      string
+		initiator ChargeInitiator
+		status    int
+		body      string
+		wantErr   error
+		want3DS   bool
+		wantTxn   string
+	}{
+		{"charged", ChargeMerchantInitiated, http.StatusCreated, `{"transactionId":"tx-1"}`, nil, false, "tx-1"},
+		{"needs 3ds", ChargeCustomerInitiated, http.StatusForbidden, `{"transactionId":"tx-2","threeDSecureUrl":"https://pay.example/3ds"}`, nil, true, "tx-2"},
+		{"declined", ChargeMerchantInitiated, http.StatusForbidden, `{"status":"error","message":"Declined"}`, ErrChargeDeclined, false, ""},
+		{"server error", ChargeMerchantInitiated, http.StatusBadGateway, `{}`, nil, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakePaytrail(t, secret, func(w http.ResponseWriter, r *http.Request) {
+				if want := "/payments/token/" + string(tt.initiator) + "/charge"; r.URL.Path != want {
+					t.Errorf("path = %s, want %s", r.URL.Path, want)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			client := NewClient(server.URL, "375917", secret)
+			req := NewTokenPaymentRequest(&SimplePaymentRequest{Stamp: "s-1", Amount: 990, Email: "a@example.com"}, "card-token")
+			resp, err := client.ChargeToken(context.Background(), tt.initiator, req)
+
+			if tt.status == http.StatusBadGateway {
+				if err == nil || errors.Is(err, ErrChargeDeclined) {
+					t.Fatalf("ChargeToken() error = %v, want a retryable error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ChargeToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if resp.TransactionID != tt.wantTxn || resp.RequiresThreeDS() != tt.want3DS {
+				t.Errorf("ChargeToken() = %+v, want transaction %s, 3DS %v", resp, tt.wantTxn, tt.want3DS)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package paytrail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefundPayment(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantRejected bool
+		wantErr      bool
+	}{
+		{"accepted", http.StatusCreated, `{"provider":"nordea","status":"pending","transactionId":"rf-1"}`, false, false},
+		{"rejected", http.StatusBadRequest, `{"status":"error","message":"Refund amount too large"}`, true, true},
+		{"server error", http.StatusServiceUnavailable, `{}`, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/payments/tx-1/refund" {
+					t.Errorf("path = %s, want /payments/tx-1/refund", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, "375917", "SAIPPUAKAUPPIAS")
+			resp, err := client.RefundPayment(context.Background(), "tx-1", &RefundRequest{Amount: 990, RefundStamp: "refund-1"})
+			if (err != nil) != tt.wantErr || errors.Is(err, ErrRefundRejected) != tt.wantRejected {
+				t.Fatalf("RefundPayment() error = %v, want error %v, rejected %v", err, tt.wantErr, tt.wantRejected)
+			}
+			if err == nil && !resp.IsPending() {
+				t.Errorf("Status = %q, want pending", resp.Status)
+			}
+		})
+	}
+}
@@ -31,10 +31,8 @@ func CalculateSignature(secret string, headers map[string]string, body string) s
 	}
 
 	// Join with newlines and append body
-	payload := strings.Join(parts, "\n")
-	if body != "" {
-		payload += "\n" + body
-	}
+	// The newline separating headers from body is required even when the body is empty
+	payload := strings.Join(parts, "\n") + "\n" + body
 
 	// Calculate HMAC-SHA256
 	h := hmac.New(sha256.New, []byte(secret))
@@ -0,0 +1,213 @@
+package paytrail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrChargeDeclined is returned when Paytrail or the card issuer rejects a token charge
+var ErrChargeDeclined = errors.New("paytrail token charge declined")
+
+// AddCardRequest holds the redirect URLs for the add card form
+type AddCardRequest struct {
+	SuccessURL string // Paytrail appends checkout-tokenization-id and a signature
+	CancelURL  string
+	Language   string // Language (FI, SV, EN)
+}
+
+// AddCardForm is a signed form the buyer's browser posts to Paytrail to save a card
+type AddCardForm struct {
+	Action string      `json:"action"`
+	Fields []FormField `json:"fields"`
+}
+
+// AddCardForm builds the signed form for Paytrail's card tokenization page
+// No API call is made; the browser submits the form directly to Paytrail.
+func (c *Client) AddCardForm(req *AddCardRequest) *AddCardForm {
+	if req.Language == "" {
+		req.Language = "FI"
+	}
+
+	fields := c.checkoutHeaders("POST")
+	fields["checkout-redirect-success-url"] = req.SuccessURL
+	fields["checkout-redirect-cancel-url"] = req.CancelURL
+	signature := CalculateSignature(c.secretKey, fields, "")
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	form := &AddCardForm{Action: c.baseURL + "/tokenization/addcard-form"}
+	for _, name := range names {
+		form.Fields = append(form.Fields, FormField{Name: name, Value: fields[name]})
+	}
+	form.Fields = append(form.Fields,
+		FormField{Name: "language", Value: req.Language},
+		FormField{Name: "signature", Value: signature},
+	)
+	return form
+}
+
+// CardTokenResponse is the response from fetching a saved card's token
+type CardTokenResponse struct {
+	Token string `json:"token"`
+	Card  Card   `json:"card"`
+}
+
+// Card describes a saved payment card
+type Card struct {
+	Type        string `json:"type"`         // e.g. Visa, MasterCard
+	PartialPAN  string `json:"partial_pan"`  // Last four digits
+	ExpireYear  string `json:"expire_year"`  // e.g. 2027
+	ExpireMonth string `json:"expire_month"` // e.g. 11
+}
+
+// GetCardToken exchanges the checkout-tokenization-id from the add card redirect for a reusable card token
+func (c *Client) GetCardToken(ctx context.Context, tokenizationID string) (*CardTokenResponse, error) {
+	extra := map[string]string{"checkout-tokenization-id": tokenizationID}
+	respBody, status, err := c.doWithHeaders(ctx, "POST", "/tokenization/"+tokenizationID, extra, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		log.Error().
+			Int("status", status).
+			Str("response", string(respBody)).
+			Msg("Paytrail tokenization API error")
+		return nil, fmt.Errorf("paytrail API error: status=%d body=%s", status, string(respBody))
+	}
+
+	var result CardTokenResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if result.Token == "" {
+		return nil, errors.New("paytrail tokenization response has no token")
+	}
+
+	return &result, nil
+}
+
+// ChargeInitiator tells Paytrail whether the customer is present for a token charge
+type ChargeInitiator string
+
+const (
+	// ChargeCustomerInitiated is a charge the customer started; it may require 3-D Secure
+	ChargeCustomerInitiated ChargeInitiator = "cit"
+	// ChargeMerchantInitiated is a recurring charge made without the customer present
+	ChargeMerchantInitiated ChargeInitiator = "mit"
+)
+
+// TokenPaymentRequest is the request body for charging a saved card
+type TokenPaymentRequest struct {
+	CreatePaymentRequest
+	Token string `json:"token"`
+}
+
+// TokenChargeResponse is the response from a token charge
+type TokenChargeResponse struct {
+	TransactionID   string `json:"transactionId"`
+	ThreeDSecureURL string `json:"threeDSecureUrl,omitempty"` // Set when the customer must complete 3-D Secure
+}
+
+// RequiresThreeDS returns true if the charge completes only after the customer passes 3-D Secure
+// The result then arrives on the request's redirect and callback URLs.
+func (r *TokenChargeResponse) RequiresThreeDS() bool {
+	return r.ThreeDSecureURL != ""
+}
+
+// ChargeToken charges a saved card
+// Returns ErrChargeDeclined (wrapped) when the charge is rejected; other errors are
+// transport or server failures and the charge can be retried with the same stamp.
+func (c *Client) ChargeToken(ctx context.Context, initiator ChargeInitiator, req *TokenPaymentRequest) (*TokenChargeResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	log.Debug().
+		Str("stamp", req.Stamp).
+		Str("initiator", string(initiator)).
+		Int("amount", req.Amount).
+		Msg("Sending Paytrail token charge")
+
+	respBody, status, err := c.do(ctx, "POST", "/payments/token/"+string(initiator)+"/charge", "", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result TokenChargeResponse
+	switch {
+	case status == http.StatusOK || status == http.StatusCreated:
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		return &result, nil
+	case status == http.StatusForbidden && initiator == ChargeCustomerInitiated:
+		// 403 with a 3-D Secure URL means the customer must authenticate first
+		if err := json.Unmarshal(respBody, &result); err == nil && result.RequiresThreeDS() {
+			return &result, nil
+		}
+	}
+
+	log.Error().
+		Int("status", status).
+		Str("response", string(respBody)).
+		Str("stamp", req.Stamp).
+		Msg("Paytrail token charge error")
+	if status >= 400 && status < 500 {
+		return nil, fmt.Errorf("%w: status=%d body=%s", ErrChargeDeclined, status, string(respBody))
+	}
+	return nil, fmt.Errorf("paytrail API error: status=%d body=%s", status, string(respBody))
+}
+
+// NewTokenPaymentRequest builds a single-item token charge
+func NewTokenPaymentRequest(req *SimplePaymentRequest, token string) *TokenPaymentRequest {
+	if req.Language == "" {
+		req.Language = "FI"
+	}
+
+	full := &TokenPaymentRequest{
+		CreatePaymentRequest: CreatePaymentRequest{
+			Stamp:     req.Stamp,
+			Reference: req.Reference,
+			Amount:    req.Amount,
+			Currency:  "EUR",
+			Language:  req.Language,
+			Items: []PaymentItem{
+				{
+					UnitPrice:     req.Amount,
+					Units:         1,
+					VATPercentage: 24, // Finnish VAT
+					ProductCode:   "membership",
+					Description:   req.Description,
+					Stamp:         req.Stamp + "-item",
+				},
+			},
+			Customer: Customer{
+				Email: req.Email,
+			},
+			RedirectURLs: RedirectURLs{
+				Success: req.SuccessURL,
+				Cancel:  req.CancelURL,
+			},
+		},
+		Token: token,
+	}
+	if req.CallbackURL != "" {
+		full.CallbackURLs = &CallbackURLs{
+			Success: req.CallbackURL,
+			Cancel:  req.CallbackURL,
+		}
+	}
+	return full
+}
@@ -0,0 +1,377 @@
+// Package scheduler runs streams to their schedule
+// A stream with a start time has its Owncast warmed up ahead of it, goes live
+// when the broadcaster starts sending, ends when the end time passes or the
+// broadcast stays down, and has its Owncast stopped once it has ended.
+package scheduler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/config"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// leaderJob is the leadership every instance competes for
+	leaderJob = "scheduler"
+	// markTTL is how long a stream mark outlives its last update
+	markTTL = 48 * time.Hour
+
+	markWarmedUp = "warmed-up" // The Owncast was started for the schedule; suffixed with the start time
+	markOffline  = "offline"   // A live stream's broadcast is down
+	markEnded    = "ended"     // The stream has ended
+)
+
+// StreamStore is the part of the stream storage the scheduler uses
+type StreamStore interface {
+	ListStreams(ctx context.Context) ([]*models.Stream, error)
+	SetStreamStatusIf(ctx context.Context, id uuid.UUID, from, to models.StreamStatus) (bool, error)
+	SetContainerStatusIf(ctx context.Context, id uuid.UUID, from, to models.ContainerStatus) (bool, error)
+	UpdateContainerStatus(ctx context.Context, id uuid.UUID, status models.ContainerStatus) error
+}
+
+// Coordinator shares the scheduler's state between instances; *storage.RedisStore implements it
+type Coordinator interface {
+	AcquireLeadership(ctx context.Context, job, owner string, ttl time.Duration) (bool, error)
+	ReleaseLeadership(ctx context.Context, job, owner string) error
+	MarkStreamSince(ctx context.Context, streamID uuid.UUID, mark string, now time.Time, ttl time.Duration) (since time.Time, set bool, err error)
+	ClearStreamMark(ctx context.Context, streamID uuid.UUID, mark string) error
+	PublishStreamChange(ctx context.Context, streamID uuid.UUID) error
+}
+
+// Backends looks up a stream's ingest backend; *ingest.Registry implements it
+type Backends interface {
+	Get(kind models.IngestBackend) (ingest.Backend, error)
+}
+
+// Provisioner sets up a warmed-up Owncast and its webhook; *ingest.Provisioner implements it
+type Provisioner interface {
+	ProvisionWhenReady(stream *models.Stream)
+}
+
+// Report summarises a scheduler pass
+type Report struct {
+	Started int // Owncast instances warmed up
+	Live    int // Streams moved to live
+	Ended   int // Streams moved to ended
+	Stopped int // Owncast instances stopped after their stream ended
+	Errors  int
+}
+
+func (r *Report) changed() bool {
+	return r.Started+r.Live+r.Ended+r.Stopped > 0
+}
+
+// Scheduler moves scheduled streams through their lifecycle
+// Only one instance schedules at a time, the one holding the leadership in
+// Redis. Every change is also a compare-and-set on the stream, so a leader
+// that lost its lease in the middle of a slow container start cannot undo
+// what the next one did.
+type Scheduler struct {
+	store       StreamStore
+	coord       Coordinator
+	backends    Backends
+	provisioner Provisioner
+	interval    time.Duration
+	warmup      time.Duration
+	idle        time.Duration
+	grace       time.Duration
+	owner       string
+	now         func() time.Time
+	online      func(ctx context.Context, owncastURL string) (bool, error)
+}
+
+// NewScheduler creates a scheduler with the intervals from the configuration
+func NewScheduler(cfg *config.Config, store StreamStore, coord Coordinator, backends Backends, provisioner Provisioner) *Scheduler {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return &Scheduler{
+		store:       store,
+		coord:       coord,
+		backends:    backends,
+		provisioner: provisioner,
+		interval:    cfg.SchedulerInterval,
+		warmup:      cfg.ScheduleWarmup,
+		idle:        cfg.ScheduleIdleTimeout,
+		grace:       cfg.ScheduleStopGrace,
+		owner:       uuid.New().String(),
+		now:         time.Now,
+		online: func(ctx context.Context, owncastURL string) (bool, error) {
+			status, err := ingest.GetOwncastStatus(ctx, client, owncastURL)
+			if err != nil {
+				return false, err
+			}
+			return status.Online, nil
+		},
+	}
+}
+
+// Run schedules every interval while this instance is the leader, until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	if s.interval <= 0 {
+		log.Info().Msg("Stream scheduler disabled")
+		return
+	}
+	defer func() {
+		// Let another instance take over without waiting for the lease to expire
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.coord.ReleaseLeadership(releaseCtx, leaderJob, s.owner); err != nil {
+			log.Warn().Err(err).Msg("Failed to release scheduler leadership")
+		}
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leader, err := s.coord.AcquireLeadership(ctx, leaderJob, s.owner, 3*s.interval)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to acquire scheduler leadership")
+				continue
+			}
+			if !leader {
+				continue
+			}
+			s.Tick(ctx)
+		}
+	}
+}
+
+// Tick runs one scheduler pass over every stream with a start time
+func (s *Scheduler) Tick(ctx context.Context) *Report {
+	report := &Report{}
+	streams, err := s.store.ListStreams(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list streams for scheduling")
+		report.Errors++
+		return report
+	}
+
+	now := s.now()
+	for _, stream := range streams {
+		if stream.StartTime == nil {
+			continue
+		}
+		backend, err := s.backends.Get(stream.Backend)
+		if err != nil {
+			continue
+		}
+		switch stream.Status {
+		case models.StreamStatusScheduled:
+			s.scheduled(ctx, stream, backend, now, report)
+		case models.StreamStatusLive:
+			s.live(ctx, stream, backend, now, report)
+		case models.StreamStatusEnded:
+			s.ended(ctx, stream, backend, now, report)
+		}
+	}
+
+	event := log.Debug()
+	if report.changed() || report.Errors > 0 {
+		event = log.Info()
+	}
+	event.
+		Int("started", report.Started).
+		Int("live", report.Live).
+		Int("ended", report.Ended).
+		Int("stopped", report.Stopped).
+		Int("errors", report.Errors).
+		Msg("Scheduler pass complete")
+	return report
+}
+
+// scheduled warms up a stream's Owncast and takes it live once the broadcast starts
+func (s *Scheduler) scheduled(ctx context.Context, stream *models.Stream, backend ingest.Backend, now time.Time, report *Report) {
+	if now.Before(stream.StartTime.Add(-s.warmup)) {
+		return
+	}
+	over := stream.EndTime != nil && !now.Before(*stream.EndTime)
+
+	switch stream.ContainerStatus {
+	case models.ContainerStatusStopped, "":
+		if !over {
+			s.warmUp(ctx, stream, backend, now, report)
+		}
+	case models.ContainerStatusRunning:
+		online, err := s.online(ctx, backend.InternalURL(stream))
+		if err != nil {
+			log.Debug().Err(err).Str("slug", stream.Slug).Msg("Owncast status not available")
+		}
+		if online {
+			if s.setStatus(ctx, stream, models.StreamStatusScheduled, models.StreamStatusLive, report) {
+				report.Live++
+				s.clearMark(ctx, stream, markOffline)
+				s.clearMark(ctx, stream, markEnded)
+			}
+			return
+		}
+	}
+
+	// Nobody broadcast before the end time
+	if over && s.setStatus(ctx, stream, models.StreamStatusScheduled, models.StreamStatusEnded, report) {
+		report.Ended++
+		s.resetMark(ctx, stream, markEnded, now)
+	}
+}
+
+// warmUp starts a scheduled stream's Owncast, once per start time
+// A stream whose Owncast an admin stopped after the warm-up stays stopped, unless
+// it is rescheduled. A warm-up that failed is tried again on the next pass.
+func (s *Scheduler) warmUp(ctx context.Context, stream *models.Stream, backend ingest.Backend, now time.Time, report *Report) {
+	mark := markWarmedUp + ":" + strconv.FormatInt(stream.StartTime.Unix(), 10)
+	_, set, err := s.coord.MarkStreamSince(ctx, stream.ID, mark, now, markTTL)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to mark stream warmed up")
+		report.Errors++
+		return
+	}
+	if !set {
+		return // Already warmed up for this start time
+	}
+
+	ok, err := s.store.SetContainerStatusIf(ctx, stream.ID, stream.ContainerStatus, models.ContainerStatusStarting)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to update container status")
+		s.clearMark(ctx, stream, mark)
+		report.Errors++
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err := backend.Start(ctx, stream); err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to warm up container")
+		s.clearMark(ctx, stream, mark)
+		s.store.UpdateContainerStatus(ctx, stream.ID, models.ContainerStatusError)
+		report.Errors++
+		return
+	}
+	log.Info().
+		Str("slug", stream.Slug).
+		Str("container", stream.ContainerName).
+		Time("start_time", *stream.StartTime).
+		Msg("Container warmed up for scheduled stream")
+	s.store.UpdateContainerStatus(ctx, stream.ID, models.ContainerStatusRunning)
+	s.provisioner.ProvisionWhenReady(stream)
+	report.Started++
+}
+
+// live ends a stream after its end time, or once its broadcast has been down for the idle timeout
+func (s *Scheduler) live(ctx context.Context, stream *models.Stream, backend ingest.Backend, now time.Time, report *Report) {
+	online := false
+	if stream.ContainerStatus == models.ContainerStatusRunning {
+		var err error
+		online, err = s.online(ctx, backend.InternalURL(stream))
+		if err != nil {
+			log.Debug().Err(err).Str("slug", stream.Slug).Msg("Owncast status not available")
+		}
+	}
+	if online {
+		s.clearMark(ctx, stream, markOffline)
+		return
+	}
+
+	offlineSince, _, err := s.coord.MarkStreamSince(ctx, stream.ID, markOffline, now, markTTL)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to mark stream offline")
+		report.Errors++
+		return
+	}
+	over := stream.EndTime != nil && !now.Before(*stream.EndTime)
+	if !over && now.Sub(offlineSince) < s.idle {
+		return
+	}
+
+	if s.setStatus(ctx, stream, models.StreamStatusLive, models.StreamStatusEnded, report) {
+		report.Ended++
+		s.clearMark(ctx, stream, markOffline)
+		s.resetMark(ctx, stream, markEnded, now)
+	}
+}
+
+// ended stops an ended stream's Owncast after the stop grace period
+func (s *Scheduler) ended(ctx context.Context, stream *models.Stream, backend ingest.Backend, now time.Time, report *Report) {
+	if stream.ContainerStatus != models.ContainerStatusRunning {
+		return
+	}
+	endedSince, _, err := s.coord.MarkStreamSince(ctx, stream.ID, markEnded, now, markTTL)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to mark stream ended")
+		report.Errors++
+		return
+	}
+	if now.Sub(endedSince) < s.grace {
+		return
+	}
+
+	ok, err := s.store.SetContainerStatusIf(ctx, stream.ID, models.ContainerStatusRunning, models.ContainerStatusStopping)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to update container status")
+		report.Errors++
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err := backend.Stop(ctx, stream); err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to stop container of ended stream")
+		s.store.UpdateContainerStatus(ctx, stream.ID, models.ContainerStatusError)
+		report.Errors++
+		return
+	}
+	log.Info().
+		Str("slug", stream.Slug).
+		Str("container", stream.ContainerName).
+		Msg("Container of ended stream stopped")
+	s.store.UpdateContainerStatus(ctx, stream.ID, models.ContainerStatusStopped)
+	report.Stopped++
+}
+
+// setStatus changes a stream's status if it is still from, and tells every instance
+func (s *Scheduler) setStatus(ctx context.Context, stream *models.Stream, from, to models.StreamStatus, report *Report) bool {
+	ok, err := s.store.SetStreamStatusIf(ctx, stream.ID, from, to)
+	if err != nil {
+		log.Error().Err(err).Str("slug", stream.Slug).Msg("Failed to update stream status")
+		report.Errors++
+		return false
+	}
+	if !ok {
+		return false
+	}
+	log.Info().
+		Str("slug", stream.Slug).
+		Str("from", string(from)).
+		Str("to", string(to)).
+		Msg("Scheduled stream status changed")
+	if err := s.coord.PublishStreamChange(ctx, stream.ID); err != nil {
+		log.Warn().Err(err).Str("id", stream.ID.String()).Msg("Failed to publish stream change")
+	}
+	return true
+}
+
+// clearMark forgets a stream mark; a failure only delays the next decision
+func (s *Scheduler) clearMark(ctx context.Context, stream *models.Stream, mark string) {
+	if err := s.coord.ClearStreamMark(ctx, stream.ID, mark); err != nil {
+		log.Warn().Err(err).Str("slug", stream.Slug).Str("mark", mark).Msg("Failed to clear stream mark")
+	}
+}
+
+// resetMark records a stream mark as starting now, replacing an earlier one
+func (s *Scheduler) resetMark(ctx context.Context, stream *models.Stream, mark string, now time.Time) {
+	s.clearMark(ctx, stream, mark)
+	if _, _, err := s.coord.MarkStreamSince(ctx, stream.ID, mark, now, markTTL); err != nil {
+		log.Warn().Err(err).Str("slug", stream.Slug).Str("mark", mark).Msg("Failed to set stream mark")
+	}
+}
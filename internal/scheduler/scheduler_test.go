@@ -0,0 +1,314 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/ingest"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// fakeStore holds streams in memory
+type fakeStore struct {
+	streams []*models.Stream
+}
+
+func (f *fakeStore) ListStreams(ctx context.Context) ([]*models.Stream, error) {
+	// Hand out copies, as the database would
+	streams := make([]*models.Stream, len(f.streams))
+	for i, stream := range f.streams {
+		copied := *stream
+		streams[i] = &copied
+	}
+	return streams, nil
+}
+
+func (f *fakeStore) get(id uuid.UUID) *models.Stream {
+	for _, stream := range f.streams {
+		if stream.ID == id {
+			return stream
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) SetStreamStatusIf(ctx context.Context, id uuid.UUID, from, to models.StreamStatus) (bool, error) {
+	stream := f.get(id)
+	if stream == nil || stream.Status != from {
+		return false, nil
+	}
+	stream.Status = to
+	return true, nil
+}
+
+func (f *fakeStore) SetContainerStatusIf(ctx context.Context, id uuid.UUID, from, to models.ContainerStatus) (bool, error) {
+	stream := f.get(id)
+	if stream == nil || stream.ContainerStatus != from {
+		return false, nil
+	}
+	stream.ContainerStatus = to
+	return true, nil
+}
+
+func (f *fakeStore) UpdateContainerStatus(ctx context.Context, id uuid.UUID, status models.ContainerStatus) error {
+	f.get(id).ContainerStatus = status
+	return nil
+}
+
+// fakeCoordinator keeps marks in memory
+type fakeCoordinator struct {
+	marks     map[string]time.Time
+	published int
+}
+
+func (f *fakeCoordinator) AcquireLeadership(ctx context.Context, job, owner string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeCoordinator) ReleaseLeadership(ctx context.Context, job, owner string) error {
+	return nil
+}
+
+func (f *fakeCoordinator) MarkStreamSince(ctx context.Context, streamID uuid.UUID, mark string, now time.Time, ttl time.Duration) (time.Time, bool, error) {
+	key := mark + ":" + streamID.String()
+	if since, ok := f.marks[key]; ok {
+		return since, false, nil
+	}
+	f.marks[key] = time.Unix(now.Unix(), 0)
+	return f.marks[key], true, nil
+}
+
+func (f *fakeCoordinator) ClearStreamMark(ctx context.Context, streamID uuid.UUID, mark string) error {
+	delete(f.marks, mark+":"+streamID.String())
+	return nil
+}
+
+func (f *fakeCoordinator) PublishStreamChange(ctx context.Context, streamID uuid.UUID) error {
+	f.published++
+	return nil
+}
+
+// fakeBackend counts starts and stops; starts fail with startErr when it is set
+type fakeBackend struct {
+	starts, stops int
+	startErr      error
+}
+
+func (b *fakeBackend) Provision(ctx context.Context, stream *models.Stream) error { return nil }
+func (b *fakeBackend) Start(ctx context.Context, stream *models.Stream) error {
+	b.starts++
+	return b.startErr
+}
+func (b *fakeBackend) Stop(ctx context.Context, stream *models.Stream) error {
+	b.stops++
+	return nil
+}
+func (b *fakeBackend) Remove(ctx context.Context, stream *models.Stream) error { return nil }
+func (b *fakeBackend) Status(ctx context.Context, stream *models.Stream) (models.ContainerStatus, error) {
+	return models.ContainerStatusRunning, nil
+}
+func (b *fakeBackend) InternalURL(stream *models.Stream) string { return "http://" + stream.Slug }
+func (b *fakeBackend) RTMPURL(stream *models.Stream) string     { return "" }
+
+// fakeProvisioner counts provisioned Owncast instances
+type fakeProvisioner struct {
+	provisioned int
+}
+
+func (f *fakeProvisioner) ProvisionWhenReady(stream *models.Stream) {
+	f.provisioned++
+}
+
+type fakeBackends struct {
+	backend *fakeBackend
+}
+
+func (f fakeBackends) Get(kind models.IngestBackend) (ingest.Backend, error) {
+	return f.backend, nil
+}
+
+type schedulerTest struct {
+	scheduler    *Scheduler
+	store        *fakeStore
+	coord        *fakeCoordinator
+	backend      *fakeBackend
+	provisioner  *fakeProvisioner
+	broadcasting map[string]bool // By Owncast URL
+	now          time.Time
+}
+
+func newSchedulerTest(streams ...*models.Stream) *schedulerTest {
+	st := &schedulerTest{
+		store:        &fakeStore{streams: streams},
+		coord:        &fakeCoordinator{marks: make(map[string]time.Time)},
+		backend:      &fakeBackend{},
+		provisioner:  &fakeProvisioner{},
+		broadcasting: make(map[string]bool),
+		now:          time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC),
+	}
+	st.scheduler = &Scheduler{
+		store:       st.store,
+		coord:       st.coord,
+		backends:    fakeBackends{st.backend},
+		provisioner: st.provisioner,
+		interval:    30 * time.Second,
+		warmup:      15 * time.Minute,
+		idle:        10 * time.Minute,
+		grace:       30 * time.Minute,
+		owner:       "test",
+		now:         func() time.Time { return st.now },
+		online: func(ctx context.Context, owncastURL string) (bool, error) {
+			return st.broadcasting[owncastURL], nil
+		},
+	}
+	return st
+}
+
+func (st *schedulerTest) advance(d time.Duration) *Report {
+	st.now = st.now.Add(d)
+	return st.scheduler.Tick(context.Background())
+}
+
+func scheduledStream(slug string, start, end time.Time) *models.Stream {
+	return &models.Stream{
+		ID:              uuid.New(),
+		Slug:            slug,
+		StartTime:       &start,
+		EndTime:         &end,
+		Status:          models.StreamStatusScheduled,
+		ContainerStatus: models.ContainerStatusStopped,
+	}
+}
+
+func TestSchedulerLifecycle(t *testing.T) {
+	start := time.Date(2024, 6, 1, 18, 30, 0, 0, time.UTC)
+	stream := scheduledStream("final", start, start.Add(2*time.Hour))
+	st := newSchedulerTest(stream)
+
+	// Too early to warm up
+	if report := st.advance(0); report.Started != 0 || st.backend.starts != 0 {
+		t.Fatalf("Expected no warm-up 30 minutes ahead, got %+v", report)
+	}
+
+	// Within the warm-up lead time
+	if report := st.advance(20 * time.Minute); report.Started != 1 || stream.ContainerStatus != models.ContainerStatusRunning {
+		t.Fatalf("Expected the container to be warmed up, got %+v (%s)", report, stream.ContainerStatus)
+	}
+	if st.provisioner.provisioned != 1 {
+		t.Errorf("Expected the warmed-up Owncast to be provisioned, got %d", st.provisioner.provisioned)
+	}
+
+	// An admin stopping it afterwards is respected
+	stream.ContainerStatus = models.ContainerStatusStopped
+	st.advance(time.Minute)
+	if st.backend.starts != 1 {
+		t.Errorf("Expected the container to be warmed up once, started %d times", st.backend.starts)
+	}
+	stream.ContainerStatus = models.ContainerStatusRunning
+
+	// Running but nobody broadcasting yet
+	if st.advance(time.Minute); stream.Status != models.StreamStatusScheduled {
+		t.Fatalf("Expected the stream to stay scheduled without a broadcast, got %s", stream.Status)
+	}
+
+	st.broadcasting["http://final"] = true
+	if report := st.advance(time.Minute); report.Live != 1 || stream.Status != models.StreamStatusLive || st.coord.published != 1 {
+		t.Fatalf("Expected the stream to go live, got %+v (%s)", report, stream.Status)
+	}
+
+	// A short drop does not end it
+	st.broadcasting["http://final"] = false
+	st.advance(time.Minute)
+	st.advance(5 * time.Minute)
+	st.broadcasting["http://final"] = true
+	st.advance(time.Minute)
+	st.broadcasting["http://final"] = false
+	st.advance(time.Minute)
+	if report := st.advance(9 * time.Minute); report.Ended != 0 || stream.Status != models.StreamStatusLive {
+		t.Fatalf("Expected the stream to survive a drop shorter than the idle timeout, got %+v", report)
+	}
+
+	// Down for the idle timeout
+	if report := st.advance(time.Minute); report.Ended != 1 || stream.Status != models.StreamStatusEnded {
+		t.Fatalf("Expected the idle stream to end, got %+v (%s)", report, stream.Status)
+	}
+
+	// Stopped after the grace period
+	if report := st.advance(29 * time.Minute); report.Stopped != 0 {
+		t.Fatalf("Expected the container to run through the grace period, got %+v", report)
+	}
+	if report := st.advance(time.Minute); report.Stopped != 1 || stream.ContainerStatus != models.ContainerStatusStopped || st.backend.stops != 1 {
+		t.Fatalf("Expected the container to be stopped, got %+v (%s)", report, stream.ContainerStatus)
+	}
+}
+
+func TestSchedulerEndTime(t *testing.T) {
+	start := time.Date(2024, 6, 1, 17, 0, 0, 0, time.UTC)
+	live := scheduledStream("live", start, start.Add(time.Hour))
+	live.Status = models.StreamStatusLive
+	live.ContainerStatus = models.ContainerStatusRunning
+	noShow := scheduledStream("no-show", start, start.Add(time.Hour))
+	noShow.ContainerStatus = models.ContainerStatusRunning
+	unscheduled := &models.Stream{ID: uuid.New(), Slug: "unscheduled", Status: models.StreamStatusLive, ContainerStatus: models.ContainerStatusRunning}
+	st := newSchedulerTest(live, noShow, unscheduled)
+
+	// Past the end time, both end as soon as nothing is broadcast
+	report := st.advance(time.Minute)
+	if report.Ended != 2 || live.Status != models.StreamStatusEnded || noShow.Status != models.StreamStatusEnded {
+		t.Errorf("Expected both streams past their end time to end, got %+v", report)
+	}
+	if unscheduled.Status != models.StreamStatusLive {
+		t.Error("Expected a stream without a start time to be left alone")
+	}
+	if st.backend.starts != 0 {
+		t.Error("Expected no warm-up after the end time")
+	}
+}
+
+func TestSchedulerBroadcastPastEndTime(t *testing.T) {
+	start := time.Date(2024, 6, 1, 17, 0, 0, 0, time.UTC)
+	overtime := scheduledStream("overtime", start, start.Add(time.Hour))
+	overtime.Status = models.StreamStatusLive
+	overtime.ContainerStatus = models.ContainerStatusRunning
+	st := newSchedulerTest(overtime)
+	st.broadcasting["http://overtime"] = true
+
+	if st.advance(time.Minute); overtime.Status != models.StreamStatusLive {
+		t.Error("Expected a stream still broadcasting past its end time to stay live")
+	}
+}
+
+func TestSchedulerWarmUpRetriesAndReschedules(t *testing.T) {
+	start := time.Date(2024, 6, 1, 18, 10, 0, 0, time.UTC)
+	stream := scheduledStream("cup", start, start.Add(2*time.Hour))
+	st := newSchedulerTest(stream)
+
+	// A failed start is not recorded as a warm-up
+	st.backend.startErr = errors.New("docker unavailable")
+	if report := st.advance(0); report.Errors != 1 || stream.ContainerStatus != models.ContainerStatusError {
+		t.Fatalf("Expected the failed warm-up to be reported, got %+v (%s)", report, stream.ContainerStatus)
+	}
+
+	// Once an admin resets the container, the next pass tries again
+	st.backend.startErr = nil
+	stream.ContainerStatus = models.ContainerStatusStopped
+	if report := st.advance(time.Minute); report.Started != 1 || st.backend.starts != 2 {
+		t.Fatalf("Expected the warm-up to be retried, got %+v after %d starts", report, st.backend.starts)
+	}
+
+	// Stopped by an admin, then moved to a later start: warmed up again for the new time
+	stream.ContainerStatus = models.ContainerStatusStopped
+	st.advance(time.Minute)
+	if st.backend.starts != 2 {
+		t.Fatalf("Expected the stopped container to stay stopped, started %d times", st.backend.starts)
+	}
+	later := start.Add(time.Hour)
+	stream.StartTime = &later
+	stream.EndTime = nil
+	if report := st.advance(time.Hour); report.Started != 1 || st.backend.starts != 3 {
+		t.Errorf("Expected a warm-up for the new start time, got %+v after %d starts", report, st.backend.starts)
+	}
+}
@@ -0,0 +1,100 @@
+package security
+
+import (
+	"context"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+)
+
+// PendingSeatHold is how long a pending payment holds a seat while the buyer
+// is in the Paytrail flow. Abandoned payments release their seat after this.
+const PendingSeatHold = 30 * time.Minute
+
+// AdmissionController enforces Stream.MaxViewers, the stream's number of seats
+// A seat is both a ticket sold and a token watching at the same time: at most
+// MaxViewers tickets are sold, and at most MaxViewers tokens watch at once, which
+// also holds back guests who got in without a ticket (e.g. whitelisted emails).
+type AdmissionController struct {
+	pgStore *storage.PostgresStore
+	redis   *storage.RedisStore
+	seatTTL time.Duration
+}
+
+// NewAdmissionController creates a new admission controller
+// seatTTL is how long a seat is held without a heartbeat or playlist reload
+func NewAdmissionController(pgStore *storage.PostgresStore, redis *storage.RedisStore, seatTTL time.Duration) *AdmissionController {
+	return &AdmissionController{
+		pgStore: pgStore,
+		redis:   redis,
+		seatTTL: seatTTL,
+	}
+}
+
+// AdmissionResult contains the result of a seat admission attempt
+type AdmissionResult struct {
+	Admitted      bool
+	HeldSeat      bool // Token already held a seat before this attempt
+	ActiveViewers int64
+	MaxViewers    int
+}
+
+// AdmitViewer takes or refreshes a viewing seat for a token
+// Viewers who already hold a seat are always re-admitted, new viewers are
+// refused once the stream is full. Streams without a cap always admit.
+func (c *AdmissionController) AdmitViewer(ctx context.Context, stream *models.Stream, token string) (*AdmissionResult, error) {
+	admitted, held, active, err := c.redis.AdmitActiveSession(ctx, stream.ID, token, stream.MaxViewers, c.seatTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdmissionResult{
+		Admitted:      admitted,
+		HeldSeat:      held,
+		ActiveViewers: active,
+		MaxViewers:    stream.MaxViewers,
+	}, nil
+}
+
+// AdmitSession admits a session's token like AdmitViewer, trusting a recent admission cached on the session
+// Playlist requests (several a second with LL-HLS blocking reloads) then only
+// refresh the seat once a third of the seat TTL has passed. The session is
+// updated in Redis when the seat is refreshed; if that fails, the next request
+// simply refreshes it again.
+func (c *AdmissionController) AdmitSession(ctx context.Context, stream *models.Stream, token string, session *storage.SessionData) (*AdmissionResult, error) {
+	if stream.MaxViewers <= 0 {
+		return &AdmissionResult{Admitted: true}, nil
+	}
+	now := time.Now()
+	if until, ok := session.Seats[stream.ID.String()]; ok && now.Before(until) {
+		return &AdmissionResult{Admitted: true, HeldSeat: true, MaxViewers: stream.MaxViewers}, nil
+	}
+
+	result, err := c.AdmitViewer(ctx, stream, token)
+	if err != nil || !result.Admitted {
+		return result, err
+	}
+	if session.Seats == nil {
+		session.Seats = make(map[string]time.Time)
+	}
+	session.Seats[stream.ID.String()] = now.Add(c.seatTTL / 3)
+	c.redis.UpdateSession(ctx, token, session)
+	return result, nil
+}
+
+// IsSoldOut reports whether all tickets for a capped stream have been sold
+// Pending payments younger than PendingSeatHold count as sold. This is only a
+// snapshot for showing availability and refusing early; the seat itself is
+// reserved atomically when the payment is stored (storage.CreatePaymentWithSeats).
+func (c *AdmissionController) IsSoldOut(ctx context.Context, stream *models.Stream) (bool, error) {
+	if stream.MaxViewers <= 0 {
+		return false, nil
+	}
+
+	sold, err := c.pgStore.CountSoldSeatsByStream(ctx, stream.ID, time.Now().Add(-PendingSeatHold))
+	if err != nil {
+		return false, err
+	}
+	return sold >= stream.MaxViewers, nil
+}
@@ -0,0 +1,115 @@
+package security
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/storage/storagetest"
+)
+
+func TestAdmitViewer(t *testing.T) {
+	_, redis := storagetest.NewRedisStore(t)
+	c := NewAdmissionController(nil, redis, time.Minute)
+	ctx := context.Background()
+	stream := &models.Stream{ID: uuid.New(), MaxViewers: 2}
+
+	tests := []struct {
+		token        string
+		wantAdmitted bool
+		wantHeld     bool
+		wantActive   int64
+	}{
+		{"viewer-1", true, false, 1},
+		{"viewer-2", true, false, 2},
+		{"viewer-3", false, false, 2}, // Full at the cap
+		{"viewer-1", true, true, 2},   // Seat holders keep their seat
+	}
+	for _, tt := range tests {
+		result, err := c.AdmitViewer(ctx, stream, tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Admitted != tt.wantAdmitted || result.HeldSeat != tt.wantHeld || result.ActiveViewers != tt.wantActive {
+			t.Errorf("%s: result = %+v, want admitted %v, held %v, %d active", tt.token, result, tt.wantAdmitted, tt.wantHeld, tt.wantActive)
+		}
+	}
+
+	// Without a cap everyone gets in
+	unlimited := &models.Stream{ID: uuid.New()}
+	for _, token := range []string{"viewer-1", "viewer-2", "viewer-3"} {
+		if result, err := c.AdmitViewer(ctx, unlimited, token); err != nil || !result.Admitted {
+			t.Errorf("%s refused from an uncapped stream: %+v, %v", token, result, err)
+		}
+	}
+}
+
+func TestAdmitSessionCachesSeat(t *testing.T) {
+	mr, redis := storagetest.NewRedisStore(t)
+	c := NewAdmissionController(nil, redis, 30*time.Second)
+	ctx := context.Background()
+	stream := &models.Stream{ID: uuid.New(), MaxViewers: 1}
+
+	session := &storage.SessionData{Token: "viewer-1", StreamID: stream.ID.String()}
+	if err := redis.SetSession(ctx, "viewer-1", session, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.AdmitSession(ctx, stream, "viewer-1", session)
+	if err != nil || !result.Admitted {
+		t.Fatalf("first admission = %+v, %v; want admitted", result, err)
+	}
+	until := session.Seats[stream.ID.String()]
+	if wait := time.Until(until); wait < 9*time.Second || wait > 10*time.Second {
+		t.Errorf("seat cached for %v, want a third of the seat TTL", wait)
+	}
+	stored, _ := redis.GetSession(ctx, "viewer-1")
+	if stored == nil || !stored.Seats[stream.ID.String()].Equal(until) {
+		t.Errorf("stored session = %+v, want the cached seat", stored)
+	}
+	if ttl := mr.TTL("session:viewer-1"); ttl < 59*time.Minute {
+		t.Errorf("session TTL = %v after caching the seat, want it kept", ttl)
+	}
+
+	// Playlist reloads within the window do not touch Redis
+	commands := mr.CommandCount()
+	for i := 0; i < 10; i++ {
+		if result, err := c.AdmitSession(ctx, stream, "viewer-1", session); err != nil || !result.Admitted || !result.HeldSeat {
+			t.Fatalf("cached admission = %+v, %v; want the held seat", result, err)
+		}
+	}
+	if n := mr.CommandCount() - commands; n != 0 {
+		t.Errorf("cached admissions sent %d Redis commands, want none", n)
+	}
+
+	// The stream is full for others, and a stale cache asks Redis again
+	other := &storage.SessionData{Token: "viewer-2"}
+	if result, err := c.AdmitSession(ctx, stream, "viewer-2", other); err != nil || result.Admitted {
+		t.Errorf("second viewer = %+v, %v; want refused", result, err)
+	}
+	session.Seats[stream.ID.String()] = time.Now().Add(-time.Second)
+	if result, err := c.AdmitSession(ctx, stream, "viewer-1", session); err != nil || !result.Admitted || mr.CommandCount() == commands {
+		t.Errorf("stale cache = %+v, %v; want the seat refreshed in Redis", result, err)
+	}
+
+	// Uncapped streams need no seat at all
+	if result, err := c.AdmitSession(ctx, &models.Stream{ID: uuid.New()}, "viewer-2", other); err != nil || !result.Admitted {
+		t.Errorf("uncapped stream = %+v, %v; want admitted", result, err)
+	}
+}
+
+func TestUpdateSessionKeepsDeletedSessionsDeleted(t *testing.T) {
+	mr, redis := storagetest.NewRedisStore(t)
+	ctx := context.Background()
+
+	session := &storage.SessionData{Token: "refunded"}
+	if err := redis.UpdateSession(ctx, "refunded", session); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("session:refunded") {
+		t.Error("UpdateSession recreated a deleted session")
+	}
+}
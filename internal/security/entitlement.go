@@ -0,0 +1,156 @@
+package security
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+)
+
+// bundleCacheTTL is how long bundle definitions are cached for access checks
+// Admin changes to a bundle take effect on running viewers within this time.
+const bundleCacheTTL = 60 * time.Second
+
+// subscriptionCacheTTL is how long memberships are cached for access checks
+// Kept short so canceled or expired memberships stop playback quickly.
+const subscriptionCacheTTL = 30 * time.Second
+
+// bundleCacheEntry holds a cached bundle with expiry
+type bundleCacheEntry struct {
+	bundle    *models.Bundle
+	expiresAt time.Time
+}
+
+// subscriptionCacheEntry holds a cached subscription with expiry
+type subscriptionCacheEntry struct {
+	sub       *models.Subscription
+	expiresAt time.Time
+}
+
+// EntitlementChecker decides whether a token grants access to a stream,
+// either through a single-stream purchase, a bundle that covers the stream
+// or a membership for members-only streams
+type EntitlementChecker struct {
+	pgStore           *storage.PostgresStore
+	bundleCache       sync.Map // uuid.UUID -> *bundleCacheEntry
+	subscriptionCache sync.Map // uuid.UUID -> *subscriptionCacheEntry
+}
+
+// NewEntitlementChecker creates a new entitlement checker
+func NewEntitlementChecker(pgStore *storage.PostgresStore) *EntitlementChecker {
+	return &EntitlementChecker{
+		pgStore: pgStore,
+	}
+}
+
+// SessionGrants reports whether a Redis session grants access to the stream
+func (c *EntitlementChecker) SessionGrants(ctx context.Context, session *storage.SessionData, stream *models.Stream) (bool, error) {
+	if session.SubscriptionID != "" {
+		subID, err := uuid.Parse(session.SubscriptionID)
+		if err != nil {
+			return false, nil
+		}
+		return c.subscriptionCovers(ctx, subID, stream)
+	}
+
+	if session.BundleID == "" {
+		return session.StreamID == stream.ID.String(), nil
+	}
+
+	bundleID, err := uuid.Parse(session.BundleID)
+	if err != nil {
+		return false, nil
+	}
+	return c.bundleCovers(ctx, bundleID, stream)
+}
+
+// PaymentGrants reports whether a payment grants access to the stream
+// The caller is responsible for checking the payment's token is still valid.
+func (c *EntitlementChecker) PaymentGrants(ctx context.Context, payment *models.Payment, stream *models.Stream) (bool, error) {
+	if !payment.IsBundle() {
+		return payment.StreamID == stream.ID, nil
+	}
+	return c.bundleCovers(ctx, *payment.BundleID, stream)
+}
+
+// ResolveToken looks up what an access token was issued for and returns its session data
+// Returns nil if the token is unknown, expired, or belongs to a membership without access.
+func (c *EntitlementChecker) ResolveToken(ctx context.Context, token string) (*storage.SessionData, error) {
+	payment, err := c.pgStore.GetPaymentByAccessToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if payment != nil {
+		if !payment.IsTokenValid() {
+			return nil, nil
+		}
+		return storage.NewPaymentSession(payment, token, *payment.TokenExpiry), nil
+	}
+
+	sub, err := c.pgStore.GetSubscriptionByAccessToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil || !sub.HasAccessAt(time.Now()) {
+		return nil, nil
+	}
+	return storage.NewSubscriptionSession(sub, token, *sub.CurrentPeriodEnd), nil
+}
+
+// subscriptionCovers checks a membership grants access to a members-only stream, using the cache when possible
+func (c *EntitlementChecker) subscriptionCovers(ctx context.Context, subID uuid.UUID, stream *models.Stream) (bool, error) {
+	if !stream.MembersOnly {
+		return false, nil
+	}
+
+	if entry, ok := c.subscriptionCache.Load(subID); ok {
+		e := entry.(*subscriptionCacheEntry)
+		if time.Now().Before(e.expiresAt) {
+			return e.sub.HasAccessAt(time.Now()), nil
+		}
+		c.subscriptionCache.Delete(subID)
+	}
+
+	sub, err := c.pgStore.GetSubscriptionByID(ctx, subID)
+	if err != nil {
+		return false, err
+	}
+	if sub == nil {
+		return false, nil
+	}
+
+	c.subscriptionCache.Store(subID, &subscriptionCacheEntry{
+		sub:       sub,
+		expiresAt: time.Now().Add(subscriptionCacheTTL),
+	})
+	return sub.HasAccessAt(time.Now()), nil
+}
+
+// bundleCovers checks a bundle's stream selection, using the cache when possible
+// Bundles that were deactivated keep granting access to those who bought them.
+func (c *EntitlementChecker) bundleCovers(ctx context.Context, bundleID uuid.UUID, stream *models.Stream) (bool, error) {
+	if entry, ok := c.bundleCache.Load(bundleID); ok {
+		e := entry.(*bundleCacheEntry)
+		if time.Now().Before(e.expiresAt) {
+			return e.bundle.Covers(stream), nil
+		}
+		c.bundleCache.Delete(bundleID)
+	}
+
+	bundle, err := c.pgStore.GetBundleByID(ctx, bundleID)
+	if err != nil {
+		return false, err
+	}
+	if bundle == nil {
+		return false, nil
+	}
+
+	c.bundleCache.Store(bundleID, &bundleCacheEntry{
+		bundle:    bundle,
+		expiresAt: time.Now().Add(bundleCacheTTL),
+	})
+	return bundle.Covers(stream), nil
+}
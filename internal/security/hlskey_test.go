@@ -0,0 +1,87 @@
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+	"time"
+)
+
+func TestSegmentKeys(t *testing.T) {
+	keys := NewSegmentKeys("test-secret-key", 10*time.Minute)
+	if !keys.Enabled() {
+		t.Fatal("expected encryption to be enabled")
+	}
+	if NewSegmentKeys("test-secret-key", 0).Enabled() {
+		t.Error("rotation 0 should disable encryption")
+	}
+
+	key := keys.Key("stream-123", "token-a", 42)
+	if len(key) != 16 {
+		t.Fatalf("expected a 16-byte key, got %d bytes", len(key))
+	}
+	if !bytes.Equal(key, keys.Key("stream-123", "token-a", 42)) {
+		t.Error("keys should be deterministic")
+	}
+	if bytes.Equal(key, keys.Key("stream-123", "token-b", 42)) {
+		t.Error("sessions should get different keys")
+	}
+	if bytes.Equal(key, keys.Key("stream-123", "token-a", 43)) {
+		t.Error("keys should change every rotation period")
+	}
+	if bytes.Equal(key, NewSegmentKeys("other-secret", 10*time.Minute).Key("stream-123", "token-a", 42)) {
+		t.Error("keys should depend on the secret")
+	}
+}
+
+func TestSegmentKeysIsCurrent(t *testing.T) {
+	keys := NewSegmentKeys("test-secret-key", 10*time.Minute)
+	now := time.Unix(1_700_000_000, 0)
+	epoch := keys.Epoch(now)
+
+	tests := []struct {
+		epoch int64
+		want  bool
+	}{
+		{epoch, true},
+		{epoch - 1, true},
+		{epoch - 2, false},
+		{epoch + 1, false},
+	}
+	for _, tt := range tests {
+		if got := keys.IsCurrent(tt.epoch, now); got != tt.want {
+			t.Errorf("IsCurrent(%d) = %v, want %v (current %d)", tt.epoch, got, tt.want, epoch)
+		}
+	}
+}
+
+func TestEncryptSegment(t *testing.T) {
+	key := NewSegmentKeys("test-secret-key", time.Minute).Key("stream-123", "token-a", 1)
+	iv := SegmentIV("/stream/stream-123/hls/0/stream-1.ts")
+
+	for _, size := range []int{0, 1, 15, 16, 17, 188 * 7} {
+		data := bytes.Repeat([]byte{0x47}, size)
+
+		encrypted, err := EncryptSegment(key, iv, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encrypted)%aes.BlockSize != 0 || len(encrypted) <= size {
+			t.Fatalf("size %d: unexpected ciphertext length %d", size, len(encrypted))
+		}
+
+		// Decrypt as a player would and strip the PKCS#7 padding
+		block, _ := aes.NewCipher(key)
+		decrypted := make([]byte, len(encrypted))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+		padding := int(decrypted[len(decrypted)-1])
+		if !bytes.Equal(decrypted[:len(decrypted)-padding], data) {
+			t.Errorf("size %d: round trip mismatch", size)
+		}
+	}
+
+	if _, err := EncryptSegment(key, iv[:8], []byte("x")); err == nil {
+		t.Error("expected an error for a short IV")
+	}
+}
@@ -0,0 +1,96 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// secretBoxVersion prefixes sealed values, so the key derivation can change later
+	// v2 values also name the key that sealed them; v1 values are still opened.
+	secretBoxVersion       = "v2:"
+	secretBoxLegacyVersion = "v1:"
+)
+
+// SecretBox encrypts credentials the paywall stores in the database
+// Values are sealed with AES-256-GCM under a key derived from the credentials
+// secret; a database dump alone does not reveal them. Each value records the ID
+// of the key that sealed it, so a value sealed under another secret is reported
+// as such instead of as corrupt.
+type SecretBox struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+// NewSecretBox creates a secret box keyed by secret
+func NewSecretBox(secret string) (*SecretBox, error) {
+	if secret == "" {
+		return nil, errors.New("credentials secret is empty")
+	}
+	key := sha256.Sum256([]byte("secretbox:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256([]byte("secretbox-id:" + secret))
+	return &SecretBox{aead: aead, keyID: hex.EncodeToString(id[:4])}, nil
+}
+
+// KeyID identifies the secret the box seals with without revealing it
+func (b *SecretBox) KeyID() string {
+	return b.keyID
+}
+
+// Seal encrypts a value
+// Output format: v2:{key ID}:{base64(nonce || ciphertext)}
+func (b *SecretBox) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretBoxVersion + b.keyID + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed by Seal
+func (b *SecretBox) Open(sealed string) (string, error) {
+	encoded, ok := strings.CutPrefix(sealed, secretBoxLegacyVersion)
+	if !ok {
+		rest, ok := strings.CutPrefix(sealed, secretBoxVersion)
+		if !ok {
+			return "", errors.New("unknown sealed value format")
+		}
+		keyID, data, ok := strings.Cut(rest, ":")
+		if !ok {
+			return "", errors.New("invalid sealed value: no key ID")
+		}
+		if keyID != b.keyID {
+			return "", fmt.Errorf("sealed value was sealed with key %s, not the current key %s; was the credentials secret changed?", keyID, b.keyID)
+		}
+		encoded = data
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid sealed value: %w", err)
+	}
+	if len(data) < b.aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("sealed value does not open with this secret")
+	}
+	return string(plaintext), nil
+}
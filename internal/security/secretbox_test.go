@@ -0,0 +1,56 @@
+package security
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox("test-secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.Seal("owncast-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "v2:"+box.KeyID()+":") || strings.Contains(sealed, "owncast-password") {
+		t.Errorf("unexpected sealed value %q", sealed)
+	}
+	again, _ := box.Seal("owncast-password")
+	if again == sealed {
+		t.Error("sealing twice should use different nonces")
+	}
+
+	opened, err := box.Open(sealed)
+	if err != nil || opened != "owncast-password" {
+		t.Fatalf("expected the value back, got %q (%v)", opened, err)
+	}
+
+	other, _ := NewSecretBox("other-secret")
+	if _, err := other.Open(sealed); err == nil || !strings.Contains(err.Error(), box.KeyID()) {
+		t.Errorf("a different secret should not open the value and should name its key, got %v", err)
+	}
+	if other.KeyID() == box.KeyID() {
+		t.Error("different secrets should have different key IDs")
+	}
+
+	// Values sealed before key IDs were recorded still open
+	legacy := "v1:" + strings.SplitN(sealed, ":", 3)[2]
+	if opened, err := box.Open(legacy); err != nil || opened != "owncast-password" {
+		t.Errorf("expected a v1 value to open, got %q (%v)", opened, err)
+	}
+	if _, err := other.Open(legacy); err == nil {
+		t.Error("a different secret should not open a v1 value")
+	}
+	if _, err := box.Open(sealed[:len(sealed)-2] + "AA"); err == nil {
+		t.Error("a tampered value should not open")
+	}
+	if _, err := box.Open("owncast-password"); err == nil {
+		t.Error("an unsealed value should not open")
+	}
+	if _, err := NewSecretBox(""); err == nil {
+		t.Error("an empty secret should be rejected")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -27,6 +28,7 @@ func NewURLSigner(secret string, validity time.Duration) *URLSigner {
 
 // SignURL generates a signed URL for a stream segment
 // Input format: {streamID}:{token}:{path}:{expires}
+// A query already in path is signed with it and kept in front of the signature parameters.
 func (s *URLSigner) SignURL(streamID, token, path string) string {
 	expires := time.Now().Add(s.validity).Unix()
 	
@@ -44,7 +46,11 @@ func (s *URLSigner) SignURL(streamID, token, path string) string {
 	params.Set("expires", strconv.FormatInt(expires, 10))
 	params.Set("sig", sig)
 	
-	return path + "?" + params.Encode()
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + params.Encode()
 }
 
 // SignedURLParams contains the parameters needed to verify a signed URL
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// accessCodeBatchColumns is the list of columns for access code batch queries
+// redeemed counts the batch's codes that have been used
+const accessCodeBatchColumns = `id, stream_id, label, code_count, expires_at,
+	(SELECT COUNT(*) FROM access_codes c WHERE c.batch_id = access_code_batches.id AND c.redeemed_at IS NOT NULL),
+	created_at`
+
+// scanAccessCodeBatch scans a row into an AccessCodeBatch struct
+func scanAccessCodeBatch(row pgx.Row) (*models.AccessCodeBatch, error) {
+	batch := &models.AccessCodeBatch{}
+	err := row.Scan(
+		&batch.ID,
+		&batch.StreamID,
+		&batch.Label,
+		&batch.CodeCount,
+		&batch.ExpiresAt,
+		&batch.RedeemedCount,
+		&batch.CreatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// accessCodeColumns is the list of columns for access code queries
+const accessCodeColumns = `id, batch_id, code, COALESCE(redeemed_email, ''), redeemed_at, payment_id`
+
+// scanAccessCode scans a row into an AccessCode struct
+func scanAccessCode(row pgx.Row) (*models.AccessCode, error) {
+	code := &models.AccessCode{}
+	err := row.Scan(
+		&code.ID,
+		&code.BatchID,
+		&code.Code,
+		&code.RedeemedEmail,
+		&code.RedeemedAt,
+		&code.PaymentID,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// CreateAccessCodeBatch creates a batch together with its codes
+func (s *PostgresStore) CreateAccessCodeBatch(ctx context.Context, batch *models.AccessCodeBatch, codes []string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO access_code_batches (id, stream_id, label, code_count, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = tx.Exec(ctx, query,
+		batch.ID,
+		batch.StreamID,
+		batch.Label,
+		len(codes),
+		batch.ExpiresAt,
+		batch.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO access_codes (batch_id, code)
+		SELECT $1, unnest($2::text[])
+	`
+	if _, err := tx.Exec(ctx, query, batch.ID, codes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetAccessCodeBatchByID retrieves an access code batch by ID
+func (s *PostgresStore) GetAccessCodeBatchByID(ctx context.Context, id uuid.UUID) (*models.AccessCodeBatch, error) {
+	query := "SELECT " + accessCodeBatchColumns + " FROM access_code_batches WHERE id = $1"
+	return scanAccessCodeBatch(s.pool.QueryRow(ctx, query, id))
+}
+
+// ListAccessCodeBatchesByStream retrieves a stream's access code batches, newest first
+func (s *PostgresStore) ListAccessCodeBatchesByStream(ctx context.Context, streamID uuid.UUID) ([]*models.AccessCodeBatch, error) {
+	query := "SELECT " + accessCodeBatchColumns + ` FROM access_code_batches
+		WHERE stream_id = $1
+		ORDER BY created_at DESC`
+	rows, err := s.pool.Query(ctx, query, streamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []*models.AccessCodeBatch
+	for rows.Next() {
+		batch, err := scanAccessCodeBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
+
+// DeleteAccessCodeBatch deletes a batch and its codes
+// Access already granted by redeemed codes is kept.
+func (s *PostgresStore) DeleteAccessCodeBatch(ctx context.Context, id uuid.UUID) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM access_code_batches WHERE id = $1", id)
+	return err
+}
+
+// GetAccessCodeByCode retrieves an access code by its code string
+func (s *PostgresStore) GetAccessCodeByCode(ctx context.Context, code string) (*models.AccessCode, error) {
+	query := "SELECT " + accessCodeColumns + " FROM access_codes WHERE code = $1"
+	return scanAccessCode(s.pool.QueryRow(ctx, query, code))
+}
+
+// ListAccessCodes retrieves all codes in a batch
+func (s *PostgresStore) ListAccessCodes(ctx context.Context, batchID uuid.UUID) ([]*models.AccessCode, error) {
+	query := "SELECT " + accessCodeColumns + ` FROM access_codes
+		WHERE batch_id = $1
+		ORDER BY code`
+	rows, err := s.pool.Query(ctx, query, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []*models.AccessCode
+	for rows.Next() {
+		code, err := scanAccessCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// RedeemAccessCode inserts the payment that a code grants and marks the code used
+// Returns false, without inserting the payment, if the code was already redeemed,
+// and ErrSoldOut if the stream has no seat left (see CreatePaymentWithSeats).
+func (s *PostgresStore) RedeemAccessCode(ctx context.Context, id uuid.UUID, payment *models.Payment, pendingSince time.Time) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := reserveSeats(ctx, tx, []uuid.UUID{payment.StreamID}, pendingSince); err != nil {
+		return false, err
+	}
+	if err := insertPayment(ctx, tx, payment); err != nil {
+		return false, err
+	}
+
+	query := `
+		UPDATE access_codes
+		SET redeemed_email = $1, redeemed_at = NOW(), payment_id = $2
+		WHERE id = $3 AND redeemed_at IS NULL
+	`
+	tag, err := tx.Exec(ctx, query, payment.Email, payment.ID, id)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() != 1 {
+		return false, nil
+	}
+	return true, tx.Commit(ctx)
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Broadcast State ---
+
+const (
+	broadcastKeyPrefix = "broadcast:"
+	// broadcastTTL is how long a stream's broadcast state outlives its last webhook
+	broadcastTTL = 7 * 24 * time.Hour
+)
+
+func broadcastKey(streamID uuid.UUID) string {
+	return broadcastKeyPrefix + streamID.String()
+}
+
+// SetBroadcastOnline records that a stream's broadcast started or stopped
+// Starting a broadcast resets its chat counters.
+func (s *RedisStore) SetBroadcastOnline(ctx context.Context, streamID uuid.UUID, online bool, at time.Time) error {
+	key := broadcastKey(streamID)
+	pipe := s.client.TxPipeline()
+	if online {
+		pipe.HDel(ctx, key, "chat_messages", "chat_users", "last_chat")
+	}
+	pipe.HSet(ctx, key, "online", online, "since", at.Unix(), "updated", at.Unix())
+	pipe.Expire(ctx, key, broadcastTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// SetBroadcastTitle records the stream title set in Owncast
+func (s *RedisStore) SetBroadcastTitle(ctx context.Context, streamID uuid.UUID, title string, at time.Time) error {
+	key := broadcastKey(streamID)
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, key, "title", title, "updated", at.Unix())
+	pipe.Expire(ctx, key, broadcastTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RecordChatMessage counts a chat message in a stream's broadcast
+func (s *RedisStore) RecordChatMessage(ctx context.Context, streamID uuid.UUID, at time.Time) error {
+	return s.recordChat(ctx, streamID, "chat_messages", at)
+}
+
+// RecordChatUser counts a chatter joining a stream's broadcast
+func (s *RedisStore) RecordChatUser(ctx context.Context, streamID uuid.UUID, at time.Time) error {
+	return s.recordChat(ctx, streamID, "chat_users", at)
+}
+
+func (s *RedisStore) recordChat(ctx context.Context, streamID uuid.UUID, counter string, at time.Time) error {
+	key := broadcastKey(streamID)
+	pipe := s.client.TxPipeline()
+	pipe.HIncrBy(ctx, key, counter, 1)
+	pipe.HSet(ctx, key, "last_chat", at.Unix(), "updated", at.Unix())
+	pipe.Expire(ctx, key, broadcastTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetBroadcastState returns what a stream's Owncast last reported, nil if it never has
+func (s *RedisStore) GetBroadcastState(ctx context.Context, streamID uuid.UUID) (*models.BroadcastState, error) {
+	fields, err := s.client.HGetAll(ctx, broadcastKey(streamID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseBroadcastState(fields), nil
+}
+
+// GetBroadcastStates returns the broadcast states of several streams, leaving out those without one
+func (s *RedisStore) GetBroadcastStates(ctx context.Context, streamIDs []uuid.UUID) (map[uuid.UUID]*models.BroadcastState, error) {
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(streamIDs))
+	for i, id := range streamIDs {
+		cmds[i] = pipe.HGetAll(ctx, broadcastKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	states := make(map[uuid.UUID]*models.BroadcastState)
+	for i, cmd := range cmds {
+		if state := parseBroadcastState(cmd.Val()); state != nil {
+			states[streamIDs[i]] = state
+		}
+	}
+	return states, nil
+}
+
+func parseBroadcastState(fields map[string]string) *models.BroadcastState {
+	if len(fields) == 0 {
+		return nil
+	}
+	unix := func(field string) time.Time {
+		n, _ := strconv.ParseInt(fields[field], 10, 64)
+		return time.Unix(n, 0)
+	}
+
+	state := &models.BroadcastState{
+		Online:    fields["online"] == "1",
+		Since:     unix("since"),
+		Title:     fields["title"],
+		UpdatedAt: unix("updated"),
+	}
+	state.ChatMessages, _ = strconv.ParseInt(fields["chat_messages"], 10, 64)
+	state.ChatUsers, _ = strconv.ParseInt(fields["chat_users"], 10, 64)
+	if _, ok := fields["last_chat"]; ok {
+		lastChat := unix("last_chat")
+		state.LastChatAt = &lastChat
+	}
+	return state
+}
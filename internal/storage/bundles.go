@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// ErrBundleHasPayments is returned when deleting a bundle that has been sold
+var ErrBundleHasPayments = errors.New("bundle has payments")
+
+// bundleColumns is the list of columns for bundle queries
+const bundleColumns = `id, slug, title, COALESCE(description, ''), price_cents,
+	ARRAY(SELECT stream_id FROM bundle_streams bs WHERE bs.bundle_id = bundles.id),
+	COALESCE(tag, ''), starts_after, starts_before, active, created_at`
+
+// scanBundle scans a row into a Bundle struct
+func scanBundle(row pgx.Row) (*models.Bundle, error) {
+	bundle := &models.Bundle{}
+	err := row.Scan(
+		&bundle.ID,
+		&bundle.Slug,
+		&bundle.Title,
+		&bundle.Description,
+		&bundle.PriceCents,
+		&bundle.StreamIDs,
+		&bundle.Tag,
+		&bundle.StartsAfter,
+		&bundle.StartsBefore,
+		&bundle.Active,
+		&bundle.CreatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// CreateBundle creates a new bundle and its explicit stream list
+func (s *PostgresStore) CreateBundle(ctx context.Context, bundle *models.Bundle) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO bundles (id, slug, title, description, price_cents, tag, starts_after, starts_before, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10)
+	`
+	_, err = tx.Exec(ctx, query,
+		bundle.ID,
+		bundle.Slug,
+		bundle.Title,
+		bundle.Description,
+		bundle.PriceCents,
+		bundle.Tag,
+		bundle.StartsAfter,
+		bundle.StartsBefore,
+		bundle.Active,
+		bundle.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := setBundleStreams(ctx, tx, bundle); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetBundleByID retrieves a bundle by ID
+func (s *PostgresStore) GetBundleByID(ctx context.Context, id uuid.UUID) (*models.Bundle, error) {
+	query := "SELECT " + bundleColumns + " FROM bundles WHERE id = $1"
+	return scanBundle(s.pool.QueryRow(ctx, query, id))
+}
+
+// GetBundleBySlug retrieves a bundle by its slug
+func (s *PostgresStore) GetBundleBySlug(ctx context.Context, slug string) (*models.Bundle, error) {
+	query := "SELECT " + bundleColumns + " FROM bundles WHERE slug = $1"
+	return scanBundle(s.pool.QueryRow(ctx, query, slug))
+}
+
+// ListBundles retrieves all bundles, newest first
+func (s *PostgresStore) ListBundles(ctx context.Context) ([]*models.Bundle, error) {
+	return s.listBundles(ctx, "SELECT "+bundleColumns+" FROM bundles ORDER BY created_at DESC")
+}
+
+// ListActiveBundles retrieves bundles that are on sale
+func (s *PostgresStore) ListActiveBundles(ctx context.Context) ([]*models.Bundle, error) {
+	return s.listBundles(ctx, "SELECT "+bundleColumns+" FROM bundles WHERE active ORDER BY created_at DESC")
+}
+
+// listBundles runs a bundle query and scans all rows
+func (s *PostgresStore) listBundles(ctx context.Context, query string) ([]*models.Bundle, error) {
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bundles []*models.Bundle
+	for rows.Next() {
+		bundle, err := scanBundle(rows)
+		if err != nil {
+			return nil, err
+		}
+		bundles = append(bundles, bundle)
+	}
+	return bundles, rows.Err()
+}
+
+// UpdateBundle overwrites a bundle's settings and explicit stream list
+func (s *PostgresStore) UpdateBundle(ctx context.Context, bundle *models.Bundle) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE bundles
+		SET slug = $1, title = $2, description = $3, price_cents = $4, tag = NULLIF($5, ''),
+			starts_after = $6, starts_before = $7, active = $8
+		WHERE id = $9
+	`
+	_, err = tx.Exec(ctx, query,
+		bundle.Slug,
+		bundle.Title,
+		bundle.Description,
+		bundle.PriceCents,
+		bundle.Tag,
+		bundle.StartsAfter,
+		bundle.StartsBefore,
+		bundle.Active,
+		bundle.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM bundle_streams WHERE bundle_id = $1", bundle.ID); err != nil {
+		return err
+	}
+	if err := setBundleStreams(ctx, tx, bundle); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// setBundleStreams inserts the bundle's explicit stream list
+func setBundleStreams(ctx context.Context, db execer, bundle *models.Bundle) error {
+	if len(bundle.StreamIDs) == 0 {
+		return nil
+	}
+	query := `
+		INSERT INTO bundle_streams (bundle_id, stream_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+	`
+	_, err := db.Exec(ctx, query, bundle.ID, bundle.StreamIDs)
+	return err
+}
+
+// DeleteBundle deletes a bundle
+// Returns ErrBundleHasPayments if the bundle has been sold; deactivate it instead.
+func (s *PostgresStore) DeleteBundle(ctx context.Context, id uuid.UUID) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM bundles WHERE id = $1", id)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		return ErrBundleHasPayments
+	}
+	return err
+}
+
+// ListPaymentsByBundle retrieves all payments for a bundle
+func (s *PostgresStore) ListPaymentsByBundle(ctx context.Context, bundleID uuid.UUID) ([]*models.Payment, error) {
+	query := `
+		SELECT ` + paymentColumns + `
+		FROM payments
+		WHERE bundle_id = $1
+		ORDER BY created_at DESC
+	`
+	return s.listPayments(ctx, query, bundleID)
+}
+
+// ListCompletedBundlePaymentsByEmail retrieves an email's completed bundle purchases, newest first
+// Emails are compared case-insensitively.
+func (s *PostgresStore) ListCompletedBundlePaymentsByEmail(ctx context.Context, email string) ([]*models.Payment, error) {
+	query := `
+		SELECT ` + paymentColumns + `
+		FROM payments
+		WHERE lower(email) = lower($1) AND bundle_id IS NOT NULL AND status = 'completed'
+		ORDER BY created_at DESC
+	`
+	return s.listPayments(ctx, query, email)
+}
+
+// listPayments runs a payment query and scans all rows
+func (s *PostgresStore) listPayments(ctx context.Context, query string, args ...any) ([]*models.Payment, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []*models.Payment
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// RecordPaymentCallback stores an audit record of a Paytrail payment callback
+func (s *PostgresStore) RecordPaymentCallback(ctx context.Context, cb *models.PaymentCallback) error {
+	query := `
+		INSERT INTO payment_callbacks (id, payment_id, stamp, transaction_id, status, source, outcome, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := s.pool.Exec(ctx, query,
+		cb.ID,
+		cb.PaymentID,
+		cb.Stamp,
+		cb.TransactionID,
+		cb.Status,
+		cb.Source,
+		cb.Outcome,
+		cb.ReceivedAt,
+	)
+	return err
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// outboundEmailColumns is the list of columns for outbound email queries
+const outboundEmailColumns = `id, to_email, template, data, status, attempts, next_attempt_at,
+	COALESCE(last_error, ''), created_at, sent_at`
+
+// scanOutboundEmail scans a row into an OutboundEmail struct
+func scanOutboundEmail(row pgx.Row) (*models.OutboundEmail, error) {
+	email := &models.OutboundEmail{}
+	err := row.Scan(
+		&email.ID,
+		&email.ToEmail,
+		&email.Template,
+		&email.Data,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+		&email.CreatedAt,
+		&email.SentAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+// EnqueueEmail adds an email to the outbound queue, due immediately
+func (s *PostgresStore) EnqueueEmail(ctx context.Context, toEmail, template string, data []byte) error {
+	query := `
+		INSERT INTO outbound_emails (to_email, template, data)
+		VALUES ($1, $2, $3)
+	`
+	_, err := s.pool.Exec(ctx, query, toEmail, template, data)
+	return err
+}
+
+// ClaimDueEmails takes up to limit pending emails that are due and counts an attempt on each
+// Claimed emails are not due again until leaseUntil, so concurrent workers skip them
+// and an email whose send was interrupted is retried after that.
+func (s *PostgresStore) ClaimDueEmails(ctx context.Context, limit int, leaseUntil time.Time) ([]*models.OutboundEmail, error) {
+	query := `
+		UPDATE outbound_emails
+		SET attempts = attempts + 1, next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM outbound_emails
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + outboundEmailColumns
+	rows, err := s.pool.Query(ctx, query, leaseUntil, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []*models.OutboundEmail
+	for rows.Next() {
+		email, err := scanOutboundEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// MarkEmailSent records that an email was delivered
+// The template data is cleared; it can hold secrets such as recovery link tokens.
+func (s *PostgresStore) MarkEmailSent(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE outbound_emails
+		SET status = 'sent', sent_at = NOW(), last_error = NULL, data = '{}'
+		WHERE id = $1
+	`
+	_, err := s.pool.Exec(ctx, query, id)
+	return err
+}
+
+// RetryEmail records a failed send and schedules the next attempt
+func (s *PostgresStore) RetryEmail(ctx context.Context, id uuid.UUID, nextAttemptAt time.Time, lastError string) error {
+	query := `
+		UPDATE outbound_emails
+		SET next_attempt_at = $1, last_error = $2
+		WHERE id = $3
+	`
+	_, err := s.pool.Exec(ctx, query, nextAttemptAt, lastError, id)
+	return err
+}
+
+// FailEmail records a failed send and gives up on the email, clearing its template data
+func (s *PostgresStore) FailEmail(ctx context.Context, id uuid.UUID, lastError string) error {
+	query := `
+		UPDATE outbound_emails
+		SET status = 'failed', last_error = $1, data = '{}'
+		WHERE id = $2
+	`
+	_, err := s.pool.Exec(ctx, query, lastError, id)
+	return err
+}
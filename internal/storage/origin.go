@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Shared Origin Cache ---
+
+// Key patterns and channels
+const (
+	originObjectPrefix = "origin:"
+	originLockPrefix   = "origin_lock:"
+
+	// streamChangesChannel carries the IDs of streams an admin changed
+	streamChangesChannel = "stream_changes"
+)
+
+// OriginObject is a playlist or segment fetched from Owncast, shared by every paywall instance
+type OriginObject struct {
+	ContentType string
+	Data        []byte
+}
+
+// originKey stores objects under a hash of their upstream URL, which may be long
+func originKey(prefix, url string) string {
+	h := sha256.Sum256([]byte(url))
+	return prefix + hex.EncodeToString(h[:])
+}
+
+// GetOriginObject returns the object cached for an upstream URL with its remaining TTL
+// Returns nil if it is not cached.
+func (s *RedisStore) GetOriginObject(ctx context.Context, url string) (*OriginObject, time.Duration, error) {
+	key := originKey(originObjectPrefix, url)
+
+	var get *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		ttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	return parseOriginObject(get, ttl)
+}
+
+// PollOriginObject is GetOriginObject for instances waiting on another's fetch
+// It also reports whether the fetch's lock is still held, all in one round trip.
+// The lock is checked first: it is released after the object is stored.
+func (s *RedisStore) PollOriginObject(ctx context.Context, url string) (*OriginObject, time.Duration, bool, error) {
+	key := originKey(originObjectPrefix, url)
+
+	var held *redis.IntCmd
+	var get *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		held = pipe.Exists(ctx, originKey(originLockPrefix, url))
+		get = pipe.Get(ctx, key)
+		ttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, 0, false, err
+	}
+	object, remaining, err := parseOriginObject(get, ttl)
+	return object, remaining, held.Val() > 0, err
+}
+
+// parseOriginObject reads the results of a pipelined GET and PTTL of an origin object
+func parseOriginObject(get *redis.StringCmd, ttl *redis.DurationCmd) (*OriginObject, time.Duration, error) {
+	if get.Err() == redis.Nil {
+		return nil, 0, nil
+	}
+	// Expired between the two commands
+	if ttl.Val() <= 0 {
+		return nil, 0, nil
+	}
+
+	// Stored as the content type, a newline and the data
+	data, err := get.Bytes()
+	if err != nil {
+		return nil, 0, err
+	}
+	contentType, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, 0, errors.New("malformed origin object")
+	}
+	return &OriginObject{ContentType: string(contentType), Data: body}, ttl.Val(), nil
+}
+
+// SetOriginObject caches an object for an upstream URL with TTL
+func (s *RedisStore) SetOriginObject(ctx context.Context, url string, object *OriginObject, ttl time.Duration) error {
+	value := make([]byte, 0, len(object.ContentType)+1+len(object.Data))
+	value = append(value, object.ContentType...)
+	value = append(value, '\n')
+	value = append(value, object.Data...)
+	return s.client.Set(ctx, originKey(originObjectPrefix, url), value, ttl).Err()
+}
+
+// AcquireOriginLock takes the right to fetch an upstream URL from Owncast
+// Returns the lock's owner token, or "" if another instance holds it.
+func (s *RedisStore) AcquireOriginLock(ctx context.Context, url string, ttl time.Duration) (string, error) {
+	owner := uuid.NewString()
+	ok, err := s.client.SetNX(ctx, originKey(originLockPrefix, url), owner, ttl).Result()
+	if err != nil || !ok {
+		return "", err
+	}
+	return owner, nil
+}
+
+// releaseLockScript deletes a lock only if it still belongs to the caller,
+// so a lock that expired and was taken by another instance is left alone
+// Shared by the origin locks and job leadership.
+var releaseLockScript = redis.NewScript(`
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('DEL', KEYS[1])
+	end
+	return 0
+`)
+
+// ReleaseOriginLock gives up a lock taken with AcquireOriginLock
+func (s *RedisStore) ReleaseOriginLock(ctx context.Context, url, owner string) error {
+	return releaseLockScript.Run(ctx, s.client, []string{originKey(originLockPrefix, url)}, owner).Err()
+}
+
+// --- Stream Change Notifications ---
+
+// PublishStreamChange tells every paywall instance that a stream was changed or deleted
+func (s *RedisStore) PublishStreamChange(ctx context.Context, streamID uuid.UUID) error {
+	return s.client.Publish(ctx, streamChangesChannel, streamID.String()).Err()
+}
+
+// SubscribeStreamChanges subscribes to PublishStreamChange notifications
+// Messages carry the stream ID as their payload. The subscription reconnects by
+// itself; notifications published while it is disconnected are lost.
+func (s *RedisStore) SubscribeStreamChanges(ctx context.Context) *redis.PubSub {
+	return s.client.Subscribe(ctx, streamChangesChannel)
+}
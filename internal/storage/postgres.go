@@ -7,6 +7,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/laurikarhu/stream-paywall/internal/models"
 )
@@ -57,7 +58,8 @@ func (s *PostgresStore) GetPool() *pgxpool.Pool {
 // streamColumns is the list of columns for stream queries
 const streamColumns = `id, slug, title, description, price_cents, start_time, end_time, status, 
 	COALESCE(owncast_url, ''), max_viewers, created_at, 
-	COALESCE(stream_key, ''), COALESCE(rtmp_port, 0), COALESCE(container_name, ''), COALESCE(container_status, 'stopped')`
+	COALESCE(stream_key, ''), COALESCE(rtmp_port, 0), COALESCE(container_name, ''), COALESCE(container_status, 'stopped'), tags, members_only,
+	COALESCE(watermark_url, ''), backend, COALESCE(owncast_admin_password, ''), owncast_provisioned_at`
 
 // scanStream scans a row into a Stream struct
 func scanStream(row pgx.Row) (*models.Stream, error) {
@@ -78,6 +80,12 @@ func scanStream(row pgx.Row) (*models.Stream, error) {
 		&stream.RTMPPort,
 		&stream.ContainerName,
 		&stream.ContainerStatus,
+		&stream.Tags,
+		&stream.MembersOnly,
+		&stream.WatermarkURL,
+		&stream.Backend,
+		&stream.EncryptedAdminPassword,
+		&stream.OwncastProvisionedAt,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -92,9 +100,15 @@ func scanStream(row pgx.Row) (*models.Stream, error) {
 func (s *PostgresStore) CreateStream(ctx context.Context, stream *models.Stream) error {
 	query := `
 		INSERT INTO streams (id, slug, title, description, price_cents, start_time, end_time, status, 
-			owncast_url, max_viewers, created_at, stream_key, rtmp_port, container_name, container_status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			owncast_url, max_viewers, created_at, stream_key, rtmp_port, container_name, container_status, tags, members_only, watermark_url, backend,
+			owncast_admin_password)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, 0), NULLIF($14, ''), $15, $16, $17, NULLIF($18, ''), $19,
+			NULLIF($20, ''))
 	`
+	tags := stream.Tags
+	if tags == nil {
+		tags = []string{}
+	}
 	_, err := s.pool.Exec(ctx, query,
 		stream.ID,
 		stream.Slug,
@@ -111,6 +125,11 @@ func (s *PostgresStore) CreateStream(ctx context.Context, stream *models.Stream)
 		stream.RTMPPort,
 		stream.ContainerName,
 		stream.ContainerStatus,
+		tags,
+		stream.MembersOnly,
+		stream.WatermarkURL,
+		stream.Backend,
+		stream.EncryptedAdminPassword,
 	)
 	return err
 }
@@ -138,24 +157,7 @@ func (s *PostgresStore) ListStreams(ctx context.Context) ([]*models.Stream, erro
 
 	var streams []*models.Stream
 	for rows.Next() {
-		stream := &models.Stream{}
-		err := rows.Scan(
-			&stream.ID,
-			&stream.Slug,
-			&stream.Title,
-			&stream.Description,
-			&stream.PriceCents,
-			&stream.StartTime,
-			&stream.EndTime,
-			&stream.Status,
-			&stream.OwncastURL,
-			&stream.MaxViewers,
-			&stream.CreatedAt,
-			&stream.StreamKey,
-			&stream.RTMPPort,
-			&stream.ContainerName,
-			&stream.ContainerStatus,
-		)
+		stream, err := scanStream(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -177,24 +179,7 @@ func (s *PostgresStore) ListActiveStreams(ctx context.Context) ([]*models.Stream
 
 	var streams []*models.Stream
 	for rows.Next() {
-		stream := &models.Stream{}
-		err := rows.Scan(
-			&stream.ID,
-			&stream.Slug,
-			&stream.Title,
-			&stream.Description,
-			&stream.PriceCents,
-			&stream.StartTime,
-			&stream.EndTime,
-			&stream.Status,
-			&stream.OwncastURL,
-			&stream.MaxViewers,
-			&stream.CreatedAt,
-			&stream.StreamKey,
-			&stream.RTMPPort,
-			&stream.ContainerName,
-			&stream.ContainerStatus,
-		)
+		stream, err := scanStream(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -245,6 +230,25 @@ func (s *PostgresStore) UpdateStream(ctx context.Context, id uuid.UUID, updates
 		args = append(args, *updates.MaxViewers)
 		argNum++
 	}
+	if updates.Tags != nil {
+		tags := *updates.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		query += fmt.Sprintf("tags = $%d, ", argNum)
+		args = append(args, tags)
+		argNum++
+	}
+	if updates.MembersOnly != nil {
+		query += fmt.Sprintf("members_only = $%d, ", argNum)
+		args = append(args, *updates.MembersOnly)
+		argNum++
+	}
+	if updates.WatermarkURL != nil {
+		query += fmt.Sprintf("watermark_url = NULLIF($%d, ''), ", argNum)
+		args = append(args, *updates.WatermarkURL)
+		argNum++
+	}
 	if updates.ContainerStatus != nil {
 		query += fmt.Sprintf("container_status = $%d, ", argNum)
 		args = append(args, *updates.ContainerStatus)
@@ -271,6 +275,17 @@ func (s *PostgresStore) UpdateStreamStatus(ctx context.Context, id uuid.UUID, st
 	return err
 }
 
+// SetStreamStatusIf changes a stream's status from one value to another in a single compare-and-set
+// Returns false if the status was no longer from.
+func (s *PostgresStore) SetStreamStatusIf(ctx context.Context, id uuid.UUID, from, to models.StreamStatus) (bool, error) {
+	query := "UPDATE streams SET status = $1 WHERE id = $2 AND status = $3"
+	tag, err := s.pool.Exec(ctx, query, to, id, from)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
 // UpdateContainerStatus updates only the container status
 func (s *PostgresStore) UpdateContainerStatus(ctx context.Context, id uuid.UUID, status models.ContainerStatus) error {
 	query := "UPDATE streams SET container_status = $1 WHERE id = $2"
@@ -278,6 +293,24 @@ func (s *PostgresStore) UpdateContainerStatus(ctx context.Context, id uuid.UUID,
 	return err
 }
 
+// MarkOwncastProvisioned records that a stream's Owncast has been configured
+func (s *PostgresStore) MarkOwncastProvisioned(ctx context.Context, id uuid.UUID) error {
+	query := "UPDATE streams SET owncast_provisioned_at = NOW() WHERE id = $1"
+	_, err := s.pool.Exec(ctx, query, id)
+	return err
+}
+
+// SetContainerStatusIf changes a stream's container status from one value to another in a single compare-and-set
+// Returns false if the status was no longer from, e.g. because an admin just started or stopped the container.
+func (s *PostgresStore) SetContainerStatusIf(ctx context.Context, id uuid.UUID, from, to models.ContainerStatus) (bool, error) {
+	query := "UPDATE streams SET container_status = $1 WHERE id = $2 AND container_status = $3"
+	tag, err := s.pool.Exec(ctx, query, to, id, from)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
 // DeleteStream deletes a stream
 func (s *PostgresStore) DeleteStream(ctx context.Context, id uuid.UUID) error {
 	query := "DELETE FROM streams WHERE id = $1"
@@ -316,11 +349,61 @@ func (s *PostgresStore) GetNextAvailablePort(ctx context.Context, basePort int)
 
 // --- Payment Operations ---
 
+// paymentColumns is the list of columns for payment queries
+const paymentColumns = `id, stream_id, bundle_id, email, amount_cents, status,
+	COALESCE(paytrail_ref, ''), COALESCE(paytrail_transaction_id, ''),
+	COALESCE(access_token, ''), token_expiry, promo_code_id, discount_cents,
+	COALESCE(recipient_email, ''), COALESCE(gift_code, ''), gift_redeemed_at, created_at`
+
+// scanPayment scans a row into a Payment struct
+func scanPayment(row pgx.Row) (*models.Payment, error) {
+	payment := &models.Payment{}
+	var streamID *uuid.UUID // NULL for bundle payments
+	err := row.Scan(
+		&payment.ID,
+		&streamID,
+		&payment.BundleID,
+		&payment.Email,
+		&payment.AmountCents,
+		&payment.Status,
+		&payment.PaytrailRef,
+		&payment.PaytrailTransactionID,
+		&payment.AccessToken,
+		&payment.TokenExpiry,
+		&payment.PromoCodeID,
+		&payment.DiscountCents,
+		&payment.RecipientEmail,
+		&payment.GiftCode,
+		&payment.GiftRedeemedAt,
+		&payment.CreatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if streamID != nil {
+		payment.StreamID = *streamID
+	}
+	return payment, nil
+}
+
 // CreatePayment creates a new payment record
 func (s *PostgresStore) CreatePayment(ctx context.Context, payment *models.Payment) error {
+	return insertPayment(ctx, s.pool, payment)
+}
+
+// execer is implemented by both the pool and transactions
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// insertPayment inserts a payment row using the given pool or transaction
+func insertPayment(ctx context.Context, db execer, payment *models.Payment) error {
 	query := `
-		INSERT INTO payments (id, stream_id, email, amount_cents, status, paytrail_ref, paytrail_transaction_id, access_token, token_expiry, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO payments (id, stream_id, bundle_id, email, amount_cents, status, paytrail_ref, paytrail_transaction_id, access_token, token_expiry, promo_code_id, discount_cents, recipient_email, gift_code, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''), NULLIF($14, ''), $15)
 	`
 	// Use nil for empty access_token to avoid unique constraint violation
 	// (PostgreSQL allows multiple NULLs in unique columns)
@@ -328,10 +411,15 @@ func (s *PostgresStore) CreatePayment(ctx context.Context, payment *models.Payme
 	if payment.AccessToken != "" {
 		accessToken = payment.AccessToken
 	}
+	var streamID *uuid.UUID
+	if !payment.IsBundle() {
+		streamID = &payment.StreamID
+	}
 
-	_, err := s.pool.Exec(ctx, query,
+	_, err := db.Exec(ctx, query,
 		payment.ID,
-		payment.StreamID,
+		streamID,
+		payment.BundleID,
 		payment.Email,
 		payment.AmountCents,
 		payment.Status,
@@ -339,6 +427,10 @@ func (s *PostgresStore) CreatePayment(ctx context.Context, payment *models.Payme
 		payment.PaytrailTransactionID,
 		accessToken,
 		payment.TokenExpiry,
+		payment.PromoCodeID,
+		payment.DiscountCents,
+		payment.RecipientEmail,
+		payment.GiftCode,
 		payment.CreatedAt,
 	)
 	return err
@@ -347,124 +439,67 @@ func (s *PostgresStore) CreatePayment(ctx context.Context, payment *models.Payme
 // GetPaymentByID retrieves a payment by its ID
 func (s *PostgresStore) GetPaymentByID(ctx context.Context, id uuid.UUID) (*models.Payment, error) {
 	query := `
-		SELECT id, stream_id, email, amount_cents, status, 
-			COALESCE(paytrail_ref, ''), COALESCE(paytrail_transaction_id, ''), 
-			COALESCE(access_token, ''), token_expiry, created_at
+		SELECT ` + paymentColumns + `
 		FROM payments WHERE id = $1
 	`
-	payment := &models.Payment{}
-	err := s.pool.QueryRow(ctx, query, id).Scan(
-		&payment.ID,
-		&payment.StreamID,
-		&payment.Email,
-		&payment.AmountCents,
-		&payment.Status,
-		&payment.PaytrailRef,
-		&payment.PaytrailTransactionID,
-		&payment.AccessToken,
-		&payment.TokenExpiry,
-		&payment.CreatedAt,
-	)
-	if err == pgx.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	return payment, nil
+	return scanPayment(s.pool.QueryRow(ctx, query, id))
 }
 
 // GetPaymentByPaytrailRef retrieves a payment by Paytrail reference (stamp)
 func (s *PostgresStore) GetPaymentByPaytrailRef(ctx context.Context, ref string) (*models.Payment, error) {
 	query := `
-		SELECT id, stream_id, email, amount_cents, status, 
-			COALESCE(paytrail_ref, ''), COALESCE(paytrail_transaction_id, ''), 
-			COALESCE(access_token, ''), token_expiry, created_at
+		SELECT ` + paymentColumns + `
 		FROM payments WHERE paytrail_ref = $1
 	`
-	payment := &models.Payment{}
-	err := s.pool.QueryRow(ctx, query, ref).Scan(
-		&payment.ID,
-		&payment.StreamID,
-		&payment.Email,
-		&payment.AmountCents,
-		&payment.Status,
-		&payment.PaytrailRef,
-		&payment.PaytrailTransactionID,
-		&payment.AccessToken,
-		&payment.TokenExpiry,
-		&payment.CreatedAt,
-	)
-	if err == pgx.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	return payment, nil
+	return scanPayment(s.pool.QueryRow(ctx, query, ref))
 }
 
 // GetPaymentByAccessToken retrieves a payment by access token
 func (s *PostgresStore) GetPaymentByAccessToken(ctx context.Context, token string) (*models.Payment, error) {
 	query := `
-		SELECT id, stream_id, email, amount_cents, status, 
-			COALESCE(paytrail_ref, ''), COALESCE(paytrail_transaction_id, ''), 
-			COALESCE(access_token, ''), token_expiry, created_at
+		SELECT ` + paymentColumns + `
 		FROM payments WHERE access_token = $1
 	`
-	payment := &models.Payment{}
-	err := s.pool.QueryRow(ctx, query, token).Scan(
-		&payment.ID,
-		&payment.StreamID,
-		&payment.Email,
-		&payment.AmountCents,
-		&payment.Status,
-		&payment.PaytrailRef,
-		&payment.PaytrailTransactionID,
-		&payment.AccessToken,
-		&payment.TokenExpiry,
-		&payment.CreatedAt,
-	)
-	if err == pgx.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	return payment, nil
+	return scanPayment(s.pool.QueryRow(ctx, query, token))
 }
 
 // GetCompletedPaymentByEmailAndStream retrieves a completed payment for recovery
+// Gifts belong to their recipient once redeemed; the payer cannot recover them.
+// Emails are compared case-insensitively, as they are typed in by hand.
 func (s *PostgresStore) GetCompletedPaymentByEmailAndStream(ctx context.Context, email string, streamID uuid.UUID) (*models.Payment, error) {
 	query := `
-		SELECT id, stream_id, email, amount_cents, status, 
-			COALESCE(paytrail_ref, ''), COALESCE(paytrail_transaction_id, ''), 
-			COALESCE(access_token, ''), token_expiry, created_at
+		SELECT ` + paymentColumns + `
 		FROM payments 
-		WHERE email = $1 AND stream_id = $2 AND status = 'completed'
+		WHERE lower(COALESCE(recipient_email, email)) = lower($1) AND stream_id = $2 AND status = 'completed'
+		  AND (recipient_email IS NULL OR gift_redeemed_at IS NOT NULL)
 		ORDER BY created_at DESC
 		LIMIT 1
 	`
-	payment := &models.Payment{}
-	err := s.pool.QueryRow(ctx, query, email, streamID).Scan(
-		&payment.ID,
-		&payment.StreamID,
-		&payment.Email,
-		&payment.AmountCents,
-		&payment.Status,
-		&payment.PaytrailRef,
-		&payment.PaytrailTransactionID,
-		&payment.AccessToken,
-		&payment.TokenExpiry,
-		&payment.CreatedAt,
-	)
-	if err == pgx.ErrNoRows {
-		return nil, nil
-	}
+	return scanPayment(s.pool.QueryRow(ctx, query, email, streamID))
+}
+
+// GetPaymentByGiftCode retrieves a gift payment by its code
+func (s *PostgresStore) GetPaymentByGiftCode(ctx context.Context, code string) (*models.Payment, error) {
+	query := `
+		SELECT ` + paymentColumns + `
+		FROM payments WHERE gift_code = $1
+	`
+	return scanPayment(s.pool.QueryRow(ctx, query, code))
+}
+
+// RedeemGiftPayment marks a completed gift redeemed and starts its access window
+// Returns false if the gift was already redeemed or is not completed.
+func (s *PostgresStore) RedeemGiftPayment(ctx context.Context, id uuid.UUID, tokenExpiry time.Time) (bool, error) {
+	query := `
+		UPDATE payments
+		SET gift_redeemed_at = NOW(), token_expiry = $1
+		WHERE id = $2 AND status = 'completed' AND gift_code IS NOT NULL AND gift_redeemed_at IS NULL
+	`
+	tag, err := s.pool.Exec(ctx, query, tokenExpiry, id)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return payment, nil
+	return tag.RowsAffected() == 1, nil
 }
 
 // UpdatePaymentStatus updates payment status and optionally sets transaction ID and access token
@@ -484,6 +519,73 @@ func (s *PostgresStore) UpdatePaymentStatus(ctx context.Context, id uuid.UUID, s
 	return err
 }
 
+// CompletePendingPayment moves a payment from pending to completed in a single
+// compare-and-set. Returns false if the payment was no longer pending, in which
+// case nothing is written and the caller must not use the given access token.
+func (s *PostgresStore) CompletePendingPayment(ctx context.Context, id uuid.UUID, transactionID, accessToken string, tokenExpiry *time.Time) (bool, error) {
+	query := `
+		UPDATE payments
+		SET status = 'completed', paytrail_transaction_id = $1, access_token = $2, token_expiry = $3
+		WHERE id = $4 AND status = 'pending'
+	`
+	tag, err := s.pool.Exec(ctx, query, transactionID, accessToken, tokenExpiry, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// FailPendingPayment moves a payment from pending to failed in a single compare-and-set
+// Returns false if the payment was no longer pending.
+func (s *PostgresStore) FailPendingPayment(ctx context.Context, id uuid.UUID, transactionID string) (bool, error) {
+	query := `
+		UPDATE payments
+		SET status = 'failed', paytrail_transaction_id = COALESCE(NULLIF($1, ''), paytrail_transaction_id)
+		WHERE id = $2 AND status = 'pending'
+	`
+	tag, err := s.pool.Exec(ctx, query, transactionID, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// SetPaymentTransactionID stores the Paytrail transaction ID of a payment that is still pending
+// The reconciler needs it to query the payment status if the callbacks never arrive.
+func (s *PostgresStore) SetPaymentTransactionID(ctx context.Context, id uuid.UUID, transactionID string) error {
+	query := `UPDATE payments SET paytrail_transaction_id = $1 WHERE id = $2 AND status = 'pending'`
+	_, err := s.pool.Exec(ctx, query, transactionID, id)
+	return err
+}
+
+// ListPendingPaymentsBefore returns up to limit pending payments created before createdBefore,
+// ordered by (created_at, id) and starting after the given cursor position.
+// Pass the zero time and uuid.Nil to start from the beginning.
+func (s *PostgresStore) ListPendingPaymentsBefore(ctx context.Context, createdBefore, afterCreatedAt time.Time, afterID uuid.UUID, limit int) ([]*models.Payment, error) {
+	query := `
+		SELECT ` + paymentColumns + `
+		FROM payments
+		WHERE status = 'pending' AND created_at < $1 AND (created_at, id) > ($2, $3)
+		ORDER BY created_at, id
+		LIMIT $4
+	`
+	rows, err := s.pool.Query(ctx, query, createdBefore, afterCreatedAt, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []*models.Payment
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
 // UpdatePaymentAccessToken updates only the access token (for recovery)
 func (s *PostgresStore) UpdatePaymentAccessToken(ctx context.Context, id uuid.UUID, accessToken string, tokenExpiry *time.Time) error {
 	query := `UPDATE payments SET access_token = $1, token_expiry = $2 WHERE id = $3`
@@ -494,9 +596,7 @@ func (s *PostgresStore) UpdatePaymentAccessToken(ctx context.Context, id uuid.UU
 // ListPaymentsByStream retrieves all payments for a stream
 func (s *PostgresStore) ListPaymentsByStream(ctx context.Context, streamID uuid.UUID) ([]*models.Payment, error) {
 	query := `
-		SELECT id, stream_id, email, amount_cents, status, 
-			COALESCE(paytrail_ref, ''), COALESCE(paytrail_transaction_id, ''), 
-			COALESCE(access_token, ''), token_expiry, created_at
+		SELECT ` + paymentColumns + `
 		FROM payments 
 		WHERE stream_id = $1
 		ORDER BY created_at DESC
@@ -509,19 +609,7 @@ func (s *PostgresStore) ListPaymentsByStream(ctx context.Context, streamID uuid.
 
 	var payments []*models.Payment
 	for rows.Next() {
-		payment := &models.Payment{}
-		err := rows.Scan(
-			&payment.ID,
-			&payment.StreamID,
-			&payment.Email,
-			&payment.AmountCents,
-			&payment.Status,
-			&payment.PaytrailRef,
-			&payment.PaytrailTransactionID,
-			&payment.AccessToken,
-			&payment.TokenExpiry,
-			&payment.CreatedAt,
-		)
+		payment, err := scanPayment(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -538,6 +626,12 @@ func (s *PostgresStore) CountCompletedPaymentsByStream(ctx context.Context, stre
 	return count, err
 }
 
+// CountSoldSeatsByStream counts seats sold for a stream: completed payments plus
+// pending payments created after pendingSince (buyers still in the Paytrail flow)
+func (s *PostgresStore) CountSoldSeatsByStream(ctx context.Context, streamID uuid.UUID, pendingSince time.Time) (int, error) {
+	return countSoldSeats(ctx, s.pool, streamID, pendingSince)
+}
+
 // --- Whitelist Operations ---
 
 // AddWhitelistEntry adds an email to a stream's whitelist
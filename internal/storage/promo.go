@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+var (
+	// ErrPromoCodeExhausted is returned when a promo code has reached its usage limit
+	ErrPromoCodeExhausted = errors.New("promo code usage limit reached")
+	// ErrPromoCodeEmailLimit is returned when an email has used a promo code too many times
+	ErrPromoCodeEmailLimit = errors.New("promo code already used by this email")
+)
+
+// promoCodeColumns is the list of columns for promo code queries
+// times_used counts completed payments only
+const promoCodeColumns = `id, code, stream_id, discount_type, discount_value, max_uses, max_uses_per_email,
+	valid_from, valid_until, active, created_at,
+	(SELECT COUNT(*) FROM payments p WHERE p.promo_code_id = promo_codes.id AND p.status = 'completed')`
+
+// scanPromoCode scans a row into a PromoCode struct
+func scanPromoCode(row pgx.Row) (*models.PromoCode, error) {
+	promo := &models.PromoCode{}
+	err := row.Scan(
+		&promo.ID,
+		&promo.Code,
+		&promo.StreamID,
+		&promo.DiscountType,
+		&promo.DiscountValue,
+		&promo.MaxUses,
+		&promo.MaxUsesPerEmail,
+		&promo.ValidFrom,
+		&promo.ValidUntil,
+		&promo.Active,
+		&promo.CreatedAt,
+		&promo.TimesUsed,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return promo, nil
+}
+
+// NormalizePromoCode returns the canonical (trimmed, upper-case) form of a code
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// CreatePromoCode creates a new promo code
+func (s *PostgresStore) CreatePromoCode(ctx context.Context, promo *models.PromoCode) error {
+	query := `
+		INSERT INTO promo_codes (id, code, stream_id, discount_type, discount_value, max_uses, max_uses_per_email,
+			valid_from, valid_until, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+	_, err := s.pool.Exec(ctx, query,
+		promo.ID,
+		NormalizePromoCode(promo.Code),
+		promo.StreamID,
+		promo.DiscountType,
+		promo.DiscountValue,
+		promo.MaxUses,
+		promo.MaxUsesPerEmail,
+		promo.ValidFrom,
+		promo.ValidUntil,
+		promo.Active,
+		promo.CreatedAt,
+	)
+	return err
+}
+
+// GetPromoCodeByID retrieves a promo code by ID
+func (s *PostgresStore) GetPromoCodeByID(ctx context.Context, id uuid.UUID) (*models.PromoCode, error) {
+	query := "SELECT " + promoCodeColumns + " FROM promo_codes WHERE id = $1"
+	return scanPromoCode(s.pool.QueryRow(ctx, query, id))
+}
+
+// GetPromoCodeByCode retrieves a promo code by its code (case-insensitive)
+func (s *PostgresStore) GetPromoCodeByCode(ctx context.Context, code string) (*models.PromoCode, error) {
+	query := "SELECT " + promoCodeColumns + " FROM promo_codes WHERE code = $1"
+	return scanPromoCode(s.pool.QueryRow(ctx, query, NormalizePromoCode(code)))
+}
+
+// ListPromoCodes retrieves all promo codes, newest first
+func (s *PostgresStore) ListPromoCodes(ctx context.Context) ([]*models.PromoCode, error) {
+	query := "SELECT " + promoCodeColumns + " FROM promo_codes ORDER BY created_at DESC"
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promos []*models.PromoCode
+	for rows.Next() {
+		promo, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		promos = append(promos, promo)
+	}
+	return promos, rows.Err()
+}
+
+// UpdatePromoCode overwrites a promo code's settings
+func (s *PostgresStore) UpdatePromoCode(ctx context.Context, promo *models.PromoCode) error {
+	query := `
+		UPDATE promo_codes
+		SET code = $1, stream_id = $2, discount_type = $3, discount_value = $4, max_uses = $5,
+			max_uses_per_email = $6, valid_from = $7, valid_until = $8, active = $9
+		WHERE id = $10
+	`
+	_, err := s.pool.Exec(ctx, query,
+		NormalizePromoCode(promo.Code),
+		promo.StreamID,
+		promo.DiscountType,
+		promo.DiscountValue,
+		promo.MaxUses,
+		promo.MaxUsesPerEmail,
+		promo.ValidFrom,
+		promo.ValidUntil,
+		promo.Active,
+		promo.ID,
+	)
+	return err
+}
+
+// DeletePromoCode deletes a promo code
+// Payments that used it keep their discount but lose the reference.
+func (s *PostgresStore) DeletePromoCode(ctx context.Context, id uuid.UUID) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM promo_codes WHERE id = $1", id)
+	return err
+}
+
+// checkPromoCodeLimits enforces a promo code's usage limits for a payment about to be inserted in tx
+// The promo code row is locked until the transaction ends so concurrent
+// checkouts cannot exceed the limits. Completed payments and pending payments
+// created after pendingSince count as uses.
+func checkPromoCodeLimits(ctx context.Context, tx pgx.Tx, payment *models.Payment, promo *models.PromoCode, pendingSince time.Time) error {
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM promo_codes WHERE id = $1 FOR UPDATE", promo.ID); err != nil {
+		return err
+	}
+
+	var totalUses, emailUses int
+	query := `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE LOWER(email) = LOWER($3))
+		FROM payments
+		WHERE promo_code_id = $1
+		  AND (status = 'completed' OR (status = 'pending' AND created_at > $2))
+	`
+	if err := tx.QueryRow(ctx, query, promo.ID, pendingSince, payment.Email).Scan(&totalUses, &emailUses); err != nil {
+		return err
+	}
+
+	if promo.MaxUses > 0 && totalUses >= promo.MaxUses {
+		return ErrPromoCodeExhausted
+	}
+	if promo.MaxUsesPerEmail > 0 && emailUses >= promo.MaxUsesPerEmail {
+		return ErrPromoCodeEmailLimit
+	}
+	return nil
+}
@@ -53,19 +53,54 @@ func (s *RedisStore) GetClient() *redis.Client {
 
 // Key patterns
 const (
-	sessionKeyPrefix    = "session:"
-	deviceKeyPrefix     = "device:"
-	rateLimitKeyPrefix  = "ratelimit:"
-	viewerCountPrefix   = "viewers:"
+	sessionKeyPrefix     = "session:"
+	deviceKeyPrefix      = "device:"
+	rateLimitKeyPrefix   = "ratelimit:"
+	viewerCountPrefix    = "viewers:"
+	activeSessionsPrefix = "active_sessions:"
+	recoveryLinkPrefix   = "recovery_link:"
 )
 
 // SessionData represents the data stored in a session
+// Bundle and membership sessions have an empty StreamID and grant every stream they cover.
 type SessionData struct {
-	Token     string    `json:"token"`
-	StreamID  string    `json:"stream_id"`
-	Email     string    `json:"email"`
-	PaymentID string    `json:"payment_id"`
-	ExpiresAt time.Time `json:"expires_at"`
+	Token          string    `json:"token"`
+	StreamID       string    `json:"stream_id"`
+	BundleID       string    `json:"bundle_id,omitempty"`
+	SubscriptionID string    `json:"subscription_id,omitempty"` // Set instead of PaymentID for membership tokens
+	Email          string    `json:"email"`
+	PaymentID      string    `json:"payment_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+
+	// Seats caches viewing seat admissions by stream ID: until when the token
+	// is known to hold a seat without asking the active session set again
+	Seats map[string]time.Time `json:"seats,omitempty"`
+}
+
+// NewPaymentSession builds the session data for a completed payment's access token
+func NewPaymentSession(payment *models.Payment, token string, expiresAt time.Time) *SessionData {
+	session := &SessionData{
+		Token:     token,
+		Email:     payment.Email,
+		PaymentID: payment.ID.String(),
+		ExpiresAt: expiresAt,
+	}
+	if payment.IsBundle() {
+		session.BundleID = payment.BundleID.String()
+	} else {
+		session.StreamID = payment.StreamID.String()
+	}
+	return session
+}
+
+// NewSubscriptionSession builds the session data for a membership's access token
+func NewSubscriptionSession(sub *models.Subscription, token string, expiresAt time.Time) *SessionData {
+	return &SessionData{
+		Token:          token,
+		Email:          sub.Email,
+		SubscriptionID: sub.ID.String(),
+		ExpiresAt:      expiresAt,
+	}
 }
 
 // SetSession stores session data with TTL
@@ -96,6 +131,21 @@ func (s *RedisStore) GetSession(ctx context.Context, token string) (*SessionData
 	return &session, nil
 }
 
+// UpdateSession rewrites an existing session's data, keeping its TTL
+// A session deleted meanwhile (e.g. by a refund) is not recreated.
+func (s *RedisStore) UpdateSession(ctx context.Context, token string, data *SessionData) error {
+	key := sessionKeyPrefix + token
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session data: %w", err)
+	}
+	err = s.client.SetArgs(ctx, key, jsonData, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
 // DeleteSession removes a session
 func (s *RedisStore) DeleteSession(ctx context.Context, token string) error {
 	key := sessionKeyPrefix + token
@@ -212,6 +262,48 @@ func (s *RedisStore) CheckRecoveryRateLimit(ctx context.Context, email, ip strin
 	return ipAllowed, nil
 }
 
+// --- Recovery Links ---
+
+// RecoveryLink is what an emailed recovery link proves: that the holder reads Email
+type RecoveryLink struct {
+	Email      string `json:"email"`
+	StreamSlug string `json:"stream_slug"`
+	GiftCode   string `json:"gift_code,omitempty"`
+}
+
+// recoveryLinkKey stores links under a hash of the token, so the keys alone cannot be used as links
+func recoveryLinkKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return recoveryLinkPrefix + hex.EncodeToString(h[:])
+}
+
+// SetRecoveryLink stores a recovery link token with TTL
+func (s *RedisStore) SetRecoveryLink(ctx context.Context, token string, link *RecoveryLink, ttl time.Duration) error {
+	jsonData, err := json.Marshal(link)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recovery link: %w", err)
+	}
+	return s.client.Set(ctx, recoveryLinkKey(token), jsonData, ttl).Err()
+}
+
+// ConsumeRecoveryLink retrieves and deletes a recovery link, so each link works once
+// Returns nil if the link is unknown, expired or already used.
+func (s *RedisStore) ConsumeRecoveryLink(ctx context.Context, token string) (*RecoveryLink, error) {
+	data, err := s.client.GetDel(ctx, recoveryLinkKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var link RecoveryLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal recovery link: %w", err)
+	}
+	return &link, nil
+}
+
 // --- Viewer Counting ---
 
 // IncrementViewerCount increments the viewer count for a stream
@@ -254,7 +346,7 @@ func (s *RedisStore) SetViewerCount(ctx context.Context, streamID uuid.UUID, cou
 
 // TrackActiveSession adds a session to the active sessions set for a stream
 func (s *RedisStore) TrackActiveSession(ctx context.Context, streamID uuid.UUID, token string, ttl time.Duration) error {
-	key := "active_sessions:" + streamID.String()
+	key := activeSessionsPrefix + streamID.String()
 	member := redis.Z{
 		Score:  float64(time.Now().Add(ttl).Unix()),
 		Member: token,
@@ -264,13 +356,13 @@ func (s *RedisStore) TrackActiveSession(ctx context.Context, streamID uuid.UUID,
 
 // RemoveActiveSession removes a session from the active sessions set
 func (s *RedisStore) RemoveActiveSession(ctx context.Context, streamID uuid.UUID, token string) error {
-	key := "active_sessions:" + streamID.String()
+	key := activeSessionsPrefix + streamID.String()
 	return s.client.ZRem(ctx, key, token).Err()
 }
 
 // CountActiveSessions counts active sessions for a stream (removes expired ones)
 func (s *RedisStore) CountActiveSessions(ctx context.Context, streamID uuid.UUID) (int64, error) {
-	key := "active_sessions:" + streamID.String()
+	key := activeSessionsPrefix + streamID.String()
 	now := float64(time.Now().Unix())
 
 	// Remove expired sessions
@@ -281,3 +373,52 @@ func (s *RedisStore) CountActiveSessions(ctx context.Context, streamID uuid.UUID
 	// Count remaining
 	return s.client.ZCard(ctx, key).Result()
 }
+
+// admitActiveSessionScript atomically admits a token into a stream's active session set.
+// Expired members are pruned first, a token that already holds a seat is always
+// re-admitted (and its expiry refreshed), and new tokens are only added while the
+// set is below the cap. A cap of 0 means unlimited.
+// Returns {admitted, already_held, active_count}.
+var admitActiveSessionScript = redis.NewScript(`
+	local now = tonumber(ARGV[1])
+	local expiry = tonumber(ARGV[2])
+	local cap = tonumber(ARGV[3])
+	local token = ARGV[4]
+
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+
+	if redis.call('ZSCORE', KEYS[1], token) then
+		redis.call('ZADD', KEYS[1], expiry, token)
+		return {1, 1, redis.call('ZCARD', KEYS[1])}
+	end
+
+	local count = redis.call('ZCARD', KEYS[1])
+	if cap > 0 and count >= cap then
+		return {0, 0, count}
+	end
+
+	redis.call('ZADD', KEYS[1], expiry, token)
+	return {1, 0, count + 1}
+`)
+
+// AdmitActiveSession tries to take (or keep) a viewer seat for a token.
+// Unlike TrackActiveSession, it refuses new tokens once maxViewers seats are taken.
+func (s *RedisStore) AdmitActiveSession(ctx context.Context, streamID uuid.UUID, token string, maxViewers int, ttl time.Duration) (admitted, held bool, active int64, err error) {
+	key := activeSessionsPrefix + streamID.String()
+	now := time.Now()
+
+	result, err := admitActiveSessionScript.Run(ctx, s.client, []string{key},
+		now.Unix(),
+		now.Add(ttl).Unix(),
+		maxViewers,
+		token,
+	).Int64Slice()
+	if err != nil {
+		return false, false, 0, err
+	}
+	if len(result) != 3 {
+		return false, false, 0, fmt.Errorf("unexpected admission script result: %v", result)
+	}
+
+	return result[0] == 1, result[1] == 1, result[2], nil
+}
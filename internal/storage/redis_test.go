@@ -0,0 +1,51 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/storage/storagetest"
+)
+
+func TestRecoveryLinkWorksOnce(t *testing.T) {
+	_, redis := storagetest.NewRedisStore(t)
+	ctx := context.Background()
+	link := &storage.RecoveryLink{Email: "viewer@example.com", StreamSlug: "final", GiftCode: "GIFT-7KQ2-M9XD-H4TB"}
+
+	if err := redis.SetRecoveryLink(ctx, "link-token", link, 15*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := redis.ConsumeRecoveryLink(ctx, "link-token")
+	if err != nil || got == nil || *got != *link {
+		t.Fatalf("first use = %+v, %v; want %+v", got, err, link)
+	}
+	if got, err := redis.ConsumeRecoveryLink(ctx, "link-token"); err != nil || got != nil {
+		t.Errorf("second use = %+v, %v; want nothing", got, err)
+	}
+	if got, err := redis.ConsumeRecoveryLink(ctx, "unknown-token"); err != nil || got != nil {
+		t.Errorf("unknown token = %+v, %v; want nothing", got, err)
+	}
+}
+
+func TestRecoveryLinkExpires(t *testing.T) {
+	mr, redis := storagetest.NewRedisStore(t)
+	ctx := context.Background()
+	link := &storage.RecoveryLink{Email: "viewer@example.com", StreamSlug: "final"}
+
+	if err := redis.SetRecoveryLink(ctx, "link-token", link, 15*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Only a hash of the token is stored
+	for _, key := range mr.Keys() {
+		if key == "recovery_link:link-token" {
+			t.Errorf("recovery link stored under its token")
+		}
+	}
+
+	mr.FastForward(15*time.Minute + time.Second)
+	if got, err := redis.ConsumeRecoveryLink(ctx, "link-token"); err != nil || got != nil {
+		t.Errorf("expired link = %+v, %v; want nothing", got, err)
+	}
+}
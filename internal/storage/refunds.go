@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// ErrRefundPending is returned when a payment already has a refund waiting for Paytrail
+var ErrRefundPending = errors.New("payment already has a pending refund")
+
+// refundColumns is the list of columns for refund queries
+const refundColumns = `id, payment_id, amount_cents, status, refund_stamp,
+	COALESCE(paytrail_transaction_id, ''), COALESCE(requested_by, ''), created_at, completed_at`
+
+// scanRefund scans a row into a Refund struct
+func scanRefund(row pgx.Row) (*models.Refund, error) {
+	refund := &models.Refund{}
+	err := row.Scan(
+		&refund.ID,
+		&refund.PaymentID,
+		&refund.AmountCents,
+		&refund.Status,
+		&refund.RefundStamp,
+		&refund.PaytrailTransactionID,
+		&refund.RequestedBy,
+		&refund.CreatedAt,
+		&refund.CompletedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// CreateRefund creates a new refund record
+// Returns ErrRefundPending if the payment already has a pending refund.
+func (s *PostgresStore) CreateRefund(ctx context.Context, refund *models.Refund) error {
+	query := `
+		INSERT INTO payment_refunds (id, payment_id, amount_cents, status, refund_stamp, paytrail_transaction_id, requested_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := s.pool.Exec(ctx, query,
+		refund.ID,
+		refund.PaymentID,
+		refund.AmountCents,
+		refund.Status,
+		refund.RefundStamp,
+		refund.PaytrailTransactionID,
+		refund.RequestedBy,
+		refund.CreatedAt,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_payment_refunds_one_pending" { // unique_violation
+		return ErrRefundPending
+	}
+	return err
+}
+
+// GetRefundByStamp retrieves a refund by its Paytrail refund stamp
+func (s *PostgresStore) GetRefundByStamp(ctx context.Context, stamp string) (*models.Refund, error) {
+	query := "SELECT " + refundColumns + " FROM payment_refunds WHERE refund_stamp = $1"
+	return scanRefund(s.pool.QueryRow(ctx, query, stamp))
+}
+
+// GetPendingRefundByPayment retrieves the in-flight refund for a payment, if any
+func (s *PostgresStore) GetPendingRefundByPayment(ctx context.Context, paymentID uuid.UUID) (*models.Refund, error) {
+	query := "SELECT " + refundColumns + ` FROM payment_refunds
+		WHERE payment_id = $1 AND status = 'pending'
+		ORDER BY created_at DESC
+		LIMIT 1`
+	return scanRefund(s.pool.QueryRow(ctx, query, paymentID))
+}
+
+// UpdateRefundStatus updates a refund's status and Paytrail transaction ID
+// completed_at is set when the refund reaches a final state
+func (s *PostgresStore) UpdateRefundStatus(ctx context.Context, id uuid.UUID, status models.RefundStatus, transactionID string) error {
+	var completedAt *time.Time
+	if status != models.RefundStatusPending {
+		now := time.Now()
+		completedAt = &now
+	}
+
+	query := `
+		UPDATE payment_refunds
+		SET status = $1, paytrail_transaction_id = COALESCE(NULLIF($2, ''), paytrail_transaction_id), completed_at = $3
+		WHERE id = $4
+	`
+	_, err := s.pool.Exec(ctx, query, status, transactionID, completedAt, id)
+	return err
+}
+
+// ListRefundsByPayments returns the latest refund for each of the given payments, keyed by payment ID
+// Works for stream and bundle payments alike.
+func (s *PostgresStore) ListRefundsByPayments(ctx context.Context, paymentIDs []uuid.UUID) (map[uuid.UUID]*models.Refund, error) {
+	query := "SELECT DISTINCT ON (payment_id) " + refundColumns + `
+		FROM payment_refunds
+		WHERE payment_id = ANY($1)
+		ORDER BY payment_id, created_at DESC
+	`
+	rows, err := s.pool.Query(ctx, query, paymentIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := make(map[uuid.UUID]*models.Refund)
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds[refund.PaymentID] = refund
+	}
+	return refunds, rows.Err()
+}
+
+// MarkPaymentRefunded moves a completed payment to refunded
+// Returns false if the payment was not in the completed state
+func (s *PostgresStore) MarkPaymentRefunded(ctx context.Context, paymentID uuid.UUID) (bool, error) {
+	query := `UPDATE payments SET status = 'refunded' WHERE id = $1 AND status = 'completed'`
+	tag, err := s.pool.Exec(ctx, query, paymentID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Leader Election and Schedule Marks ---
+
+// Key patterns
+const (
+	leaderKeyPrefix       = "leader:"
+	scheduleMarkKeyPrefix = "schedule:"
+)
+
+// renewLeadershipScript takes a lock that is free or extends one the caller already holds
+var renewLeadershipScript = redis.NewScript(`
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+		return 1
+	end
+	return 0
+`)
+
+// AcquireLeadership makes owner the one instance that runs a background job, for ttl
+// Called again by the leader before ttl runs out, it extends the lease. Returns
+// false while another instance holds it.
+func (s *RedisStore) AcquireLeadership(ctx context.Context, job, owner string, ttl time.Duration) (bool, error) {
+	n, err := renewLeadershipScript.Run(ctx, s.client, []string{leaderKeyPrefix + job}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseLeadership gives up leadership of a job, if owner still holds it
+func (s *RedisStore) ReleaseLeadership(ctx context.Context, job, owner string) error {
+	return releaseLockScript.Run(ctx, s.client, []string{leaderKeyPrefix + job}, owner).Err()
+}
+
+func scheduleMarkKey(streamID uuid.UUID, mark string) string {
+	return scheduleMarkKeyPrefix + mark + ":" + streamID.String()
+}
+
+// MarkStreamSince records that a condition of a stream holds since now, unless already recorded
+// Returns when it was first recorded, and set true if this call recorded it.
+// Marks live in Redis so a new leader carries on where the previous one
+// stopped; they expire after ttl.
+func (s *RedisStore) MarkStreamSince(ctx context.Context, streamID uuid.UUID, mark string, now time.Time, ttl time.Duration) (since time.Time, set bool, err error) {
+	key := scheduleMarkKey(streamID, mark)
+	set, err = s.client.SetNX(ctx, key, now.Unix(), ttl).Result()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if set {
+		return time.Unix(now.Unix(), 0), true, nil
+	}
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return now, false, nil // Expired in between
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	unix, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return now, false, nil
+	}
+	return time.Unix(unix, 0), false, nil
+}
+
+// ClearStreamMark forgets a condition recorded with MarkStreamSince
+func (s *RedisStore) ClearStreamMark(ctx context.Context, streamID uuid.UUID, mark string) error {
+	return s.client.Del(ctx, scheduleMarkKey(streamID, mark)).Err()
+}
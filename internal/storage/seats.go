@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// ErrSoldOut is returned when a payment would take a seat of a capped stream that has none left
+var ErrSoldOut = errors.New("stream is sold out")
+
+// querier is implemented by both the pool and transactions
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// bundleCoversStream is the SQL form of models.Bundle.Covers for bundle b and stream s
+const bundleCoversStream = `(
+	EXISTS (SELECT 1 FROM bundle_streams bs WHERE bs.bundle_id = b.id AND bs.stream_id = s.id)
+	OR ((b.tag IS NOT NULL OR b.starts_after IS NOT NULL OR b.starts_before IS NOT NULL)
+		AND (b.tag IS NULL OR lower(b.tag) = ANY(s.tags))
+		AND (b.starts_after IS NULL OR s.start_time >= b.starts_after)
+		AND (b.starts_before IS NULL OR s.start_time < b.starts_before))
+)`
+
+// countSoldSeats counts seats sold for a stream: completed payments plus
+// pending payments created after pendingSince (buyers still in the Paytrail flow)
+// Bundle payments take a seat on every stream their bundle covers.
+func countSoldSeats(ctx context.Context, db querier, streamID uuid.UUID, pendingSince time.Time) (int, error) {
+	query := `
+		SELECT COUNT(*) FROM payments p
+		WHERE (p.status = 'completed' OR (p.status = 'pending' AND p.created_at > $2))
+		  AND (p.stream_id = $1 OR EXISTS (
+			SELECT 1 FROM bundles b JOIN streams s ON s.id = $1
+			WHERE b.id = p.bundle_id AND ` + bundleCoversStream + `
+		  ))
+	`
+	var count int
+	err := db.QueryRow(ctx, query, streamID, pendingSince).Scan(&count)
+	return count, err
+}
+
+// reserveSeats locks the given streams and checks each capped one still has a free seat
+// The stream rows stay locked until the transaction ends, so concurrent buyers
+// of a stream queue up behind each other instead of all counting the same last
+// seat as free. Rows are locked in ID order, so purchases covering several
+// streams cannot deadlock.
+func reserveSeats(ctx context.Context, tx pgx.Tx, streamIDs []uuid.UUID, pendingSince time.Time) error {
+	if len(streamIDs) == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx, "SELECT id, max_viewers FROM streams WHERE id = ANY($1) ORDER BY id FOR UPDATE", streamIDs)
+	if err != nil {
+		return err
+	}
+	caps := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var id uuid.UUID
+		var maxViewers int
+		if err := rows.Scan(&id, &maxViewers); err != nil {
+			rows.Close()
+			return err
+		}
+		if maxViewers > 0 {
+			caps[id] = maxViewers
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, maxViewers := range caps {
+		sold, err := countSoldSeats(ctx, tx, id, pendingSince)
+		if err != nil {
+			return err
+		}
+		if sold >= maxViewers {
+			return ErrSoldOut
+		}
+	}
+	return nil
+}
+
+// CreatePaymentWithSeats stores a new payment once every capped stream in streamIDs has a free seat for it
+// The promo code, if given, is redeemed in the same transaction. Returns
+// ErrSoldOut, ErrPromoCodeExhausted or ErrPromoCodeEmailLimit when a limit is
+// reached. Pending payments created after pendingSince hold their seat and use.
+func (s *PostgresStore) CreatePaymentWithSeats(ctx context.Context, payment *models.Payment, streamIDs []uuid.UUID, promo *models.PromoCode, pendingSince time.Time) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := reserveSeats(ctx, tx, streamIDs, pendingSince); err != nil {
+		return err
+	}
+	if promo != nil {
+		if err := checkPromoCodeLimits(ctx, tx, payment, promo, pendingSince); err != nil {
+			return err
+		}
+	}
+
+	if err := insertPayment(ctx, tx, payment); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,207 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+	"github.com/laurikarhu/stream-paywall/internal/storage"
+	"github.com/laurikarhu/stream-paywall/internal/storage/storagetest"
+)
+
+// createTestStream stores a scheduled stream with maxViewers seats
+func createTestStream(t *testing.T, s *storage.PostgresStore, maxViewers int, tags []string, startTime *time.Time) *models.Stream {
+	t.Helper()
+	id := uuid.New()
+	stream := &models.Stream{
+		ID:              id,
+		Slug:            "stream-" + id.String()[:8],
+		Title:           "Test stream",
+		PriceCents:      990,
+		StartTime:       startTime,
+		Status:          models.StreamStatusScheduled,
+		MaxViewers:      maxViewers,
+		ContainerStatus: models.ContainerStatusStopped,
+		Tags:            tags,
+		Backend:         models.IngestBackendDocker,
+		CreatedAt:       time.Now(),
+	}
+	if err := s.CreateStream(context.Background(), stream); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// newTestPayment returns a ticket for streamID in the given status, created at createdAt
+func newTestPayment(streamID uuid.UUID, status models.PaymentStatus, createdAt time.Time) *models.Payment {
+	return &models.Payment{
+		ID:          uuid.New(),
+		StreamID:    streamID,
+		Email:       "viewer@example.com",
+		AmountCents: 990,
+		Status:      status,
+		PaytrailRef: uuid.New().String(),
+		CreatedAt:   createdAt,
+	}
+}
+
+func TestCreatePaymentWithSeatsSellsOutAtTheCap(t *testing.T) {
+	s := storagetest.NewPostgresStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	pendingSince := now.Add(-30 * time.Minute)
+	stream := createTestStream(t, s, 3, nil, nil)
+
+	// Failed and refunded payments give their seat back
+	for _, status := range []models.PaymentStatus{models.PaymentStatusFailed, models.PaymentStatusRefunded} {
+		if err := s.CreatePayment(ctx, newTestPayment(stream.ID, status, now)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CreatePayment(ctx, newTestPayment(stream.ID, models.PaymentStatusCompleted, now)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []error{nil, nil, storage.ErrSoldOut, storage.ErrSoldOut} {
+		err := s.CreatePaymentWithSeats(ctx, newTestPayment(stream.ID, models.PaymentStatusPending, now), []uuid.UUID{stream.ID}, nil, pendingSince)
+		if !errors.Is(err, want) {
+			t.Fatalf("purchase %d: error = %v, want %v", i+1, err, want)
+		}
+	}
+	if sold, err := s.CountSoldSeatsByStream(ctx, stream.ID, pendingSince); err != nil || sold != 3 {
+		t.Errorf("sold seats = %d, %v; want 3", sold, err)
+	}
+
+	// Uncapped streams never sell out
+	unlimited := createTestStream(t, s, 0, nil, nil)
+	for i := 0; i < 5; i++ {
+		if err := s.CreatePaymentWithSeats(ctx, newTestPayment(unlimited.ID, models.PaymentStatusPending, now), []uuid.UUID{unlimited.ID}, nil, pendingSince); err != nil {
+			t.Fatalf("uncapped purchase %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestPendingPaymentsHoldSeatsForPendingSeatHold(t *testing.T) {
+	s := storagetest.NewPostgresStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	pendingSince := now.Add(-30 * time.Minute)
+
+	// A buyer still in the Paytrail flow holds the last seat
+	held := createTestStream(t, s, 1, nil, nil)
+	if err := s.CreatePayment(ctx, newTestPayment(held.ID, models.PaymentStatusPending, now.Add(-29*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	err := s.CreatePaymentWithSeats(ctx, newTestPayment(held.ID, models.PaymentStatusPending, now), []uuid.UUID{held.ID}, nil, pendingSince)
+	if !errors.Is(err, storage.ErrSoldOut) {
+		t.Errorf("seat held by a recent pending payment: error = %v, want storage.ErrSoldOut", err)
+	}
+
+	// An abandoned one has released it
+	released := createTestStream(t, s, 1, nil, nil)
+	if err := s.CreatePayment(ctx, newTestPayment(released.ID, models.PaymentStatusPending, now.Add(-31*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if sold, err := s.CountSoldSeatsByStream(ctx, released.ID, pendingSince); err != nil || sold != 0 {
+		t.Errorf("sold seats = %d, %v; want the abandoned payment not counted", sold, err)
+	}
+	if err := s.CreatePaymentWithSeats(ctx, newTestPayment(released.ID, models.PaymentStatusPending, now), []uuid.UUID{released.ID}, nil, pendingSince); err != nil {
+		t.Errorf("seat released by an abandoned payment: error = %v, want the sale", err)
+	}
+}
+
+func TestBundlePaymentsTakeASeatOnEveryCoveredStream(t *testing.T) {
+	s := storagetest.NewPostgresStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	pendingSince := now.Add(-30 * time.Minute)
+	inRange := now.Add(48 * time.Hour)
+	outOfRange := now.Add(30 * 24 * time.Hour)
+
+	listed := createTestStream(t, s, 1, nil, nil)
+	tagged := createTestStream(t, s, 1, []string{"finals"}, &inRange)
+	taggedLater := createTestStream(t, s, 1, []string{"finals"}, &outOfRange)
+	other := createTestStream(t, s, 1, []string{"league"}, &inRange)
+
+	weekAfter := now.Add(7 * 24 * time.Hour)
+	bundle := &models.Bundle{
+		ID:           uuid.New(),
+		Slug:         "finals-pass",
+		Title:        "Finals pass",
+		PriceCents:   2990,
+		StreamIDs:    []uuid.UUID{listed.ID},
+		Tag:          "finals",
+		StartsAfter:  &now,
+		StartsBefore: &weekAfter,
+		Active:       true,
+		CreatedAt:    now,
+	}
+	if err := s.CreateBundle(ctx, bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	pass := newTestPayment(uuid.Nil, models.PaymentStatusPending, now)
+	pass.BundleID = &bundle.ID
+	if err := s.CreatePaymentWithSeats(ctx, pass, []uuid.UUID{listed.ID, tagged.ID}, nil, pendingSince); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stream  *models.Stream
+		wantErr error
+	}{
+		{"listed in the bundle", listed, storage.ErrSoldOut},
+		{"tag inside the date range", tagged, storage.ErrSoldOut},
+		{"tag outside the date range", taggedLater, nil},
+		{"other tag", other, nil},
+	}
+	for _, tt := range tests {
+		err := s.CreatePaymentWithSeats(ctx, newTestPayment(tt.stream.ID, models.PaymentStatusPending, now), []uuid.UUID{tt.stream.ID}, nil, pendingSince)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: ticket error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// A second pass finds its streams full
+	second := newTestPayment(uuid.Nil, models.PaymentStatusPending, now)
+	second.BundleID = &bundle.ID
+	if err := s.CreatePaymentWithSeats(ctx, second, []uuid.UUID{listed.ID, tagged.ID}, nil, pendingSince); !errors.Is(err, storage.ErrSoldOut) {
+		t.Errorf("second pass: error = %v, want storage.ErrSoldOut", err)
+	}
+}
+
+func TestConcurrentPurchasesDoNotOversell(t *testing.T) {
+	s := storagetest.NewPostgresStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	stream := createTestStream(t, s, 5, nil, nil)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.CreatePaymentWithSeats(ctx, newTestPayment(stream.ID, models.PaymentStatusPending, now), []uuid.UUID{stream.ID}, nil, now.Add(-30*time.Minute))
+		}()
+	}
+	wg.Wait()
+
+	sold := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			sold++
+		case !errors.Is(err, storage.ErrSoldOut):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if sold != 5 {
+		t.Errorf("sold %d tickets, want exactly 5", sold)
+	}
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/laurikarhu/stream-paywall/internal/models"
+)
+
+// subscriptionColumns is the list of columns for subscription queries
+const subscriptionColumns = `id, email, status, price_cents, period_months,
+	current_period_start, current_period_end, next_charge_at, cancel_at_period_end, failed_charges,
+	COALESCE(card_token, ''), COALESCE(card_type, ''), COALESCE(card_last4, ''), COALESCE(card_expiry, ''),
+	COALESCE(access_token, ''), created_at, canceled_at`
+
+// scanSubscription scans a row into a Subscription struct
+func scanSubscription(row pgx.Row) (*models.Subscription, error) {
+	sub := &models.Subscription{}
+	err := row.Scan(
+		&sub.ID,
+		&sub.Email,
+		&sub.Status,
+		&sub.PriceCents,
+		&sub.PeriodMonths,
+		&sub.CurrentPeriodStart,
+		&sub.CurrentPeriodEnd,
+		&sub.NextChargeAt,
+		&sub.CancelAtPeriodEnd,
+		&sub.FailedCharges,
+		&sub.CardToken,
+		&sub.CardType,
+		&sub.CardLast4,
+		&sub.CardExpiry,
+		&sub.AccessToken,
+		&sub.CreatedAt,
+		&sub.CanceledAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// CreateSubscription creates a new subscription record
+func (s *PostgresStore) CreateSubscription(ctx context.Context, sub *models.Subscription) error {
+	query := `
+		INSERT INTO subscriptions (id, email, status, price_cents, period_months, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := s.pool.Exec(ctx, query,
+		sub.ID,
+		sub.Email,
+		sub.Status,
+		sub.PriceCents,
+		sub.PeriodMonths,
+		sub.CreatedAt,
+	)
+	return err
+}
+
+// GetSubscriptionByID retrieves a subscription by ID
+func (s *PostgresStore) GetSubscriptionByID(ctx context.Context, id uuid.UUID) (*models.Subscription, error) {
+	query := "SELECT " + subscriptionColumns + " FROM subscriptions WHERE id = $1"
+	return scanSubscription(s.pool.QueryRow(ctx, query, id))
+}
+
+// GetSubscriptionByAccessToken retrieves a subscription by its access token
+func (s *PostgresStore) GetSubscriptionByAccessToken(ctx context.Context, token string) (*models.Subscription, error) {
+	query := "SELECT " + subscriptionColumns + " FROM subscriptions WHERE access_token = $1"
+	return scanSubscription(s.pool.QueryRow(ctx, query, token))
+}
+
+// GetLiveSubscriptionByEmail retrieves an email's newest active or past-due subscription
+// Emails are compared case-insensitively.
+func (s *PostgresStore) GetLiveSubscriptionByEmail(ctx context.Context, email string) (*models.Subscription, error) {
+	query := "SELECT " + subscriptionColumns + ` FROM subscriptions
+		WHERE lower(email) = lower($1) AND status IN ('active', 'past_due')
+		ORDER BY created_at DESC
+		LIMIT 1`
+	return scanSubscription(s.pool.QueryRow(ctx, query, email))
+}
+
+// ListSubscriptions retrieves subscriptions that got past signup, newest first
+func (s *PostgresStore) ListSubscriptions(ctx context.Context) ([]*models.Subscription, error) {
+	query := "SELECT " + subscriptionColumns + ` FROM subscriptions
+		WHERE status <> 'incomplete'
+		ORDER BY created_at DESC`
+	return s.listSubscriptions(ctx, query)
+}
+
+// ListDueSubscriptions retrieves live subscriptions whose next charge is due at or before now
+func (s *PostgresStore) ListDueSubscriptions(ctx context.Context, now time.Time, limit int) ([]*models.Subscription, error) {
+	query := "SELECT " + subscriptionColumns + ` FROM subscriptions
+		WHERE status IN ('active', 'past_due') AND next_charge_at <= $1
+		ORDER BY next_charge_at
+		LIMIT $2`
+	return s.listSubscriptions(ctx, query, now, limit)
+}
+
+// listSubscriptions runs a subscription query and scans all rows
+func (s *PostgresStore) listSubscriptions(ctx context.Context, query string, args ...any) ([]*models.Subscription, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*models.Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// SetSubscriptionCard stores the saved card used for renewals
+func (s *PostgresStore) SetSubscriptionCard(ctx context.Context, id uuid.UUID, token, cardType, last4, expiry string) error {
+	query := `
+		UPDATE subscriptions
+		SET card_token = $1, card_type = $2, card_last4 = $3, card_expiry = $4
+		WHERE id = $5
+	`
+	_, err := s.pool.Exec(ctx, query, token, cardType, last4, expiry, id)
+	return err
+}
+
+// StartSubscriptionPeriod marks a subscription active for a paid period
+// The access token is only set if the subscription does not have one yet.
+func (s *PostgresStore) StartSubscriptionPeriod(ctx context.Context, id uuid.UUID, start, end time.Time, accessToken string) error {
+	query := `
+		UPDATE subscriptions
+		SET status = 'active', current_period_start = $1, current_period_end = $2, next_charge_at = $2,
+			failed_charges = 0, access_token = COALESCE(access_token, NULLIF($3, ''))
+		WHERE id = $4
+	`
+	_, err := s.pool.Exec(ctx, query, start, end, accessToken, id)
+	return err
+}
+
+// ClaimDueSubscription pushes a due subscription's next charge to leaseUntil
+// Returns false if another worker already claimed it (next_charge_at changed).
+// If the charge never settles, the renewal is retried once the lease runs out.
+func (s *PostgresStore) ClaimDueSubscription(ctx context.Context, id uuid.UUID, dueAt, leaseUntil time.Time) (bool, error) {
+	query := `
+		UPDATE subscriptions
+		SET next_charge_at = $1
+		WHERE id = $2 AND next_charge_at = $3 AND status IN ('active', 'past_due')
+	`
+	tag, err := s.pool.Exec(ctx, query, leaseUntil, id, dueAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// MarkSubscriptionPastDue records a failed renewal and when to retry it
+func (s *PostgresStore) MarkSubscriptionPastDue(ctx context.Context, id uuid.UUID, failedCharges int, nextChargeAt time.Time) error {
+	query := `
+		UPDATE subscriptions
+		SET status = 'past_due', failed_charges = $1, next_charge_at = $2
+		WHERE id = $3 AND status IN ('active', 'past_due')
+	`
+	_, err := s.pool.Exec(ctx, query, failedCharges, nextChargeAt, id)
+	return err
+}
+
+// EndSubscription moves a subscription to canceled or expired and stops renewals
+func (s *PostgresStore) EndSubscription(ctx context.Context, id uuid.UUID, status models.SubscriptionStatus) error {
+	query := `
+		UPDATE subscriptions
+		SET status = $1, next_charge_at = NULL,
+			canceled_at = CASE WHEN $1 = 'canceled' THEN NOW() ELSE canceled_at END
+		WHERE id = $2
+	`
+	_, err := s.pool.Exec(ctx, query, string(status), id)
+	return err
+}
+
+// SetSubscriptionCancelAtPeriodEnd sets whether a subscription stops renewing
+func (s *PostgresStore) SetSubscriptionCancelAtPeriodEnd(ctx context.Context, id uuid.UUID, cancel bool) error {
+	query := "UPDATE subscriptions SET cancel_at_period_end = $1 WHERE id = $2"
+	_, err := s.pool.Exec(ctx, query, cancel, id)
+	return err
+}
+
+// UpdateSubscriptionAccessToken replaces a subscription's access token (used by recovery)
+func (s *PostgresStore) UpdateSubscriptionAccessToken(ctx context.Context, id uuid.UUID, token string) error {
+	query := "UPDATE subscriptions SET access_token = $1 WHERE id = $2"
+	_, err := s.pool.Exec(ctx, query, token, id)
+	return err
+}
+
+// subscriptionChargeColumns is the list of columns for subscription charge queries
+const subscriptionChargeColumns = `id, subscription_id, amount_cents, status, initiator, paytrail_stamp,
+	COALESCE(paytrail_transaction_id, ''), COALESCE(error, ''), created_at, completed_at`
+
+// scanSubscriptionCharge scans a row into a SubscriptionCharge struct
+func scanSubscriptionCharge(row pgx.Row) (*models.SubscriptionCharge, error) {
+	charge := &models.SubscriptionCharge{}
+	err := row.Scan(
+		&charge.ID,
+		&charge.SubscriptionID,
+		&charge.AmountCents,
+		&charge.Status,
+		&charge.Initiator,
+		&charge.PaytrailStamp,
+		&charge.PaytrailTransactionID,
+		&charge.Error,
+		&charge.CreatedAt,
+		&charge.CompletedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return charge, nil
+}
+
+// CreateSubscriptionCharge records a charge before it is sent to Paytrail
+func (s *PostgresStore) CreateSubscriptionCharge(ctx context.Context, charge *models.SubscriptionCharge) error {
+	query := `
+		INSERT INTO subscription_charges (id, subscription_id, amount_cents, status, initiator, paytrail_stamp, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := s.pool.Exec(ctx, query,
+		charge.ID,
+		charge.SubscriptionID,
+		charge.AmountCents,
+		charge.Status,
+		charge.Initiator,
+		charge.PaytrailStamp,
+		charge.CreatedAt,
+	)
+	return err
+}
+
+// GetSubscriptionChargeByStamp retrieves a charge by its Paytrail stamp
+func (s *PostgresStore) GetSubscriptionChargeByStamp(ctx context.Context, stamp string) (*models.SubscriptionCharge, error) {
+	query := "SELECT " + subscriptionChargeColumns + " FROM subscription_charges WHERE paytrail_stamp = $1"
+	return scanSubscriptionCharge(s.pool.QueryRow(ctx, query, stamp))
+}
+
+// GetUnconfirmedSubscriptionCharge retrieves a subscription's latest pending charge that Paytrail never answered
+// Returns nil if every charge was answered (settled, or waiting for 3-D Secure).
+func (s *PostgresStore) GetUnconfirmedSubscriptionCharge(ctx context.Context, subscriptionID uuid.UUID, initiator string) (*models.SubscriptionCharge, error) {
+	query := "SELECT " + subscriptionChargeColumns + ` FROM subscription_charges
+		WHERE subscription_id = $1 AND initiator = $2 AND status = 'pending' AND paytrail_transaction_id IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1`
+	return scanSubscriptionCharge(s.pool.QueryRow(ctx, query, subscriptionID, initiator))
+}
+
+// SettleSubscriptionCharge moves a pending charge to completed or failed
+// Returns false if the charge had already been settled.
+func (s *PostgresStore) SettleSubscriptionCharge(ctx context.Context, id uuid.UUID, status models.ChargeStatus, transactionID, errMsg string) (bool, error) {
+	query := `
+		UPDATE subscription_charges
+		SET status = $1, paytrail_transaction_id = NULLIF($2, ''), error = NULLIF($3, ''), completed_at = NOW()
+		WHERE id = $4 AND status = 'pending'
+	`
+	tag, err := s.pool.Exec(ctx, query, string(status), transactionID, errMsg, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// SetSubscriptionChargeTransaction stores the Paytrail transaction ID of a charge awaiting 3-D Secure
+func (s *PostgresStore) SetSubscriptionChargeTransaction(ctx context.Context, id uuid.UUID, transactionID string) error {
+	query := "UPDATE subscription_charges SET paytrail_transaction_id = $1 WHERE id = $2"
+	_, err := s.pool.Exec(ctx, query, transactionID, id)
+	return err
+}
+
+// ListSubscriptionCharges retrieves all charges for a subscription, newest first
+func (s *PostgresStore) ListSubscriptionCharges(ctx context.Context, subscriptionID uuid.UUID) ([]*models.SubscriptionCharge, error) {
+	query := "SELECT " + subscriptionChargeColumns + ` FROM subscription_charges
+		WHERE subscription_id = $1
+		ORDER BY created_at DESC`
+	rows, err := s.pool.Query(ctx, query, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var charges []*models.SubscriptionCharge
+	for rows.Next() {
+		charge, err := scanSubscriptionCharge(rows)
+		if err != nil {
+			return nil, err
+		}
+		charges = append(charges, charge)
+	}
+	return charges, rows.Err()
+}
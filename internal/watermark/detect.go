@@ -0,0 +1,280 @@
+package watermark
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxFrameDistance is the mean pixel difference up to which a captured frame is taken
+	// for a reference frame; re-encoding stays well below it, other pictures well above
+	maxFrameDistance = 16.0
+
+	// alignWindow is how many reference frames past the last matched one are tried
+	// before searching the whole reference, allowing for dropped frames
+	alignWindow = 8
+
+	// alignSlack is how much further than the closest frame in the window the
+	// earliest one may be and still be preferred, so a static scene is followed
+	// frame by frame instead of skipping ahead
+	alignSlack = 2.0
+
+	// minBitMargin is how far from halfway between A and B a segment must land to count
+	// Closer segments are left out rather than risk a wrong vote.
+	minBitMargin = 0.15
+)
+
+// sequenceRegex finds the media sequence number in a segment file name, e.g. stream-1234.ts
+var sequenceRegex = regexp.MustCompile(`(\d+)\.[A-Za-z0-9]+$`)
+
+// SequenceFromName returns the media sequence number in a segment file name
+func SequenceFromName(name string) (int64, bool) {
+	m := sequenceRegex.FindStringSubmatch(filepath.Base(name))
+	if m == nil {
+		return 0, false
+	}
+	sequence, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return sequence, true
+}
+
+// referenceSegment is the decoded A and B renditions of a segment
+type referenceSegment struct {
+	sequence   int64
+	renditions [2][]Frame
+}
+
+// aligned returns true if both renditions are present with the same number of frames
+func (s *referenceSegment) aligned() bool {
+	return s.renditions[0] != nil && s.renditions[1] != nil && len(s.renditions[0]) == len(s.renditions[1])
+}
+
+// referenceFrame is one frame of an aligned segment, with the difference the mark makes to it
+type referenceFrame struct {
+	segment *referenceSegment
+	a       Frame
+	mark    []float64 // B - A per pixel
+	energy  float64   // Squared length of mark; 0 for frames the mark left alone
+}
+
+// Reference holds the decoded A and B renditions of a stream's segments
+//
+// A captured frame is located in the reference by its picture, so captures
+// need not keep the segment boundaries, container or encoding they were served
+// with. Its bit is then read from whether it lies closer to the A or the B
+// frame, and the frames of a segment vote. This requires the renditions to be
+// aligned: rendition B must be encoded from the same source frames as A, with
+// the same frame rate, keyframes and segment boundaries, so that frame i of
+// segment n is the same picture in both. Segments whose renditions differ in
+// frame count cannot be compared and are skipped.
+type Reference struct {
+	segments map[int64]*referenceSegment
+	frames   []*referenceFrame // Aligned frames in sequence order, built on first use
+}
+
+// NewReference creates an empty reference archive
+func NewReference() *Reference {
+	return &Reference{segments: make(map[int64]*referenceSegment)}
+}
+
+// Add adds the decoded frames of one rendition (0 = A, 1 = B) of the segment with the given media sequence number
+func (r *Reference) Add(sequence int64, bit byte, frames []Frame) {
+	segment, ok := r.segments[sequence]
+	if !ok {
+		segment = &referenceSegment{sequence: sequence}
+		r.segments[sequence] = segment
+	}
+	segment.renditions[bit&1] = frames
+	r.frames = nil
+}
+
+// AddDir decodes every segment file in dir as rendition bit; file names carry the sequence number
+func (r *Reference) AddDir(dir string, bit byte) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		sequence, ok := SequenceFromName(entry.Name())
+		if !ok {
+			continue
+		}
+		frames, err := DecodeFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return added, err
+		}
+		r.Add(sequence, bit, frames)
+		added++
+	}
+	return added, nil
+}
+
+// Misaligned returns the sequence numbers of segments whose renditions cannot be compared
+// They lack a rendition or differ in frame count.
+func (r *Reference) Misaligned() []int64 {
+	var misaligned []int64
+	for sequence, segment := range r.segments {
+		if !segment.aligned() {
+			misaligned = append(misaligned, sequence)
+		}
+	}
+	sort.Slice(misaligned, func(i, j int) bool { return misaligned[i] < misaligned[j] })
+	return misaligned
+}
+
+// index returns the aligned frames in sequence order, with their marks
+func (r *Reference) index() []*referenceFrame {
+	if r.frames != nil {
+		return r.frames
+	}
+
+	sequences := make([]int64, 0, len(r.segments))
+	for sequence, segment := range r.segments {
+		if segment.aligned() {
+			sequences = append(sequences, sequence)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	frames := []*referenceFrame{}
+	for _, sequence := range sequences {
+		segment := r.segments[sequence]
+		for i, a := range segment.renditions[0] {
+			b := segment.renditions[1][i]
+			if len(a) != FrameSize || len(b) != FrameSize {
+				continue
+			}
+			frame := &referenceFrame{segment: segment, a: a, mark: make([]float64, len(a))}
+			for p := range a {
+				d := float64(b[p]) - float64(a[p])
+				frame.mark[p] = d
+				frame.energy += d * d
+			}
+			frames = append(frames, frame)
+		}
+	}
+	r.frames = frames
+	return frames
+}
+
+// locate returns the index of the reference frame showing the same picture as frame, or -1
+// The frames following the previous match are tried first, so repeated pictures
+// (a static scene) are attributed in order rather than to an arbitrary segment.
+func locate(index []*referenceFrame, frame Frame, previous int) int {
+	best, bestDistance := -1, maxFrameDistance
+	if previous >= 0 {
+		end := min(previous+alignWindow, len(index)-1)
+		distances := make([]float64, 0, alignWindow)
+		for i := previous + 1; i <= end; i++ {
+			d := distance(frame, index[i].a)
+			distances = append(distances, d)
+			bestDistance = min(bestDistance, d)
+		}
+		for i, d := range distances {
+			if d <= bestDistance+alignSlack && d <= maxFrameDistance {
+				return previous + 1 + i
+			}
+		}
+		bestDistance = maxFrameDistance
+	}
+	for i, ref := range index {
+		if d := distance(frame, ref.a); d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	return best
+}
+
+// Detect reads the rendition of every segment seen in a sequence of captured frames
+// Frames not found in the reference are ignored, as are segments the mark
+// does not change or whose frames land too close to halfway between A and B.
+func (r *Reference) Detect(frames []Frame) map[int64]byte {
+	index := r.index()
+
+	// Projection of (captured - A) onto (B - A), summed over each segment's frames
+	type projection struct{ dot, energy float64 }
+	projections := make(map[*referenceSegment]*projection)
+
+	previous := -1
+	for _, frame := range frames {
+		if len(frame) != FrameSize {
+			continue
+		}
+		i := locate(index, frame, previous)
+		if i < 0 {
+			continue
+		}
+		previous = i
+
+		ref := index[i]
+		if ref.energy == 0 {
+			continue
+		}
+		p, ok := projections[ref.segment]
+		if !ok {
+			p = &projection{}
+			projections[ref.segment] = p
+		}
+		for px, d := range ref.mark {
+			p.dot += (float64(frame[px]) - float64(ref.a[px])) * d
+		}
+		p.energy += ref.energy
+	}
+
+	observed := make(map[int64]byte)
+	for segment, p := range projections {
+		position := p.dot / p.energy // 0 at A, 1 at B
+		if math.Abs(position-0.5) < minBitMargin {
+			continue
+		}
+		if position > 0.5 {
+			observed[segment.sequence] = 1
+		} else {
+			observed[segment.sequence] = 0
+		}
+	}
+	return observed
+}
+
+// DetectFiles decodes captured segments or recordings, in order, and recovers the ID they were marked with
+func (r *Reference) DetectFiles(paths []string) (uuid.UUID, map[int64]byte, error) {
+	var frames []Frame
+	for _, path := range paths {
+		decoded, err := DecodeFile(path)
+		if err != nil {
+			return uuid.Nil, nil, err
+		}
+		frames = append(frames, decoded...)
+	}
+
+	observed := r.Detect(frames)
+	id, err := Decode(observed)
+	if err != nil {
+		return uuid.Nil, observed, fmt.Errorf("matched %d segments: %w", len(observed), err)
+	}
+	return id, observed, nil
+}
+
+// Sequences returns the observed media sequence numbers in order
+func Sequences(observed map[int64]byte) []int64 {
+	sequences := make([]int64, 0, len(observed))
+	for sequence := range observed {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences
+}
@@ -0,0 +1,80 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FrameWidth and FrameHeight are the size of the luma thumbnails frames are compared at
+	// Small enough to average out re-encoding noise and rescaling, large enough to
+	// tell frames apart and to keep a low-frequency mark.
+	FrameWidth  = 32
+	FrameHeight = 18
+
+	// FrameSize is the number of bytes in a Frame
+	FrameSize = FrameWidth * FrameHeight
+
+	// RawExt is the extension of files holding raw Frames back to back
+	// They are read as they are instead of being decoded with ffmpeg.
+	RawExt = ".gray"
+)
+
+// FFmpeg is the ffmpeg binary used to decode video files
+var FFmpeg = "ffmpeg"
+
+// Frame is the 8-bit luma of one decoded video frame, scaled to FrameWidth x FrameHeight
+type Frame []byte
+
+// DecodeFile returns the frames of a video file or a RawExt file
+// Video is decoded with ffmpeg, so anything it reads works: MPEG-TS and fMP4
+// segments, or a whole recording remuxed or re-encoded into another container.
+func DecodeFile(path string) ([]Frame, error) {
+	if filepath.Ext(path) == RawExt {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return SplitFrames(data)
+	}
+
+	scale := "scale=" + strconv.Itoa(FrameWidth) + ":" + strconv.Itoa(FrameHeight) + ":flags=area,format=gray"
+	cmd := exec.Command(FFmpeg, "-v", "error", "-i", path, "-an", "-vf", scale, "-f", "rawvideo", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return SplitFrames(out)
+}
+
+// SplitFrames splits raw luma thumbnails into Frames
+func SplitFrames(data []byte) ([]Frame, error) {
+	if len(data)%FrameSize != 0 {
+		return nil, fmt.Errorf("raw frame data is %d bytes, not a multiple of %d", len(data), FrameSize)
+	}
+	frames := make([]Frame, 0, len(data)/FrameSize)
+	for offset := 0; offset < len(data); offset += FrameSize {
+		frames = append(frames, Frame(data[offset:offset+FrameSize]))
+	}
+	return frames, nil
+}
+
+// distance returns the mean absolute difference between two frames' pixels
+func distance(a, b Frame) float64 {
+	sum := 0
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return float64(sum) / float64(len(a))
+}
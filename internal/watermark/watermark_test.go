@@ -0,0 +1,237 @@
+package watermark
+
+import (
+	"bytes"
+	"errors"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCodewordRoundTrip(t *testing.T) {
+	id := uuid.MustParse("6f1c2d3e-4b5a-4c7d-8e9f-0a1b2c3d4e5f")
+	codeword := Codeword(id)
+	if len(codeword) != CodewordBits {
+		t.Fatalf("expected %d bits, got %d", CodewordBits, len(codeword))
+	}
+
+	// Any window of CodewordBits consecutive segments decodes, wherever it starts
+	for _, start := range []int64{0, 1, 77, 1000003} {
+		observed := make(map[int64]byte)
+		for seq := start; seq < start+CodewordBits; seq++ {
+			observed[seq] = Bit(codeword, seq)
+		}
+		got, err := Decode(observed)
+		if err != nil {
+			t.Fatalf("start %d: %v", start, err)
+		}
+		if got != id {
+			t.Errorf("start %d: decoded %s, want %s", start, got, id)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	codeword := Codeword(uuid.New())
+
+	observed := make(map[int64]byte)
+	for seq := int64(0); seq < CodewordBits-1; seq++ {
+		observed[seq] = Bit(codeword, seq)
+	}
+	if _, err := Decode(observed); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("expected ErrIncomplete, got %v", err)
+	}
+
+	observed[CodewordBits-1] = Bit(codeword, CodewordBits-1)
+	observed[5] ^= 1
+	if _, err := Decode(observed); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+
+	// A second pass over the codeword outvotes a single misread segment
+	observed[5+CodewordBits] = Bit(codeword, 5)
+	observed[5+2*CodewordBits] = Bit(codeword, 5)
+	if _, err := Decode(observed); err != nil {
+		t.Errorf("expected majority vote to fix the bit, got %v", err)
+	}
+}
+
+func TestSequenceFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want int64
+		ok   bool
+	}{
+		{"stream-1234.ts", 1234, true},
+		{"0/stream-7.m4s", 7, true},
+		{"segment_00042.ts", 42, true},
+		{"stream.m3u8", 0, false},
+		{"notes.txt", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := SequenceFromName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("SequenceFromName(%q) = %d, %v; want %d, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// syntheticStream returns decoded A and B renditions of count segments, and
+// the frames a viewer marked with id would have been served
+// B differs from A by a faint fixed pattern; segments 3 to 5 show one still picture.
+// Streams with different seeds share no pictures.
+func syntheticStream(seed int64, id uuid.UUID, first, count int64, framesPerSegment int) (map[int64][2][]Frame, []Frame) {
+	rng := mathrand.New(mathrand.NewSource(seed))
+	pattern := make([]int, FrameSize)
+	for p := range pattern {
+		pattern[p] = 3 - 6*rng.Intn(2)
+	}
+	picture := func() Frame {
+		frame := make(Frame, FrameSize)
+		for p := range frame {
+			frame[p] = byte(40 + rng.Intn(176))
+		}
+		return frame
+	}
+	still := picture()
+
+	codeword := Codeword(id)
+	segments := make(map[int64][2][]Frame)
+	var served []Frame
+	for seq := first; seq < first+count; seq++ {
+		var renditions [2][]Frame
+		for i := 0; i < framesPerSegment; i++ {
+			a := picture()
+			if n := seq - first; n >= 3 && n <= 5 {
+				a = still
+			}
+			b := make(Frame, FrameSize)
+			for p := range b {
+				b[p] = byte(int(a[p]) + pattern[p])
+			}
+			renditions[0] = append(renditions[0], a)
+			renditions[1] = append(renditions[1], b)
+		}
+		segments[seq] = renditions
+		served = append(served, renditions[Bit(codeword, seq)]...)
+	}
+	return segments, served
+}
+
+// reencode imitates a re-encoded recording: every frame picks up noise and every seventh is dropped
+func reencode(frames []Frame) []Frame {
+	rng := mathrand.New(mathrand.NewSource(3))
+	var out []Frame
+	for i, frame := range frames {
+		if i%7 == 6 {
+			continue
+		}
+		noisy := make(Frame, FrameSize)
+		for p := range noisy {
+			noisy[p] = byte(int(frame[p]) + rng.Intn(7) - 3)
+		}
+		out = append(out, noisy)
+	}
+	return out
+}
+
+func writeFrames(t *testing.T, path string, frames []Frame) {
+	t.Helper()
+	if err := os.WriteFile(path, bytes.Join(frameBytes(frames), nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func frameBytes(frames []Frame) [][]byte {
+	out := make([][]byte, len(frames))
+	for i, frame := range frames {
+		out[i] = frame
+	}
+	return out
+}
+
+func TestDetectReencodedRecording(t *testing.T) {
+	id := uuid.New()
+	segments, served := syntheticStream(1, id, 500, CodewordBits+20, 6)
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for seq, renditions := range segments {
+		name := "stream-" + strconv.FormatInt(seq, 10) + RawExt
+		writeFrames(t, filepath.Join(dirA, name), renditions[0])
+		writeFrames(t, filepath.Join(dirB, name), renditions[1])
+	}
+	ref := NewReference()
+	if _, err := ref.AddDir(dirA, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ref.AddDir(dirB, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-encoded, cut into chunks that ignore the segment boundaries, with unrelated frames in front
+	capture := reencode(served)
+	junk, _ := syntheticStream(2, uuid.New(), 0, 1, 4)
+	capture = append(junk[0][0], capture...)
+
+	captureDir := t.TempDir()
+	var paths []string
+	for i := 0; i*10 < len(capture); i++ {
+		path := filepath.Join(captureDir, "chunk-"+strconv.Itoa(i)+RawExt)
+		writeFrames(t, path, capture[i*10:min((i+1)*10, len(capture))])
+		paths = append(paths, path)
+	}
+
+	got, observed, err := ref.DetectFiles(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Errorf("decoded %s, want %s", got, id)
+	}
+	codeword := Codeword(id)
+	for seq, bit := range observed {
+		if bit != Bit(codeword, seq) {
+			t.Errorf("segment %d read as %d, served %d", seq, bit, Bit(codeword, seq))
+		}
+	}
+
+	// Too short a recording is reported, not misattributed
+	if _, _, err := ref.DetectFiles(paths[:len(paths)/2]); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("expected ErrIncomplete for a short recording, got %v", err)
+	}
+}
+
+func TestReferenceSkipsUnmarkedAndMisalignedSegments(t *testing.T) {
+	segments, _ := syntheticStream(1, uuid.New(), 1, 3, 4)
+	ref := NewReference()
+
+	// Segment 1 is unmarked, segment 2's B rendition lost a frame
+	ref.Add(1, 0, segments[1][0])
+	ref.Add(1, 1, segments[1][0])
+	ref.Add(2, 0, segments[2][0])
+	ref.Add(2, 1, segments[2][1][1:])
+	ref.Add(3, 0, segments[3][0])
+	ref.Add(3, 1, segments[3][1])
+
+	if misaligned := ref.Misaligned(); len(misaligned) != 1 || misaligned[0] != 2 {
+		t.Errorf("Misaligned = %v, want [2]", misaligned)
+	}
+
+	var capture []Frame
+	for seq := int64(1); seq <= 3; seq++ {
+		capture = append(capture, segments[seq][1]...)
+	}
+	if observed := ref.Detect(capture); len(observed) != 1 || observed[3] != 1 {
+		t.Errorf("Detect = %v, want only segment 3 as B", observed)
+	}
+
+	// A different picture is not mistaken for a reference frame
+	other, _ := syntheticStream(2, uuid.New(), 3, 1, 4)
+	if observed := ref.Detect(other[3][1]); len(observed) != 0 {
+		t.Errorf("Detect = %v for unrelated frames, want nothing", observed)
+	}
+}
@@ -0,0 +1,22 @@
+-- Refunds issued through the Paytrail refund API
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/004_refunds.sql
+
+CREATE TABLE IF NOT EXISTS payment_refunds (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    payment_id UUID NOT NULL REFERENCES payments(id) ON DELETE CASCADE,
+    amount_cents INTEGER NOT NULL CHECK (amount_cents > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed')),
+    refund_stamp VARCHAR(100) UNIQUE NOT NULL,  -- Unique stamp sent to Paytrail
+    paytrail_transaction_id VARCHAR(100),       -- Refund transaction ID returned by Paytrail
+    requested_by VARCHAR(50),                   -- Admin username or "api"
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_refunds_payment_id ON payment_refunds(payment_id);
+CREATE INDEX IF NOT EXISTS idx_payment_refunds_refund_stamp ON payment_refunds(refund_stamp);
+-- At most one refund per payment may wait for Paytrail at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payment_refunds_one_pending ON payment_refunds(payment_id) WHERE status = 'pending';
+
+COMMENT ON TABLE payment_refunds IS 'Refunds issued through the Paytrail refund API';
+COMMENT ON COLUMN payment_refunds.refund_stamp IS 'Unique refund stamp sent to Paytrail, echoed back in refund callbacks';
@@ -0,0 +1,20 @@
+-- Audit log of every signature-verified Paytrail payment callback
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/005_payment_callbacks.sql
+
+CREATE TABLE IF NOT EXISTS payment_callbacks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    payment_id UUID REFERENCES payments(id) ON DELETE CASCADE,  -- NULL when the stamp matched no payment
+    stamp VARCHAR(100) NOT NULL,
+    transaction_id VARCHAR(100),
+    status VARCHAR(20) NOT NULL,   -- Status reported by Paytrail (ok, pending, fail, ...)
+    source VARCHAR(20) NOT NULL CHECK (source IN ('redirect', 'server')),
+    outcome VARCHAR(20) NOT NULL,  -- completed, failed, pending, duplicate, not_found
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_callbacks_payment_id ON payment_callbacks(payment_id);
+CREATE INDEX IF NOT EXISTS idx_payment_callbacks_stamp ON payment_callbacks(stamp);
+CREATE INDEX IF NOT EXISTS idx_payment_callbacks_received_at ON payment_callbacks(received_at);
+
+COMMENT ON TABLE payment_callbacks IS 'Every signature-verified Paytrail payment callback, for auditing replays and races';
+COMMENT ON COLUMN payment_callbacks.outcome IS 'What processing the callback did to the payment';
@@ -0,0 +1,31 @@
+-- Promo codes for discounted stream purchases
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/006_promo_codes.sql
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code VARCHAR(50) UNIQUE NOT NULL,                                -- Stored upper-case, matched case-insensitively
+    stream_id UUID REFERENCES streams(id) ON DELETE CASCADE,         -- NULL = valid for every stream
+    discount_type VARCHAR(10) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value INTEGER NOT NULL CHECK (discount_value > 0),      -- Percent (1-100) or cents
+    max_uses INTEGER NOT NULL DEFAULT 0 CHECK (max_uses >= 0),       -- 0 = unlimited
+    max_uses_per_email INTEGER NOT NULL DEFAULT 0 CHECK (max_uses_per_email >= 0),
+    valid_from TIMESTAMPTZ,
+    valid_until TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT valid_percent CHECK (discount_type <> 'percent' OR discount_value <= 100),
+    CONSTRAINT valid_promo_window CHECK (valid_until IS NULL OR valid_from IS NULL OR valid_until > valid_from)
+);
+
+CREATE INDEX IF NOT EXISTS idx_promo_codes_stream_id ON promo_codes(stream_id);
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS promo_code_id UUID REFERENCES promo_codes(id) ON DELETE SET NULL;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS discount_cents INTEGER NOT NULL DEFAULT 0 CHECK (discount_cents >= 0);
+
+CREATE INDEX IF NOT EXISTS idx_payments_promo_code_id ON payments(promo_code_id);
+
+COMMENT ON TABLE promo_codes IS 'Discount codes applied at checkout';
+COMMENT ON COLUMN promo_codes.max_uses IS 'Completed plus recently pending payments count as uses; 0 means unlimited';
+COMMENT ON COLUMN payments.promo_code_id IS 'Promo code applied to this payment, if any';
+COMMENT ON COLUMN payments.discount_cents IS 'Discount subtracted from the stream price';
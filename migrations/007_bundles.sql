@@ -0,0 +1,43 @@
+-- Bundles (season passes) that sell access to several streams at once
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/007_bundles.sql
+
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_streams_tags ON streams USING GIN (tags);
+
+CREATE TABLE IF NOT EXISTS bundles (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    slug VARCHAR(255) UNIQUE NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    description TEXT,
+    price_cents INTEGER NOT NULL CHECK (price_cents >= 0),
+    tag VARCHAR(50),                                  -- Include every stream with this tag
+    starts_after TIMESTAMPTZ,                         -- Include streams starting in [starts_after, starts_before)
+    starts_before TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT valid_bundle_window CHECK (starts_before IS NULL OR starts_after IS NULL OR starts_before > starts_after)
+);
+
+-- Streams included in a bundle explicitly, regardless of its tag and date range
+CREATE TABLE IF NOT EXISTS bundle_streams (
+    bundle_id UUID NOT NULL REFERENCES bundles(id) ON DELETE CASCADE,
+    stream_id UUID NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+    PRIMARY KEY (bundle_id, stream_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bundle_streams_stream_id ON bundle_streams(stream_id);
+
+-- A payment buys either a single stream or a bundle
+ALTER TABLE payments ALTER COLUMN stream_id DROP NOT NULL;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS bundle_id UUID REFERENCES bundles(id);
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payment_product;
+ALTER TABLE payments ADD CONSTRAINT payment_product CHECK ((stream_id IS NULL) <> (bundle_id IS NULL));
+
+CREATE INDEX IF NOT EXISTS idx_payments_bundle_id ON payments(bundle_id);
+
+COMMENT ON TABLE bundles IS 'Products that grant access to several streams for one price';
+COMMENT ON COLUMN bundles.tag IS 'Streams carrying this tag (and inside the date range, if set) are included';
+COMMENT ON COLUMN streams.tags IS 'Lower-case labels used to group streams into bundles';
+COMMENT ON COLUMN payments.bundle_id IS 'Bundle bought by this payment; NULL for single-stream payments';
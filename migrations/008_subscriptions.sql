@@ -0,0 +1,54 @@
+-- Recurring memberships that grant access to members-only streams
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/008_subscriptions.sql
+
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS members_only BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'incomplete',
+    price_cents INTEGER NOT NULL CHECK (price_cents > 0),
+    period_months INTEGER NOT NULL CHECK (period_months > 0),
+    current_period_start TIMESTAMPTZ,
+    current_period_end TIMESTAMPTZ,
+    next_charge_at TIMESTAMPTZ,                       -- Next renewal or dunning retry; pushed forward while a charge runs
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+    failed_charges INTEGER NOT NULL DEFAULT 0,        -- Consecutive failed renewal charges
+    card_token VARCHAR(255),                          -- Paytrail card token for recurring charges
+    card_type VARCHAR(50),
+    card_last4 VARCHAR(4),
+    card_expiry VARCHAR(7),                           -- MM/YYYY
+    access_token VARCHAR(255) UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    canceled_at TIMESTAMPTZ,
+
+    CONSTRAINT valid_subscription_status CHECK (status IN ('incomplete', 'active', 'past_due', 'canceled', 'expired'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_email ON subscriptions(email);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_next_charge_at ON subscriptions(next_charge_at)
+    WHERE status IN ('active', 'past_due');
+
+-- Every charge made against a subscription's saved card
+CREATE TABLE IF NOT EXISTS subscription_charges (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    amount_cents INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    initiator VARCHAR(3) NOT NULL,                    -- cit (customer present) or mit (renewal)
+    paytrail_stamp VARCHAR(255) UNIQUE NOT NULL,
+    paytrail_transaction_id VARCHAR(255),
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ,
+
+    CONSTRAINT valid_charge_status CHECK (status IN ('pending', 'completed', 'failed')),
+    CONSTRAINT valid_charge_initiator CHECK (initiator IN ('cit', 'mit'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_charges_subscription_id ON subscription_charges(subscription_id);
+
+COMMENT ON TABLE subscriptions IS 'Recurring memberships renewed by charging a saved card';
+COMMENT ON COLUMN subscriptions.status IS 'incomplete until the first charge, past_due while dunning retries a failed renewal';
+COMMENT ON COLUMN subscription_charges.paytrail_stamp IS 'Unique stamp sent to Paytrail';
+COMMENT ON COLUMN streams.members_only IS 'Only members can watch; single tickets are not sold';
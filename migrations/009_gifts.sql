@@ -0,0 +1,13 @@
+-- Gift purchases: the payer buys a ticket that is redeemed by another email
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/009_gifts.sql
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS recipient_email VARCHAR(255);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS gift_code VARCHAR(32) UNIQUE;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS gift_redeemed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_payments_recipient_email ON payments(recipient_email)
+    WHERE recipient_email IS NOT NULL;
+
+COMMENT ON COLUMN payments.recipient_email IS 'Gift recipient; the entitlement belongs to this email instead of the payer';
+COMMENT ON COLUMN payments.gift_code IS 'Code the recipient redeems to claim a gift';
+COMMENT ON COLUMN payments.gift_redeemed_at IS 'When the recipient redeemed the gift; access starts then';
@@ -0,0 +1,27 @@
+-- Prepaid access code batches sold to companies, redeemed one seat per code
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/010_access_codes.sql
+
+CREATE TABLE IF NOT EXISTS access_code_batches (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    stream_id UUID NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+    label VARCHAR(255) NOT NULL,
+    code_count INTEGER NOT NULL CHECK (code_count > 0),
+    expires_at TIMESTAMPTZ,                           -- NULL = codes can be redeemed until the batch is deleted
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_code_batches_stream_id ON access_code_batches(stream_id);
+
+CREATE TABLE IF NOT EXISTS access_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    batch_id UUID NOT NULL REFERENCES access_code_batches(id) ON DELETE CASCADE,
+    code VARCHAR(32) UNIQUE NOT NULL,
+    redeemed_email VARCHAR(255),
+    redeemed_at TIMESTAMPTZ,
+    payment_id UUID REFERENCES payments(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_codes_batch_id ON access_codes(batch_id);
+
+COMMENT ON TABLE access_code_batches IS 'Prepaid single-use access codes for one stream, e.g. seats invoiced to a company';
+COMMENT ON COLUMN access_codes.payment_id IS 'Zero-amount payment created when the code was redeemed';
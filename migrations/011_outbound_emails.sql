@@ -0,0 +1,23 @@
+-- Outbound email queue; a background worker sends queued emails and retries failures
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/011_outbound_emails.sql
+
+CREATE TABLE IF NOT EXISTS outbound_emails (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    to_email VARCHAR(255) NOT NULL,
+    template VARCHAR(50) NOT NULL,                    -- File name under web/templates/email, without .txt
+    data JSONB NOT NULL DEFAULT '{}',                 -- Template data; rendered when the email is sent, cleared once sent or failed
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMPTZ,
+
+    CONSTRAINT valid_email_status CHECK (status IN ('pending', 'sent', 'failed'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbound_emails_next_attempt_at ON outbound_emails(next_attempt_at)
+    WHERE status = 'pending';
+
+COMMENT ON TABLE outbound_emails IS 'Transactional emails waiting to be sent, and their delivery history';
+COMMENT ON COLUMN outbound_emails.next_attempt_at IS 'When to send or retry; pushed forward while a send is in progress';
@@ -0,0 +1,6 @@
+-- Forensic A/B watermarking: the second, marked rendition of a stream's HLS output
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/012_watermark.sql
+
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS watermark_url TEXT;
+
+COMMENT ON COLUMN streams.watermark_url IS 'Base URL of the marked B rendition (same /hls/ layout as owncast_url); NULL disables watermarking';
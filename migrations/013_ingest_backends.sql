@@ -0,0 +1,8 @@
+-- Pluggable ingest backends: Owncast in Docker, run elsewhere, or on Kubernetes
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/013_ingest_backends.sql
+
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS backend VARCHAR(20) NOT NULL DEFAULT 'docker'
+    CHECK (backend IN ('docker', 'external', 'kubernetes'));
+
+COMMENT ON COLUMN streams.backend IS 'Where the Owncast instance runs: docker (container on this host), external (owncast_url) or kubernetes';
+COMMENT ON COLUMN streams.container_name IS 'Docker container or Kubernetes Deployment name; NULL for external Owncast';
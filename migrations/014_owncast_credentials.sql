@@ -0,0 +1,8 @@
+-- Per-stream Owncast admin passwords and first-boot provisioning
+-- Run: docker compose exec -T postgres psql -U paywall -d paywall < migrations/014_owncast_credentials.sql
+
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS owncast_admin_password TEXT;
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS owncast_provisioned_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN streams.owncast_admin_password IS 'Generated Owncast admin password, encrypted with CREDENTIALS_SECRET; NULL uses OWNCAST_ADMIN_PASSWORD';
+COMMENT ON COLUMN streams.owncast_provisioned_at IS 'When the paywall pushed the stream''s title, video defaults and lock-down settings to its Owncast';
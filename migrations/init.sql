@@ -110,6 +110,272 @@ CREATE INDEX IF NOT EXISTS idx_whitelist_email ON stream_whitelist(email);
 COMMENT ON TABLE stream_whitelist IS 'Whitelisted emails that can access streams without payment';
 COMMENT ON COLUMN stream_whitelist.notes IS 'Optional admin notes explaining why this email is whitelisted';
 
+-- ============================================
+-- PAYMENT REFUNDS TABLE
+-- ============================================
+CREATE TABLE IF NOT EXISTS payment_refunds (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    payment_id UUID NOT NULL REFERENCES payments(id) ON DELETE CASCADE,
+    amount_cents INTEGER NOT NULL CHECK (amount_cents > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed')),
+    refund_stamp VARCHAR(100) UNIQUE NOT NULL,  -- Unique stamp sent to Paytrail
+    paytrail_transaction_id VARCHAR(100),       -- Refund transaction ID returned by Paytrail
+    requested_by VARCHAR(50),                   -- Admin username or "api"
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_refunds_payment_id ON payment_refunds(payment_id);
+CREATE INDEX IF NOT EXISTS idx_payment_refunds_refund_stamp ON payment_refunds(refund_stamp);
+-- At most one refund per payment may wait for Paytrail at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payment_refunds_one_pending ON payment_refunds(payment_id) WHERE status = 'pending';
+
+COMMENT ON TABLE payment_refunds IS 'Refunds issued through the Paytrail refund API';
+COMMENT ON COLUMN payment_refunds.refund_stamp IS 'Unique refund stamp sent to Paytrail, echoed back in refund callbacks';
+
+-- ============================================
+-- PAYMENT CALLBACKS TABLE
+-- ============================================
+CREATE TABLE IF NOT EXISTS payment_callbacks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    payment_id UUID REFERENCES payments(id) ON DELETE CASCADE,  -- NULL when the stamp matched no payment
+    stamp VARCHAR(100) NOT NULL,
+    transaction_id VARCHAR(100),
+    status VARCHAR(20) NOT NULL,   -- Status reported by Paytrail (ok, pending, fail, ...)
+    source VARCHAR(20) NOT NULL CHECK (source IN ('redirect', 'server')),
+    outcome VARCHAR(20) NOT NULL,  -- completed, failed, pending, duplicate, not_found
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_callbacks_payment_id ON payment_callbacks(payment_id);
+CREATE INDEX IF NOT EXISTS idx_payment_callbacks_stamp ON payment_callbacks(stamp);
+CREATE INDEX IF NOT EXISTS idx_payment_callbacks_received_at ON payment_callbacks(received_at);
+
+COMMENT ON TABLE payment_callbacks IS 'Every signature-verified Paytrail payment callback, for auditing replays and races';
+COMMENT ON COLUMN payment_callbacks.outcome IS 'What processing the callback did to the payment';
+
+-- ============================================
+-- PROMO CODES TABLE
+-- ============================================
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code VARCHAR(50) UNIQUE NOT NULL,                                -- Stored upper-case, matched case-insensitively
+    stream_id UUID REFERENCES streams(id) ON DELETE CASCADE,         -- NULL = valid for every stream
+    discount_type VARCHAR(10) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value INTEGER NOT NULL CHECK (discount_value > 0),      -- Percent (1-100) or cents
+    max_uses INTEGER NOT NULL DEFAULT 0 CHECK (max_uses >= 0),       -- 0 = unlimited
+    max_uses_per_email INTEGER NOT NULL DEFAULT 0 CHECK (max_uses_per_email >= 0),
+    valid_from TIMESTAMPTZ,
+    valid_until TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT valid_percent CHECK (discount_type <> 'percent' OR discount_value <= 100),
+    CONSTRAINT valid_promo_window CHECK (valid_until IS NULL OR valid_from IS NULL OR valid_until > valid_from)
+);
+
+CREATE INDEX IF NOT EXISTS idx_promo_codes_stream_id ON promo_codes(stream_id);
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS promo_code_id UUID REFERENCES promo_codes(id) ON DELETE SET NULL;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS discount_cents INTEGER NOT NULL DEFAULT 0 CHECK (discount_cents >= 0);
+
+CREATE INDEX IF NOT EXISTS idx_payments_promo_code_id ON payments(promo_code_id);
+
+COMMENT ON TABLE promo_codes IS 'Discount codes applied at checkout';
+COMMENT ON COLUMN promo_codes.max_uses IS 'Completed plus recently pending payments count as uses; 0 means unlimited';
+COMMENT ON COLUMN payments.promo_code_id IS 'Promo code applied to this payment, if any';
+COMMENT ON COLUMN payments.discount_cents IS 'Discount subtracted from the stream price';
+
+-- ============================================
+-- BUNDLES
+-- ============================================
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_streams_tags ON streams USING GIN (tags);
+
+CREATE TABLE IF NOT EXISTS bundles (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    slug VARCHAR(255) UNIQUE NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    description TEXT,
+    price_cents INTEGER NOT NULL CHECK (price_cents >= 0),
+    tag VARCHAR(50),                                  -- Include every stream with this tag
+    starts_after TIMESTAMPTZ,                         -- Include streams starting in [starts_after, starts_before)
+    starts_before TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT valid_bundle_window CHECK (starts_before IS NULL OR starts_after IS NULL OR starts_before > starts_after)
+);
+
+-- Streams included in a bundle explicitly, regardless of its tag and date range
+CREATE TABLE IF NOT EXISTS bundle_streams (
+    bundle_id UUID NOT NULL REFERENCES bundles(id) ON DELETE CASCADE,
+    stream_id UUID NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+    PRIMARY KEY (bundle_id, stream_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bundle_streams_stream_id ON bundle_streams(stream_id);
+
+-- A payment buys either a single stream or a bundle
+ALTER TABLE payments ALTER COLUMN stream_id DROP NOT NULL;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS bundle_id UUID REFERENCES bundles(id);
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payment_product;
+ALTER TABLE payments ADD CONSTRAINT payment_product CHECK ((stream_id IS NULL) <> (bundle_id IS NULL));
+
+CREATE INDEX IF NOT EXISTS idx_payments_bundle_id ON payments(bundle_id);
+
+COMMENT ON TABLE bundles IS 'Products that grant access to several streams for one price';
+COMMENT ON COLUMN bundles.tag IS 'Streams carrying this tag (and inside the date range, if set) are included';
+COMMENT ON COLUMN streams.tags IS 'Lower-case labels used to group streams into bundles';
+COMMENT ON COLUMN payments.bundle_id IS 'Bundle bought by this payment; NULL for single-stream payments';
+
+-- ============================================
+-- SUBSCRIPTIONS
+-- ============================================
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS members_only BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'incomplete',
+    price_cents INTEGER NOT NULL CHECK (price_cents > 0),
+    period_months INTEGER NOT NULL CHECK (period_months > 0),
+    current_period_start TIMESTAMPTZ,
+    current_period_end TIMESTAMPTZ,
+    next_charge_at TIMESTAMPTZ,                       -- Next renewal or dunning retry; pushed forward while a charge runs
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+    failed_charges INTEGER NOT NULL DEFAULT 0,        -- Consecutive failed renewal charges
+    card_token VARCHAR(255),                          -- Paytrail card token for recurring charges
+    card_type VARCHAR(50),
+    card_last4 VARCHAR(4),
+    card_expiry VARCHAR(7),                           -- MM/YYYY
+    access_token VARCHAR(255) UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    canceled_at TIMESTAMPTZ,
+
+    CONSTRAINT valid_subscription_status CHECK (status IN ('incomplete', 'active', 'past_due', 'canceled', 'expired'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_email ON subscriptions(email);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_next_charge_at ON subscriptions(next_charge_at)
+    WHERE status IN ('active', 'past_due');
+
+-- Every charge made against a subscription's saved card
+CREATE TABLE IF NOT EXISTS subscription_charges (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    amount_cents INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    initiator VARCHAR(3) NOT NULL,                    -- cit (customer present) or mit (renewal)
+    paytrail_stamp VARCHAR(255) UNIQUE NOT NULL,
+    paytrail_transaction_id VARCHAR(255),
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ,
+
+    CONSTRAINT valid_charge_status CHECK (status IN ('pending', 'completed', 'failed')),
+    CONSTRAINT valid_charge_initiator CHECK (initiator IN ('cit', 'mit'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_charges_subscription_id ON subscription_charges(subscription_id);
+
+COMMENT ON TABLE subscriptions IS 'Recurring memberships renewed by charging a saved card';
+COMMENT ON COLUMN subscriptions.status IS 'incomplete until the first charge, past_due while dunning retries a failed renewal';
+COMMENT ON COLUMN subscription_charges.paytrail_stamp IS 'Unique stamp sent to Paytrail';
+COMMENT ON COLUMN streams.members_only IS 'Only members can watch; single tickets are not sold';
+
+-- ============================================
+-- GIFT PURCHASES
+-- ============================================
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS recipient_email VARCHAR(255);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS gift_code VARCHAR(32) UNIQUE;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS gift_redeemed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_payments_recipient_email ON payments(recipient_email)
+    WHERE recipient_email IS NOT NULL;
+
+COMMENT ON COLUMN payments.recipient_email IS 'Gift recipient; the entitlement belongs to this email instead of the payer';
+COMMENT ON COLUMN payments.gift_code IS 'Code the recipient redeems to claim a gift';
+COMMENT ON COLUMN payments.gift_redeemed_at IS 'When the recipient redeemed the gift; access starts then';
+
+-- ============================================
+-- ACCESS CODE BATCHES
+-- ============================================
+CREATE TABLE IF NOT EXISTS access_code_batches (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    stream_id UUID NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+    label VARCHAR(255) NOT NULL,
+    code_count INTEGER NOT NULL CHECK (code_count > 0),
+    expires_at TIMESTAMPTZ,                           -- NULL = codes can be redeemed until the batch is deleted
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_code_batches_stream_id ON access_code_batches(stream_id);
+
+CREATE TABLE IF NOT EXISTS access_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    batch_id UUID NOT NULL REFERENCES access_code_batches(id) ON DELETE CASCADE,
+    code VARCHAR(32) UNIQUE NOT NULL,
+    redeemed_email VARCHAR(255),
+    redeemed_at TIMESTAMPTZ,
+    payment_id UUID REFERENCES payments(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_codes_batch_id ON access_codes(batch_id);
+
+COMMENT ON TABLE access_code_batches IS 'Prepaid single-use access codes for one stream, e.g. seats invoiced to a company';
+COMMENT ON COLUMN access_codes.payment_id IS 'Zero-amount payment created when the code was redeemed';
+
+-- ============================================
+-- OUTBOUND EMAIL QUEUE
+-- ============================================
+CREATE TABLE IF NOT EXISTS outbound_emails (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    to_email VARCHAR(255) NOT NULL,
+    template VARCHAR(50) NOT NULL,                    -- File name under web/templates/email, without .txt
+    data JSONB NOT NULL DEFAULT '{}',                 -- Template data; rendered when the email is sent, cleared once sent or failed
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMPTZ,
+
+    CONSTRAINT valid_email_status CHECK (status IN ('pending', 'sent', 'failed'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbound_emails_next_attempt_at ON outbound_emails(next_attempt_at)
+    WHERE status = 'pending';
+
+COMMENT ON TABLE outbound_emails IS 'Transactional emails waiting to be sent, and their delivery history';
+COMMENT ON COLUMN outbound_emails.next_attempt_at IS 'When to send or retry; pushed forward while a send is in progress';
+
+-- ============================================
+-- FORENSIC WATERMARKING
+-- ============================================
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS watermark_url TEXT;
+
+COMMENT ON COLUMN streams.watermark_url IS 'Base URL of the marked B rendition (same /hls/ layout as owncast_url); NULL disables watermarking';
+
+-- ============================================
+-- INGEST BACKENDS
+-- ============================================
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS backend VARCHAR(20) NOT NULL DEFAULT 'docker'
+    CHECK (backend IN ('docker', 'external', 'kubernetes'));
+
+COMMENT ON COLUMN streams.backend IS 'Where the Owncast instance runs: docker (container on this host), external (owncast_url) or kubernetes';
+COMMENT ON COLUMN streams.container_name IS 'Docker container or Kubernetes Deployment name; NULL for external Owncast';
+
+-- ============================================
+-- OWNCAST CREDENTIALS
+-- ============================================
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS owncast_admin_password TEXT;
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS owncast_provisioned_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN streams.owncast_admin_password IS 'Generated Owncast admin password, encrypted with CREDENTIALS_SECRET; NULL uses OWNCAST_ADMIN_PASSWORD';
+COMMENT ON COLUMN streams.owncast_provisioned_at IS 'When the paywall pushed the stream''s title, video defaults and lock-down settings to its Owncast';
+
 -- ============================================
 -- DONE
 -- ============================================
@@ -0,0 +1,169 @@
+// Command watermark recovers the payment ID from a recording of a watermarked stream
+//
+// Detect: compare a captured recording against the archived A and B renditions
+// Segments and recordings are decoded with ffmpeg, so re-encoded captures work.
+//
+//	go run ./tools/watermark -a archive/a -b archive/b capture.mp4
+//
+// Generate: write synthetic decoded renditions and a re-encoded capture for a
+// payment as raw frames, to try detection offline without ffmpeg
+//
+//	go run ./tools/watermark -generate /tmp/wm -payment <uuid>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/laurikarhu/stream-paywall/internal/watermark"
+)
+
+func main() {
+	dirA := flag.String("a", "", "Directory of archived A rendition segments")
+	dirB := flag.String("b", "", "Directory of archived B rendition segments")
+	generate := flag.String("generate", "", "Write synthetic a/, b/ and capture/ directories here instead of detecting")
+	payment := flag.String("payment", "", "Payment ID to mark the synthetic capture with (with -generate)")
+	segments := flag.Int("segments", watermark.CodewordBits, "Number of synthetic segments (with -generate)")
+	framesPerSegment := flag.Int("frames", 8, "Frames in each synthetic segment (with -generate)")
+	flag.StringVar(&watermark.FFmpeg, "ffmpeg", watermark.FFmpeg, "ffmpeg binary used to decode video")
+
+	flag.Parse()
+
+	if *generate != "" {
+		id, err := uuid.Parse(*payment)
+		if err != nil {
+			fmt.Printf("❌ -payment must be a UUID: %v\n", err)
+			os.Exit(1)
+		}
+		if err := generateSynthetic(*generate, id, *segments, *framesPerSegment); err != nil {
+			fmt.Printf("❌ Failed to generate segments: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %d synthetic segments for %s to %s\n", *segments, id, *generate)
+		fmt.Printf("Detect with: go run ./tools/watermark -a %s -b %s %s\n",
+			filepath.Join(*generate, "a"), filepath.Join(*generate, "b"), filepath.Join(*generate, "capture"))
+		return
+	}
+
+	if *dirA == "" || *dirB == "" || flag.NArg() == 0 {
+		fmt.Println("Usage: watermark -a <dir> -b <dir> <captured segments or recordings...>")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	ref := watermark.NewReference()
+	countA, err := ref.AddDir(*dirA, 0)
+	if err != nil {
+		fmt.Printf("❌ Failed to read A rendition: %v\n", err)
+		os.Exit(1)
+	}
+	countB, err := ref.AddDir(*dirB, 1)
+	if err != nil {
+		fmt.Printf("❌ Failed to read B rendition: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Reference: %d A segments, %d B segments\n", countA, countB)
+	if misaligned := ref.Misaligned(); len(misaligned) > 0 {
+		fmt.Printf("⚠️  Skipping %d segments missing a rendition or with A and B frame counts differing: %v\n", len(misaligned), misaligned)
+	}
+
+	paths, err := expandPaths(flag.Args())
+	if err != nil {
+		fmt.Printf("❌ Failed to read capture: %v\n", err)
+		os.Exit(1)
+	}
+
+	id, observed, err := ref.DetectFiles(paths)
+	sequences := watermark.Sequences(observed)
+	if len(sequences) > 0 {
+		fmt.Printf("Matched %d segments (sequence %d-%d)\n", len(sequences), sequences[0], sequences[len(sequences)-1])
+	}
+	if err != nil {
+		fmt.Printf("❌ No watermark recovered: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Payment ID: %s\n", id)
+}
+
+// expandPaths replaces directories with the files in them
+func expandPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				paths = append(paths, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// generateSynthetic writes random A frames, B frames differing by a faint
+// pattern, and the capture a viewer marked with id would have been served,
+// with noise and dropped frames as after re-encoding, as one raw recording
+func generateSynthetic(dir string, id uuid.UUID, count, framesPerSegment int) error {
+	if framesPerSegment < 1 {
+		return fmt.Errorf("segments need at least one frame")
+	}
+	for _, sub := range []string{"a", "b", "capture"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return err
+		}
+	}
+
+	pattern := make([]int, watermark.FrameSize)
+	for p := range pattern {
+		pattern[p] = 3 - 6*rand.Intn(2)
+	}
+
+	mark := watermark.Codeword(id)
+	var capture []byte
+	for sequence := int64(0); sequence < int64(count); sequence++ {
+		var a, b []byte
+		for i := 0; i < framesPerSegment; i++ {
+			for p := 0; p < watermark.FrameSize; p++ {
+				luma := 40 + rand.Intn(176)
+				a = append(a, byte(luma))
+				b = append(b, byte(luma+pattern[p]))
+			}
+		}
+
+		name := fmt.Sprintf("stream-%d%s", sequence, watermark.RawExt)
+		if err := os.WriteFile(filepath.Join(dir, "a", name), a, 0o644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "b", name), b, 0o644); err != nil {
+			return err
+		}
+
+		served := a
+		if watermark.Bit(mark, sequence) == 1 {
+			served = b
+		}
+		for i := 0; i < framesPerSegment; i++ {
+			if rand.Intn(10) == 0 {
+				continue // Dropped frame
+			}
+			for _, luma := range served[i*watermark.FrameSize : (i+1)*watermark.FrameSize] {
+				capture = append(capture, byte(int(luma)+rand.Intn(7)-3))
+			}
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "capture", "recording"+watermark.RawExt), capture, 0o644)
+}
@@ -9,16 +9,25 @@
     class StreamPlayer {
         constructor(options) {
             this.videoElement = options.videoElement;
-            this.playlistUrl = options.playlistUrl;
             this.streamId = options.streamId;
             this.heartbeatInterval = options.heartbeatInterval || 30000; // 30 seconds
             this.onError = options.onError || console.error;
             this.onReady = options.onReady || (() => {});
+            this.onBroadcast = options.onBroadcast || (() => {});
 
             this.hls = null;
             this.heartbeatTimer = null;
             this.isPlaying = false;
             this.deviceId = this.getOrCreateDeviceId();
+            this.playlistUrl = this.withDeviceId(options.playlistUrl);
+        }
+
+        /**
+         * Add the device ID to a playlist URL; the server passes it on to the
+         * segment key URLs, which are only served to the device watching
+         */
+        withDeviceId(url) {
+            return url + (url.includes('?') ? '&' : '?') + 'device=' + encodeURIComponent(this.deviceId);
         }
 
         /**
@@ -175,6 +184,14 @@
                     });
                     break;
 
+                case 503:
+                    this.onError({
+                        type: 'full',
+                        code: 503,
+                        message: 'This stream is full right now. Please try again in a moment.'
+                    });
+                    break;
+
                 default:
                     this.onError({
                         type: 'network',
@@ -245,6 +262,16 @@
                                 message: 'This stream is being watched on another device.',
                                 action: 'redirect_purchase'
                             });
+                        } else if (response.status === 503) {
+                            // Stream is full and this viewer lost its seat
+                            this.destroy();
+                            this.videoElement.pause();
+                            this.videoElement.src = '';
+                            this.onError({
+                                type: 'full',
+                                code: 503,
+                                message: 'This stream is full right now. Please try again in a moment.'
+                            });
                         }
                         return;
                     }
@@ -253,7 +280,11 @@
                     const data = await response.json();
                     if (data.playlist_url) {
                         // Store updated URL for potential recovery
-                        this.playlistUrl = data.playlist_url;
+                        this.playlistUrl = this.withDeviceId(data.playlist_url);
+                    }
+                    // Whether the broadcast is running, as reported by Owncast
+                    if (typeof data.on_air === 'boolean') {
+                        this.onBroadcast(data.on_air);
                     }
                 } catch (error) {
                     console.warn('Heartbeat failed:', error);